@@ -24,6 +24,15 @@ import (
 
 const IbConfigKind = "IbConfig"
 
+// ConfigDriverName returns the driver name under which an IbConfig is passed
+// as opaque device configuration for the devices of driverName, e.g.
+// config.ib.sigs.k8s.io for ib.sigs.k8s.io. DRANET decodes every opaque
+// config for the driver name itself strictly as its own NetworkConfig and
+// fails the prepare of anything else, so IbConfig cannot use it.
+func ConfigDriverName(driverName string) string {
+	return "config." + driverName
+}
+
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
@@ -37,11 +46,20 @@ type IbConfig struct {
 
 	// TrafficClass specifies the QoS traffic class for IB packets.
 	// Valid range is 0-255. If nil, the default traffic class (0) is used.
+	// It is set on the port, which requires the MLNX_OFED drivers, and
+	// ignored with upstream drivers.
 	TrafficClass *uint8 `json:"trafficClass,omitempty"`
 
 	// MTU specifies the Maximum Transmission Unit for the IB port.
 	// Valid values are 256, 512, 1024, 2048, 4096. If nil, the port's active MTU is used.
 	MTU *IbMTU `json:"mtu,omitempty"`
+
+	// Mode selects how the device is handed to the pod: "Netdev" moves its
+	// netdev and RDMA device into the pod, "VFIO" binds it to vfio-pci for
+	// passthrough to a VM and is only valid for VFs. If nil, "Netdev" is
+	// used. Pkey, TrafficClass and MTU are configured by the guest in VFIO
+	// mode and must not be set.
+	Mode *IbDeviceMode `json:"mode,omitempty"`
 }
 
 // DefaultIbConfig returns the default IB configuration with fabric defaults.
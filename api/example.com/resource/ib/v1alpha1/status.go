@@ -0,0 +1,76 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const IbDeviceStatusKind = "IbDeviceStatus"
+
+// IbDeviceStatus describes an InfiniBand device allocated to a claim. The
+// kubelet plugin reports it as the data of the device's entry in the
+// ResourceClaim status, next to the netdev in the networkData.
+type IbDeviceStatus struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// IBDevName is the RDMA device name, e.g. mlx5_1.
+	IBDevName string `json:"ibDevName"`
+
+	// Port is the port number of the device.
+	Port int `json:"port"`
+
+	// LID is the local identifier assigned to the port by the subnet
+	// manager. It is 0 on RoCE ports and until the port is initialized.
+	LID uint16 `json:"lid"`
+
+	// PortGID is the GID at index 0 of the port.
+	PortGID string `json:"portGID,omitempty"`
+
+	// NodeGUID is the node GUID of the device.
+	NodeGUID string `json:"nodeGUID,omitempty"`
+
+	// Pkey is the P_Key of the netdev: the one requested by the IbConfig, or
+	// the default P_Key of the port.
+	Pkey uint16 `json:"pkey,omitempty"`
+
+	// MTU is the IB MTU of the netdev: the one requested by the IbConfig, or
+	// the active MTU of the port.
+	MTU IbMTU `json:"mtu,omitempty"`
+
+	// LinkLayer is the link layer of the port, "InfiniBand" or "Ethernet"
+	// for RoCE.
+	LinkLayer string `json:"linkLayer,omitempty"`
+
+	// RoCEv2GIDIndex is the GID index RoCE v2 traffic should use by default,
+	// e.g. as NCCL_IB_GID_INDEX. It is only set on ports with a RoCE v2 GID.
+	RoCEv2GIDIndex *int `json:"roceV2GIDIndex,omitempty"`
+
+	// IOMMUGroup is the IOMMU group of the VF, whose /dev/vfio/<group> is
+	// passed to the pod. It is only set in VFIO mode.
+	IOMMUGroup *int `json:"iommuGroup,omitempty"`
+}
+
+// NewIbDeviceStatus returns an empty IbDeviceStatus with its type set.
+func NewIbDeviceStatus() *IbDeviceStatus {
+	return &IbDeviceStatus{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: GroupName + "/" + Version,
+			Kind:       IbDeviceStatusKind,
+		},
+	}
+}
@@ -37,3 +37,23 @@ func (m IbMTU) Validate() error {
 	}
 	return fmt.Errorf("invalid IB MTU value: %d, must be one of 256, 512, 1024, 2048, 4096", m)
 }
+
+// IbDeviceMode selects how an allocated IB device is handed to a pod.
+type IbDeviceMode string
+
+const (
+	// DeviceModeNetdev moves the netdev and RDMA device into the pod.
+	DeviceModeNetdev IbDeviceMode = "Netdev"
+	// DeviceModeVFIO binds the VF to vfio-pci and passes /dev/vfio/<group>
+	// to the pod, e.g. for a KubeVirt VM to take the VF over.
+	DeviceModeVFIO IbDeviceMode = "VFIO"
+)
+
+// Validate ensures IbDeviceMode has a valid value.
+func (m IbDeviceMode) Validate() error {
+	switch m {
+	case DeviceModeNetdev, DeviceModeVFIO:
+		return nil
+	}
+	return fmt.Errorf("invalid device mode: %q, must be one of %q, %q", m, DeviceModeNetdev, DeviceModeVFIO)
+}
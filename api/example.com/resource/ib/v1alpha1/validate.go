@@ -40,6 +40,14 @@ func (c *IbConfig) Validate() error {
 		}
 	}
 
+	if c.Mode != nil {
+		if err := c.Mode.Validate(); err != nil {
+			errs = append(errs, err.Error())
+		} else if *c.Mode == DeviceModeVFIO && (c.Pkey != nil || c.TrafficClass != nil || c.MTU != nil) {
+			errs = append(errs, "pkey, trafficClass and mtu cannot be set in VFIO mode, the guest configures the device")
+		}
+	}
+
 	if len(errs) > 0 {
 		return fmt.Errorf("invalid IbConfig: %s", strings.Join(errs, "; "))
 	}
@@ -85,6 +85,36 @@ func TestValidateIbConfig(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "VFIO mode is valid",
+			config: &IbConfig{
+				Mode: ptr.To(DeviceModeVFIO),
+			},
+			wantErr: false,
+		},
+		{
+			name: "unknown mode",
+			config: &IbConfig{
+				Mode: ptr.To(IbDeviceMode("SRIOV")),
+			},
+			wantErr: true,
+		},
+		{
+			name: "pkey in VFIO mode",
+			config: &IbConfig{
+				Pkey: ptr.To(uint16(0x8001)),
+				Mode: ptr.To(DeviceModeVFIO),
+			},
+			wantErr: true,
+		},
+		{
+			name: "pkey in netdev mode",
+			config: &IbConfig{
+				Pkey: ptr.To(uint16(0x8001)),
+				Mode: ptr.To(DeviceModeNetdev),
+			},
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -43,6 +43,11 @@ func (in *IbConfig) DeepCopyInto(out *IbConfig) {
 		*out = new(IbMTU)
 		**out = **in
 	}
+	if in.Mode != nil {
+		in, out := &in.Mode, &out.Mode
+		*out = new(IbDeviceMode)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IbConfig.
@@ -62,3 +67,29 @@ func (in *IbConfig) DeepCopyObject() runtime.Object {
 	}
 	return nil
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IbDeviceStatus) DeepCopyInto(out *IbDeviceStatus) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	if in.RoCEv2GIDIndex != nil {
+		in, out := &in.RoCEv2GIDIndex, &out.RoCEv2GIDIndex
+		*out = new(int)
+		**out = **in
+	}
+	if in.IOMMUGroup != nil {
+		in, out := &in.IOMMUGroup, &out.IOMMUGroup
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IbDeviceStatus.
+func (in *IbDeviceStatus) DeepCopy() *IbDeviceStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(IbDeviceStatus)
+	in.DeepCopyInto(out)
+	return out
+}
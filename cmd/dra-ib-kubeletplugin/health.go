@@ -0,0 +1,78 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/health"
+)
+
+// kubeletPluginChecks returns health checks calling the registration and DRA
+// sockets that DRANET serves to the kubelet, so that a plugin the kubelet can
+// no longer reach is reported unhealthy. The returned function closes the
+// connections.
+func kubeletPluginChecks(driverName string) ([]health.Check, func(), error) {
+	regConn, err := dialUnix(filepath.Join(kubeletRegistryDir, driverName+"-reg.sock"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to registration socket: %w", err)
+	}
+	draConn, err := dialUnix(filepath.Join(kubeletPluginsDir, driverName, "dra.sock"))
+	if err != nil {
+		regConn.Close()
+		return nil, nil, fmt.Errorf("connect to DRA socket: %w", err)
+	}
+	regClient := registerapi.NewRegistrationClient(regConn)
+	draClient := drapb.NewDRAPluginClient(draConn)
+
+	checks := []health.Check{
+		{
+			Name: "kubelet registration",
+			Func: func(ctx context.Context) error {
+				_, err := regClient.GetInfo(ctx, &registerapi.InfoRequest{})
+				return err
+			},
+		},
+		{
+			Name: "DRA service",
+			Func: func(ctx context.Context) error {
+				// An empty request exercises the service without preparing
+				// anything.
+				_, err := draClient.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{})
+				return err
+			},
+		},
+	}
+	return checks, func() {
+		regConn.Close()
+		draConn.Close()
+	}, nil
+}
+
+func dialUnix(path string) (*grpc.ClientConn, error) {
+	target := (&url.URL{Scheme: "unix", Path: path}).String()
+	return grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
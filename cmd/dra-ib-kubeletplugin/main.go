@@ -21,24 +21,45 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	nodeutil "k8s.io/component-helpers/node/util"
 	"k8s.io/klog/v2"
 
 	"github.com/google/dranet/pkg/driver"
 
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/health"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibclaims"
 	"github.com/kubernetes-sigs/dra-example-driver/internal/ibinventory"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/rdmamode"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sriov"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/vfionri"
 	"github.com/kubernetes-sigs/dra-example-driver/pkg/flags"
 )
 
 const (
 	defaultDriverName = "ib.sigs.k8s.io"
+	// kubeletPluginsDir is where the kubelet keeps per-driver state.
+	kubeletPluginsDir = "/var/lib/kubelet/plugins"
+	// kubeletRegistryDir is where the kubelet looks for plugin registration
+	// sockets.
+	kubeletRegistryDir = "/var/lib/kubelet/plugins_registry"
 )
 
 func main() {
@@ -54,7 +75,17 @@ func newApp() *cli.App {
 		hostnameOverride string
 		driverName       string
 		numVFs           int
+		sriovPolicyPath  string
 		numSimDevices    int
+		simTopologyPath  string
+		linkDownGrace    time.Duration
+		discoveryBackend string
+		sysfsRoot        string
+		checkpointFile   string
+		rdmaNetnsPolicy  string
+		metricsAddress   string
+		healthcheckPort  int
+		scanStaleness    time.Duration
 	)
 
 	loggingConfig := flags.NewLoggingConfig()
@@ -86,6 +117,12 @@ func newApp() *cli.App {
 			Destination: &numVFs,
 			EnvVars:     []string{"NUM_VFS"},
 		},
+		&cli.StringFlag{
+			Name:        "sriov-policy",
+			Usage:       "Path to a YAML or JSON SR-IOV policy that sets the number of VFs per PF, matching PFs by PCI address, IB device name, part ID or NUMA node, opts PFs out of provisioning, or creates their VFs on demand. PFs that no rule matches get --num-vfs VFs.",
+			Destination: &sriovPolicyPath,
+			EnvVars:     []string{"SRIOV_POLICY"},
+		},
 		&cli.IntFlag{
 			Name:        "num-sim-devices",
 			Usage:       "Number of simulated IB VFs to create when no real hardware is found (0 = disabled). For testing only.",
@@ -93,6 +130,66 @@ func newApp() *cli.App {
 			Destination: &numSimDevices,
 			EnvVars:     []string{"NUM_SIM_DEVICES"},
 		},
+		&cli.StringFlag{
+			Name:        "sim-topology",
+			Usage:       "Path to a YAML or JSON topology of simulated IB devices to create when no real hardware is found. Takes precedence over --num-sim-devices. For testing only.",
+			Destination: &simTopologyPath,
+			EnvVars:     []string{"SIM_TOPOLOGY"},
+		},
+		&cli.DurationFlag{
+			Name:        "link-down-grace-period",
+			Usage:       "How long an IB port link must stay down before its device is tainted NoExecute. Ports that are not Active are always tainted NoSchedule.",
+			Value:       5 * time.Minute,
+			Destination: &linkDownGrace,
+			EnvVars:     []string{"LINK_DOWN_GRACE_PERIOD"},
+		},
+		&cli.StringFlag{
+			Name:        "discovery-backend",
+			Usage:       "How to query IB devices and ports: 'ibverbs' (libibverbs, requires a cgo build), 'sysfs' (/sys/class/infiniband), or 'auto' to use ibverbs when compiled in.",
+			Value:       ibverbs.BackendAuto,
+			Destination: &discoveryBackend,
+			EnvVars:     []string{"DISCOVERY_BACKEND"},
+		},
+		&cli.StringFlag{
+			Name:        "sysfs-root",
+			Usage:       "Mount point of the sysfs tree to discover devices in. Combine with --discovery-backend=sysfs to run against a fixture tree.",
+			Value:       sysfs.DefaultRoot,
+			Destination: &sysfsRoot,
+			EnvVars:     []string{"SYSFS_ROOT"},
+		},
+		&cli.StringFlag{
+			Name:        "checkpoint-file",
+			Usage:       "File recording the netdevs handed to pods and the claim configs applied to devices, used to return and release them after a plugin restart. Defaults to " + kubeletPluginsDir + "/<driver-name>/ib-netdevs.json.",
+			Destination: &checkpointFile,
+			EnvVars:     []string{"CHECKPOINT_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "rdma-netns-mode-policy",
+			Usage:       "What to do at startup if the RDMA subsystem is not in exclusive netns mode, in which RDMA devices are only visible in the pod they are allocated to: 'enforce' (switch to exclusive mode, or exit if that fails), 'warn' (report it), or 'ignore' (don't check).",
+			Value:       string(rdmamode.PolicyWarn),
+			Destination: &rdmaNetnsPolicy,
+			EnvVars:     []string{"RDMA_NETNS_MODE_POLICY"},
+		},
+		&cli.StringFlag{
+			Name:        "metrics-address",
+			Usage:       "Address to serve Prometheus metrics on at " + metrics.Path + ", including the counters of the published IB ports and the operational metrics of the plugin, e.g. ':9402'. Empty disables the metrics server.",
+			Destination: &metricsAddress,
+			EnvVars:     []string{"METRICS_ADDRESS"},
+		},
+		&cli.IntFlag{
+			Name:        "healthcheck-port",
+			Usage:       "Port to serve the gRPC health service on, 0 for a random port. Negative disables the service.",
+			Value:       -1,
+			Destination: &healthcheckPort,
+			EnvVars:     []string{"HEALTHCHECK_PORT"},
+		},
+		&cli.DurationFlag{
+			Name:        "inventory-staleness",
+			Usage:       "How long the IB inventory may go without a successful scan before the health service reports NOT_SERVING. Must be longer than the fallback polling interval of 5m.",
+			Value:       15 * time.Minute,
+			Destination: &scanStaleness,
+			EnvVars:     []string{"INVENTORY_STALENESS"},
+		},
 	}
 	cliFlags = append(cliFlags, loggingConfig.Flags()...)
 
@@ -102,18 +199,26 @@ func newApp() *cli.App {
 		ArgsUsage:       " ",
 		HideHelpCommand: true,
 		Flags:           cliFlags,
+		Commands: []*cli.Command{
+			newMoveNetdevCommand(),
+		},
 		Before: func(c *cli.Context) error {
-			if c.Args().Len() > 0 {
-				return fmt.Errorf("arguments not supported: %v", c.Args().Slice())
-			}
 			return loggingConfig.Apply()
 		},
 		Action: func(c *cli.Context) error {
+			// Only reached when no subcommand matched.
+			if c.Args().Len() > 0 {
+				return fmt.Errorf("arguments not supported: %v", c.Args().Slice())
+			}
 			ctx := c.Context
 
+			policy, err := rdmamode.ParsePolicy(rdmaNetnsPolicy)
+			if err != nil {
+				return err
+			}
+
 			// Build Kubernetes client.
 			var config *rest.Config
-			var err error
 			if kubeconfig != "" {
 				config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 			} else {
@@ -137,11 +242,82 @@ func newApp() *cli.App {
 				return fmt.Errorf("get node name: %w", err)
 			}
 
-			// Create the IB inventory adapter that implements DRANET's inventoryDB.
-			ibDB := ibinventory.New(
+			backend, err := ibverbs.NewBackend(discoveryBackend, sysfsRoot)
+			if err != nil {
+				return err
+			}
+
+			if checkpointFile == "" {
+				checkpointFile = filepath.Join(kubeletPluginsDir, driverName, "ib-netdevs.json")
+			}
+
+			// Record events about the IB devices of the node, e.g. VF
+			// provisioning deferred while VFs are in use.
+			broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+			broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+			defer broadcaster.Shutdown()
+			recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: driverName, Host: nodeName})
+
+			opts := []ibinventory.Option{
+				ibinventory.WithDiscoveryBackend(backend),
+				ibinventory.WithSysfs(sysfs.New(sysfsRoot)),
 				ibinventory.WithNumVFs(numVFs),
 				ibinventory.WithNumSimDevices(numSimDevices),
-			)
+				ibinventory.WithLinkDownGracePeriod(linkDownGrace),
+				ibinventory.WithCheckpointFile(checkpointFile),
+				ibinventory.WithEventRecorder(recorder, nodeName),
+			}
+			if policy != rdmamode.PolicyIgnore {
+				status, err := rdmamode.Check(ctx, policy, rdmamode.HostSystem{})
+				if reportErr := rdmamode.ReportNodeCondition(ctx, clientset, nodeName, driverName+"/rdma-netns", status); reportErr != nil {
+					klog.Errorf("Failed to report RDMA netns mode: %v", reportErr)
+				}
+				if err != nil {
+					return err
+				}
+				opts = append(opts, ibinventory.WithRDMANetnsMode(status.Mode))
+			}
+			if sriovPolicyPath != "" {
+				sriovPolicy, err := sriov.LoadPolicy(sriovPolicyPath)
+				if err != nil {
+					return err
+				}
+				node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+				if err != nil {
+					return fmt.Errorf("get node %s for its SR-IOV policy: %w", nodeName, err)
+				}
+				opts = append(opts, ibinventory.WithSRIOVPolicy(sriovPolicy.ForNode(node.Labels)))
+			}
+			if simTopologyPath != "" {
+				topo, err := fakesysfs.LoadTopology(simTopologyPath)
+				if err != nil {
+					return err
+				}
+				opts = append(opts, ibinventory.WithSimTopology(topo))
+			}
+
+			// Create the IB inventory adapter that implements DRANET's inventoryDB.
+			ibDB := ibinventory.New(opts...)
+
+			ctx, cancel := context.WithCancel(ctx)
+
+			signalCh := make(chan os.Signal, 1)
+			signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+
+			// Apply the IbConfig of claims allocated on this node to their
+			// devices while DRANET prepares them, before it moves them into
+			// the pod, and report it in the claim status.
+			claims, err := ibclaims.New(clientset, driverName, nodeName, ibDB)
+			if err != nil {
+				cancel()
+				return fmt.Errorf("create IB claims tracker: %w", err)
+			}
+			ibDB.SetPreparer(claims)
+			go func() {
+				if err := claims.Run(ctx); err != nil {
+					klog.Errorf("IB claims tracker stopped: %v", err)
+				}
+			}()
 
 			// Start the DRANET driver framework.
 			// This handles:
@@ -150,11 +326,6 @@ func newApp() *cli.App {
 			//   - Resource publishing via ResourceSlice
 			//   - PrepareResourceClaims / UnprepareResourceClaims
 			//   - Network device namespace management (netdev + RDMA)
-			ctx, cancel := context.WithCancel(ctx)
-
-			signalCh := make(chan os.Signal, 1)
-			signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
-
 			dranet, err := driver.Start(ctx, driverName, clientset, nodeName,
 				driver.WithInventory(ibDB),
 			)
@@ -164,6 +335,48 @@ func newApp() *cli.App {
 			}
 			defer dranet.Stop()
 
+			// DRANET moves the placeholder netdevs of VFs bound to vfio-pci
+			// into their pods; their containers get the VFs themselves from
+			// a second NRI plugin.
+			go func() {
+				if err := vfionri.Run(ctx, driverName+"-vfio", ibDB); err != nil {
+					klog.Errorf("VFIO NRI plugin stopped: %v", err)
+				}
+			}()
+
+			if metricsAddress != "" {
+				registry, err := metrics.NewRegistry(append(metrics.PluginCollectors(),
+					metrics.NewPortCollector(sysfs.New(sysfsRoot), nodeName, ibDB, claims),
+				)...)
+				if err != nil {
+					cancel()
+					return err
+				}
+				go func() {
+					if err := metrics.Serve(ctx, metricsAddress, registry); err != nil {
+						klog.Errorf("Metrics server stopped: %v", err)
+					}
+				}()
+			}
+
+			if healthcheckPort >= 0 {
+				checks, closeChecks, err := kubeletPluginChecks(driverName)
+				if err != nil {
+					cancel()
+					return err
+				}
+				defer closeChecks()
+				checks = append(checks, health.Check{
+					Name: "IB inventory",
+					Func: func(context.Context) error { return ibDB.CheckScans(scanStaleness) },
+				})
+				go func() {
+					if err := health.NewServer(checks...).Serve(ctx, healthcheckPort); err != nil {
+						klog.Errorf("Health service stopped: %v", err)
+					}
+				}()
+			}
+
 			klog.Infof("IB DRA driver started (driver=%s, node=%s, numVFs=%d, numSimDevices=%d)",
 				driverName, nodeName, numVFs, numSimDevices)
 
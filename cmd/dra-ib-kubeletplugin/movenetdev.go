@@ -0,0 +1,85 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/urfave/cli/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/profiles/ib"
+)
+
+// newMoveNetdevCommand returns the move-netdev subcommand. The container
+// runtime invokes it as a createRuntime CDI hook, with the OCI state of the
+// container on stdin, to move an IB device into the container's network
+// namespace.
+func newMoveNetdevCommand() *cli.Command {
+	var (
+		ibDevName string
+		netDevs   cli.StringSlice
+	)
+
+	return &cli.Command{
+		Name:      "move-netdev",
+		Usage:     "Move an IB netdev and RDMA device into a container's network namespace. Run as a CDI createRuntime hook.",
+		ArgsUsage: " ",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "ib-dev",
+				Usage:       "Name of the IB device to move, e.g. mlx5_1.",
+				Required:    true,
+				Destination: &ibDevName,
+			},
+			&cli.StringSliceFlag{
+				Name:        "netdev",
+				Usage:       "Netdev of the IB device to move. Defaults to all netdevs of the IB device in the host network namespace.",
+				Destination: &netDevs,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.Args().Len() > 0 {
+				return fmt.Errorf("arguments not supported: %v", c.Args().Slice())
+			}
+			pid, err := readContainerPID(os.Stdin)
+			if err != nil {
+				return err
+			}
+			if err := ib.MoveNetdevHookHelper(c.Context, ibDevName, netDevs.Value(), pid); err != nil {
+				return fmt.Errorf("move IB device %s into netns of container pid %d: %w", ibDevName, pid, err)
+			}
+			return nil
+		},
+	}
+}
+
+// readContainerPID reads the OCI state of a container, as passed to hooks,
+// and returns the PID of the container process.
+func readContainerPID(r io.Reader) (int, error) {
+	var state specs.State
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return 0, fmt.Errorf("decode OCI state from stdin: %w", err)
+	}
+	if state.Pid <= 0 {
+		return 0, fmt.Errorf("OCI state of container %q has no pid (status %q)", state.ID, state.Status)
+	}
+	return state.Pid, nil
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadContainerPID(t *testing.T) {
+	pid, err := readContainerPID(strings.NewReader(`{"ociVersion":"1.2.0","id":"abc","status":"created","pid":4242,"bundle":"/run/bundle"}`))
+	require.NoError(t, err)
+	assert.Equal(t, 4242, pid)
+
+	_, err = readContainerPID(strings.NewReader(`{"ociVersion":"1.2.0","id":"abc","status":"creating"}`))
+	assert.EqualError(t, err, `OCI state of container "abc" has no pid (status "creating")`)
+
+	_, err = readContainerPID(strings.NewReader(`not json`))
+	assert.ErrorContains(t, err, "decode OCI state from stdin")
+}
@@ -34,6 +34,8 @@ import (
 	kjson "k8s.io/apimachinery/pkg/runtime/serializer/json"
 	"k8s.io/klog/v2"
 
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
 	"github.com/kubernetes-sigs/dra-example-driver/internal/profiles"
 	"github.com/kubernetes-sigs/dra-example-driver/internal/profiles/ib"
 	"github.com/kubernetes-sigs/dra-example-driver/pkg/flags"
@@ -162,6 +164,12 @@ func newMux(configHandler profiles.ConfigHandler, driverName string) (*http.Serv
 	mux := http.NewServeMux()
 	mux.HandleFunc("/validate-resource-claim-parameters", serveResourceClaim(configDecoder, configHandler.Validate, driverName))
 	mux.HandleFunc("/readyz", readyHandler)
+
+	registry, err := metrics.NewRegistry(metrics.WebhookAdmissions)
+	if err != nil {
+		return nil, err
+	}
+	mux.Handle(metrics.Path, metrics.Handler(registry))
 	return mux, nil
 }
 
@@ -188,6 +196,7 @@ func serve(w http.ResponseWriter, r *http.Request, ctx context.Context, admit fu
 		data, err := io.ReadAll(r.Body)
 		if err != nil {
 			logger.Error(err, "failed to read request body")
+			metrics.WebhookAdmissions.WithLabelValues(metrics.AdmissionError).Inc()
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -199,6 +208,7 @@ func serve(w http.ResponseWriter, r *http.Request, ctx context.Context, admit fu
 	if contentType != "application/json" {
 		msg := fmt.Sprintf("contentType=%s, expected application/json", contentType)
 		logger.Error(nil, msg)
+		metrics.WebhookAdmissions.WithLabelValues(metrics.AdmissionError).Inc()
 		http.Error(w, msg, http.StatusUnsupportedMediaType)
 		return
 	}
@@ -209,6 +219,7 @@ func serve(w http.ResponseWriter, r *http.Request, ctx context.Context, admit fu
 	if err != nil {
 		msg := fmt.Sprintf("failed to read AdmissionReview from request body: %v", err)
 		logger.Error(err, msg)
+		metrics.WebhookAdmissions.WithLabelValues(metrics.AdmissionError).Inc()
 		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
@@ -216,6 +227,7 @@ func serve(w http.ResponseWriter, r *http.Request, ctx context.Context, admit fu
 	responseAdmissionReview.SetGroupVersionKind(requestedAdmissionReview.GroupVersionKind())
 	responseAdmissionReview.Response = admit(ctx, *requestedAdmissionReview)
 	responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+	metrics.WebhookAdmissions.WithLabelValues(admissionResult(responseAdmissionReview.Response)).Inc()
 
 	logger.V(2).Info("sending response", "response", responseAdmissionReview)
 	respBytes, err := json.Marshal(responseAdmissionReview)
@@ -230,6 +242,19 @@ func serve(w http.ResponseWriter, r *http.Request, ctx context.Context, admit fu
 	}
 }
 
+// admissionResult returns the result label of an admission response:
+// requests whose object could not be decoded are errors rather than denials.
+func admissionResult(response *admissionv1.AdmissionResponse) string {
+	switch {
+	case response.Allowed:
+		return metrics.AdmissionAllowed
+	case response.Result != nil && response.Result.Reason == metav1.StatusReasonBadRequest:
+		return metrics.AdmissionError
+	default:
+		return metrics.AdmissionDenied
+	}
+}
+
 func readAdmissionReview(data []byte) (*admissionv1.AdmissionReview, error) {
 	deserializer := codecs.UniversalDeserializer()
 	obj, gvk, err := deserializer.Decode(data, nil, nil)
@@ -250,7 +275,7 @@ func readAdmissionReview(data []byte) (*admissionv1.AdmissionReview, error) {
 }
 
 // admitResourceClaimParameters accepts both ResourceClaims and ResourceClaimTemplates and validates their
-// opaque device configuration parameters for this driver.
+// opaque device configuration parameters for this driver, which are passed with its config driver name.
 func admitResourceClaimParameters(configDecoder runtime.Decoder, validate validator, driverName string) func(context.Context, admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	return func(ctx context.Context, ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 		logger := klog.FromContext(ctx)
@@ -302,12 +327,26 @@ func admitResourceClaimParameters(configDecoder runtime.Decoder, validate valida
 		}
 
 		var errs []error
+		configDriver := configapi.ConfigDriverName(driverName)
 		for configIndex, config := range deviceConfigs {
-			if config.Opaque == nil || config.Opaque.Driver != driverName {
+			if config.Opaque == nil {
 				continue
 			}
 
 			fieldPath := fmt.Sprintf("%s.devices.config[%d].opaque.parameters", specPath, configIndex)
+			switch config.Opaque.Driver {
+			case configDriver:
+			case driverName:
+				// These are DRANET's own configs, which it fails to
+				// decode if they are IbConfigs.
+				if _, err := runtime.Decode(configDecoder, config.Opaque.Parameters.Raw); err == nil {
+					errs = append(errs, fmt.Errorf("object at %s must be passed with driver %s", fieldPath, configDriver))
+				}
+				continue
+			default:
+				continue
+			}
+
 			decodedConfig, err := runtime.Decode(configDecoder, config.Opaque.Parameters.Raw)
 			if err != nil {
 				errs = append(errs, fmt.Errorf("error decoding object at %s: %w", fieldPath, err))
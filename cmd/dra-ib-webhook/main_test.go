@@ -25,6 +25,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -37,6 +38,7 @@ import (
 	"k8s.io/utils/ptr"
 
 	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
 	"github.com/kubernetes-sigs/dra-example-driver/internal/profiles/ib"
 )
 
@@ -103,6 +105,27 @@ func TestResourceClaimValidatingWebhook(t *testing.T) {
 			expectedAllowed: false,
 			expectedMessage: "2 configs failed to validate: object at spec.devices.config[0].opaque.parameters is invalid: invalid IbConfig: pkey must be in range 0x0001-0xFFFF, got 0x0000; object at spec.devices.config[1].opaque.parameters is invalid: invalid IbConfig: invalid IB MTU value: 9999, must be one of 256, 512, 1024, 2048, 4096",
 		},
+		"IbConfig for DRANET in ResourceClaim": {
+			admissionReview: admissionReviewWithObject(
+				withOpaqueDriver(resourceClaimWithIbConfigs(validIbConfig), driverName),
+				resourceClaimResourceV1,
+			),
+			expectedAllowed: false,
+			expectedMessage: "1 configs failed to validate: object at spec.devices.config[0].opaque.parameters must be passed with driver config.ib.sigs.k8s.io",
+		},
+		"DRANET config in ResourceClaim": {
+			admissionReview: admissionReviewWithObject(
+				withOpaqueDriver(&resourceapi.ResourceClaim{
+					Spec: resourceapi.ResourceClaimSpec{Devices: resourceapi.DeviceClaim{Config: []resourceapi.DeviceClaimConfiguration{{
+						DeviceConfiguration: resourceapi.DeviceConfiguration{Opaque: &resourceapi.OpaqueDeviceConfiguration{
+							Parameters: runtime.RawExtension{Raw: []byte(`{"interface":{"name":"ib0"}}`)},
+						}},
+					}}}},
+				}, driverName),
+				resourceClaimResourceV1,
+			),
+			expectedAllowed: true,
+		},
 		"valid IbConfig in ResourceClaimTemplate": {
 			admissionReview: admissionReviewWithObject(
 				resourceClaimTemplateWithIbConfigs(validIbConfig),
@@ -201,6 +224,32 @@ func TestResourceClaimValidatingWebhook(t *testing.T) {
 	}
 }
 
+func TestMetricsEndpoint(t *testing.T) {
+	mux, err := newMux(ib.Profile{}, driverName)
+	require.NoError(t, err)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	allowed := testutil.ToFloat64(metrics.WebhookAdmissions.WithLabelValues(metrics.AdmissionAllowed))
+	denied := testutil.ToFloat64(metrics.WebhookAdmissions.WithLabelValues(metrics.AdmissionDenied))
+	for _, ibConfig := range []*configapi.IbConfig{{MTU: ptr.To(configapi.MTU4096)}, {Pkey: ptr.To(uint16(0))}} {
+		body, err := json.Marshal(admissionReviewWithObject(resourceClaimWithIbConfigs(ibConfig), resourceClaimResourceV1))
+		require.NoError(t, err)
+		res, err := http.Post(s.URL+"/validate-resource-claim-parameters", "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+	assert.Equal(t, allowed+1, testutil.ToFloat64(metrics.WebhookAdmissions.WithLabelValues(metrics.AdmissionAllowed)))
+	assert.Equal(t, denied+1, testutil.ToFloat64(metrics.WebhookAdmissions.WithLabelValues(metrics.AdmissionDenied)))
+
+	res, err := http.Get(s.URL + metrics.Path)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `ib_webhook_admission_requests_total{result="allowed"}`)
+}
+
 func admissionReviewWithObject(obj runtime.Object, resource metav1.GroupVersionResource) *admissionv1.AdmissionReview {
 	requestedAdmissionReview := &admissionv1.AdmissionReview{
 		Request: &admissionv1.AdmissionRequest{
@@ -222,6 +271,15 @@ func resourceClaimWithIbConfigs(ibConfigs ...*configapi.IbConfig) *resourceapi.R
 	return resourceClaim
 }
 
+// withOpaqueDriver passes the opaque configs of claim with driver.
+func withOpaqueDriver(claim *resourceapi.ResourceClaim, driver string) *resourceapi.ResourceClaim {
+	for _, config := range claim.Spec.Devices.Config {
+		config.Opaque.Driver = driver
+	}
+	claim.SetGroupVersionKind(resourceapi.SchemeGroupVersion.WithKind("ResourceClaim"))
+	return claim
+}
+
 func resourceClaimTemplateWithIbConfigs(ibConfigs ...*configapi.IbConfig) *resourceapi.ResourceClaimTemplate {
 	resourceClaimTemplate := &resourceapi.ResourceClaimTemplate{
 		Spec: resourceapi.ResourceClaimTemplateSpec{
@@ -243,7 +301,7 @@ func resourceClaimSpecWithIbConfigs(ibConfigs ...*configapi.IbConfig) resourceap
 		deviceConfig := resourceapi.DeviceClaimConfiguration{
 			DeviceConfiguration: resourceapi.DeviceConfiguration{
 				Opaque: &resourceapi.OpaqueDeviceConfiguration{
-					Driver: driverName,
+					Driver: configapi.ConfigDriverName(driverName),
 					Parameters: runtime.RawExtension{
 						Object: ibConfig,
 					},
@@ -15,7 +15,7 @@
 GOLANG_VERSION ?= 1.25.5
 
 DRIVER_NAME := dra-example-driver
-MODULE := github.com/MartinForReal/$(DRIVER_NAME)
+MODULE := github.com/kubernetes-sigs/$(DRIVER_NAME)
 
 VERSION  ?=
 vVERSION := v$(VERSION:v%=%)
@@ -0,0 +1,425 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fakesysfs builds sysfs trees modelling InfiniBand HCAs, so that
+// discovery can run against a fixture instead of real hardware.
+//
+// The generated layout mirrors the kernel's: devices live below
+// devices/pci0000:00, possibly below PCIe bridges, and bus/pci/devices,
+// class/infiniband and class/net hold relative symlinks to them, so a tree
+// can be moved or copied.
+package fakesysfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const pciRootComplex = "devices/pci0000:00"
+
+// Port describes an IB port. Values are written verbatim to the files of the
+// same name below ports/<n>.
+type Port struct {
+	State     string // e.g. "4: ACTIVE"
+	PhysState string // e.g. "5: LinkUp"
+	Rate      string // e.g. "200 Gb/sec (4X HDR)"
+	LinkLayer string // "InfiniBand" or "Ethernet"
+	LID       string // e.g. "0x1a"
+	GID       string // GID index 0
+	// GIDs is the GID table with the attributes of its entries. It
+	// defaults to GID at index 0 with type "IB/RoCE v1".
+	GIDs []GID
+	// Pkeys is the P_Key table, e.g. "0xffff". It defaults to the default
+	// partition only.
+	Pkeys []string
+	// Counters overrides values of the IBA port counters, keyed by file
+	// name below counters/, e.g. "symbol_error". Unset counters read 0.
+	Counters map[string]uint64
+	// HWCounters are the driver-specific counters written below
+	// hw_counters/. None are written if it is empty.
+	HWCounters map[string]uint64
+}
+
+// portCounterNames are the counters written below counters/ of every port.
+var portCounterNames = []string{
+	"excessive_buffer_overrun_errors",
+	"link_downed",
+	"link_error_recovery",
+	"local_link_integrity_errors",
+	"port_rcv_constraint_errors",
+	"port_rcv_data",
+	"port_rcv_errors",
+	"port_rcv_packets",
+	"port_rcv_remote_physical_errors",
+	"port_rcv_switch_relay_errors",
+	"port_xmit_constraint_errors",
+	"port_xmit_data",
+	"port_xmit_discards",
+	"port_xmit_packets",
+	"port_xmit_wait",
+	"symbol_error",
+	"VL15_dropped",
+}
+
+// GID is an entry of a port's GID table. Values are written to gids/<i>,
+// gid_attrs/types/<i> and gid_attrs/ndevs/<i> below the port.
+type GID struct {
+	GID    string // e.g. "fe80:0000:0000:0000:ec0d:9a03:0078:6a4c"
+	Type   string // "IB/RoCE v1" or "RoCE v2"
+	NetDev string // empty on InfiniBand
+}
+
+// Device describes a PCI function with one IB device on it.
+type Device struct {
+	// PCIAddress is the PCI bus address, e.g. 0000:3b:00.0.
+	PCIAddress string
+	// Vendor and DeviceID are the PCI IDs, e.g. "0x15b3" and "0x101b".
+	Vendor   string
+	DeviceID string
+	// NUMANode is the NUMA node of the function, -1 if unknown.
+	NUMANode int
+	// TotalVFs is sriov_totalvfs; 0 for functions that are not SR-IOV PFs.
+	TotalVFs int
+	// PhysFn is the PCI address of the parent PF; set only for VFs. The PF
+	// must have been added first, and the VF is placed next to it.
+	PhysFn string
+	// Parent is the PCI address of the bridge the function is below, e.g.
+	// a root port or the downstream port of a PCIe switch. The bridge must
+	// have been added first. Functions without a parent are placed directly
+	// below the root complex.
+	Parent string
+	// LinkSpeed and LinkWidth are the current PCIe link speed and width,
+	// e.g. "16.0 GT/s PCIe" and 16. Neither is written if LinkSpeed is
+	// empty.
+	LinkSpeed string
+	LinkWidth int
+	// Driver is the PCI driver bound to the function, e.g. "mlx5_core".
+	// Writes to its bind and unbind files are recorded but have no effect.
+	Driver string
+	// IOMMUGroup is the IOMMU group of the function, e.g. "42"; empty if
+	// the IOMMU is disabled.
+	IOMMUGroup string
+
+	// IBDevName is the IB device name, e.g. mlx5_0.
+	IBDevName       string
+	NodeGUID        string
+	FirmwareVersion string
+	// Ports are numbered from 1.
+	Ports []Port
+	// NetDevices are the netdevs of the function, one per port.
+	NetDevices []string
+	// NetDevMTU is the MTU of the netdevs; IPoIB netdevs are in datagram
+	// mode.
+	NetDevMTU int
+}
+
+// Tree is a fake sysfs tree rooted at Root.
+type Tree struct {
+	Root string
+
+	// numIBDevs numbers the IB devices added by AddHCA.
+	numIBDevs int
+}
+
+// New returns a Tree rooted at root, creating the directory if needed.
+func New(root string) (*Tree, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("create fake sysfs root: %w", err)
+	}
+	return &Tree{Root: root}, nil
+}
+
+// AddDevice creates the PCI function, IB device and netdevs of d, and links
+// a VF to its PF.
+func (t *Tree) AddDevice(d Device) error {
+	parentRel := pciRootComplex
+	switch {
+	case d.PhysFn != "":
+		pfRel, err := t.pciRel(d.PhysFn)
+		if err != nil {
+			return fmt.Errorf("PF %s of VF %s: %w", d.PhysFn, d.PCIAddress, err)
+		}
+		parentRel = filepath.Dir(pfRel)
+	case d.Parent != "":
+		var err error
+		if parentRel, err = t.pciRel(d.Parent); err != nil {
+			return fmt.Errorf("parent %s of %s: %w", d.Parent, d.PCIAddress, err)
+		}
+	}
+	pciRel := filepath.Join(parentRel, d.PCIAddress)
+	pciDir := filepath.Join(t.Root, pciRel)
+
+	files := map[string]string{
+		"vendor":    d.Vendor,
+		"device":    d.DeviceID,
+		"numa_node": strconv.Itoa(d.NUMANode),
+		// Like in the kernel when no override is set.
+		"driver_override": "(null)",
+	}
+	if d.TotalVFs > 0 {
+		files["sriov_totalvfs"] = strconv.Itoa(d.TotalVFs)
+		files["sriov_numvfs"] = "0"
+		files["sriov_drivers_autoprobe"] = "1"
+	}
+	if d.LinkSpeed != "" {
+		files["current_link_speed"] = d.LinkSpeed
+		files["current_link_width"] = strconv.Itoa(d.LinkWidth)
+	}
+	if err := writeFiles(pciDir, files); err != nil {
+		return err
+	}
+	if err := t.symlink(pciRel, filepath.Join("bus/pci/devices", d.PCIAddress)); err != nil {
+		return err
+	}
+	if d.Driver != "" {
+		if err := t.AddPCIDriver(d.Driver); err != nil {
+			return err
+		}
+		if err := t.symlink(filepath.Join("bus/pci/drivers", d.Driver), filepath.Join(pciRel, "driver")); err != nil {
+			return err
+		}
+	}
+	if d.IOMMUGroup != "" {
+		groupRel := filepath.Join("kernel/iommu_groups", d.IOMMUGroup)
+		if err := t.symlink(groupRel, filepath.Join(pciRel, "iommu_group")); err != nil {
+			return err
+		}
+		if err := t.symlink(pciRel, filepath.Join(groupRel, "devices", d.PCIAddress)); err != nil {
+			return err
+		}
+	}
+
+	if d.PhysFn != "" {
+		if err := t.linkVF(d.PhysFn, pciDir); err != nil {
+			return err
+		}
+	}
+
+	if d.IBDevName != "" {
+		if err := t.addIBDevice(pciRel, d); err != nil {
+			return err
+		}
+	}
+
+	linkLayer := ""
+	if len(d.Ports) > 0 {
+		linkLayer = d.Ports[0].LinkLayer
+	}
+	for i, netdev := range d.NetDevices {
+		netRel := filepath.Join(pciRel, "net", netdev)
+		files := map[string]string{
+			"mtu":      strconv.Itoa(d.NetDevMTU),
+			"dev_port": strconv.Itoa(i),
+		}
+		if linkLayer == "InfiniBand" {
+			files["mode"] = "datagram"
+		}
+		if err := writeFiles(filepath.Join(t.Root, netRel), files); err != nil {
+			return err
+		}
+		if err := t.symlink(netRel, filepath.Join("class/net", netdev)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tree) addIBDevice(pciRel string, d Device) error {
+	ibRel := filepath.Join(pciRel, "infiniband", d.IBDevName)
+	ibDir := filepath.Join(t.Root, ibRel)
+	if err := writeFiles(ibDir, map[string]string{
+		"node_guid": d.NodeGUID,
+		"fw_ver":    d.FirmwareVersion,
+		"node_type": "1: CA",
+	}); err != nil {
+		return err
+	}
+	for i, p := range d.Ports {
+		portDir := filepath.Join(ibDir, "ports", strconv.Itoa(i+1))
+		if err := writeFiles(portDir, map[string]string{
+			"state":      p.State,
+			"phys_state": p.PhysState,
+			"rate":       p.Rate,
+			"link_layer": p.LinkLayer,
+			"lid":        p.LID,
+		}); err != nil {
+			return err
+		}
+		gids := p.GIDs
+		if len(gids) == 0 {
+			gids = []GID{{GID: p.GID, Type: "IB/RoCE v1"}}
+		}
+		gidFiles := make(map[string]string)
+		for idx, g := range gids {
+			gidFiles[filepath.Join("gids", strconv.Itoa(idx))] = g.GID
+			gidFiles[filepath.Join("gid_attrs", "types", strconv.Itoa(idx))] = g.Type
+			if g.NetDev != "" {
+				gidFiles[filepath.Join("gid_attrs", "ndevs", strconv.Itoa(idx))] = g.NetDev
+			}
+		}
+		if err := writeFiles(portDir, gidFiles); err != nil {
+			return err
+		}
+		counterFiles := make(map[string]string)
+		for _, name := range portCounterNames {
+			counterFiles[filepath.Join("counters", name)] = strconv.FormatUint(p.Counters[name], 10)
+		}
+		for name, val := range p.HWCounters {
+			counterFiles[filepath.Join("hw_counters", name)] = strconv.FormatUint(val, 10)
+		}
+		if err := writeFiles(portDir, counterFiles); err != nil {
+			return err
+		}
+		pkeys := p.Pkeys
+		if len(pkeys) == 0 {
+			pkeys = []string{"0xffff"}
+		}
+		files := map[string]string{
+			filepath.Join("tc", strconv.Itoa(i+1), "traffic_class"): "",
+		}
+		for idx, pkey := range pkeys {
+			files[filepath.Join("ports", strconv.Itoa(i+1), "pkeys", strconv.Itoa(idx))] = pkey
+		}
+		if err := writeFiles(ibDir, files); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink("../..", filepath.Join(ibDir, "device")); err != nil {
+		return fmt.Errorf("link IB device %s: %w", d.IBDevName, err)
+	}
+	return t.symlink(ibRel, filepath.Join("class/infiniband", d.IBDevName))
+}
+
+// SetPortCounter sets a counter of an IB port, given relative to the port
+// directory, e.g. "counters/symbol_error" or "hw_counters/out_of_buffer".
+func (t *Tree) SetPortCounter(ibDevName string, port int, counter string, value uint64) error {
+	portDir := filepath.Join(t.Root, "class/infiniband", ibDevName, "ports", strconv.Itoa(port))
+	return writeFiles(portDir, map[string]string{counter: strconv.FormatUint(value, 10)})
+}
+
+// linkVF adds the physfn and virtfn<n> links between the VF in vfDir and its
+// PF next to it, and bumps the PF's sriov_numvfs.
+func (t *Tree) linkVF(pfAddr, vfDir string) error {
+	vfAddr := filepath.Base(vfDir)
+	pfDir := filepath.Join(filepath.Dir(vfDir), pfAddr)
+	numVFsPath := filepath.Join(pfDir, "sriov_numvfs")
+	data, err := os.ReadFile(numVFsPath)
+	if err != nil {
+		return fmt.Errorf("PF %s of VF %s: %w", pfAddr, vfAddr, err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", numVFsPath, err)
+	}
+
+	if err := os.Symlink(filepath.Join("..", vfAddr), filepath.Join(pfDir, "virtfn"+strconv.Itoa(n))); err != nil {
+		return fmt.Errorf("link VF %s: %w", vfAddr, err)
+	}
+	if err := os.Symlink(filepath.Join("..", pfAddr), filepath.Join(vfDir, "physfn")); err != nil {
+		return fmt.Errorf("link VF %s: %w", vfAddr, err)
+	}
+	// Like on mlx5 before the GUIDs of a VF are set.
+	if err := writeFiles(filepath.Join(pfDir, "sriov", strconv.Itoa(n)), map[string]string{
+		"node":   "00:00:00:00:00:00:00:00",
+		"port":   "00:00:00:00:00:00:00:00",
+		"policy": "Down",
+	}); err != nil {
+		return err
+	}
+	return os.WriteFile(numVFsPath, []byte(strconv.Itoa(n+1)+"\n"), 0o644)
+}
+
+// AddPCIDriver creates the bind and unbind files of a PCI driver, as if its
+// module was loaded. Drivers of added devices are added implicitly.
+func (t *Tree) AddPCIDriver(driver string) error {
+	driverDir := filepath.Join(t.Root, "bus/pci/drivers", driver)
+	for _, name := range []string{"bind", "unbind"} {
+		if _, err := os.Stat(filepath.Join(driverDir, name)); err == nil {
+			continue
+		}
+		if err := writeFiles(driverDir, map[string]string{name: ""}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetPCIDriver binds a PCI function to driver, or unbinds it if driver is
+// empty, as if the kernel had acted on a write to a bind or unbind file.
+func (t *Tree) SetPCIDriver(pciAddr, driver string) error {
+	pciRel, err := t.pciRel(pciAddr)
+	if err != nil {
+		return err
+	}
+	linkRel := filepath.Join(pciRel, "driver")
+	if err := os.Remove(filepath.Join(t.Root, linkRel)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if driver == "" {
+		return nil
+	}
+	if err := t.AddPCIDriver(driver); err != nil {
+		return err
+	}
+	return t.symlink(filepath.Join("bus/pci/drivers", driver), linkRel)
+}
+
+// pciRel returns the directory of an added PCI function, relative to the tree
+// root.
+func (t *Tree) pciRel(pciAddr string) (string, error) {
+	root, err := filepath.EvalSymlinks(t.Root)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, "bus/pci/devices", pciAddr))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(root, dir)
+}
+
+// symlink creates a relative symlink at linkRel pointing to targetRel, both
+// relative to the tree root.
+func (t *Tree) symlink(targetRel, linkRel string) error {
+	link := filepath.Join(t.Root, linkRel)
+	if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+		return err
+	}
+	target, err := filepath.Rel(filepath.Dir(link), filepath.Join(t.Root, targetRel))
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(target, link); err != nil {
+		return fmt.Errorf("link %s: %w", linkRel, err)
+	}
+	return nil
+}
+
+func writeFiles(dir string, files map[string]string) error {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakesysfs
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+)
+
+// Model describes an HCA generation.
+type Model struct {
+	Name            string
+	PFDeviceID      string
+	VFDeviceID      string
+	FirmwareVersion string
+	// Speed is the per-lane speed of the model's ports, e.g. "HDR".
+	Speed  string
+	MaxVFs int
+	// PCIeLinkSpeed and PCIeLinkWidth are the PCIe link of the PFs, e.g.
+	// "16.0 GT/s PCIe" and 16.
+	PCIeLinkSpeed string
+	PCIeLinkWidth int
+}
+
+var (
+	// ConnectX6 is a ConnectX-6 HDR InfiniBand HCA.
+	ConnectX6 = Model{
+		Name:            "ConnectX-6",
+		PFDeviceID:      "0x101b",
+		VFDeviceID:      "0x101c",
+		FirmwareVersion: "20.39.1002",
+		Speed:           "HDR",
+		MaxVFs:          16,
+		PCIeLinkSpeed:   "16.0 GT/s PCIe",
+		PCIeLinkWidth:   16,
+	}
+	// ConnectX7 is a ConnectX-7 NDR InfiniBand HCA.
+	ConnectX7 = Model{
+		Name:            "ConnectX-7",
+		PFDeviceID:      "0x1021",
+		VFDeviceID:      "0x101e",
+		FirmwareVersion: "28.39.1002",
+		Speed:           "NDR",
+		MaxVFs:          16,
+		PCIeLinkSpeed:   "32.0 GT/s PCIe",
+		PCIeLinkWidth:   16,
+	}
+
+	// Models are the known HCA models by name.
+	Models = map[string]Model{
+		ConnectX6.Name: ConnectX6,
+		ConnectX7.Name: ConnectX7,
+	}
+)
+
+const mellanoxVendorID = "0x15b3"
+
+// AddHCA adds a single-port InfiniBand PF of the given model on PCI bus
+// 0000:<bus>:00.0 together with numVFs VFs, all with an active 4X port. IB
+// devices are named mlx5_<n> in the order they are added; the PF netdev is
+// ibp<bus>s0 and its VFs' netdevs are ibp<bus>s0v<i>.
+func (t *Tree) AddHCA(m Model, bus, numaNode, numVFs int) error {
+	return t.AddHCABelow("", m, bus, numaNode, numVFs)
+}
+
+// AddHCABelow is like AddHCA but places the HCA below the bridge with PCI
+// address parent, e.g. the downstream port of a PCIe switch added with
+// AddBridge.
+func (t *Tree) AddHCABelow(parent string, m Model, bus, numaNode, numVFs int) error {
+	if numVFs > m.MaxVFs {
+		return fmt.Errorf("%s supports at most %d VFs, got %d", m.Name, m.MaxVFs, numVFs)
+	}
+	rate, err := formatRate(m.Speed, "4X")
+	if err != nil {
+		return err
+	}
+	port := Port{State: "4: ACTIVE", PhysState: "5: LinkUp", Rate: rate, LinkLayer: "InfiniBand"}
+
+	pfAddr := pciAddress(fmt.Sprintf("0000:%02x", bus), 0)
+	pfNetdev := fmt.Sprintf("ibp%ds0", bus)
+	pf := t.function(m, pfAddr, m.PFDeviceID, numaNode, "mlx5_", pfNetdev, port)
+	pf.TotalVFs = m.MaxVFs
+	pf.Parent = parent
+	if err := t.AddDevice(pf); err != nil {
+		return fmt.Errorf("add %s PF %s: %w", m.Name, pfAddr, err)
+	}
+	for i := 0; i < numVFs; i++ {
+		vf := t.function(m, pciAddress(fmt.Sprintf("0000:%02x", bus), i+1), m.VFDeviceID, numaNode,
+			"mlx5_", fmt.Sprintf("%sv%d", pfNetdev, i), port)
+		vf.PhysFn = pfAddr
+		if err := t.AddDevice(vf); err != nil {
+			return fmt.Errorf("add %s VF %s: %w", m.Name, vf.PCIAddress, err)
+		}
+	}
+	return nil
+}
+
+// AddBridge adds a PCIe bridge, e.g. a root port or an upstream or
+// downstream port of a PCIe switch, below the bridge with PCI address parent,
+// or below the root complex if parent is empty.
+func (t *Tree) AddBridge(pciAddr, parent string) error {
+	if err := t.AddDevice(Device{
+		PCIAddress: pciAddr,
+		Vendor:     "0x1000",
+		DeviceID:   "0xc010",
+		NUMANode:   -1,
+		Parent:     parent,
+		Driver:     "pcieport",
+	}); err != nil {
+		return fmt.Errorf("add bridge %s: %w", pciAddr, err)
+	}
+	return nil
+}
+
+// function returns a PCI function of model m with a single port. The IB
+// device is named ibDevPrefix followed by a number counting all functions
+// added to the tree, which also makes its GUIDs, LID and IOMMU group unique.
+func (t *Tree) function(m Model, pciAddr, deviceID string, numaNode int, ibDevPrefix, netdev string, port Port) Device {
+	idx := t.numIBDevs
+	t.numIBDevs++
+	guid := 0xec0d9a0300000000 | uint64(idx+1)
+
+	port.LID = fmt.Sprintf("0x%x", idx+1)
+	port.GID = "fe80:0000:0000:0000:" + formatGUID(guid)
+	if port.LinkLayer == ibverbs.LinkLayerEthernet {
+		// RoCE ports have no LID, and a RoCE v1 and v2 GID for the
+		// link-local address of their netdev.
+		port.LID = "0x0"
+		port.GIDs = []GID{
+			{GID: port.GID, Type: "IB/RoCE v1", NetDev: netdev},
+			{GID: port.GID, Type: "RoCE v2", NetDev: netdev},
+		}
+	}
+	linkSpeed, linkWidth := m.PCIeLinkSpeed, m.PCIeLinkWidth
+	if deviceID == m.VFDeviceID {
+		// VFs have no link of their own.
+		linkSpeed, linkWidth = "Unknown", 0
+	}
+	return Device{
+		PCIAddress:      pciAddr,
+		Vendor:          mellanoxVendorID,
+		DeviceID:        deviceID,
+		NUMANode:        numaNode,
+		Driver:          "mlx5_core",
+		IOMMUGroup:      strconv.Itoa(idx),
+		IBDevName:       ibDevPrefix + strconv.Itoa(idx),
+		NodeGUID:        formatGUID(guid),
+		FirmwareVersion: m.FirmwareVersion,
+		Ports:           []Port{port},
+		NetDevices:      []string{netdev},
+		NetDevMTU:       4092,
+		LinkSpeed:       linkSpeed,
+		LinkWidth:       linkWidth,
+	}
+}
+
+// formatRate returns the contents of ports/<n>/rate for a speed and width,
+// e.g. "200 Gb/sec (4X HDR)". SDR has no suffix, like in the kernel.
+func formatRate(speed, width string) (string, error) {
+	ls, ok := ibverbs.ParseLinkSpeed(speed)
+	if !ok {
+		return "", fmt.Errorf("unknown IB speed %q", speed)
+	}
+	lw, ok := ibverbs.ParseLinkWidth(width)
+	if !ok {
+		return "", fmt.Errorf("unknown IB link width %q", width)
+	}
+	suffix := " " + speed
+	if ls == ibverbs.LinkSpeedSDR {
+		suffix = ""
+	}
+	gbps := float64(ls.LaneMbps()*int64(lw.Lanes())) / 1000
+	return fmt.Sprintf("%g Gb/sec (%s%s)", gbps, width, suffix), nil
+}
+
+// pciAddress returns the address of the fn-th function below a
+// domain:bus prefix, spilling over into the next device slot after 8
+// functions like VFs do.
+func pciAddress(domainBus string, fn int) string {
+	return fmt.Sprintf("%s:%02x.%d", domainBus, fn/8, fn%8)
+}
+
+// formatGUID formats a GUID the way sysfs does, e.g. ec0d:9a03:0078:6a4c.
+func formatGUID(guid uint64) string {
+	return fmt.Sprintf("%04x:%04x:%04x:%04x",
+		uint16(guid>>48), uint16(guid>>32), uint16(guid>>16), uint16(guid))
+}
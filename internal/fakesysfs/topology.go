@@ -0,0 +1,279 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakesysfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+)
+
+const (
+	// SimIBDevPrefix prefixes the IB device names created by AddTopology.
+	SimIBDevPrefix = "sim_mlx5_"
+	// SimNetdevPrefix prefixes the netdev names created by AddTopology. The
+	// names are kept short so they fit IFNAMSIZ and don't clash with real
+	// interfaces when dummy netdevs are created for them.
+	SimNetdevPrefix = "simib"
+)
+
+var pciAddressRE = regexp.MustCompile(`^([0-9a-f]{4}:[0-9a-f]{2}):([0-9a-f]{2})\.([0-7])$`)
+
+// Topology describes a simulated host with InfiniBand HCAs. It is usually
+// loaded from a YAML or JSON file with LoadTopology.
+type Topology struct {
+	HCAs []TopologyHCA `json:"hcas"`
+}
+
+// TopologyHCA describes a simulated HCA. Like on mlx5, every port is its own
+// PF, and every PF has NumVFs single-port VFs.
+type TopologyHCA struct {
+	// Model is the HCA model, "ConnectX-6" (default) or "ConnectX-7".
+	Model string `json:"model,omitempty"`
+	// PCIAddress is the address of the first PF, e.g. "0000:3b:00.0". The
+	// other PFs and then the VFs take the following functions. Defaults to
+	// function 0 on bus 0x10, 0x20, ... for the first, second, ... HCA.
+	PCIAddress string `json:"pciAddress,omitempty"`
+	// NUMANode is the NUMA node of the HCA, -1 if unknown.
+	NUMANode int `json:"numaNode,omitempty"`
+	// FirmwareVersion defaults to the model's.
+	FirmwareVersion string `json:"firmwareVersion,omitempty"`
+	// Ports defaults to a single active port.
+	Ports []TopologyPort `json:"ports,omitempty"`
+	// NumVFs is the number of VFs created on each PF.
+	NumVFs int `json:"numVFs,omitempty"`
+}
+
+// TopologyPort describes the state of a simulated port. VFs share the state
+// of their PF's port.
+type TopologyPort struct {
+	// Speed is the per-lane speed, e.g. "HDR". Defaults to the model's.
+	Speed string `json:"speed,omitempty"`
+	// Width is the link width, e.g. "4X" (default).
+	Width string `json:"width,omitempty"`
+	// State is the logical port state: "Active" (default), "Armed", "Init"
+	// or "Down".
+	State string `json:"state,omitempty"`
+	// PhysState is the physical port state, e.g. "LinkUp" or "Disabled".
+	// Defaults to "Polling" for ports that are Down and "LinkUp" otherwise.
+	PhysState string `json:"physState,omitempty"`
+	// LinkLayer is "InfiniBand" (default) or "Ethernet" for a RoCE port.
+	LinkLayer string `json:"linkLayer,omitempty"`
+}
+
+// DefaultTopology returns the topology simulated for a plain VF count: one
+// EDR ConnectX-6 PF at 0000:00:00.0 on NUMA node 0 with numVFs VFs.
+func DefaultTopology(numVFs int) *Topology {
+	return &Topology{HCAs: []TopologyHCA{{
+		Model:           ConnectX6.Name,
+		PCIAddress:      "0000:00:00.0",
+		FirmwareVersion: "20.99.0000",
+		Ports:           []TopologyPort{{Speed: "EDR"}},
+		NumVFs:          numVFs,
+	}}}
+}
+
+// LoadTopology reads and validates a YAML or JSON topology file.
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read topology: %w", err)
+	}
+	var topo Topology
+	if err := yaml.UnmarshalStrict(data, &topo); err != nil {
+		return nil, fmt.Errorf("parse topology %s: %w", path, err)
+	}
+	if err := topo.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid topology %s: %w", path, err)
+	}
+	return &topo, nil
+}
+
+// Validate checks the topology for unknown models, speeds, states and link
+// layers, and malformed PCI addresses.
+func (topo *Topology) Validate() error {
+	if len(topo.HCAs) == 0 {
+		return errors.New("no HCAs")
+	}
+	var errs []error
+	for i, hca := range topo.HCAs {
+		if _, err := hca.model(); err != nil {
+			errs = append(errs, fmt.Errorf("hcas[%d]: %w", i, err))
+		}
+		if hca.PCIAddress != "" && !pciAddressRE.MatchString(hca.PCIAddress) {
+			errs = append(errs, fmt.Errorf("hcas[%d]: malformed PCI address %q", i, hca.PCIAddress))
+		}
+		if hca.NumVFs < 0 {
+			errs = append(errs, fmt.Errorf("hcas[%d]: negative numVFs", i))
+		}
+		for j, p := range hca.Ports {
+			if _, err := p.sysfsPort(ConnectX6); err != nil {
+				errs = append(errs, fmt.Errorf("hcas[%d].ports[%d]: %w", i, j, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AddTopology adds the PFs and VFs of a validated topology to the tree and
+// returns the names of their netdevs. IB devices are named
+// SimIBDevPrefix<n> and netdevs SimNetdevPrefix<n>, numbered in the order
+// the functions are added.
+func (t *Tree) AddTopology(topo *Topology) ([]string, error) {
+	var netdevs []string
+	for i, hca := range topo.HCAs {
+		m, err := hca.model()
+		if err != nil {
+			return nil, err
+		}
+		if hca.FirmwareVersion != "" {
+			m.FirmwareVersion = hca.FirmwareVersion
+		}
+
+		addr := hca.PCIAddress
+		if addr == "" {
+			addr = fmt.Sprintf("0000:%02x:00.0", (i+1)*0x10)
+		}
+		match := pciAddressRE.FindStringSubmatch(addr)
+		if match == nil {
+			return nil, fmt.Errorf("malformed PCI address %q", addr)
+		}
+		domainBus := match[1]
+		dev, _ := strconv.ParseInt(match[2], 16, 0)
+		fn, _ := strconv.Atoi(match[3])
+		first := int(dev)*8 + fn
+
+		ports := hca.Ports
+		if len(ports) == 0 {
+			ports = []TopologyPort{{}}
+		}
+
+		var pfs []Device
+		for p, tp := range ports {
+			port, err := tp.sysfsPort(m)
+			if err != nil {
+				return nil, err
+			}
+			netdev := SimNetdevPrefix + strconv.Itoa(t.numIBDevs)
+			pf := t.function(m, pciAddress(domainBus, first+p), m.PFDeviceID, hca.NUMANode, SimIBDevPrefix, netdev, port)
+			pf.TotalVFs = max(m.MaxVFs, hca.NumVFs)
+			if err := t.AddDevice(pf); err != nil {
+				return nil, fmt.Errorf("add %s PF %s: %w", m.Name, pf.PCIAddress, err)
+			}
+			pfs = append(pfs, pf)
+			netdevs = append(netdevs, netdev)
+		}
+
+		next := first + len(pfs)
+		for _, pf := range pfs {
+			for v := 0; v < hca.NumVFs; v++ {
+				netdev := SimNetdevPrefix + strconv.Itoa(t.numIBDevs)
+				vf := t.function(m, pciAddress(domainBus, next), m.VFDeviceID, hca.NUMANode, SimIBDevPrefix, netdev, pf.Ports[0])
+				vf.PhysFn = pf.PCIAddress
+				next++
+				if err := t.AddDevice(vf); err != nil {
+					return nil, fmt.Errorf("add %s VF %s: %w", m.Name, vf.PCIAddress, err)
+				}
+				netdevs = append(netdevs, netdev)
+			}
+		}
+	}
+	return netdevs, nil
+}
+
+func (hca TopologyHCA) model() (Model, error) {
+	if hca.Model == "" {
+		return ConnectX6, nil
+	}
+	m, ok := Models[hca.Model]
+	if !ok {
+		return Model{}, fmt.Errorf("unknown HCA model %q", hca.Model)
+	}
+	return m, nil
+}
+
+// sysfsPort converts the port description to sysfs file contents, using the
+// speed of model m by default.
+func (tp TopologyPort) sysfsPort(m Model) (Port, error) {
+	speed, width := tp.Speed, tp.Width
+	if speed == "" {
+		speed = m.Speed
+	}
+	if width == "" {
+		width = "4X"
+	}
+	rate, err := formatRate(speed, width)
+	if err != nil {
+		return Port{}, err
+	}
+
+	state := ibverbs.PortStateActive
+	if tp.State != "" {
+		if state, err = parsePortState(tp.State); err != nil {
+			return Port{}, err
+		}
+	}
+	physState := ibverbs.PhysPortStateLinkUp
+	if tp.PhysState != "" {
+		if physState, err = parsePhysPortState(tp.PhysState); err != nil {
+			return Port{}, err
+		}
+	} else if state == ibverbs.PortStateDown {
+		physState = ibverbs.PhysPortStatePolling
+	}
+
+	linkLayer := ibverbs.LinkLayerInfiniBand
+	switch tp.LinkLayer {
+	case "", ibverbs.LinkLayerInfiniBand:
+	case ibverbs.LinkLayerEthernet:
+		linkLayer = tp.LinkLayer
+	default:
+		return Port{}, fmt.Errorf("unknown link layer %q", tp.LinkLayer)
+	}
+
+	return Port{
+		State:     fmt.Sprintf("%d: %s", state, strings.ToUpper(state.String())),
+		PhysState: fmt.Sprintf("%d: %s", physState, physState),
+		Rate:      rate,
+		LinkLayer: linkLayer,
+	}, nil
+}
+
+func parsePortState(s string) (ibverbs.PortState, error) {
+	for st := ibverbs.PortStateDown; st <= ibverbs.PortStateActive; st++ {
+		if st.String() == s {
+			return st, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown port state %q", s)
+}
+
+func parsePhysPortState(s string) (ibverbs.PhysPortState, error) {
+	for st := ibverbs.PhysPortStateSleep; st <= ibverbs.PhysPortStatePhyTest; st++ {
+		if st.String() == s {
+			return st, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown physical port state %q", s)
+}
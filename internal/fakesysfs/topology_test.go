@@ -0,0 +1,105 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fakesysfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+)
+
+func TestLoadTopology(t *testing.T) {
+	topo, err := LoadTopology("../../demo/sim-topology.yaml")
+	require.NoError(t, err)
+	require.Len(t, topo.HCAs, 2)
+	assert.Equal(t, "Down", topo.HCAs[0].Ports[1].State)
+	assert.Equal(t, 1, topo.HCAs[1].NUMANode)
+
+	tree, err := New(t.TempDir())
+	require.NoError(t, err)
+	netdevs, err := tree.AddTopology(topo)
+	require.NoError(t, err)
+	// 2 PFs with 4 VFs each, plus 1 PF with 4 VFs.
+	assert.Len(t, netdevs, 15)
+
+	state, err := os.ReadFile(filepath.Join(tree.Root, "class/infiniband/sim_mlx5_1/ports/1/state"))
+	require.NoError(t, err)
+	assert.Equal(t, "1: DOWN\n", string(state))
+	rate, err := os.ReadFile(filepath.Join(tree.Root, "class/infiniband/sim_mlx5_0/ports/1/rate"))
+	require.NoError(t, err)
+	assert.Equal(t, "400 Gb/sec (4X NDR)\n", string(rate))
+}
+
+func TestTopologyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{name: "empty", yaml: "hcas: []", wantErr: "no HCAs"},
+		{name: "unknown field", yaml: "hcas:\n- numVF: 2", wantErr: "unknown field"},
+		{name: "unknown model", yaml: "hcas:\n- model: ConnectX-3", wantErr: "unknown HCA model"},
+		{name: "bad PCI address", yaml: "hcas:\n- pciAddress: 3b:00.0", wantErr: "malformed PCI address"},
+		{name: "bad speed", yaml: "hcas:\n- ports:\n  - speed: GDR", wantErr: "unknown IB speed"},
+		{name: "bad state", yaml: "hcas:\n- ports:\n  - state: Up", wantErr: "unknown port state"},
+		{name: "bad link layer", yaml: "hcas:\n- ports:\n  - linkLayer: OmniPath", wantErr: "unknown link layer"},
+		{name: "valid", yaml: "hcas:\n- numVFs: 2\n  ports:\n  - state: Init\n    physState: LinkUp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "topology.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.yaml), 0o644))
+			_, err := LoadTopology(path)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddTopologyRoCE(t *testing.T) {
+	tree, err := New(t.TempDir())
+	require.NoError(t, err)
+	netdevs, err := tree.AddTopology(&Topology{HCAs: []TopologyHCA{{
+		Ports:  []TopologyPort{{LinkLayer: "Ethernet"}},
+		NumVFs: 1,
+	}}})
+	require.NoError(t, err)
+	require.Len(t, netdevs, 2)
+
+	devices, err := ibverbs.NewSysfsBackend(tree.Root).ListDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	for i, dev := range devices {
+		require.Len(t, dev.Ports, 1)
+		port := dev.Ports[0]
+		assert.Equal(t, ibverbs.LinkLayerEthernet, port.LinkLayer)
+		assert.Zero(t, port.LID)
+		require.Len(t, port.GIDs, 2)
+		assert.Equal(t, ibverbs.GIDTypeRoCEv1, port.GIDs[0].Type)
+		assert.Equal(t, ibverbs.GIDTypeRoCEv2, port.GIDs[1].Type)
+		assert.Equal(t, netdevs[i], port.GIDs[1].NetDevice)
+		assert.Equal(t, 1, port.DefaultRoCEv2GIDIndex())
+	}
+}
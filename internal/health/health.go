@@ -0,0 +1,107 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package health implements the standard gRPC health service of the kubelet
+// plugin, which the livenessProbe of its container queries.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"k8s.io/klog/v2"
+)
+
+// LivenessService is the service name the livenessProbe asks about. The
+// empty service name, the overall health of the server, is answered the same.
+const LivenessService = "liveness"
+
+// Check is a named health check. It returns an error describing why the
+// plugin is unhealthy.
+type Check struct {
+	Name string
+	Func func(ctx context.Context) error
+}
+
+// Server reports SERVING while all of its checks pass, and NOT_SERVING
+// otherwise.
+type Server struct {
+	grpc_health_v1.UnimplementedHealthServer
+
+	checks []Check
+}
+
+var _ grpc_health_v1.HealthServer = &Server{}
+
+// NewServer returns a Server running checks on every health check.
+func NewServer(checks ...Check) *Server {
+	return &Server{checks: checks}
+}
+
+// Check implements grpc_health_v1.HealthServer.
+func (s *Server) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if svc := req.GetService(); svc != "" && svc != LivenessService {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", svc)
+	}
+
+	resp := &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}
+	if err := s.run(ctx); err != nil {
+		klog.FromContext(ctx).Error(err, "Health check failed")
+		resp.Status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	return resp, nil
+}
+
+// run runs every check and joins their errors.
+func (s *Server) run(ctx context.Context) error {
+	var errs []error
+	for _, c := range s.checks {
+		if err := c.Func(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Serve runs the health service on port until ctx is cancelled.
+func (s *Server) Serve(ctx context.Context, port int) error {
+	addr := net.JoinHostPort("", strconv.Itoa(port))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen for health service on %s: %w", addr, err)
+	}
+
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, s)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+
+	klog.FromContext(ctx).Info("Serving gRPC health service", "address", lis.Addr().String())
+	if err := srv.Serve(lis); err != nil {
+		return fmt.Errorf("serve health service: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheck(t *testing.T) {
+	pass := Check{Name: "pass", Func: func(context.Context) error { return nil }}
+	fail := Check{Name: "inventory", Func: func(context.Context) error { return errors.New("last IB inventory scan completed 20m0s ago") }}
+
+	tests := []struct {
+		name    string
+		service string
+		checks  []Check
+		want    grpc_health_v1.HealthCheckResponse_ServingStatus
+	}{
+		{name: "no checks", want: grpc_health_v1.HealthCheckResponse_SERVING},
+		{name: "all pass", service: LivenessService, checks: []Check{pass, pass}, want: grpc_health_v1.HealthCheckResponse_SERVING},
+		{name: "one fails", service: LivenessService, checks: []Check{pass, fail}, want: grpc_health_v1.HealthCheckResponse_NOT_SERVING},
+		{name: "overall health", checks: []Check{fail}, want: grpc_health_v1.HealthCheckResponse_NOT_SERVING},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := NewServer(tt.checks...).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: tt.service})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, resp.Status)
+		})
+	}
+}
+
+func TestCheckUnknownService(t *testing.T) {
+	_, err := NewServer().Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: "readiness"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestRunJoinsErrors(t *testing.T) {
+	s := NewServer(
+		Check{Name: "registration", Func: func(context.Context) error { return errors.New("connection refused") }},
+		Check{Name: "inventory", Func: func(context.Context) error { return errors.New("stale") }},
+	)
+	assert.EqualError(t, s.run(context.Background()), "registration: connection refused\ninventory: stale")
+}
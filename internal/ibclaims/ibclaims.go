@@ -0,0 +1,684 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ibclaims watches the ResourceClaims allocated to IB devices of this
+// node, decodes their IbConfig opaque configuration and applies it to each
+// allocated device when the device is prepared. The outcome is reported as a
+// condition on the device's entry in the claim status, along with an
+// IbDeviceStatus describing the IB port.
+package ibclaims
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	resourceapi "k8s.io/api/resource/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	kjson "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	metav1apply "k8s.io/client-go/applyconfigurations/meta/v1"
+	resourceapply "k8s.io/client-go/applyconfigurations/resource/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	resourcelisters "k8s.io/client-go/listers/resource/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+)
+
+const (
+	// ConditionIbConfigApplied is set on the status of every device whose
+	// claim carries an IbConfig.
+	ConditionIbConfigApplied = "IbConfigApplied"
+
+	// ReasonApplied, ReasonInvalidConfig and ReasonApplyFailed are the
+	// reasons of ConditionIbConfigApplied.
+	ReasonApplied       = "Applied"
+	ReasonInvalidConfig = "InvalidConfig"
+	ReasonApplyFailed   = "ApplyFailed"
+)
+
+// Applier programs the IbConfig of a claim on an allocated device.
+type Applier interface {
+	// ApplyDeviceConfig programs the config of a claim on device.
+	ApplyDeviceConfig(ctx context.Context, device string, claimUID types.UID, config *configapi.IbConfig) error
+	// RejectDeviceConfig records that the config of device is invalid, so
+	// that the device is not handed to a pod without it.
+	RejectDeviceConfig(device string, err error)
+	// ReleaseDeviceConfig undoes ApplyDeviceConfig or RejectDeviceConfig
+	// once device is no longer allocated.
+	ReleaseDeviceConfig(ctx context.Context, device string) error
+	// DeviceStatus describes the IB port of an allocated device once its
+	// config has been applied.
+	DeviceStatus(device string) (*configapi.IbDeviceStatus, error)
+	// AddShare records an allocation share of device by a claim and the
+	// capacity it consumes, before it is handed to a pod. Adding it again
+	// is a no-op.
+	AddShare(ctx context.Context, device string, claimUID types.UID, shareID string, consumed map[resourceapi.QualifiedName]resource.Quantity) error
+	// RemoveShare undoes AddShare once the share is no longer allocated.
+	RemoveShare(ctx context.Context, device string, claimUID types.UID, shareID string) error
+	// RestoredClaims returns the UIDs of the claims whose configs or shares
+	// were restored after a restart and have not been applied or added
+	// again since. Applying or adding them again keeps them as they are.
+	RestoredClaims() []types.UID
+	// ReleaseRestored releases the configs and shares restored after a
+	// restart that have not been applied or added again since.
+	ReleaseRestored(ctx context.Context) error
+}
+
+// restoreRetryInterval is how often taking over the configs and shares
+// restored after a restart is retried.
+const restoreRetryInterval = 10 * time.Second
+
+// claimState records what has been applied for a claim.
+type claimState struct {
+	uid types.UID
+	// allocated holds every device allocated to the claim on this node.
+	allocated []string
+	// pods are the pods the claim is reserved for.
+	pods []string
+	// devices maps the allocated devices that carry an IbConfig to the
+	// condition reported for them.
+	devices map[string]*metav1apply.ConditionApplyConfiguration
+	// applied holds the devices whose config was applied successfully.
+	applied map[string]bool
+	// info holds the JSON encoding of the IbDeviceStatus of every allocated
+	// device.
+	info map[string][]byte
+	// shares maps the IDs of the allocation shares added with AddShare to
+	// their device.
+	shares map[string]string
+	// reported is set once the conditions in devices and info are in the
+	// claim status.
+	reported bool
+}
+
+// Tracker applies the IbConfig of the claims allocated on this node when
+// their devices are prepared, and reports it in the claim status.
+type Tracker struct {
+	clientset  kubernetes.Interface
+	driverName string
+	// configDriver is the opaque driver name of IbConfigs, see
+	// configapi.ConfigDriverName.
+	configDriver string
+	nodeName     string
+	applier      Applier
+	decoder      runtime.Decoder
+
+	factory informers.SharedInformerFactory
+	lister  resourcelisters.ResourceClaimLister
+	synced  cache.InformerSynced
+	queue   workqueue.TypedRateLimitingInterface[string]
+
+	mu     sync.Mutex
+	claims map[string]*claimState
+}
+
+// New creates a Tracker for the devices that driverName publishes in the
+// pool of nodeName.
+func New(clientset kubernetes.Interface, driverName, nodeName string, applier Applier) (*Tracker, error) {
+	scheme := runtime.NewScheme()
+	if err := configapi.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("create config scheme: %w", err)
+	}
+
+	factory := informers.NewSharedInformerFactory(clientset, 0)
+	informer := factory.Resource().V1().ResourceClaims()
+	t := &Tracker{
+		clientset:    clientset,
+		driverName:   driverName,
+		configDriver: configapi.ConfigDriverName(driverName),
+		nodeName:     nodeName,
+		applier:      applier,
+		decoder: kjson.NewSerializerWithOptions(
+			kjson.DefaultMetaFactory, scheme, scheme,
+			kjson.SerializerOptions{Strict: true},
+		),
+		factory: factory,
+		lister:  informer.Lister(),
+		synced:  informer.Informer().HasSynced,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "ibclaims"},
+		),
+		claims: make(map[string]*claimState),
+	}
+
+	enqueue := func(obj any) {
+		if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			t.queue.Add(key)
+		}
+	}
+	if _, err := informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj any) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	}); err != nil {
+		return nil, fmt.Errorf("add ResourceClaim event handler: %w", err)
+	}
+	return t, nil
+}
+
+// Run watches ResourceClaims until ctx is cancelled. Once they are synced, it
+// takes over the configs and shares the applier restored after a restart.
+func (t *Tracker) Run(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	defer t.queue.ShutDown()
+
+	t.factory.Start(ctx.Done())
+	defer t.factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), t.synced) {
+		return fmt.Errorf("wait for ResourceClaim informer to sync: %w", ctx.Err())
+	}
+	logger.Info("IB claims: watching ResourceClaims", "driver", t.driverName, "pool", t.nodeName)
+
+	go func() {
+		_ = wait.PollUntilContextCancel(ctx, restoreRetryInterval, true, func(ctx context.Context) (bool, error) {
+			if err := t.adoptRestored(ctx); err != nil {
+				logger.Error(err, "IB claims: failed to take over configs restored after a restart, retrying")
+				return false, nil
+			}
+			return true, nil
+		})
+	}()
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		for t.processNext(ctx) {
+		}
+	}, time.Second)
+	<-ctx.Done()
+	return nil
+}
+
+func (t *Tracker) processNext(ctx context.Context) bool {
+	key, shutdown := t.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer t.queue.Done(key)
+
+	if err := t.syncClaim(ctx, key); err != nil {
+		klog.FromContext(ctx).Error(err, "IB claims: failed to sync ResourceClaim, retrying", "claim", key)
+		t.queue.AddRateLimited(key)
+		return true
+	}
+	t.queue.Forget(key)
+	return true
+}
+
+// PrepareDevice applies the IbConfig of the claims that allocate device on
+// this node and are reserved for a pod, and reports whether there are any.
+// It is called while DRANET prepares the device, so that the device is
+// configured before it is handed out; Run only reports the outcome in the
+// claim status and releases the devices of claims that are gone.
+func (t *Tracker) PrepareDevice(ctx context.Context, device string) (bool, error) {
+	if !t.synced() {
+		return false, nil
+	}
+	claims, err := t.lister.List(labels.Everything())
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	var errs []error
+	for _, claim := range claims {
+		if claim.DeletionTimestamp != nil || claim.Status.Allocation == nil || len(reservedPods(claim)) == 0 {
+			continue
+		}
+		results, _ := t.deviceConfigs(claim)
+		if !slices.ContainsFunc(results, func(result resourceapi.DeviceRequestAllocationResult) bool {
+			return result.Device == device
+		}) {
+			continue
+		}
+		found = true
+		if err := t.prepareClaim(ctx, claim); err != nil {
+			errs = append(errs, err)
+		}
+		if key, err := cache.MetaNamespaceKeyFunc(claim); err == nil {
+			t.queue.Add(key)
+		}
+	}
+	return found, errors.Join(errs...)
+}
+
+// ReleaseDevice undoes the IbConfig that PrepareDevice applied to device once
+// the pod it was handed to is gone, e.g. binds a VF in VFIO mode back to its
+// driver. The device is forgotten, so that the claim status no longer reports
+// it and preparing the claim again applies the config again. A device of no
+// known claim is released all the same.
+func (t *Tracker) ReleaseDevice(ctx context.Context, device string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.applier.ReleaseDeviceConfig(ctx, device); err != nil {
+		return err
+	}
+	for key, state := range t.claims {
+		if _, ok := state.devices[device]; !ok {
+			continue
+		}
+		delete(state.devices, device)
+		delete(state.applied, device)
+		delete(state.info, device)
+		state.reported = false
+		t.queue.Add(key)
+	}
+	return nil
+}
+
+// adoptRestored takes over the configs and allocation shares the applier
+// restored after a restart. The claims that still hold them are prepared
+// again, which keeps them as they are and lets them be released with the
+// claim; the others belong to claims released in the meantime and are
+// released.
+func (t *Tracker) adoptRestored(ctx context.Context) error {
+	restored := t.applier.RestoredClaims()
+	if len(restored) == 0 {
+		return nil
+	}
+	claims, err := t.lister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, claim := range claims {
+		if claim.DeletionTimestamp != nil || claim.Status.Allocation == nil || !slices.Contains(restored, claim.UID) {
+			continue
+		}
+		if err := t.prepareClaim(ctx, claim); err != nil {
+			errs = append(errs, err)
+		}
+		if key, err := cache.MetaNamespaceKeyFunc(claim); err == nil {
+			t.queue.Add(key)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.applier.ReleaseRestored(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// prepareClaim applies the IbConfig of a claim to its devices on this node
+// and adds its allocation shares. Devices that are already configured are
+// left alone, so a retried prepare does not apply anything twice.
+func (t *Tracker) prepareClaim(ctx context.Context, claim *resourceapi.ResourceClaim) error {
+	key, err := cache.MetaNamespaceKeyFunc(claim)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.claims[key]
+	if state != nil && state.uid != claim.UID {
+		if err := t.release(ctx, key, state); err != nil {
+			return err
+		}
+		state = nil
+	}
+	results, configs := t.deviceConfigs(claim)
+	if len(results) == 0 {
+		return nil
+	}
+	if state == nil {
+		state = &claimState{
+			uid:     claim.UID,
+			devices: make(map[string]*metav1apply.ConditionApplyConfiguration),
+			applied: make(map[string]bool),
+			info:    make(map[string][]byte),
+			shares:  make(map[string]string),
+		}
+		t.claims[key] = state
+	}
+	state.allocated = state.allocated[:0]
+	for _, result := range results {
+		state.allocated = append(state.allocated, result.Device)
+	}
+	state.pods = reservedPods(claim)
+
+	var errs []error
+	for _, result := range results {
+		config, hasConfig := configs[result.Device]
+		if result.ShareID != nil {
+			if err := t.addShare(ctx, claim, state, result, hasConfig); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		// The netdev of a device changes when its config is applied.
+		configured := hasConfig && !state.applied[result.Device]
+		if configured {
+			if err := t.applyConfig(ctx, claim, state, result.Device, config); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if _, ok := state.info[result.Device]; ok && !configured {
+			continue
+		}
+		if err := t.describe(state, result.Device); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncClaim reports what PrepareDevice did for a claim in its status, or
+// releases its devices once the claim is gone or no longer allocated.
+func (t *Tracker) syncClaim(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	claim, err := t.lister.ResourceClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		claim = nil
+	} else if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.claims[key]
+	if state == nil {
+		return nil
+	}
+	if claim == nil || claim.UID != state.uid || claim.Status.Allocation == nil {
+		return t.release(ctx, key, state)
+	}
+	state.pods = reservedPods(claim)
+	if state.reported {
+		return nil
+	}
+	results, _ := t.deviceConfigs(claim)
+	if err := t.reportStatus(ctx, claim, results, state); err != nil {
+		return err
+	}
+	state.reported = true
+	return nil
+}
+
+// applyConfig applies the IbConfig of an allocated device and records the
+// outcome as the device's condition.
+func (t *Tracker) applyConfig(ctx context.Context, claim *resourceapi.ResourceClaim, state *claimState, device string, config deviceConfig) error {
+	var applyErr error
+	status, reason, message := metav1.ConditionTrue, ReasonApplied, ""
+	if config.err != nil {
+		status, reason, message = metav1.ConditionFalse, ReasonInvalidConfig, config.err.Error()
+		t.applier.RejectDeviceConfig(device, config.err)
+	} else if err := t.applier.ApplyDeviceConfig(ctx, device, claim.UID, config.config); err != nil {
+		status, reason, message = metav1.ConditionFalse, ReasonApplyFailed, err.Error()
+		applyErr = fmt.Errorf("apply IbConfig to device %s: %w", device, err)
+	} else {
+		state.applied[device] = true
+	}
+
+	t.setCondition(claim, state, device, status, reason, message)
+	return applyErr
+}
+
+// addShare adds an allocation share of a device. A share is handed one of
+// the VFs of the device, or the device itself, so an IbConfig cannot be
+// applied to it and is reported as invalid instead.
+func (t *Tracker) addShare(ctx context.Context, claim *resourceapi.ResourceClaim, state *claimState, result resourceapi.DeviceRequestAllocationResult, hasConfig bool) error {
+	shareID := string(*result.ShareID)
+	if hasConfig {
+		t.setCondition(claim, state, result.Device, metav1.ConditionFalse, ReasonInvalidConfig, "IbConfig is not supported on allocation shares")
+		return nil
+	}
+	if _, ok := state.shares[shareID]; ok {
+		return nil
+	}
+	if err := t.applier.AddShare(ctx, result.Device, claim.UID, shareID, result.ConsumedCapacity); err != nil {
+		return fmt.Errorf("add share %s of device %s: %w", shareID, result.Device, err)
+	}
+	state.shares[shareID] = result.Device
+	return nil
+}
+
+// setCondition records the condition of an allocated device unless it is
+// unchanged.
+func (t *Tracker) setCondition(claim *resourceapi.ResourceClaim, state *claimState, device string, status metav1.ConditionStatus, reason, message string) {
+	prev := state.devices[device]
+	if prev != nil && *prev.Status == status && *prev.Reason == reason && ptr.Deref(prev.Message, "") == message {
+		return
+	}
+	condition := metav1apply.Condition().
+		WithType(ConditionIbConfigApplied).
+		WithStatus(status).
+		WithReason(reason).
+		WithObservedGeneration(claim.Generation).
+		WithLastTransitionTime(metav1.Now())
+	if message != "" {
+		condition.WithMessage(message)
+	}
+	state.devices[device] = condition
+	state.reported = false
+}
+
+// describe records the description of an allocated device.
+func (t *Tracker) describe(state *claimState, device string) error {
+	ibStatus, err := t.applier.DeviceStatus(device)
+	if err != nil {
+		return fmt.Errorf("describe device %s: %w", device, err)
+	}
+	data, err := json.Marshal(ibStatus)
+	if err != nil {
+		return fmt.Errorf("encode status of device %s: %w", device, err)
+	}
+
+	if prev, ok := state.info[device]; ok && bytes.Equal(prev, data) {
+		return nil
+	}
+	state.info[device] = data
+	state.reported = false
+	return nil
+}
+
+// release undoes the config of every device of a claim and removes its
+// allocation shares.
+func (t *Tracker) release(ctx context.Context, key string, state *claimState) error {
+	var errs []error
+	for shareID, device := range state.shares {
+		if err := t.applier.RemoveShare(ctx, device, state.uid, shareID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(state.shares, shareID)
+	}
+	for device := range state.devices {
+		if err := t.applier.ReleaseDeviceConfig(ctx, device); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(state.devices, device)
+		delete(state.applied, device)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	delete(t.claims, key)
+	return nil
+}
+
+// reportStatus applies the IbDeviceStatus of all allocated devices of the
+// claim as their data, and the conditions of those that carry an IbConfig.
+// DRANET owns the networkData of the devices, so it is left alone.
+// Server-side apply replaces everything previously applied by this field
+// manager, so all of them are sent every time.
+func (t *Tracker) reportStatus(ctx context.Context, claim *resourceapi.ResourceClaim, results []resourceapi.DeviceRequestAllocationResult, state *claimState) error {
+	status := resourceapply.ResourceClaimStatus()
+	for _, result := range results {
+		condition, hasCondition := state.devices[result.Device]
+		data, hasData := state.info[result.Device]
+		if !hasCondition && !hasData {
+			continue
+		}
+		device := resourceapply.AllocatedDeviceStatus().
+			WithDriver(result.Driver).
+			WithPool(result.Pool).
+			WithDevice(result.Device)
+		if result.ShareID != nil {
+			device.WithShareID(string(*result.ShareID))
+		}
+		if hasCondition {
+			device.WithConditions(condition)
+		}
+		if hasData {
+			device.WithData(runtime.RawExtension{Raw: data})
+		}
+		status.WithDevices(device)
+	}
+
+	claimApply := resourceapply.ResourceClaim(claim.Name, claim.Namespace).
+		WithUID(claim.UID).
+		WithStatus(status)
+	_, err := t.clientset.ResourceV1().ResourceClaims(claim.Namespace).ApplyStatus(ctx, claimApply,
+		metav1.ApplyOptions{FieldManager: t.fieldManager(), Force: true})
+	if err != nil {
+		return fmt.Errorf("update status of ResourceClaim %s/%s: %w", claim.Namespace, claim.Name, err)
+	}
+	return nil
+}
+
+// DeviceOwner returns the claim device is allocated to and the pods it is
+// reserved for. It implements metrics.OwnerLookup.
+func (t *Tracker) DeviceOwner(device string) (metrics.Owner, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, state := range t.claims {
+		if !slices.Contains(state.allocated, device) {
+			continue
+		}
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		return metrics.Owner{Namespace: namespace, Claim: name, Pods: slices.Clone(state.pods)}, true
+	}
+	return metrics.Owner{}, false
+}
+
+// reservedPods returns the names of the pods the claim is reserved for.
+func reservedPods(claim *resourceapi.ResourceClaim) []string {
+	var pods []string
+	for _, ref := range claim.Status.ReservedFor {
+		if ref.APIGroup == "" && ref.Resource == "pods" {
+			pods = append(pods, ref.Name)
+		}
+	}
+	slices.Sort(pods)
+	return pods
+}
+
+func (t *Tracker) fieldManager() string {
+	return t.driverName + "/ibconfig"
+}
+
+// deviceConfig is the IbConfig of a device, or the error decoding it.
+type deviceConfig struct {
+	config *configapi.IbConfig
+	err    error
+}
+
+// deviceConfigs returns the allocation results of the claim for this node and
+// driver, and the IbConfig of those that have one. IbConfigs are the opaque
+// configs for the config driver name; those for the driver name itself
+// belong to DRANET. Configs from the class
+// come before those from the claim, and a later config for the same request
+// takes precedence over an earlier one.
+func (t *Tracker) deviceConfigs(claim *resourceapi.ResourceClaim) ([]resourceapi.DeviceRequestAllocationResult, map[string]deviceConfig) {
+	allocation := claim.Status.Allocation.Devices
+
+	var opaque []resourceapi.DeviceAllocationConfiguration
+	for _, source := range []resourceapi.AllocationConfigSource{resourceapi.AllocationConfigSourceClass, resourceapi.AllocationConfigSourceClaim} {
+		for _, config := range allocation.Config {
+			if config.Source == source && config.Opaque != nil && config.Opaque.Driver == t.configDriver {
+				opaque = append(opaque, config)
+			}
+		}
+	}
+
+	var results []resourceapi.DeviceRequestAllocationResult
+	configs := make(map[string]deviceConfig)
+	for _, result := range allocation.Results {
+		if result.Driver != t.driverName || result.Pool != t.nodeName {
+			continue
+		}
+		results = append(results, result)
+
+		var raw []byte
+		for _, config := range opaque {
+			if len(config.Requests) == 0 || slices.ContainsFunc(config.Requests, func(request string) bool {
+				return requestMatches(request, result.Request)
+			}) {
+				raw = config.Opaque.Parameters.Raw
+			}
+		}
+		if raw != nil {
+			configs[result.Device] = t.decode(raw)
+		}
+	}
+	return results, configs
+}
+
+func (t *Tracker) decode(raw []byte) deviceConfig {
+	obj, err := runtime.Decode(t.decoder, raw)
+	if err != nil {
+		return deviceConfig{err: fmt.Errorf("decode IbConfig: %w", err)}
+	}
+	config, ok := obj.(*configapi.IbConfig)
+	if !ok {
+		return deviceConfig{err: fmt.Errorf("expected v1alpha1.IbConfig but got: %T", obj)}
+	}
+	if err := config.Normalize(); err != nil {
+		return deviceConfig{err: err}
+	}
+	if err := config.Validate(); err != nil {
+		return deviceConfig{err: err}
+	}
+	return deviceConfig{config: config}
+}
+
+// requestMatches reports whether a config for request applies to an
+// allocation result for resultRequest, which names a subrequest as
+// <request>/<subrequest>.
+func requestMatches(request, resultRequest string) bool {
+	if request == resultRequest {
+		return true
+	}
+	parent, _, found := strings.Cut(resultRequest, "/")
+	return found && request == parent
+}
@@ -0,0 +1,504 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibclaims
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/dranet/pkg/apis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	resourceapply "k8s.io/client-go/applyconfigurations/resource/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+)
+
+const (
+	testDriver = "ib.sigs.k8s.io"
+	testNode   = "node-a"
+)
+
+type fakeApplier struct {
+	applied  map[string]*configapi.IbConfig
+	rejected map[string]error
+	released []string
+	failures map[string]error
+	// shares maps claim UIDs and share IDs to the VFs they consume.
+	shares map[string]int64
+	// restored maps the devices whose config was restored after a restart
+	// to the UID of their claim.
+	restored map[string]types.UID
+}
+
+func newFakeApplier() *fakeApplier {
+	return &fakeApplier{
+		applied:  make(map[string]*configapi.IbConfig),
+		rejected: make(map[string]error),
+		failures: make(map[string]error),
+		shares:   make(map[string]int64),
+		restored: make(map[string]types.UID),
+	}
+}
+
+func (a *fakeApplier) ApplyDeviceConfig(_ context.Context, device string, claimUID types.UID, config *configapi.IbConfig) error {
+	if a.restored[device] == claimUID {
+		delete(a.restored, device)
+	}
+	if err := a.failures[device]; err != nil {
+		return err
+	}
+	a.applied[device] = config
+	return nil
+}
+
+func (a *fakeApplier) RejectDeviceConfig(device string, err error) {
+	a.rejected[device] = err
+}
+
+func (a *fakeApplier) DeviceStatus(device string) (*configapi.IbDeviceStatus, error) {
+	status := configapi.NewIbDeviceStatus()
+	status.IBDevName = strings.ReplaceAll(strings.TrimSuffix(device, "-port1"), "-", "_")
+	status.Port = 1
+	status.Pkey = 0xffff
+	if config := a.applied[device]; config != nil && config.Pkey != nil {
+		status.Pkey = *config.Pkey
+	}
+	return status, nil
+}
+
+func (a *fakeApplier) ReleaseDeviceConfig(_ context.Context, device string) error {
+	a.released = append(a.released, device)
+	delete(a.applied, device)
+	delete(a.rejected, device)
+	return nil
+}
+
+func (a *fakeApplier) AddShare(_ context.Context, device string, claimUID types.UID, shareID string, consumed map[resourceapi.QualifiedName]resource.Quantity) error {
+	if err := a.failures[device]; err != nil {
+		return err
+	}
+	vfs := consumed["dra.net/ibVFs"]
+	a.shares[string(claimUID)+"/"+shareID] = vfs.Value()
+	return nil
+}
+
+func (a *fakeApplier) RemoveShare(_ context.Context, device string, claimUID types.UID, shareID string) error {
+	delete(a.shares, string(claimUID)+"/"+shareID)
+	return nil
+}
+
+func (a *fakeApplier) RestoredClaims() []types.UID {
+	var claims []types.UID
+	for _, claimUID := range a.restored {
+		claims = append(claims, claimUID)
+	}
+	return claims
+}
+
+func (a *fakeApplier) ReleaseRestored(ctx context.Context) error {
+	for device := range a.restored {
+		if err := a.ReleaseDeviceConfig(ctx, device); err != nil {
+			return err
+		}
+		delete(a.restored, device)
+	}
+	return nil
+}
+
+func opaqueConfig(source resourceapi.AllocationConfigSource, raw string, requests ...string) resourceapi.DeviceAllocationConfiguration {
+	return resourceapi.DeviceAllocationConfiguration{
+		Source:   source,
+		Requests: requests,
+		DeviceConfiguration: resourceapi.DeviceConfiguration{
+			Opaque: &resourceapi.OpaqueDeviceConfiguration{
+				Driver:     configapi.ConfigDriverName(testDriver),
+				Parameters: runtime.RawExtension{Raw: []byte(raw)},
+			},
+		},
+	}
+}
+
+// dranetConfig returns an opaque claim config for the driver name itself,
+// which DRANET reads.
+func dranetConfig(raw string) resourceapi.DeviceAllocationConfiguration {
+	config := opaqueConfig(resourceapi.AllocationConfigSourceClaim, raw)
+	config.Opaque.Driver = testDriver
+	return config
+}
+
+// dranetConfigErrors returns the errors DRANET's prepare hook reports for the
+// opaque configs of a claim: it decodes every config for its driver name,
+// whatever its kind, strictly as a NetworkConfig.
+func dranetConfigErrors(claim *resourceapi.ResourceClaim) []error {
+	var errs []error
+	for _, config := range claim.Status.Allocation.Devices.Config {
+		if config.Opaque == nil || config.Opaque.Driver != testDriver {
+			continue
+		}
+		_, configErrs := apis.ValidateConfig(&config.Opaque.Parameters)
+		errs = append(errs, configErrs...)
+	}
+	return errs
+}
+
+func testClaim(configs ...resourceapi.DeviceAllocationConfiguration) *resourceapi.ResourceClaim {
+	return &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "claim", Namespace: "default", UID: "uid-1"},
+		Status: resourceapi.ResourceClaimStatus{
+			ReservedFor: []resourceapi.ResourceClaimConsumerReference{
+				{Resource: "pods", Name: "worker-0", UID: "pod-1"},
+			},
+			Allocation: &resourceapi.AllocationResult{
+				Devices: resourceapi.DeviceAllocationResult{
+					Results: []resourceapi.DeviceRequestAllocationResult{
+						{Request: "ib", Driver: testDriver, Pool: testNode, Device: "mlx5-1-port1"},
+						{Request: "ib", Driver: testDriver, Pool: "node-b", Device: "mlx5-2-port1"},
+						{Request: "gpu/small", Driver: "gpu.example.com", Pool: testNode, Device: "gpu-0"},
+						{Request: "mpi/ib", Driver: testDriver, Pool: testNode, Device: "mlx5-3-port1"},
+					},
+					Config: configs,
+				},
+			},
+		},
+	}
+}
+
+const (
+	pkeyConfig  = `{"apiVersion":"ib.resource.sigs.k8s.io/v1alpha1","kind":"IbConfig","pkey":32769}`
+	mtuConfig   = `{"apiVersion":"ib.resource.sigs.k8s.io/v1alpha1","kind":"IbConfig","mtu":2048}`
+	badConfig   = `{"apiVersion":"ib.resource.sigs.k8s.io/v1alpha1","kind":"IbConfig","pkey":0}`
+	unknownKind = `{"apiVersion":"ib.resource.sigs.k8s.io/v1alpha1","kind":"IbConfig","bogus":1}`
+)
+
+func newTestTracker(t *testing.T, claim *resourceapi.ResourceClaim) (*Tracker, *fakeApplier, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewClientset(claim)
+	applier := newFakeApplier()
+	tracker, err := New(client, testDriver, testNode, applier)
+	require.NoError(t, err)
+	tracker.synced = func() bool { return true }
+	require.NoError(t, tracker.factory.Resource().V1().ResourceClaims().Informer().GetStore().Add(claim))
+	return tracker, applier, client
+}
+
+func deviceConditions(t *testing.T, client *fake.Clientset) map[string]metav1.Condition {
+	t.Helper()
+	claim, err := client.ResourceV1().ResourceClaims("default").Get(context.Background(), "claim", metav1.GetOptions{})
+	require.NoError(t, err)
+	conditions := make(map[string]metav1.Condition)
+	for _, d := range claim.Status.Devices {
+		for _, c := range d.Conditions {
+			if c.Type == ConditionIbConfigApplied {
+				conditions[d.Device] = c
+			}
+		}
+	}
+	return conditions
+}
+
+func TestPrepareDeviceAppliesConfig(t *testing.T) {
+	ctx := context.Background()
+	claim := testClaim(
+		opaqueConfig(resourceapi.AllocationConfigSourceClaim, pkeyConfig),
+		opaqueConfig(resourceapi.AllocationConfigSourceClass, mtuConfig),
+		opaqueConfig(resourceapi.AllocationConfigSourceClaim, mtuConfig, "mpi"),
+	)
+	tracker, applier, client := newTestTracker(t, claim)
+
+	// Nothing is applied before a device of the claim is prepared.
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.Empty(t, applier.applied)
+
+	found, err := tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	// Claim configs take precedence over class configs and the last matching
+	// config wins; devices of other nodes and drivers are left alone.
+	require.Len(t, applier.applied, 2)
+	assert.Equal(t, uint16(0x8001), *applier.applied["mlx5-1-port1"].Pkey)
+	assert.Nil(t, applier.applied["mlx5-1-port1"].MTU)
+	assert.Equal(t, configapi.MTU2048, *applier.applied["mlx5-3-port1"].MTU)
+
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	conditions := deviceConditions(t, client)
+	require.Len(t, conditions, 2)
+	assert.Equal(t, metav1.ConditionTrue, conditions["mlx5-1-port1"].Status)
+	assert.Equal(t, ReasonApplied, conditions["mlx5-1-port1"].Reason)
+
+	// Retried prepares and resyncs don't reapply.
+	applier.applied = make(map[string]*configapi.IbConfig)
+	found, err = tracker.PrepareDevice(ctx, "mlx5-3-port1")
+	require.NoError(t, err)
+	assert.True(t, found)
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.Empty(t, applier.applied)
+
+	// Devices of other nodes are not prepared.
+	found, err = tracker.PrepareDevice(ctx, "mlx5-2-port1")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	// Deleting the claim releases its devices.
+	require.NoError(t, tracker.factory.Resource().V1().ResourceClaims().Informer().GetStore().Delete(claim))
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.ElementsMatch(t, []string{"mlx5-1-port1", "mlx5-3-port1"}, applier.released)
+	assert.Empty(t, tracker.claims)
+}
+
+func TestPrepareDeviceReportsFailures(t *testing.T) {
+	ctx := context.Background()
+	claim := testClaim(
+		opaqueConfig(resourceapi.AllocationConfigSourceClaim, pkeyConfig, "ib"),
+		opaqueConfig(resourceapi.AllocationConfigSourceClaim, badConfig, "mpi"),
+	)
+	tracker, applier, client := newTestTracker(t, claim)
+	applier.failures["mlx5-1-port1"] = errors.New("pkey 0x8001 is not in the P_Key table")
+
+	_, err := tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pkey 0x8001 is not in the P_Key table")
+	assert.Contains(t, applier.rejected, "mlx5-3-port1")
+
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	conditions := deviceConditions(t, client)
+	assert.Equal(t, metav1.ConditionFalse, conditions["mlx5-1-port1"].Status)
+	assert.Equal(t, ReasonApplyFailed, conditions["mlx5-1-port1"].Reason)
+	assert.Equal(t, metav1.ConditionFalse, conditions["mlx5-3-port1"].Status)
+	assert.Equal(t, ReasonInvalidConfig, conditions["mlx5-3-port1"].Reason)
+
+	// A retry that succeeds flips the condition.
+	delete(applier.failures, "mlx5-1-port1")
+	_, err = tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	require.NoError(t, err)
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	conditions = deviceConditions(t, client)
+	assert.Equal(t, metav1.ConditionTrue, conditions["mlx5-1-port1"].Status)
+	assert.Equal(t, ReasonInvalidConfig, conditions["mlx5-3-port1"].Reason)
+}
+
+func TestIbConfigPassesDRANETPrepare(t *testing.T) {
+	ctx := context.Background()
+	claim := testClaim(
+		opaqueConfig(resourceapi.AllocationConfigSourceClaim, pkeyConfig),
+		dranetConfig(`{"interface":{"name":"ib0"}}`),
+	)
+	assert.Empty(t, dranetConfigErrors(claim))
+
+	// The IbConfig is applied and DRANET's own config is left to it.
+	tracker, applier, _ := newTestTracker(t, claim)
+	found, err := tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	require.NoError(t, err)
+	assert.True(t, found)
+	require.Contains(t, applier.applied, "mlx5-1-port1")
+	assert.Equal(t, uint16(0x8001), *applier.applied["mlx5-1-port1"].Pkey)
+	assert.Empty(t, applier.rejected)
+
+	// Passed with the driver name itself, the IbConfig would fail the
+	// prepare of the claim in DRANET.
+	assert.NotEmpty(t, dranetConfigErrors(testClaim(dranetConfig(pkeyConfig))))
+}
+
+func TestDecode(t *testing.T) {
+	tracker, _, _ := newTestTracker(t, testClaim())
+
+	assert.NoError(t, tracker.decode([]byte(pkeyConfig)).err)
+	assert.ErrorContains(t, tracker.decode([]byte(badConfig)).err, "pkey must be in range")
+	assert.ErrorContains(t, tracker.decode([]byte(unknownKind)).err, "decode IbConfig")
+}
+
+func TestRequestMatches(t *testing.T) {
+	tests := []struct {
+		request, result string
+		want            bool
+	}{
+		{request: "ib", result: "ib", want: true},
+		{request: "mpi", result: "mpi/ib", want: true},
+		{request: "mpi/ib", result: "mpi/ib", want: true},
+		{request: "mpi/eth", result: "mpi/ib", want: false},
+		{request: "ib", result: "mpi/ib", want: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, requestMatches(tt.request, tt.result), "%s vs %s", tt.request, tt.result)
+	}
+}
+
+func TestSyncClaimReportsDeviceStatus(t *testing.T) {
+	ctx := context.Background()
+	claim := testClaim(opaqueConfig(resourceapi.AllocationConfigSourceClaim, pkeyConfig, "ib"))
+	tracker, _, client := newTestTracker(t, claim)
+
+	// DRANET reports the netdev in the pod under its own field manager.
+	dranetStatus := resourceapply.ResourceClaim("claim", "default").
+		WithStatus(resourceapply.ResourceClaimStatus().WithDevices(
+			resourceapply.AllocatedDeviceStatus().
+				WithDriver(testDriver).
+				WithPool(testNode).
+				WithDevice("mlx5-1-port1").
+				WithNetworkData(resourceapply.NetworkDeviceData().WithInterfaceName("ib0")),
+		))
+	_, err := client.ResourceV1().ResourceClaims("default").ApplyStatus(ctx, dranetStatus,
+		metav1.ApplyOptions{FieldManager: testDriver, Force: true})
+	require.NoError(t, err)
+
+	_, err = tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	require.NoError(t, err)
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+
+	claim, err = client.ResourceV1().ResourceClaims("default").Get(ctx, "claim", metav1.GetOptions{})
+	require.NoError(t, err)
+	devices := make(map[string]resourceapi.AllocatedDeviceStatus)
+	for _, d := range claim.Status.Devices {
+		devices[d.Device] = d
+	}
+	// Devices without an IbConfig are described too.
+	require.Len(t, devices, 2)
+
+	configured := devices["mlx5-1-port1"]
+	assert.Len(t, configured.Conditions, 1)
+	require.NotNil(t, configured.NetworkData)
+	assert.Equal(t, "ib0", configured.NetworkData.InterfaceName)
+	require.NotNil(t, configured.Data)
+	var status configapi.IbDeviceStatus
+	require.NoError(t, json.Unmarshal(configured.Data.Raw, &status))
+	assert.Equal(t, uint16(0x8001), status.Pkey)
+
+	plain := devices["mlx5-3-port1"]
+	assert.Empty(t, plain.Conditions)
+	assert.Nil(t, plain.NetworkData)
+	require.NotNil(t, plain.Data)
+	var plainStatus configapi.IbDeviceStatus
+	require.NoError(t, json.Unmarshal(plain.Data.Raw, &plainStatus))
+	assert.Equal(t, configapi.IbDeviceStatusKind, plainStatus.Kind)
+	assert.Equal(t, "mlx5_3", plainStatus.IBDevName)
+	assert.Equal(t, 1, plainStatus.Port)
+}
+
+func TestReleaseDevice(t *testing.T) {
+	ctx := context.Background()
+	claim := testClaim(opaqueConfig(resourceapi.AllocationConfigSourceClaim, pkeyConfig))
+	tracker, applier, client := newTestTracker(t, claim)
+	_, err := tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	require.NoError(t, err)
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	require.Contains(t, deviceConditions(t, client), "mlx5-1-port1")
+
+	// Once the pod is gone the device is released, and no longer reported
+	// as configured.
+	require.NoError(t, tracker.ReleaseDevice(ctx, "mlx5-1-port1"))
+	assert.Contains(t, applier.released, "mlx5-1-port1")
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.NotContains(t, deviceConditions(t, client), "mlx5-1-port1")
+
+	// Preparing the claim again applies the config again.
+	applier.applied = make(map[string]*configapi.IbConfig)
+	_, err = tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Contains(t, applier.applied, "mlx5-1-port1")
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.Equal(t, metav1.ConditionTrue, deviceConditions(t, client)["mlx5-1-port1"].Status)
+}
+
+func TestAdoptRestored(t *testing.T) {
+	ctx := context.Background()
+	claim := testClaim(opaqueConfig(resourceapi.AllocationConfigSourceClaim, pkeyConfig, "ib"))
+	tracker, applier, client := newTestTracker(t, claim)
+	applier.restored["mlx5-1-port1"] = "uid-1"
+	applier.restored["mlx5-0-port1"] = "uid-released"
+
+	// The config of the claim that still holds its device is kept, and
+	// that of a claim released while the plugin was down is released.
+	require.NoError(t, tracker.adoptRestored(ctx))
+	assert.Empty(t, applier.restored)
+	assert.Equal(t, []string{"mlx5-0-port1"}, applier.released)
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.Equal(t, metav1.ConditionTrue, deviceConditions(t, client)["mlx5-1-port1"].Status)
+
+	// The config taken over is released with its claim.
+	require.NoError(t, tracker.factory.Resource().V1().ResourceClaims().Informer().GetStore().Delete(claim))
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.Contains(t, applier.released, "mlx5-1-port1")
+	assert.Empty(t, tracker.claims)
+}
+
+func TestDeviceOwner(t *testing.T) {
+	ctx := context.Background()
+	claim := testClaim()
+	claim.Status.ReservedFor = []resourceapi.ResourceClaimConsumerReference{
+		{Resource: "pods", Name: "worker-1", UID: "pod-2"},
+		{Resource: "pods", Name: "worker-0", UID: "pod-1"},
+	}
+	tracker, _, _ := newTestTracker(t, claim)
+	_, err := tracker.PrepareDevice(ctx, "mlx5-3-port1")
+	require.NoError(t, err)
+
+	owner, ok := tracker.DeviceOwner("mlx5-3-port1")
+	require.True(t, ok)
+	assert.Equal(t, metrics.Owner{Namespace: "default", Claim: "claim", Pods: []string{"worker-0", "worker-1"}}, owner)
+
+	// Devices of other nodes and unallocated devices have no owner.
+	_, ok = tracker.DeviceOwner("mlx5-2-port1")
+	assert.False(t, ok)
+	_, ok = tracker.DeviceOwner("mlx5-0-port1")
+	assert.False(t, ok)
+}
+
+func TestPrepareDeviceAddsShares(t *testing.T) {
+	ctx := context.Background()
+	claim := testClaim(opaqueConfig(resourceapi.AllocationConfigSourceClaim, pkeyConfig, "mpi"))
+	results := claim.Status.Allocation.Devices.Results
+	results[0].ShareID = ptr.To(types.UID("share-1"))
+	results[0].ConsumedCapacity = map[resourceapi.QualifiedName]resource.Quantity{"dra.net/ibVFs": resource.MustParse("1")}
+	results[3].ShareID = ptr.To(types.UID("share-2"))
+	tracker, applier, client := newTestTracker(t, claim)
+	applier.failures["mlx5-1-port1"] = errors.New("all 16 VFs of 0000:3b:00.0 are attached")
+
+	_, err := tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	assert.ErrorContains(t, err, "all 16 VFs of 0000:3b:00.0 are attached")
+	assert.Empty(t, applier.shares)
+
+	// Shares are not described, and an IbConfig cannot be applied to them.
+	delete(applier.failures, "mlx5-1-port1")
+	_, err = tracker.PrepareDevice(ctx, "mlx5-1-port1")
+	require.NoError(t, err)
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.Equal(t, map[string]int64{"uid-1/share-1": 1}, applier.shares)
+	assert.Empty(t, applier.applied)
+	assert.Empty(t, applier.rejected)
+	conditions := deviceConditions(t, client)
+	require.Len(t, conditions, 1)
+	assert.Equal(t, metav1.ConditionFalse, conditions["mlx5-3-port1"].Status)
+	assert.Equal(t, ReasonInvalidConfig, conditions["mlx5-3-port1"].Reason)
+
+	require.NoError(t, tracker.factory.Resource().V1().ResourceClaims().Informer().GetStore().Delete(claim))
+	require.NoError(t, tracker.syncClaim(ctx, "default/claim"))
+	assert.Empty(t, applier.shares)
+	assert.Empty(t, tracker.claims)
+}
@@ -0,0 +1,558 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ibconfig programs the IbConfig of a claim on an allocated IB device
+// before it is handed to a pod: it makes the requested P_Key usable on the
+// port, creates an IPoIB child interface bound to it, and sets the interface
+// MTU and the traffic class of the port. In VFIO mode it binds the VF to
+// vfio-pci instead.
+package ibconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+const (
+	// pkeyMask selects the partition number of a P_Key; the remaining high
+	// bit is the full membership bit.
+	pkeyMask       = 0x7fff
+	pkeyFullMember = 0x8000
+	// defaultPartition is the partition of the default P_Key 0xffff, which
+	// every port is a member of.
+	defaultPartition = 0x7fff
+
+	linkLayerInfiniBand = "InfiniBand"
+
+	// ipoibHeaderLen is the IPoIB encapsulation header, which the netdev MTU
+	// leaves room for in datagram mode.
+	ipoibHeaderLen = 4
+
+	// vfioDriver takes over VFs in VFIO mode; hostVFDriver gets them back.
+	vfioDriver   = "vfio-pci"
+	hostVFDriver = "mlx5_core"
+)
+
+// Device identifies the allocated IB port to configure.
+type Device struct {
+	// IBDevName is the IB device name, e.g. mlx5_1.
+	IBDevName string
+	// Port is the 1-based port number.
+	Port int
+	// PCIAddress is the PCI address of the IB device.
+	PCIAddress string
+	// ParentPF is the IB device name of the parent PF; set only for VFs.
+	ParentPF string
+	// NetDevice is the IPoIB netdev of the port, if any.
+	NetDevice string
+}
+
+// Result describes how a device was configured. It is checkpointed, so that
+// the configuration can be removed after a restart.
+type Result struct {
+	// NetDevice is the netdev to hand to the pod: the IPoIB child for the
+	// requested P_Key, or the device's own netdev.
+	NetDevice string `json:"netDevice,omitempty"`
+	// PkeyIndex is the index of the requested P_Key in the P_Key table of the
+	// port, or -1 if no P_Key was requested.
+	PkeyIndex int `json:"pkeyIndex"`
+	// MTU is the IB MTU programmed on NetDevice, or 0 if no MTU was
+	// requested.
+	MTU configapi.IbMTU `json:"mtu,omitempty"`
+	// ChildCreated is set if NetDevice was created by Apply and must be
+	// deleted by Remove.
+	ChildCreated bool `json:"childCreated,omitempty"`
+	// PrevMTU is the MTU of NetDevice before Apply changed it, which Remove
+	// restores, or 0 if Apply left it alone or created NetDevice.
+	PrevMTU int `json:"prevMTU,omitempty"`
+	// TrafficClass is set if Apply changed the traffic class of the port,
+	// and VFPkey if it mapped the P_Key into the virtual P_Key table of a
+	// VF. Remove undoes both.
+	TrafficClass *TrafficClassChange `json:"trafficClass,omitempty"`
+	VFPkey       *VFPkeyMapping      `json:"vfPkey,omitempty"`
+	// VFIO is set in VFIO mode, where NetDevice is empty. Remove binds the
+	// VF back to mlx5_core.
+	VFIO *VFIOBinding `json:"vfio,omitempty"`
+}
+
+// TrafficClassChange records the traffic class of a port that Apply
+// replaced.
+type TrafficClassChange struct {
+	IBDevName string `json:"ibDevName"`
+	Port      int    `json:"port"`
+	// Prev is the traffic class before Apply, -1 if none was set.
+	Prev int `json:"prev"`
+}
+
+// VFPkeyMapping records an entry of the virtual P_Key table of a VF that
+// Apply mapped to an entry of the P_Key table of its PF.
+type VFPkeyMapping struct {
+	ParentPF   string `json:"parentPF"`
+	PCIAddress string `json:"pciAddress"`
+	Port       int    `json:"port"`
+	Index      int    `json:"index"`
+}
+
+// VFIOBinding describes a VF bound to vfio-pci.
+type VFIOBinding struct {
+	// PCIAddress is the PCI address of the VF.
+	PCIAddress string `json:"pciAddress"`
+	// IOMMUGroup is the IOMMU group of the VF; the pod gets
+	// /dev/vfio/<IOMMUGroup>.
+	IOMMUGroup int `json:"iommuGroup"`
+}
+
+// VFIOResourceEnv lists the PCI addresses of the VFs in VFIO mode, the way
+// KubeVirt expects them for the host devices of a VM with resource name
+// "ib.sigs.k8s.io/vf" in its permittedHostDevices.
+const VFIOResourceEnv = "PCI_RESOURCE_IB_SIGS_K8S_IO_VF"
+
+// DeviceNodes returns the device nodes a container needs to open the VF: the
+// VFIO container and the IOMMU group of the VF.
+func (b VFIOBinding) DeviceNodes() []string {
+	return []string{"/dev/vfio/vfio", fmt.Sprintf("/dev/vfio/%d", b.IOMMUGroup)}
+}
+
+// linker is the subset of *netlink.Handle used to manage IPoIB interfaces.
+type linker interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetUp(link netlink.Link) error
+}
+
+// Configurator applies IbConfig to devices of the sysfs tree it was created
+// for.
+type Configurator struct {
+	fs sysfs.FS
+	nl linker
+}
+
+// New returns a Configurator that programs devices below fs and manages
+// netdevs in the current network namespace.
+func New(fs sysfs.FS) *Configurator {
+	return &Configurator{fs: fs, nl: &netlink.Handle{}}
+}
+
+// LookupDevice resolves the Device for a port of an IB device.
+func (c *Configurator) LookupDevice(ibDevName string, port int) (Device, error) {
+	info, err := c.fs.GetIBDeviceInfo(ibDevName)
+	if err != nil {
+		return Device{}, fmt.Errorf("get sysfs info for %s: %w", ibDevName, err)
+	}
+	dev := Device{
+		IBDevName:  ibDevName,
+		Port:       port,
+		PCIAddress: info.PCIAddress,
+	}
+	if info.IsVF && info.ParentPF != "" {
+		if pf, err := c.fs.FindIBDeviceByPCI(info.ParentPF); err == nil {
+			dev.ParentPF = pf
+		}
+	}
+	// IPoIB children share the PCI device of their parent; the parent has the
+	// shortest name.
+	for _, netdev := range info.NetDevices {
+		if dev.NetDevice == "" || len(netdev) < len(dev.NetDevice) {
+			dev.NetDevice = netdev
+		}
+	}
+	return dev, nil
+}
+
+// Apply programs config on dev. Any interface it created is removed again if
+// a later step fails, so a failed Apply leaves the host as it was.
+func (c *Configurator) Apply(ctx context.Context, dev Device, config *configapi.IbConfig) (*Result, error) {
+	logger := klog.FromContext(ctx)
+	res := &Result{NetDevice: dev.NetDevice, PkeyIndex: -1}
+	if config == nil {
+		return res, nil
+	}
+
+	if ptr.Deref(config.Mode, configapi.DeviceModeNetdev) == configapi.DeviceModeVFIO {
+		binding, err := c.bindVFIO(ctx, dev)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{PkeyIndex: -1, VFIO: binding}, nil
+	}
+
+	needsChild := config.Pkey != nil && *config.Pkey&pkeyMask != defaultPartition
+	if needsChild || config.MTU != nil {
+		linkLayer, err := c.fs.GetPortLinkLayer(dev.IBDevName, dev.Port)
+		if err != nil {
+			return nil, fmt.Errorf("get link layer of %s port %d: %w", dev.IBDevName, dev.Port, err)
+		}
+		if linkLayer != linkLayerInfiniBand {
+			return nil, fmt.Errorf("pkey and mtu require an InfiniBand port, %s port %d is %s", dev.IBDevName, dev.Port, linkLayer)
+		}
+		if dev.NetDevice == "" {
+			return nil, fmt.Errorf("%s port %d has no IPoIB netdev", dev.IBDevName, dev.Port)
+		}
+	}
+
+	if config.Pkey != nil {
+		idx, mapped, err := c.programPkey(ctx, dev, *config.Pkey)
+		res.VFPkey = mapped
+		if err != nil {
+			c.rollback(ctx, res)
+			return nil, err
+		}
+		res.PkeyIndex = idx
+	}
+
+	if needsChild {
+		name, created, err := c.ensureChild(dev.NetDevice, *config.Pkey)
+		if err != nil {
+			c.rollback(ctx, res)
+			return nil, err
+		}
+		res.NetDevice = name
+		res.ChildCreated = created
+	}
+
+	if needsChild || config.MTU != nil {
+		prevMTU, err := c.configureLink(res.NetDevice, config)
+		if !res.ChildCreated {
+			res.PrevMTU = prevMTU
+		}
+		if err != nil {
+			c.rollback(ctx, res)
+			return nil, err
+		}
+		res.MTU = ptr.Deref(config.MTU, 0)
+	}
+
+	if config.TrafficClass != nil {
+		change, err := c.setTrafficClass(ctx, dev, *config.TrafficClass)
+		if err != nil {
+			c.rollback(ctx, res)
+			return nil, err
+		}
+		res.TrafficClass = change
+	}
+
+	logger.V(2).Info("Applied IB config", "ibDev", dev.IBDevName, "port", dev.Port, "netdev", res.NetDevice, "pkeyIndex", res.PkeyIndex)
+	return res, nil
+}
+
+// Remove undoes the host changes of a successful Apply that would outlive the
+// claim: it deletes the IPoIB child it created, or restores the MTU of the
+// netdev it reused, and restores the traffic class and the virtual P_Key
+// table it changed. Removing again is a no-op.
+func (c *Configurator) Remove(ctx context.Context, res *Result) error {
+	if res == nil {
+		return nil
+	}
+	if res.VFIO != nil {
+		return c.unbindVFIO(ctx, res.VFIO)
+	}
+	logger := klog.FromContext(ctx)
+
+	var errs []error
+	switch {
+	case res.ChildCreated:
+		if err := c.deleteChild(res.NetDevice); err != nil {
+			errs = append(errs, err)
+		} else {
+			logger.V(2).Info("Deleted IPoIB child", "netdev", res.NetDevice)
+		}
+	case res.PrevMTU != 0:
+		if err := c.restoreMTU(res.NetDevice, res.PrevMTU); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if tc := res.TrafficClass; tc != nil {
+		if err := c.fs.SetTrafficClass(tc.IBDevName, tc.Port, tc.Prev); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("restore traffic class of %s port %d: %w", tc.IBDevName, tc.Port, err))
+		}
+	}
+	if m := res.VFPkey; m != nil {
+		if err := c.fs.SetVFPkeyIndex(m.ParentPF, m.PCIAddress, m.Port, m.Index, -1); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("unmap entry %d of the virtual P_Key table of VF %s: %w", m.Index, m.PCIAddress, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteChild deletes the IPoIB child netdev, unless it is gone.
+func (c *Configurator) deleteChild(netdev string) error {
+	link, err := c.nl.LinkByName(netdev)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("get link %s: %w", netdev, err)
+	}
+	if err := c.nl.LinkDel(link); err != nil {
+		return fmt.Errorf("delete IPoIB child %s: %w", netdev, err)
+	}
+	return nil
+}
+
+// restoreMTU sets the MTU of netdev back to mtu, unless netdev is not on the
+// host.
+func (c *Configurator) restoreMTU(netdev string, mtu int) error {
+	link, err := c.nl.LinkByName(netdev)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("get link %s: %w", netdev, err)
+	}
+	if link.Attrs().MTU == mtu {
+		return nil
+	}
+	if err := c.nl.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("restore MTU of %s to %d: %w", netdev, mtu, err)
+	}
+	return nil
+}
+
+// setTrafficClass sets the traffic class of the port of dev and returns what
+// it replaced. The port has none unless the driver is from MLNX_OFED; the
+// traffic class is then left to the application, and nil is returned.
+func (c *Configurator) setTrafficClass(ctx context.Context, dev Device, tclass uint8) (*TrafficClassChange, error) {
+	prev, err := c.fs.GetTrafficClass(dev.IBDevName, dev.Port)
+	if os.IsNotExist(err) {
+		klog.FromContext(ctx).Info("Ignoring traffic class, the driver has no per-port traffic class", "ibDev", dev.IBDevName, "port", dev.Port, "trafficClass", tclass)
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("get traffic class of %s port %d: %w", dev.IBDevName, dev.Port, err)
+	}
+	if err := c.fs.SetTrafficClass(dev.IBDevName, dev.Port, int(tclass)); err != nil {
+		return nil, fmt.Errorf("set traffic class %d on %s port %d: %w", tclass, dev.IBDevName, dev.Port, err)
+	}
+	return &TrafficClassChange{IBDevName: dev.IBDevName, Port: dev.Port, Prev: prev}, nil
+}
+
+func (c *Configurator) rollback(ctx context.Context, res *Result) {
+	if err := c.Remove(ctx, res); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to roll back IB config", "netdev", res.NetDevice)
+	}
+}
+
+// bindVFIO binds the VF dev to vfio-pci. The driver override keeps
+// mlx5_core from taking it back until unbindVFIO, e.g. when the PCI bus is
+// rescanned.
+func (c *Configurator) bindVFIO(ctx context.Context, dev Device) (*VFIOBinding, error) {
+	if dev.ParentPF == "" {
+		return nil, fmt.Errorf("VFIO mode requires a VF, %s is not one", dev.IBDevName)
+	}
+	if !c.fs.HasPCIDriver(vfioDriver) {
+		return nil, fmt.Errorf("the %s driver is not loaded", vfioDriver)
+	}
+	group, err := c.fs.GetIOMMUGroup(dev.PCIAddress)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("VF %s is in no IOMMU group, VFIO requires the IOMMU to be enabled", dev.PCIAddress)
+	} else if err != nil {
+		return nil, fmt.Errorf("get IOMMU group of %s: %w", dev.PCIAddress, err)
+	}
+	binding := &VFIOBinding{PCIAddress: dev.PCIAddress, IOMMUGroup: group}
+
+	driver, err := c.fs.GetPCIDriver(dev.PCIAddress)
+	if err != nil {
+		return nil, err
+	}
+	if driver == vfioDriver {
+		return binding, nil
+	}
+	if err := c.fs.SetPCIDriverOverride(dev.PCIAddress, vfioDriver); err != nil {
+		return nil, err
+	}
+	err = c.fs.UnbindPCIDriver(dev.PCIAddress)
+	if err == nil {
+		err = c.fs.BindPCIDriver(dev.PCIAddress, vfioDriver)
+	}
+	if err != nil {
+		c.rollback(ctx, &Result{VFIO: binding})
+		return nil, err
+	}
+	klog.FromContext(ctx).V(2).Info("Bound VF to vfio-pci", "ibDev", dev.IBDevName, "vf", dev.PCIAddress, "iommuGroup", group)
+	return binding, nil
+}
+
+// unbindVFIO binds a VF bound to vfio-pci by bindVFIO back to mlx5_core.
+func (c *Configurator) unbindVFIO(ctx context.Context, binding *VFIOBinding) error {
+	if err := c.fs.SetPCIDriverOverride(binding.PCIAddress, ""); err != nil {
+		return err
+	}
+	driver, err := c.fs.GetPCIDriver(binding.PCIAddress)
+	if err != nil {
+		return err
+	}
+	if driver == hostVFDriver {
+		return nil
+	}
+	if err := c.fs.UnbindPCIDriver(binding.PCIAddress); err != nil {
+		return err
+	}
+	if err := c.fs.BindPCIDriver(binding.PCIAddress, hostVFDriver); err != nil {
+		return err
+	}
+	klog.FromContext(ctx).V(2).Info("Bound VF back to its driver", "vf", binding.PCIAddress, "driver", hostVFDriver)
+	return nil
+}
+
+// programPkey makes pkey usable on the port of dev and returns its index in
+// the P_Key table of the port. The P_Key table is owned by the subnet
+// manager; for VFs whose driver virtualizes it through the PF, the P_Key is
+// additionally mapped into the VF's table, and the mapping returned, also on
+// failure.
+func (c *Configurator) programPkey(ctx context.Context, dev Device, pkey uint16) (int, *VFPkeyMapping, error) {
+	var mapped *VFPkeyMapping
+	if dev.ParentPF != "" {
+		var err error
+		if mapped, err = c.mapVFPkey(ctx, dev, pkey); err != nil && !os.IsNotExist(err) {
+			return -1, nil, err
+		}
+	}
+
+	table, err := c.fs.GetPkeyTable(dev.IBDevName, dev.Port)
+	if err != nil {
+		return -1, mapped, fmt.Errorf("read P_Key table of %s port %d: %w", dev.IBDevName, dev.Port, err)
+	}
+	idx := findPkey(table, pkey)
+	if idx < 0 {
+		return -1, mapped, fmt.Errorf("pkey 0x%04x is not in the P_Key table of %s port %d, it must be configured on the subnet manager", pkey, dev.IBDevName, dev.Port)
+	}
+	return idx, mapped, nil
+}
+
+// mapVFPkey maps pkey from the P_Key table of the parent PF into the virtual
+// P_Key table of the VF dev, and returns the entry it mapped, nil if pkey
+// was mapped already. It returns an error satisfying os.IsNotExist if the
+// driver does not virtualize the P_Key table.
+func (c *Configurator) mapVFPkey(ctx context.Context, dev Device, pkey uint16) (*VFPkeyMapping, error) {
+	indexes, err := c.fs.GetVFPkeyIndexes(dev.ParentPF, dev.PCIAddress, dev.Port)
+	if err != nil {
+		return nil, err
+	}
+	pfTable, err := c.fs.GetPkeyTable(dev.ParentPF, dev.Port)
+	if err != nil {
+		return nil, fmt.Errorf("read P_Key table of %s port %d: %w", dev.ParentPF, dev.Port, err)
+	}
+	pfIdx := findPkey(pfTable, pkey)
+	if pfIdx < 0 {
+		return nil, fmt.Errorf("pkey 0x%04x is not in the P_Key table of PF %s port %d, it must be configured on the subnet manager", pkey, dev.ParentPF, dev.Port)
+	}
+	if slices.Contains(indexes, pfIdx) {
+		return nil, nil
+	}
+	vIdx := slices.Index(indexes, -1)
+	if vIdx < 0 {
+		return nil, fmt.Errorf("no free entry in the virtual P_Key table of VF %s for pkey 0x%04x", dev.PCIAddress, pkey)
+	}
+	if err := c.fs.SetVFPkeyIndex(dev.ParentPF, dev.PCIAddress, dev.Port, vIdx, pfIdx); err != nil {
+		return nil, fmt.Errorf("map pkey 0x%04x into VF %s: %w", pkey, dev.PCIAddress, err)
+	}
+	klog.FromContext(ctx).V(2).Info("Mapped P_Key into VF", "vf", dev.PCIAddress, "pkey", fmt.Sprintf("0x%04x", pkey), "vfIndex", vIdx, "pfIndex", pfIdx)
+	return &VFPkeyMapping{ParentPF: dev.ParentPF, PCIAddress: dev.PCIAddress, Port: dev.Port, Index: vIdx}, nil
+}
+
+// ensureChild returns the IPoIB child interface of parent for pkey, creating
+// it if needed. The boolean reports whether the interface was created.
+func (c *Configurator) ensureChild(parent string, pkey uint16) (string, bool, error) {
+	// The kernel always sets the full membership bit of IPoIB children; the
+	// membership actually granted is the one in the P_Key table.
+	pkey |= pkeyFullMember
+	name := childName(parent, pkey)
+
+	if link, err := c.nl.LinkByName(name); err == nil {
+		ipoib, ok := link.(*netlink.IPoIB)
+		if !ok || ipoib.Pkey|pkeyFullMember != pkey {
+			return "", false, fmt.Errorf("interface %s exists but is not an IPoIB child for pkey 0x%04x", name, pkey)
+		}
+		return name, false, nil
+	}
+
+	parentLink, err := c.nl.LinkByName(parent)
+	if err != nil {
+		return "", false, fmt.Errorf("get link %s: %w", parent, err)
+	}
+	child := &netlink.IPoIB{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: parentLink.Attrs().Index,
+		},
+		Pkey: pkey,
+		Mode: netlink.IPOIB_MODE_DATAGRAM,
+	}
+	if err := c.nl.LinkAdd(child); err != nil {
+		return "", false, fmt.Errorf("create IPoIB child %s for pkey 0x%04x: %w", name, pkey, err)
+	}
+	return name, true, nil
+}
+
+// configureLink sets the MTU of netdev, if requested, and brings it up. It
+// returns the MTU it replaced, also on failure, or 0 if it left it alone.
+func (c *Configurator) configureLink(netdev string, config *configapi.IbConfig) (int, error) {
+	link, err := c.nl.LinkByName(netdev)
+	if err != nil {
+		return 0, fmt.Errorf("get link %s: %w", netdev, err)
+	}
+	prevMTU := 0
+	if mtu := int(ptr.Deref(config.MTU, 0)) - ipoibHeaderLen; config.MTU != nil && link.Attrs().MTU != mtu {
+		prev := link.Attrs().MTU
+		if err := c.nl.LinkSetMTU(link, mtu); err != nil {
+			return 0, fmt.Errorf("set MTU of %s to %d: %w", netdev, mtu, err)
+		}
+		prevMTU = prev
+	}
+	if err := c.nl.LinkSetUp(link); err != nil {
+		return prevMTU, fmt.Errorf("set %s up: %w", netdev, err)
+	}
+	return prevMTU, nil
+}
+
+// findPkey returns the index of pkey in table, or -1. A limited membership
+// P_Key is also satisfied by a full membership entry for the same partition.
+func findPkey(table []uint16, pkey uint16) int {
+	match := -1
+	for i, entry := range table {
+		if entry == pkey {
+			return i
+		}
+		if match < 0 && pkey&pkeyFullMember == 0 && entry&pkeyMask == pkey {
+			match = i
+		}
+	}
+	return match
+}
+
+// childName returns the name of the IPoIB child of parent for pkey, following
+// the kernel's <parent>.<pkey> convention and truncating parent to fit.
+func childName(parent string, pkey uint16) string {
+	suffix := fmt.Sprintf(".%04x", pkey)
+	if maxLen := unix.IFNAMSIZ - 1 - len(suffix); len(parent) > maxLen {
+		parent = parent[:maxLen]
+	}
+	return parent + suffix
+}
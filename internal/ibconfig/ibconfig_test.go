@@ -0,0 +1,361 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibconfig
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+// fakeLinker keeps links in memory instead of talking to the kernel.
+type fakeLinker struct {
+	links  map[string]netlink.Link
+	up     map[string]bool
+	mtuErr error
+}
+
+func newFakeLinker(names ...string) *fakeLinker {
+	l := &fakeLinker{links: make(map[string]netlink.Link), up: make(map[string]bool)}
+	for i, name := range names {
+		l.links[name] = &netlink.IPoIB{LinkAttrs: netlink.LinkAttrs{Name: name, Index: i + 1, MTU: 2044}, Pkey: 0xffff}
+	}
+	return l
+}
+
+func (l *fakeLinker) LinkByName(name string) (netlink.Link, error) {
+	link, ok := l.links[name]
+	if !ok {
+		return nil, netlink.LinkNotFoundError{}
+	}
+	return link, nil
+}
+
+func (l *fakeLinker) LinkAdd(link netlink.Link) error {
+	if _, ok := l.links[link.Attrs().Name]; ok {
+		return os.ErrExist
+	}
+	l.links[link.Attrs().Name] = link
+	return nil
+}
+
+func (l *fakeLinker) LinkDel(link netlink.Link) error {
+	delete(l.links, link.Attrs().Name)
+	delete(l.up, link.Attrs().Name)
+	return nil
+}
+
+func (l *fakeLinker) LinkSetMTU(link netlink.Link, mtu int) error {
+	if l.mtuErr != nil {
+		return l.mtuErr
+	}
+	link.Attrs().MTU = mtu
+	return nil
+}
+
+func (l *fakeLinker) LinkSetUp(link netlink.Link) error {
+	l.up[link.Attrs().Name] = true
+	return nil
+}
+
+// newFixture builds a ConnectX-6 PF with two VFs whose port 1 P_Key tables
+// contain the default P_Key and 0x8001.
+func newFixture(t *testing.T) (*Configurator, *fakeLinker, string) {
+	t.Helper()
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	for _, dev := range []string{"mlx5_0", "mlx5_1", "mlx5_2"} {
+		writeFile(t, filepath.Join(tree.Root, "class/infiniband", dev, "ports/1/pkeys/1"), "0x8001")
+	}
+
+	nl := newFakeLinker("ibp59s0", "ibp59s0v0", "ibp59s0v1")
+	return &Configurator{fs: sysfs.New(tree.Root), nl: nl}, nl, tree.Root
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(content+"\n"), 0o644))
+}
+
+func TestLookupDevice(t *testing.T) {
+	c, _, _ := newFixture(t)
+
+	dev, err := c.LookupDevice("mlx5_1", 1)
+	require.NoError(t, err)
+	assert.Equal(t, Device{
+		IBDevName:  "mlx5_1",
+		Port:       1,
+		PCIAddress: "0000:3b:00.1",
+		ParentPF:   "mlx5_0",
+		NetDevice:  "ibp59s0v0",
+	}, dev)
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	c, nl, root := newFixture(t)
+	dev, err := c.LookupDevice("mlx5_1", 1)
+	require.NoError(t, err)
+
+	res, err := c.Apply(ctx, dev, &configapi.IbConfig{
+		Pkey:         ptr.To[uint16](0x8001),
+		MTU:          ptr.To(configapi.MTU2048),
+		TrafficClass: ptr.To[uint8](106),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &Result{
+		NetDevice:    "ibp59s0v0.8001",
+		PkeyIndex:    1,
+		MTU:          configapi.MTU2048,
+		ChildCreated: true,
+		TrafficClass: &TrafficClassChange{IBDevName: "mlx5_1", Port: 1, Prev: -1},
+	}, res)
+
+	child, ok := nl.links["ibp59s0v0.8001"].(*netlink.IPoIB)
+	require.True(t, ok)
+	assert.Equal(t, uint16(0x8001), child.Pkey)
+	assert.Equal(t, 2, child.ParentIndex)
+	assert.Equal(t, netlink.IPoIBMode(netlink.IPOIB_MODE_DATAGRAM), child.Mode)
+	assert.Equal(t, 2044, child.MTU)
+	assert.True(t, nl.up["ibp59s0v0.8001"])
+	tc, err := os.ReadFile(filepath.Join(root, "class/infiniband/mlx5_1/tc/1/traffic_class"))
+	require.NoError(t, err)
+	assert.Equal(t, "tclass=106", string(tc))
+
+	// Applying again reuses the child; only the first result owns it.
+	again, err := c.Apply(ctx, dev, &configapi.IbConfig{Pkey: ptr.To[uint16](0x8001)})
+	require.NoError(t, err)
+	assert.Equal(t, "ibp59s0v0.8001", again.NetDevice)
+	assert.False(t, again.ChildCreated)
+
+	require.NoError(t, c.Remove(ctx, again))
+	assert.Contains(t, nl.links, "ibp59s0v0.8001")
+	require.NoError(t, c.Remove(ctx, res))
+	assert.NotContains(t, nl.links, "ibp59s0v0.8001")
+	tc, err = os.ReadFile(filepath.Join(root, "class/infiniband/mlx5_1/tc/1/traffic_class"))
+	require.NoError(t, err)
+	assert.Equal(t, "tclass=-1", string(tc))
+	require.NoError(t, c.Remove(ctx, res), "removing twice is a no-op")
+}
+
+func TestApplyRestoresParentMTU(t *testing.T) {
+	ctx := context.Background()
+	c, nl, _ := newFixture(t)
+	dev, err := c.LookupDevice("mlx5_1", 1)
+	require.NoError(t, err)
+
+	// Without a P_Key the MTU is set on the netdev of the port itself, and
+	// restored once the config is removed.
+	res, err := c.Apply(ctx, dev, &configapi.IbConfig{MTU: ptr.To(configapi.MTU4096)})
+	require.NoError(t, err)
+	assert.Equal(t, &Result{NetDevice: "ibp59s0v0", PkeyIndex: -1, MTU: configapi.MTU4096, PrevMTU: 2044}, res)
+	assert.Equal(t, 4092, nl.links["ibp59s0v0"].Attrs().MTU)
+
+	require.NoError(t, c.Remove(ctx, res))
+	assert.Equal(t, 2044, nl.links["ibp59s0v0"].Attrs().MTU)
+	assert.Contains(t, nl.links, "ibp59s0v0")
+}
+
+func TestApplyWithoutTrafficClassSupport(t *testing.T) {
+	c, _, root := newFixture(t)
+	// Upstream drivers have no per-port traffic class, only MLNX_OFED does.
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "class/infiniband/mlx5_1/tc")))
+	dev, err := c.LookupDevice("mlx5_1", 1)
+	require.NoError(t, err)
+
+	res, err := c.Apply(context.Background(), dev, &configapi.IbConfig{Pkey: ptr.To[uint16](0x8001), TrafficClass: ptr.To[uint8](3)})
+	require.NoError(t, err)
+	assert.Equal(t, "ibp59s0v0.8001", res.NetDevice)
+	assert.Nil(t, res.TrafficClass)
+}
+
+func TestApplyDefaultPkey(t *testing.T) {
+	c, nl, _ := newFixture(t)
+	dev, err := c.LookupDevice("mlx5_0", 1)
+	require.NoError(t, err)
+
+	res, err := c.Apply(context.Background(), dev, &configapi.IbConfig{Pkey: ptr.To[uint16](0x7fff)})
+	require.NoError(t, err)
+	assert.Equal(t, &Result{NetDevice: "ibp59s0", PkeyIndex: 0}, res)
+	assert.Len(t, nl.links, 3)
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := map[string]struct {
+		config  *configapi.IbConfig
+		mtuErr  error
+		setup   func(t *testing.T, root string)
+		wantErr string
+	}{
+		"pkey not configured by the SM": {
+			config:  &configapi.IbConfig{Pkey: ptr.To[uint16](0x8002)},
+			wantErr: "pkey 0x8002 is not in the P_Key table of mlx5_1 port 1",
+		},
+		"full membership requested for limited member": {
+			config: &configapi.IbConfig{Pkey: ptr.To[uint16](0x8003)},
+			setup: func(t *testing.T, root string) {
+				writeFile(t, filepath.Join(root, "class/infiniband/mlx5_1/ports/1/pkeys/2"), "0x0003")
+			},
+			wantErr: "pkey 0x8003 is not in the P_Key table",
+		},
+		"MTU rejected": {
+			config:  &configapi.IbConfig{Pkey: ptr.To[uint16](0x8001), MTU: ptr.To(configapi.MTU4096)},
+			mtuErr:  errors.New("invalid argument"),
+			wantErr: "set MTU of ibp59s0v0.8001 to 4092: invalid argument",
+		},
+		"Ethernet port": {
+			config: &configapi.IbConfig{MTU: ptr.To(configapi.MTU1024)},
+			setup: func(t *testing.T, root string) {
+				writeFile(t, filepath.Join(root, "class/infiniband/mlx5_1/ports/1/link_layer"), "Ethernet")
+			},
+			wantErr: "pkey and mtu require an InfiniBand port, mlx5_1 port 1 is Ethernet",
+		},
+		"vfio-pci not loaded": {
+			config:  &configapi.IbConfig{Mode: ptr.To(configapi.DeviceModeVFIO)},
+			wantErr: "the vfio-pci driver is not loaded",
+		},
+		"IOMMU disabled": {
+			config: &configapi.IbConfig{Mode: ptr.To(configapi.DeviceModeVFIO)},
+			setup: func(t *testing.T, root string) {
+				writeFile(t, filepath.Join(root, "bus/pci/drivers/vfio-pci/bind"), "")
+				require.NoError(t, os.Remove(filepath.Join(root, "bus/pci/devices/0000:3b:00.1/iommu_group")))
+			},
+			wantErr: "VF 0000:3b:00.1 is in no IOMMU group",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, nl, root := newFixture(t)
+			nl.mtuErr = tt.mtuErr
+			if tt.setup != nil {
+				tt.setup(t, root)
+			}
+			dev, err := c.LookupDevice("mlx5_1", 1)
+			require.NoError(t, err)
+
+			_, err = c.Apply(context.Background(), dev, tt.config)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+			assert.Len(t, nl.links, 3, "a failed Apply must not leave interfaces behind")
+		})
+	}
+}
+
+func TestApplyVFIO(t *testing.T) {
+	ctx := context.Background()
+	c, _, root := newFixture(t)
+	writeFile(t, filepath.Join(root, "bus/pci/drivers/vfio-pci/bind"), "")
+	writeFile(t, filepath.Join(root, "bus/pci/drivers/vfio-pci/unbind"), "")
+	vfio := &configapi.IbConfig{Mode: ptr.To(configapi.DeviceModeVFIO)}
+	readFile := func(path string) string {
+		data, err := os.ReadFile(filepath.Join(root, path))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	dev, err := c.LookupDevice("mlx5_1", 1)
+	require.NoError(t, err)
+	res, err := c.Apply(ctx, dev, vfio)
+	require.NoError(t, err)
+	assert.Equal(t, &Result{PkeyIndex: -1, VFIO: &VFIOBinding{PCIAddress: "0000:3b:00.1", IOMMUGroup: 1}}, res)
+	assert.Equal(t, "vfio-pci\n", readFile("bus/pci/devices/0000:3b:00.1/driver_override"))
+	assert.Equal(t, "0000:3b:00.1", readFile("bus/pci/drivers/mlx5_core/unbind"))
+	assert.Equal(t, "0000:3b:00.1", readFile("bus/pci/drivers/vfio-pci/bind"))
+
+	// The fake tree does not follow the binds.
+	driverLink := filepath.Join(root, "bus/pci/devices/0000:3b:00.1/driver")
+	require.NoError(t, os.Remove(driverLink))
+	require.NoError(t, os.Symlink(filepath.Join(root, "bus/pci/drivers/vfio-pci"), driverLink))
+	require.NoError(t, c.Remove(ctx, res))
+	assert.Equal(t, "\n", readFile("bus/pci/devices/0000:3b:00.1/driver_override"))
+	assert.Equal(t, "0000:3b:00.1", readFile("bus/pci/drivers/vfio-pci/unbind"))
+	assert.Equal(t, "0000:3b:00.1", readFile("bus/pci/drivers/mlx5_core/bind"))
+
+	pf, err := c.LookupDevice("mlx5_0", 1)
+	require.NoError(t, err)
+	_, err = c.Apply(ctx, pf, vfio)
+	assert.ErrorContains(t, err, "VFIO mode requires a VF, mlx5_0 is not one")
+}
+
+func TestApplyMapsVirtualPkeyTable(t *testing.T) {
+	c, _, root := newFixture(t)
+	idxDir := filepath.Join(root, "class/infiniband/mlx5_0/iov/0000:3b:00.2/ports/1/pkey_idx")
+	writeFile(t, filepath.Join(idxDir, "0"), "0")
+	writeFile(t, filepath.Join(idxDir, "1"), "none")
+	writeFile(t, filepath.Join(idxDir, "2"), "none")
+	dev, err := c.LookupDevice("mlx5_2", 1)
+	require.NoError(t, err)
+
+	res, err := c.Apply(context.Background(), dev, &configapi.IbConfig{Pkey: ptr.To[uint16](0x8001)})
+	require.NoError(t, err)
+	assert.Equal(t, &VFPkeyMapping{ParentPF: "mlx5_0", PCIAddress: "0000:3b:00.2", Port: 1, Index: 1}, res.VFPkey)
+	indexes, err := c.fs.GetVFPkeyIndexes("mlx5_0", "0000:3b:00.2", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, -1}, indexes)
+
+	// An existing mapping is reused.
+	again, err := c.Apply(context.Background(), dev, &configapi.IbConfig{Pkey: ptr.To[uint16](0x8001)})
+	require.NoError(t, err)
+	assert.Nil(t, again.VFPkey)
+	indexes, err = c.fs.GetVFPkeyIndexes("mlx5_0", "0000:3b:00.2", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, -1}, indexes)
+
+	// Removing the config unmaps the entry it mapped.
+	require.NoError(t, c.Remove(context.Background(), res))
+	indexes, err = c.fs.GetVFPkeyIndexes("mlx5_0", "0000:3b:00.2", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, -1, -1}, indexes)
+}
+
+func TestFindPkey(t *testing.T) {
+	table := []uint16{0xffff, 0x0001, 0x8002, 0}
+	tests := []struct {
+		pkey uint16
+		want int
+	}{
+		{pkey: 0xffff, want: 0},
+		{pkey: 0x7fff, want: 0},
+		{pkey: 0x0001, want: 1},
+		{pkey: 0x8001, want: -1},
+		{pkey: 0x0002, want: 2},
+		{pkey: 0x8002, want: 2},
+		{pkey: 0x8003, want: -1},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, findPkey(table, tt.pkey), "pkey 0x%04x", tt.pkey)
+	}
+}
+
+func TestChildName(t *testing.T) {
+	assert.Equal(t, "ibp59s0v0.8001", childName("ibp59s0v0", 0x8001))
+	assert.Equal(t, "ibp134s0f1.8001", childName("ibp134s0f1v12", 0x8001))
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibconfig"
+)
+
+// Preparer applies the claim of a device before it is handed to a pod.
+type Preparer interface {
+	// PrepareDevice applies the config of the claims that allocate device
+	// and are reserved for a pod, and reports whether there are any.
+	PrepareDevice(ctx context.Context, device string) (bool, error)
+	// ReleaseDevice undoes the config PrepareDevice applied to device once
+	// the pod it was handed to is gone, before its claim is released.
+	ReleaseDevice(ctx context.Context, device string) error
+}
+
+// SetPreparer makes GetNetInterfaceName apply the claim of a device with p
+// before handing the device out. It must be called before the DB is handed
+// to DRANET.
+func (db *DB) SetPreparer(p Preparer) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.preparer = p
+}
+
+// prepare applies the claim of a device with the Preparer. The Preparer may
+// not have seen the claim yet when DRANET prepares it, so it is retried until
+// the claim shows up or the prepare timeout expires.
+func (db *DB) prepare(ctx context.Context, deviceName string) error {
+	db.mu.RLock()
+	preparer, timeout := db.preparer, db.prepareTimeout
+	db.mu.RUnlock()
+	if preparer == nil {
+		return nil
+	}
+
+	err := wait.PollUntilContextTimeout(ctx, prepareInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		return preparer.PrepareDevice(ctx, deviceName)
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("IB device %s: no claim reserved for a pod allocates it after %v", deviceName, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("IB device %s: apply claim config: %w", deviceName, err)
+	}
+	return nil
+}
+
+// prepareInterval is how often prepare asks the Preparer for the claim of a
+// device.
+const prepareInterval = 100 * time.Millisecond
+
+// deviceConfig is the outcome of applying a claim config to a device.
+type deviceConfig struct {
+	result *ibconfig.Result
+	err    error
+	// claimUID is the claim whose config was applied. restored is set if
+	// the config was restored from the checkpoint and has not been applied
+	// again since.
+	claimUID types.UID
+	restored bool
+}
+
+// ApplyDeviceConfig programs the IbConfig of a claim on an allocated device.
+// Until ReleaseDeviceConfig is called, GetNetInterfaceName returns the netdev
+// selected by the configuration, e.g. the IPoIB child for the requested P_Key.
+// A config of the same claim restored from the checkpoint is kept as it is.
+func (db *DB) ApplyDeviceConfig(ctx context.Context, deviceName string, claimUID types.UID, config *configapi.IbConfig) error {
+	db.mu.Lock()
+	prev, ok := db.deviceConfigs[deviceName]
+	if ok && prev.restored && prev.claimUID == claimUID {
+		prev.restored = false
+		db.deviceConfigs[deviceName] = prev
+		db.mu.Unlock()
+		return nil
+	}
+	db.mu.Unlock()
+
+	db.mu.RLock()
+	entry, ok := db.deviceStore[deviceName]
+	fs := db.sysfs
+	db.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("IB device %s not found in inventory", deviceName)
+	}
+
+	// A device is only allocated to one claim at a time; anything left over
+	// from a previous claim is stale.
+	if err := db.ReleaseDeviceConfig(ctx, deviceName); err != nil {
+		return err
+	}
+
+	configurator := ibconfig.New(fs)
+	dev, err := configurator.LookupDevice(entry.IBDevName, entry.PortNum)
+	if err != nil {
+		return err
+	}
+	res, err := configurator.Apply(ctx, dev, config)
+	if err != nil {
+		db.RejectDeviceConfig(deviceName, err)
+		return err
+	}
+
+	db.mu.Lock()
+	db.deviceConfigs[deviceName] = deviceConfig{result: res, claimUID: claimUID}
+	db.mu.Unlock()
+	db.saveCheckpoint()
+	klog.FromContext(ctx).Info("IB inventory: applied claim config", "device", deviceName, "netdev", res.NetDevice)
+	return nil
+}
+
+// RejectDeviceConfig records that the claim config of a device could not be
+// applied. GetNetInterfaceName fails for the device until ReleaseDeviceConfig
+// is called, so that it is not handed to a pod unconfigured.
+func (db *DB) RejectDeviceConfig(deviceName string, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.deviceConfigs[deviceName] = deviceConfig{err: err}
+}
+
+// ReleaseDeviceConfig undoes ApplyDeviceConfig or RejectDeviceConfig once the
+// device is no longer allocated.
+func (db *DB) ReleaseDeviceConfig(ctx context.Context, deviceName string) error {
+	db.mu.RLock()
+	applied, ok := db.deviceConfigs[deviceName]
+	fs := db.sysfs
+	db.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	if err := ibconfig.New(fs).Remove(ctx, applied.result); err != nil {
+		return fmt.Errorf("release config of IB device %s: %w", deviceName, err)
+	}
+
+	db.mu.Lock()
+	delete(db.deviceConfigs, deviceName)
+	db.mu.Unlock()
+	if applied.result != nil {
+		db.saveCheckpoint()
+	}
+	return nil
+}
+
+// withVFIOEntries adds the devices bound to vfio-pci by their claim config to
+// the scanned entries. Their IB device is gone until they are bound back to
+// mlx5_core, and they stay in the inventory as last scanned, so that their
+// claim can still be reported and released and their PF is not reset.
+func (db *DB) withVFIOEntries(entries []DeviceEntry) []DeviceEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var vfio []string
+	for device, configured := range db.deviceConfigs {
+		if configured.result == nil || configured.result.VFIO == nil {
+			continue
+		}
+		if _, ok := db.deviceStore[device]; !ok {
+			continue
+		}
+		if !slices.ContainsFunc(entries, func(e DeviceEntry) bool { return e.DeviceName == device }) {
+			vfio = append(vfio, device)
+		}
+	}
+	slices.Sort(vfio)
+	for _, device := range vfio {
+		entries = append(entries, db.deviceStore[device])
+	}
+	return entries
+}
+
+// vfioBinding returns the binding of a device bound to vfio-pci by its claim
+// config, if it is.
+func (db *DB) vfioBinding(deviceName string) (ibconfig.VFIOBinding, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	configured, ok := db.deviceConfigs[deviceName]
+	if !ok || configured.err != nil || configured.result.VFIO == nil {
+		return ibconfig.VFIOBinding{}, false
+	}
+	return *configured.result.VFIO, true
+}
+
+// vfioNetInterfaceName returns the netdev to hand out for a VF bound to
+// vfio-pci. The VF has none, but DRANET only prepares devices it can resolve
+// to a netdev, so a dummy netdev named after the VF stands in for it. It is
+// moved into the pod like any other, which tells VFIOBindings which pod the
+// VF belongs to, and is deleted by releaseVFIO.
+func (db *DB) vfioNetInterfaceName(ctx context.Context, deviceName string, binding ibconfig.VFIOBinding) (string, error) {
+	ifName := vfioNetdevName(binding.PCIAddress)
+
+	// On a retry the placeholder may already be in the pod.
+	db.mu.RLock()
+	prev, ok := db.handouts[deviceName]
+	db.mu.RUnlock()
+	if ok && prev.Link.Name == ifName {
+		return ifName, nil
+	}
+
+	if err := db.links.AddDummy(ifName); err != nil {
+		return "", fmt.Errorf("IB device %s: create placeholder netdev %s: %w", deviceName, ifName, err)
+	}
+	db.recordLinkHandout(ctx, deviceName, handout{PCIAddress: binding.PCIAddress, VFIO: true}, ifName)
+	return ifName, nil
+}
+
+// vfioNetdevName returns the name of the placeholder netdev of the VF at
+// pciAddress, e.g. vfio00003b001 for 0000:3b:00.1. It fits in IFNAMSIZ.
+func vfioNetdevName(pciAddress string) string {
+	return "vfio" + strings.NewReplacer(":", "", ".", "").Replace(pciAddress)
+}
+
+// releaseVFIO binds a VF handed to a pod in VFIO mode back to mlx5_core once
+// the pod is torn down, and deletes its placeholder netdev. It is not left
+// until the claim is released, which may be long after the pod is gone. The
+// Preparer releases the config, so that it forgets having applied it.
+func (db *DB) releaseVFIO(ctx context.Context, deviceName string, h handout) {
+	logger := klog.FromContext(ctx)
+	if err := db.links.DeleteDummy(h.Link.Name); err != nil {
+		logger.Error(err, "IB inventory: failed to delete placeholder netdev", "device", deviceName, "netdev", h.Link.Name)
+	}
+
+	db.mu.RLock()
+	preparer := db.preparer
+	db.mu.RUnlock()
+	release := db.ReleaseDeviceConfig
+	if preparer != nil {
+		release = preparer.ReleaseDevice
+	}
+	// On failure the claim tracker tries again when the claim is released.
+	if err := release(ctx, deviceName); err != nil {
+		logger.Error(err, "IB inventory: failed to bind VF back to the host", "device", deviceName, "pciAddress", h.PCIAddress)
+		return
+	}
+	logger.Info("IB inventory: bound VF back to the host", "device", deviceName, "pciAddress", h.PCIAddress)
+}
+
+// VFIOBindings returns the VFs bound to vfio-pci whose placeholder netdev is
+// in the network namespace netNs, sorted by PCI address. The containers of
+// the pod need their device nodes, which DRANET does not pass.
+func (db *DB) VFIOBindings(netNs string) []ibconfig.VFIOBinding {
+	type candidate struct {
+		handout handout
+		binding ibconfig.VFIOBinding
+	}
+	db.mu.RLock()
+	var candidates []candidate
+	for device, h := range db.handouts {
+		configured, ok := db.deviceConfigs[device]
+		if !h.VFIO || !ok || configured.result == nil || configured.result.VFIO == nil {
+			continue
+		}
+		candidates = append(candidates, candidate{handout: h, binding: *configured.result.VFIO})
+	}
+	db.mu.RUnlock()
+
+	var bindings []ibconfig.VFIOBinding
+	for _, c := range candidates {
+		if in, err := db.links.LinkInNetns(netNs, c.handout.Link); err == nil && in {
+			bindings = append(bindings, c.binding)
+		}
+	}
+	slices.SortFunc(bindings, func(a, b ibconfig.VFIOBinding) int { return strings.Compare(a.PCIAddress, b.PCIAddress) })
+	return bindings
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibconfig"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+func TestGetNetInterfaceNameFollowsClaimConfig(t *testing.T) {
+	ctx := context.Background()
+	db := New()
+	db.deviceStore["mlx5-1-port1"] = DeviceEntry{DeviceName: "mlx5-1-port1", NetDevices: []string{"ibp59s0v0"}}
+
+	name, err := db.GetNetInterfaceName("mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Equal(t, "ibp59s0v0", name)
+
+	db.deviceConfigs["mlx5-1-port1"] = deviceConfig{result: &ibconfig.Result{NetDevice: "ibp59s0v0.8001"}}
+	name, err = db.GetNetInterfaceName("mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Equal(t, "ibp59s0v0.8001", name)
+
+	db.RejectDeviceConfig("mlx5-1-port1", errors.New("pkey 0x8001 is not in the P_Key table"))
+	_, err = db.GetNetInterfaceName("mlx5-1-port1")
+	assert.ErrorContains(t, err, "claim config not applied: pkey 0x8001")
+
+	require.NoError(t, db.ReleaseDeviceConfig(ctx, "mlx5-1-port1"))
+	name, err = db.GetNetInterfaceName("mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Equal(t, "ibp59s0v0", name)
+}
+
+// fakePreparer applies a P_Key child config once its claim shows up.
+type fakePreparer struct {
+	db       *DB
+	calls    int
+	reserved int
+	err      error
+}
+
+func (p *fakePreparer) PrepareDevice(_ context.Context, device string) (bool, error) {
+	p.calls++
+	if p.err != nil || p.calls < p.reserved {
+		return false, p.err
+	}
+	p.db.mu.Lock()
+	p.db.deviceConfigs[device] = deviceConfig{result: &ibconfig.Result{NetDevice: "ibp59s0v0.8001"}}
+	p.db.mu.Unlock()
+	return true, nil
+}
+
+func (p *fakePreparer) ReleaseDevice(ctx context.Context, device string) error {
+	return p.db.ReleaseDeviceConfig(ctx, device)
+}
+
+func TestGetNetInterfaceNameWaitsForClaim(t *testing.T) {
+	db := New()
+	db.deviceStore["mlx5-1-port1"] = DeviceEntry{DeviceName: "mlx5-1-port1", NetDevices: []string{"ibp59s0v0"}}
+	db.prepareTimeout = time.Second
+	preparer := &fakePreparer{db: db, reserved: 3}
+	db.SetPreparer(preparer)
+
+	// The claim is only seen on the third attempt, and its config is in
+	// place before the netdev is handed out.
+	name, err := db.GetNetInterfaceName("mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Equal(t, "ibp59s0v0.8001", name)
+	assert.Equal(t, 3, preparer.calls)
+
+	preparer.err = errors.New("pkey 0x8001 is not in the P_Key table")
+	_, err = db.GetNetInterfaceName("mlx5-1-port1")
+	assert.ErrorContains(t, err, "apply claim config: pkey 0x8001")
+
+	preparer.err = nil
+	preparer.calls, preparer.reserved = 0, 100
+	db.prepareTimeout = 300 * time.Millisecond
+	_, err = db.GetNetInterfaceName("mlx5-1-port1")
+	assert.ErrorContains(t, err, "no claim reserved for a pod allocates it")
+}
+
+func TestVFIODeviceStaysInInventory(t *testing.T) {
+	ctx := context.Background()
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 1))
+	require.NoError(t, tree.AddPCIDriver("vfio-pci"))
+	db := New(
+		WithDiscoveryBackend(ibverbs.NewSysfsBackend(tree.Root)),
+		WithSysfs(sysfs.New(tree.Root)),
+	)
+	db.links = newFakeLinks()
+	_, err = db.scan(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, db.ApplyDeviceConfig(ctx, "mlx5-1-port1", "uid-1", &configapi.IbConfig{Mode: ptr.To(configapi.DeviceModeVFIO)}))
+
+	// Bound to vfio-pci, the VF has no IB device anymore.
+	require.NoError(t, os.Remove(filepath.Join(tree.Root, "class/infiniband/mlx5_1")))
+	devices, err := db.scan(ctx)
+	require.NoError(t, err)
+	assert.Len(t, devices, 2)
+	assert.True(t, db.vfInUse("0000:3b:00.1"))
+	status, err := db.DeviceStatus("mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Equal(t, ptr.To(1), status.IOMMUGroup)
+
+	require.NoError(t, db.ReleaseDeviceConfig(ctx, "mlx5-1-port1"))
+	devices, err = db.scan(ctx)
+	require.NoError(t, err)
+	assert.Len(t, devices, 1)
+}
+
+func TestVFIODeviceHandedToPod(t *testing.T) {
+	ctx := context.Background()
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 1))
+	require.NoError(t, tree.AddPCIDriver("vfio-pci"))
+	fs := sysfs.New(tree.Root)
+	db := New(
+		WithDiscoveryBackend(ibverbs.NewSysfsBackend(tree.Root)),
+		WithSysfs(fs),
+	)
+	links := newFakeLinks()
+	db.links = links
+	_, err = db.scan(ctx)
+	require.NoError(t, err)
+
+	// The VF is bound to vfio-pci while the claim is prepared, and a
+	// placeholder netdev is handed to DRANET in its place.
+	preparer := &vfioPreparer{db: db}
+	db.SetPreparer(preparer)
+	for range 2 {
+		name, err := db.GetNetInterfaceName("mlx5-1-port1")
+		require.NoError(t, err)
+		assert.Equal(t, "vfio00003b001", name)
+	}
+	bound, err := os.ReadFile(fs.Path("bus/pci/drivers/vfio-pci/bind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.1", string(bound))
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.1", "vfio-pci"))
+	assert.Equal(t, []string{"vfio00003b001"}, links.dummies)
+
+	// Once DRANET moved the placeholder into the pod, its containers get the
+	// VF.
+	db.AddPodNetNs("default/vm", "/var/run/netns/vm")
+	assert.Empty(t, db.VFIOBindings("/var/run/netns/vm"))
+	links.netnsOf["dummy-vfio00003b001"] = "/var/run/netns/vm"
+	bindings := db.VFIOBindings("/var/run/netns/vm")
+	assert.Equal(t, []ibconfig.VFIOBinding{{PCIAddress: "0000:3b:00.1", IOMMUGroup: 1}}, bindings)
+	assert.Equal(t, []string{"/dev/vfio/vfio", "/dev/vfio/1"}, bindings[0].DeviceNodes())
+	assert.Empty(t, db.VFIOBindings("/var/run/netns/other"))
+
+	// Tearing down the pod binds the VF back to mlx5_core, without waiting
+	// for the claim to be released.
+	db.RemovePodNetNs("default/vm")
+	assert.Equal(t, []string{"mlx5-1-port1"}, preparer.released)
+	bound, err = os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/bind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.1", string(bound))
+	assert.Empty(t, links.dummies)
+	assert.Empty(t, links.rdma)
+	assert.Empty(t, db.handouts)
+	_, ok := db.vfioBinding("mlx5-1-port1")
+	assert.False(t, ok)
+}
+
+// vfioPreparer applies a VFIO config to the devices it prepares.
+type vfioPreparer struct {
+	db       *DB
+	released []string
+}
+
+func (p *vfioPreparer) PrepareDevice(ctx context.Context, device string) (bool, error) {
+	if _, ok := p.db.vfioBinding(device); ok {
+		return true, nil
+	}
+	return true, p.db.ApplyDeviceConfig(ctx, device, "uid-1", &configapi.IbConfig{Mode: ptr.To(configapi.DeviceModeVFIO)})
+}
+
+func (p *vfioPreparer) ReleaseDevice(ctx context.Context, device string) error {
+	p.released = append(p.released, device)
+	return p.db.ReleaseDeviceConfig(ctx, device)
+}
+
+func TestVFIOConfigRestoredAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 1))
+	require.NoError(t, tree.AddPCIDriver("vfio-pci"))
+	fs := sysfs.New(tree.Root)
+	opts := []Option{
+		WithDiscoveryBackend(ibverbs.NewSysfsBackend(tree.Root)),
+		WithSysfs(fs),
+		WithCheckpointFile(filepath.Join(t.TempDir(), "checkpoint.json")),
+	}
+	db := New(opts...)
+	db.links = newFakeLinks()
+	_, err = db.scan(ctx)
+	require.NoError(t, err)
+	require.NoError(t, db.ApplyDeviceConfig(ctx, "mlx5-1-port1", "uid-1", &configapi.IbConfig{Mode: ptr.To(configapi.DeviceModeVFIO)}))
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.1", "vfio-pci"))
+	require.NoError(t, os.Remove(filepath.Join(tree.Root, "class/infiniband/mlx5_1")))
+
+	// After a restart the VF is still known to be bound to vfio-pci for its
+	// claim, and stays in the inventory.
+	db = New(opts...)
+	db.links = newFakeLinks()
+	assert.Equal(t, []types.UID{"uid-1"}, db.RestoredClaims())
+	devices, err := db.scan(ctx)
+	require.NoError(t, err)
+	assert.Len(t, devices, 2)
+
+	// Applying the config of the same claim again keeps the binding.
+	require.NoError(t, db.ApplyDeviceConfig(ctx, "mlx5-1-port1", "uid-1", &configapi.IbConfig{Mode: ptr.To(configapi.DeviceModeVFIO)}))
+	assert.Empty(t, db.RestoredClaims())
+	require.NoError(t, db.ReleaseRestored(ctx))
+	_, ok := db.vfioBinding("mlx5-1-port1")
+	assert.True(t, ok)
+
+	// If its claim was released in the meantime, the VF is bound back to
+	// mlx5_core.
+	db = New(opts...)
+	db.links = newFakeLinks()
+	assert.Equal(t, []types.UID{"uid-1"}, db.RestoredClaims())
+	require.NoError(t, db.ReleaseRestored(ctx))
+	bound, err := os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/bind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.1", string(bound))
+	assert.Empty(t, db.RestoredClaims())
+	assert.Empty(t, readCheckpoint(t, db.checkpointPath).Configs)
+}
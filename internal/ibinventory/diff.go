@@ -0,0 +1,106 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/klog/v2"
+)
+
+// inventoryDiff summarizes how a scan result differs from the previously
+// published device set. Device names in each list are sorted.
+type inventoryDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// Empty reports whether the two device sets are identical.
+func (d inventoryDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// publish sends devices to DRANET if they differ from the last published set.
+// Unchanged scans are suppressed so that ResourceSlices are only rewritten
+// when the inventory actually changes.
+func (db *DB) publish(ctx context.Context, devices []resourceapi.Device) {
+	logger := klog.FromContext(ctx)
+
+	hashes := hashDevices(devices)
+	diff := diffHashes(db.published, hashes)
+	if diff.Empty() {
+		logger.V(4).Info("IB inventory unchanged, not publishing", "deviceCount", len(devices))
+		return
+	}
+
+	logger.Info("IB inventory changed, publishing",
+		"deviceCount", len(devices),
+		"added", diff.Added,
+		"removed", diff.Removed,
+		"changed", diff.Changed,
+	)
+	db.notifications <- devices
+	db.published = hashes
+}
+
+// hashDevices returns a content hash for each device keyed by device name.
+// Attribute and capacity maps are serialized with sorted keys, so the hash is
+// independent of map iteration order.
+func hashDevices(devices []resourceapi.Device) map[string]string {
+	hashes := make(map[string]string, len(devices))
+	for _, d := range devices {
+		data, err := json.Marshal(d)
+		if err != nil {
+			// Can't happen for API types; make sure the device is
+			// considered changed rather than silently dropped.
+			hashes[d.Name] = ""
+			continue
+		}
+		sum := sha256.Sum256(data)
+		hashes[d.Name] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+// diffHashes compares two device hash sets by name and content.
+func diffHashes(prev, next map[string]string) inventoryDiff {
+	var diff inventoryDiff
+	for name, h := range next {
+		old, ok := prev[name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, name)
+		case old != h || h == "":
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range prev {
+		if _, ok := next[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/utils/ptr"
+)
+
+func testDevice(name, state string) resourceapi.Device {
+	return resourceapi.Device{
+		Name: name,
+		Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+			AttrIBPortState: {StringValue: ptr.To(state)},
+			AttrIBType:      {StringValue: ptr.To("VF")},
+		},
+	}
+}
+
+func TestDiffHashes(t *testing.T) {
+	prev := hashDevices([]resourceapi.Device{
+		testDevice("mlx5-0-port1", "Active"),
+		testDevice("mlx5-1-port1", "Active"),
+		testDevice("mlx5-2-port1", "Active"),
+	})
+	next := hashDevices([]resourceapi.Device{
+		testDevice("mlx5-3-port1", "Active"),
+		testDevice("mlx5-2-port1", "Active"),
+		testDevice("mlx5-1-port1", "Down"),
+	})
+
+	diff := diffHashes(prev, next)
+	assert.Equal(t, []string{"mlx5-3-port1"}, diff.Added)
+	assert.Equal(t, []string{"mlx5-0-port1"}, diff.Removed)
+	assert.Equal(t, []string{"mlx5-1-port1"}, diff.Changed)
+	assert.False(t, diff.Empty())
+}
+
+func TestDiffHashesIgnoresOrder(t *testing.T) {
+	a := hashDevices([]resourceapi.Device{
+		testDevice("mlx5-0-port1", "Active"),
+		testDevice("mlx5-1-port1", "Active"),
+	})
+	b := hashDevices([]resourceapi.Device{
+		testDevice("mlx5-1-port1", "Active"),
+		testDevice("mlx5-0-port1", "Active"),
+	})
+	assert.True(t, diffHashes(a, b).Empty())
+}
+
+func TestPublishSuppressesUnchanged(t *testing.T) {
+	db := New()
+	db.notifications = make(chan []resourceapi.Device, 4)
+	ctx := context.Background()
+
+	devices := []resourceapi.Device{testDevice("mlx5-0-port1", "Active")}
+	db.publish(ctx, devices)
+	db.publish(ctx, devices)
+	assert.Len(t, db.notifications, 1, "identical scan must not be republished")
+
+	db.publish(ctx, []resourceapi.Device{testDevice("mlx5-0-port1", "Down")})
+	assert.Len(t, db.notifications, 2)
+
+	// Losing every device must still be published.
+	db.publish(ctx, nil)
+	assert.Len(t, db.notifications, 3)
+
+	// An empty inventory on startup is not worth publishing.
+	empty := New()
+	empty.notifications = make(chan []resourceapi.Device, 1)
+	empty.publish(ctx, nil)
+	assert.Empty(t, empty.notifications)
+}
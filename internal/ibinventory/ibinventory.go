@@ -15,42 +15,117 @@
  */
 
 // Package ibinventory implements the DRANET inventoryDB interface for
-// InfiniBand devices. It discovers IB PFs and VFs using libibverbs (cgo)
-// and sysfs, optionally auto-provisions VFs on baremetal hosts, and
-// publishes them as DRA devices via the DRANET driver framework.
+// InfiniBand devices. It discovers IB PFs and VFs using an ibverbs discovery
+// backend (libibverbs or sysfs) and sysfs, optionally auto-provisions VFs on
+// baremetal hosts, and publishes them as DRA devices via the DRANET driver
+// framework.
 package ibinventory
 
 import (
 	"context"
 	"fmt"
-	"os/exec"
+	"maps"
+	"math"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/dranet/pkg/apis"
+	"github.com/vishvananda/netlink"
 
+	corev1 "k8s.io/api/core/v1"
 	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/dynamic-resource-allocation/deviceattribute"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/ptr"
 
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
 	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
 	"github.com/kubernetes-sigs/dra-example-driver/internal/sriov"
 	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
 )
 
 const (
 	// IB-specific attribute constants under the dra.net prefix.
-	AttrIBType            = "dra.net/ibType"
+	AttrIBType = "dra.net/ibType"
+	// AttrIBLinkSpeed is the link speed as a string, e.g. "100Gb/s".
+	//
+	// Deprecated: It cannot be compared in CEL; select on AttrIBLinkRateMbps
+	// instead.
 	AttrIBLinkSpeed       = "dra.net/ibLinkSpeed"
 	AttrIBPortState       = "dra.net/ibPortState"
+	AttrIBPhysState       = "dra.net/ibPhysState"
 	AttrIBFirmwareVersion = "dra.net/ibFirmwareVersion"
 	AttrIBNodeGUID        = "dra.net/ibNodeGUID"
 	AttrIBPortGUID        = "dra.net/ibPortGUID"
 	AttrIBParentDevice    = "dra.net/ibParentDevice"
 	AttrIBDevName         = "dra.net/ibDevName"
-
+	// AttrIBLinkRateMbps is the exact nominal data rate of the port in Mb/s,
+	// e.g. 2500 for 1X SDR, for numeric comparisons in CEL. AttrIBLinkWidth
+	// is the link width, e.g. "4X", and AttrIBSpeedGeneration the per-lane
+	// speed, e.g. "NDR". They are not set while the speed is unknown.
+	AttrIBLinkRateMbps    = "dra.net/ibLinkRateMbps"
+	AttrIBLinkWidth       = "dra.net/ibLinkWidth"
+	AttrIBSpeedGeneration = "dra.net/ibSpeedGeneration"
+	// AttrIBRDMANetnsMode is the netns mode of the node's RDMA subsystem,
+	// "exclusive" or "shared", when it is known.
+	AttrIBRDMANetnsMode = "dra.net/ibRdmaNetnsMode"
+	// AttrIBLinkLayer is the link layer of the port, "InfiniBand" or
+	// "Ethernet" for RoCE.
+	AttrIBLinkLayer = "dra.net/ibLinkLayer"
+	// AttrIBRoCEv2GIDIndex is the GID index RoCE v2 traffic should use on
+	// the port by default. It is only set on ports with a RoCE v2 GID.
+	AttrIBRoCEv2GIDIndex = "dra.net/ibRoceV2GIDIndex"
+	// AttrIBVendorID and AttrIBVendorPartID identify the HCA model, e.g.
+	// "0x15b3" and 4129 (0x1021) for a ConnectX-7.
+	AttrIBVendorID     = "dra.net/ibVendorID"
+	AttrIBVendorPartID = "dra.net/ibVendorPartID"
+	// AttrIBIOMMUGroup is the IOMMU group of the PCI function, when the
+	// IOMMU is enabled.
+	AttrIBIOMMUGroup = "dra.net/ibIOMMUGroup"
+	// AttrIBPCIeSwitch is the PCI address of the upstream port of the
+	// closest PCIe switch the function is below, e.g. for matchAttribute
+	// constraints that place an HCA next to a GPU. It is not set if there is
+	// no switch. The PCIe root complex is published as the standard
+	// deviceattribute.StandardDeviceAttributePCIeRoot.
+	AttrIBPCIeSwitch = "dra.net/ibPCIeSwitch"
+	// AttrIBPCIeLinkSpeed is the current PCIe link speed, e.g. "16.0 GT/s
+	// PCIe", and AttrIBPCIeLinkWidth the number of lanes. VFs report the
+	// link of their PF.
+	AttrIBPCIeLinkSpeed = "dra.net/ibPCIeLinkSpeed"
+	AttrIBPCIeLinkWidth = "dra.net/ibPCIeLinkWidth"
+
+	// HCA capabilities, only published by discovery backends that can
+	// query them.
+	AttrIBMaxQP                = "dra.net/ibMaxQP"
+	AttrIBAtomicCap            = "dra.net/ibAtomicCap"
+	AttrIBODPSupported         = "dra.net/ibODPSupported"
+	AttrIBDCSupported          = "dra.net/ibDCSupported"
+	AttrIBTagMatchingSupported = "dra.net/ibTagMatchingSupported"
+	CapacityIBDeviceMemory     = "dra.net/ibDeviceMemory"
+
+	// CapacityIBVFs is the number of VFs of a PF whose VFs are attached on
+	// demand. Each allocation of the PF consumes one VF by default, or all
+	// of them to take the PF itself.
+	CapacityIBVFs = "dra.net/ibVFs"
+
+	// defaultPollInterval is the rescan interval used when no kernel event
+	// source is available.
 	defaultPollInterval = 30 * time.Second
+	// defaultFallbackPollInterval is the slow safety-net rescan interval used
+	// while kernel events drive the inventory.
+	defaultFallbackPollInterval = 5 * time.Minute
+	// defaultEventDebounce coalesces bursts of kernel events (e.g. creating
+	// many VFs at once) into a single rescan.
+	defaultEventDebounce = time.Second
+	// defaultPrepareTimeout is how long GetNetInterfaceName waits for the
+	// Preparer to see the claim of a device.
+	defaultPrepareTimeout = 10 * time.Second
 )
 
 // DeviceEntry holds the combined ibverbs + sysfs info for a single IB port.
@@ -60,14 +135,37 @@ type DeviceEntry struct {
 	PortNum         int
 	Type            string
 	LinkSpeed       string
+	LinkRateMbps    int64 // 0 if the speed or width is unknown
+	LinkWidth       string
+	SpeedGeneration string
 	PortState       string
+	PhysState       string
 	FirmwareVersion string
 	NodeGUID        string
 	PortGUID        string
-	NUMANode        int
-	PCIAddress      string
-	ParentDevice    string
-	NetDevices      []string
+	LID             uint16
+	ActiveMTU       int
+	LinkLayer       string
+	// RDMA is set for InfiniBand ports and for Ethernet ports with RoCE
+	// GIDs; RoCE has none while it is disabled or the netdev is missing.
+	RDMA bool
+	// RoCEv2GIDIndex is the default RoCE v2 GID index, -1 if there is none.
+	RoCEv2GIDIndex int
+	VendorID       uint32
+	VendorPartID   uint32
+	// Caps is nil if the discovery backend cannot query capabilities.
+	Caps         *ibverbs.DeviceCaps
+	NUMANode     int
+	PCIAddress   string
+	ParentDevice string
+	NetDevices   []string
+	// PCIe is nil if the PCI hierarchy above the function is unknown.
+	PCIe *sysfs.PCIeTopology
+	// OnDemandVFs is the number of VFs of a PF whose VFs are attached on
+	// demand, and AttachedVF is set on such VFs. They are handed out
+	// through their PF and not published.
+	OnDemandVFs int
+	AttachedVF  bool
 }
 
 // DB implements the DRANET inventoryDB interface for InfiniBand devices.
@@ -83,14 +181,60 @@ type DeviceEntry struct {
 //	GetPodNetNs(podKey string) (netNs string)
 type DB struct {
 	numVFs        int
+	sriovPolicy   *sriov.Policy
 	numSimDevices int
+	simTopology   *fakesysfs.Topology
+	simulated     bool
+	backend       ibverbs.Backend
+	sysfs         sysfs.FS
+	rdmaNetnsMode string
 
 	mu            sync.RWMutex
 	deviceStore   map[string]DeviceEntry
 	podNetNsStore map[string]string
+	// deviceConfigs holds the claim config applied to allocated devices.
+	deviceConfigs map[string]deviceConfig
+	// preparer applies the claim of a device in GetNetInterfaceName.
+	preparer       Preparer
+	prepareTimeout time.Duration
+
+	// portHealth tracks unhealthy ports for device taints; healthCheckAt is
+	// when the next pending NoExecute taint becomes due.
+	portHealth          map[string]portHealth
+	healthCheckAt       time.Time
+	linkDownGracePeriod time.Duration
+	// scans tracks whether the inventory loop keeps scanning.
+	scans scanHealth
+	// deferredPFs holds the PFs, by PCI address, whose VF count is to be
+	// changed once their VFs are released; resettingPFs the IB device names
+	// of the PFs whose VFs are being re-created.
+	deferredPFs  map[string]deferredPF
+	resettingPFs map[string]bool
+	recorder     record.EventRecorder
+	nodeRef      *corev1.ObjectReference
+
+	// onDemandPFs holds the PFs, by PCI address, whose VFs are attached on
+	// demand; shares the allocation shares of their devices, by device
+	// name and shareKey, and handoutSeq the last share.handedOut.
+	// onDemandMu serializes attaching, handing out and detaching their VFs.
+	onDemandPFs map[string]onDemandPF
+	shares      map[string]map[string]share
+	handoutSeq  uint64
+	onDemandMu  sync.Mutex
 
 	notifications chan []resourceapi.Device
+	published     map[string]string
 	pollInterval  time.Duration
+	eventDebounce time.Duration
+	eventWatch    bool
+
+	// handouts records the netdevs given to pods so that they can be
+	// returned to the host; it is persisted to checkpointPath, with writes
+	// serialized by checkpointMu.
+	handouts       map[string]handout
+	checkpointPath string
+	checkpointMu   sync.Mutex
+	links          hostLinks
 }
 
 // Option configures the DB.
@@ -101,60 +245,189 @@ func WithNumVFs(n int) Option {
 	return func(db *DB) { db.numVFs = n }
 }
 
-// WithNumSimDevices sets the number of simulated IB devices for testing.
+// WithSRIOVPolicy sets the number of VFs to auto-provision on the PFs
+// matched by the policy's rules. The other PFs get the count set with
+// WithNumVFs.
+func WithSRIOVPolicy(p *sriov.Policy) Option {
+	return func(db *DB) { db.sriovPolicy = p }
+}
+
+// WithEventRecorder records events about the IB devices of the node, e.g.
+// VF provisioning deferred because VFs are in use, on the node object.
+func WithEventRecorder(recorder record.EventRecorder, nodeName string) Option {
+	return func(db *DB) {
+		db.recorder = recorder
+		db.nodeRef = &corev1.ObjectReference{Kind: "Node", Name: nodeName, UID: types.UID(nodeName)}
+	}
+}
+
+// WithNumSimDevices sets the number of simulated IB VFs for testing. It is
+// a shorthand for fakesysfs.DefaultTopology and ignored if WithSimTopology
+// is also given.
 func WithNumSimDevices(n int) Option {
 	return func(db *DB) { db.numSimDevices = n }
 }
 
-// WithPollInterval overrides the default polling interval.
+// WithSimTopology simulates the given topology of IB devices when no real
+// hardware is found. For testing only.
+func WithSimTopology(topo *fakesysfs.Topology) Option {
+	return func(db *DB) { db.simTopology = topo }
+}
+
+// WithPollInterval overrides the polling interval. When kernel events are
+// watched this is the fallback interval, otherwise it is the only trigger.
 func WithPollInterval(d time.Duration) Option {
 	return func(db *DB) { db.pollInterval = d }
 }
 
+// WithEventWatch enables or disables rescanning on kernel uevents, RDMA
+// netlink notifications and link updates. It is enabled by default.
+func WithEventWatch(enabled bool) Option {
+	return func(db *DB) { db.eventWatch = enabled }
+}
+
+// WithLinkDownGracePeriod sets how long a port's physical link must stay down
+// before its device is tainted NoExecute. Ports that are not Active are
+// always tainted NoSchedule.
+func WithLinkDownGracePeriod(d time.Duration) Option {
+	return func(db *DB) { db.linkDownGracePeriod = d }
+}
+
+// WithDiscoveryBackend sets the backend used to query IB devices and ports.
+// It defaults to ibverbs.DefaultBackend.
+func WithDiscoveryBackend(b ibverbs.Backend) Option {
+	return func(db *DB) { db.backend = b }
+}
+
+// WithCheckpointFile persists the record of netdevs handed to pods to path,
+// so that devices left in pods while the plugin was down are returned to the
+// host on startup. The claim configs applied to devices and the allocation
+// shares of on-demand PFs are persisted too, so that those of claims
+// released while it was down can be undone, see RestoredClaims.
+func WithCheckpointFile(path string) Option {
+	return func(db *DB) { db.checkpointPath = path }
+}
+
+// WithRDMANetnsMode publishes the netns mode of the RDMA subsystem, as found
+// at startup, on every device.
+func WithRDMANetnsMode(mode string) Option {
+	return func(db *DB) { db.rdmaNetnsMode = mode }
+}
+
+// WithSysfs sets the sysfs tree used for PCI, SR-IOV and netdev discovery
+// and VF provisioning. It defaults to the host's /sys.
+func WithSysfs(fs sysfs.FS) Option {
+	return func(db *DB) { db.sysfs = fs }
+}
+
 // New creates a new IB inventory database.
 func New(opts ...Option) *DB {
 	db := &DB{
 		deviceStore:   make(map[string]DeviceEntry),
 		podNetNsStore: make(map[string]string),
+		deviceConfigs: make(map[string]deviceConfig),
+		handouts:      make(map[string]handout),
+		deferredPFs:   make(map[string]deferredPF),
+		resettingPFs:  make(map[string]bool),
+		onDemandPFs:   make(map[string]onDemandPF),
+		shares:        make(map[string]map[string]share),
+		links:         netnsLinks{},
 		notifications: make(chan []resourceapi.Device),
-		pollInterval:  defaultPollInterval,
+		eventDebounce: defaultEventDebounce,
+		eventWatch:    true,
+		sysfs:         sysfs.Default,
+
+		portHealth:          make(map[string]portHealth),
+		linkDownGracePeriod: defaultLinkDownGracePeriod,
+		prepareTimeout:      defaultPrepareTimeout,
 	}
 	for _, o := range opts {
 		o(db)
 	}
+	if db.backend == nil {
+		db.backend = ibverbs.DefaultBackend()
+	}
+	if db.simTopology == nil && db.numSimDevices > 0 {
+		db.simTopology = fakesysfs.DefaultTopology(db.numSimDevices)
+	}
+	db.restoreClaims()
 	return db
 }
 
 // Run starts the inventory loop. It discovers IB devices on startup,
-// optionally provisions VFs, and then periodically re-discovers.
+// optionally provisions VFs, and then re-discovers whenever the kernel reports
+// a device, port or VF change, with periodic polling as a fallback.
 // This satisfies the inventoryDB.Run interface.
 func (db *DB) Run(ctx context.Context) error {
 	defer close(db.notifications)
+	logger := klog.FromContext(ctx)
+
+	db.mu.Lock()
+	db.scans.started = time.Now()
+	db.mu.Unlock()
+
+	if db.simTopology != nil {
+		cleanup, err := db.setupSimulation(ctx)
+		if err != nil {
+			return fmt.Errorf("set up simulated IB devices: %w", err)
+		}
+		defer cleanup()
+	}
+
+	// Return devices left behind by pods that went away while the plugin
+	// was down before discovering them, and learn which are still in use
+	// before touching any VFs.
+	db.reconcileHandouts(ctx)
 
-	// Auto-provision VFs on first run.
-	if db.numVFs > 0 {
+	// Auto-provision VFs on first run. Simulated topologies come with their
+	// VFs.
+	if (db.numVFs > 0 || db.sriovPolicy != nil) && !db.simulated {
 		if err := db.provisionVFs(ctx); err != nil {
 			klog.Errorf("IB inventory: failed to provision VFs: %v", err)
 		}
 	}
 
 	// Initial scan.
-	devices := db.scan(ctx)
-	if len(devices) > 0 {
-		db.notifications <- devices
+	logger.Info("IB inventory: discovering devices", "backend", db.backend.Name())
+	db.rescan(ctx)
+
+	// Event-driven rescan with periodic polling as a fallback.
+	trigger := make(chan struct{}, 1)
+	pollInterval := db.pollInterval
+	if db.eventWatch && db.watchEvents(ctx, trigger) {
+		if pollInterval == 0 {
+			pollInterval = defaultFallbackPollInterval
+		}
+		logger.Info("IB inventory: watching kernel events", "fallbackPollInterval", pollInterval)
+	} else if pollInterval == 0 {
+		pollInterval = defaultPollInterval
 	}
 
-	// Periodic rescan.
-	ticker := time.NewTicker(db.pollInterval)
+	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
+	var debounce, healthCheck <-chan time.Time
 	for {
+		// Rescan when a link-down grace period expires so that the NoExecute
+		// taint is published without waiting for the next event or poll.
+		healthCheck = nil
+		if at := db.nextHealthCheck(); !at.IsZero() {
+			healthCheck = time.After(time.Until(at))
+		}
+
 		select {
-		case <-ticker.C:
-			devices := db.scan(ctx)
-			if len(devices) > 0 {
-				db.notifications <- devices
+		case <-trigger:
+			// Wait for the burst to settle before rescanning.
+			if debounce == nil {
+				debounce = time.After(db.eventDebounce)
 			}
+		case <-debounce:
+			debounce = nil
+			db.rescan(ctx)
+		case <-healthCheck:
+			db.rescan(ctx)
+		case <-ticker.C:
+			db.rescan(ctx)
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -166,17 +439,59 @@ func (db *DB) GetResources(ctx context.Context) <-chan []resourceapi.Device {
 	return db.notifications
 }
 
-// GetNetInterfaceName returns the first network interface name for a device.
+// GetNetInterfaceName returns the network interface to move into the pod for
+// a device: the one selected by the claim config applied to it, if any, and
+// otherwise its first network interface. The interface is recorded so that
+// it can be returned to the host when the pod goes away. A VF bound to
+// vfio-pci by its claim config has no network interface and hands out a
+// placeholder, see vfioNetInterfaceName. A PF whose VFs are attached on
+// demand hands out one of its VFs.
+//
+// DRANET calls it while preparing the claim of the device, so the claim is
+// applied with the Preparer first, if one is set.
+func (db *DB) GetNetInterfaceName(deviceName string) (string, error) {
+	if err := db.prepare(context.Background(), deviceName); err != nil {
+		return "", err
+	}
+	if entry, ok := db.GetDeviceEntry(deviceName); ok && entry.OnDemandVFs > 0 {
+		return db.vfNetInterfaceName(context.Background(), entry)
+	}
+	if binding, ok := db.vfioBinding(deviceName); ok {
+		return db.vfioNetInterfaceName(context.Background(), deviceName, binding)
+	}
+	ifName, err := db.netInterfaceName(deviceName)
+	if err != nil {
+		return "", err
+	}
+	db.recordHandout(context.Background(), deviceName, ifName)
+	return ifName, nil
+}
+
+// netInterfaceName implements GetNetInterfaceName.
 // For simulated devices, it re-creates the dummy interface if it was consumed
 // (moved to a pod netns) so that DRANET can retry operations idempotently.
-func (db *DB) GetNetInterfaceName(deviceName string) (string, error) {
+func (db *DB) netInterfaceName(deviceName string) (string, error) {
 	db.mu.RLock()
 	entry, ok := db.deviceStore[deviceName]
+	configured, hasConfig := db.deviceConfigs[deviceName]
+	simulated := db.simulated
+	resetting := entry.ParentDevice != "" && db.resettingPFs[entry.ParentDevice]
 	db.mu.RUnlock()
 
 	if !ok {
 		return "", fmt.Errorf("IB device %s not found in inventory", deviceName)
 	}
+	if resetting {
+		return "", fmt.Errorf("IB device %s: the VFs of %s are being re-created", deviceName, entry.ParentDevice)
+	}
+	if hasConfig {
+		if configured.err != nil {
+			return "", fmt.Errorf("IB device %s: claim config not applied: %w", deviceName, configured.err)
+		}
+		if configured.result.NetDevice != "" {
+			return configured.result.NetDevice, nil
+		}
+	}
 	if len(entry.NetDevices) == 0 {
 		return "", fmt.Errorf("IB device %s has no associated network interfaces", deviceName)
 	}
@@ -185,11 +500,8 @@ func (db *DB) GetNetInterfaceName(deviceName string) (string, error) {
 
 	// For simulated devices, ensure the dummy interface exists on the host.
 	// It may have been consumed (moved to a pod netns) on a previous attempt.
-	if db.numSimDevices > 0 {
-		if err := exec.Command("ip", "link", "show", ifName).Run(); err != nil {
-			// Re-create the dummy interface
-			createDummyInterface(context.Background(), ifName)
-		}
+	if simulated {
+		createDummyInterface(context.Background(), ifName)
 	}
 
 	return ifName, nil
@@ -197,7 +509,8 @@ func (db *DB) GetNetInterfaceName(deviceName string) (string, error) {
 
 // GetDeviceConfig returns the DRANET NetworkConfig for a device.
 // For IB devices we always return nil (no DRANET-level network config) since
-// IB configuration is handled through our own IbConfig opaque parameters.
+// IB configuration is handled through our own IbConfig opaque parameters,
+// which are applied with ApplyDeviceConfig.
 func (db *DB) GetDeviceConfig(deviceName string) (*apis.NetworkConfig, bool) {
 	return nil, false
 }
@@ -205,15 +518,25 @@ func (db *DB) GetDeviceConfig(deviceName string) (*apis.NetworkConfig, bool) {
 // AddPodNetNs stores a pod's network namespace path.
 func (db *DB) AddPodNetNs(podKey string, netNs string) {
 	db.mu.Lock()
-	defer db.mu.Unlock()
 	db.podNetNsStore[podKey] = netNs
+	db.mu.Unlock()
+	db.saveCheckpoint()
 }
 
-// RemovePodNetNs removes a pod's network namespace mapping.
+// RemovePodNetNs removes a pod's network namespace mapping. It is called on
+// pod sandbox teardown, while the namespace still exists, and returns the IB
+// devices handed to the pod to the host.
 func (db *DB) RemovePodNetNs(podKey string) {
 	db.mu.Lock()
-	defer db.mu.Unlock()
+	netNs, ok := db.podNetNsStore[podKey]
 	delete(db.podNetNsStore, podKey)
+	db.mu.Unlock()
+	db.saveCheckpoint()
+
+	if ok && netNs != "" {
+		db.returnHandouts(context.Background(), podKey, netNs)
+		db.detachAllUnusedVFs(context.Background())
+	}
 }
 
 // GetPodNetNs retrieves a pod's network namespace path.
@@ -231,26 +554,81 @@ func (db *DB) GetDeviceEntry(deviceName string) (DeviceEntry, bool) {
 	return e, ok
 }
 
+// Ports returns the IB ports of the published devices, sorted by device
+// name. It implements metrics.PortLister. In exclusive RDMA netns mode, the
+// RDMA devices handed to pods are gone from the host and from the scans; they
+// are listed with the network namespace of their pod, found by their netdev.
+func (db *DB) Ports() []metrics.Port {
+	db.mu.RLock()
+	ports := make([]metrics.Port, 0, len(db.deviceStore))
+	for _, e := range db.deviceStore {
+		ports = append(ports, metrics.Port{Device: e.DeviceName, IBDevName: e.IBDevName, PortNum: e.PortNum})
+	}
+	handouts := make(map[string]handout)
+	for device, h := range db.handouts {
+		if _, ok := db.deviceStore[device]; !ok && !h.VFIO && h.IBDevName != "" {
+			handouts[device] = h
+		}
+	}
+	podNetNs := maps.Clone(db.podNetNsStore)
+	db.mu.RUnlock()
+
+	for device, h := range handouts {
+		for _, nsPath := range podNetNs {
+			if in, err := db.links.LinkInNetns(nsPath, h.Link); err == nil && in {
+				// Older checkpoints lack the port; IB devices of
+				// mlx5 HCAs have one.
+				ports = append(ports, metrics.Port{Device: device, IBDevName: h.IBDevName, PortNum: max(h.PortNum, 1), NetNs: nsPath})
+				break
+			}
+		}
+	}
+	slices.SortFunc(ports, func(a, b metrics.Port) int { return strings.Compare(a.Device, b.Device) })
+	return ports
+}
+
+// rescan discovers all IB devices and publishes them unless the result is
+// identical to what was last published.
+func (db *DB) rescan(ctx context.Context) {
+	// Devices returned to the host may unblock deferred VF provisioning.
+	db.provisionDeferredVFs(ctx)
+
+	devices, err := db.scan(ctx)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "IB inventory: scan failed")
+		return
+	}
+	db.publish(ctx, devices)
+}
+
 // scan discovers all IB devices and returns them as DRA devices.
-func (db *DB) scan(ctx context.Context) []resourceapi.Device {
+func (db *DB) scan(ctx context.Context) (_ []resourceapi.Device, err error) {
 	logger := klog.FromContext(ctx)
 
-	ibDevices, err := ibverbs.ListDevices()
+	start := time.Now()
+	defer func() {
+		db.recordScan(err, time.Now())
+		metrics.InventoryScanDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.InventoryScanErrors.Inc()
+		} else {
+			metrics.InventoryLastScan.SetToCurrentTime()
+		}
+	}()
+
+	ibDevices, err := db.backend.ListDevices()
 	if err != nil {
-		logger.Error(err, "IB inventory: ibverbs.ListDevices failed")
-		return nil
+		return nil, fmt.Errorf("list IB devices (%s backend): %w", db.backend.Name(), err)
 	}
 
 	if len(ibDevices) == 0 {
-		logger.Info("IB inventory: no InfiniBand devices found")
-		if db.numSimDevices > 0 {
-			return db.scanSimulated(ctx)
-		}
-		return nil
+		logger.V(2).Info("IB inventory: no InfiniBand devices found")
+		db.updateStore(nil)
+		return nil, nil
 	}
 
 	// Augment with sysfs info.
-	sysfsDevices, err := sysfs.ListIBDevices()
+	sysfsDevices, err := db.sysfs.ListIBDevices()
 	if err != nil {
 		logger.Error(err, "IB inventory: sysfs.ListIBDevices failed, using ibverbs info only")
 	}
@@ -266,15 +644,43 @@ func (db *DB) scan(ctx context.Context) []resourceapi.Device {
 	var entries []DeviceEntry
 	for _, ibDev := range ibDevices {
 		si := sysfsMap[ibDev.Name]
+		var pcie *sysfs.PCIeTopology
+		if si != nil && si.PCIAddress != "" {
+			var pcieErr error
+			if pcie, pcieErr = db.sysfs.GetPCIeTopology(si.PCIAddress); pcieErr != nil {
+				logger.V(2).Info("IB inventory: cannot read PCIe topology", "device", ibDev.Name, "err", pcieErr)
+			} else if db.sysfs.Root == sysfs.DefaultRoot {
+				// deviceattribute only reads the sysfs of the host; for
+				// other trees the root complex found above is the same.
+				root, err := deviceattribute.GetPCIeRootAttributeByPCIBusID(si.PCIAddress)
+				if err != nil {
+					logger.V(2).Info("IB inventory: cannot resolve PCIe root", "device", ibDev.Name, "err", err)
+				} else if root.Value.StringValue != nil {
+					pcie.RootComplex = *root.Value.StringValue
+				}
+			}
+		}
 		for _, port := range ibDev.Ports {
 			entry := DeviceEntry{
 				DeviceName:      sanitizeDeviceName(fmt.Sprintf("%s-port%d", ibDev.Name, port.PortNum)),
 				IBDevName:       ibDev.Name,
 				PortNum:         port.PortNum,
 				LinkSpeed:       port.EffectiveSpeed(),
+				LinkRateMbps:    port.RateMbps(),
+				LinkWidth:       port.ActiveWidth.String(),
+				SpeedGeneration: port.ActiveSpeed.Generation(),
 				PortState:       port.State.String(),
+				PhysState:       port.PhysState.String(),
 				FirmwareVersion: ibDev.FirmwareVersion,
 				NodeGUID:        ibDev.NodeGUIDString(),
+				LID:             port.LID,
+				ActiveMTU:       port.ActiveMTU,
+				LinkLayer:       port.LinkLayer,
+				RDMA:            portHasRDMA(port),
+				RoCEv2GIDIndex:  port.DefaultRoCEv2GIDIndex(),
+				VendorID:        ibDev.VendorID,
+				VendorPartID:    ibDev.DeviceID,
+				Caps:            ibDev.Caps,
 				NUMANode:        -1,
 			}
 
@@ -284,7 +690,8 @@ func (db *DB) scan(ctx context.Context) []resourceapi.Device {
 			if si != nil {
 				entry.PCIAddress = si.PCIAddress
 				entry.NUMANode = si.NUMANode
-				entry.NetDevices = si.NetDevices
+				entry.NetDevices = portNetDevices(port, si.NetDevices)
+				entry.PCIe = pcie
 				if si.IsVF {
 					entry.Type = "VF"
 					if si.ParentPF != "" {
@@ -304,66 +711,43 @@ func (db *DB) scan(ctx context.Context) []resourceapi.Device {
 	}
 
 	// Update store.
-	devices := db.entriesToDevices(entries)
+	entries = db.markOnDemand(entries)
+	entries = db.withVFIOEntries(entries)
 	db.updateStore(entries)
+	devices := db.entriesToDevices(entries)
 
-	logger.Info("IB inventory scan complete", "deviceCount", len(devices))
-	return devices
+	logger.V(2).Info("IB inventory scan complete", "deviceCount", len(devices))
+	return devices, nil
 }
 
-// scanSimulated creates simulated IB devices for testing.
-// It creates real dummy network interfaces so that DRANET's netlink-based
-// prepare flow (GetNetInterfaceName → LinkByName → netns move) works.
-func (db *DB) scanSimulated(ctx context.Context) []resourceapi.Device {
-	logger := klog.FromContext(ctx)
-	logger.Info("IB inventory: creating simulated IB devices", "count", db.numSimDevices)
-
-	var entries []DeviceEntry
-
-	// Create dummy network interfaces for simulated devices.
-	// DRANET requires real netlink-resolvable interfaces to move into pod netns.
-	pfNetdev := "simib0"
-	createDummyInterface(ctx, pfNetdev)
-
-	// Simulated PF.
-	entries = append(entries, DeviceEntry{
-		DeviceName:      "sim-mlx5-0-port1",
-		IBDevName:       "sim_mlx5_0",
-		PortNum:         1,
-		Type:            "PF",
-		LinkSpeed:       "100Gb/s",
-		PortState:       "Active",
-		FirmwareVersion: "20.99.0000",
-		NodeGUID:        "0000:0000:0000:0001",
-		PortGUID:        "0000:0000:0000:0001",
-		NUMANode:        0,
-		PCIAddress:      "0000:00:00.0",
-		NetDevices:      []string{pfNetdev},
-	})
-
-	for i := 1; i <= db.numSimDevices; i++ {
-		vfNetdev := fmt.Sprintf("simib%d", i)
-		createDummyInterface(ctx, vfNetdev)
-		entries = append(entries, DeviceEntry{
-			DeviceName:      fmt.Sprintf("sim-mlx5-%d-port1", i),
-			IBDevName:       fmt.Sprintf("sim_mlx5_%d", i),
-			PortNum:         1,
-			Type:            "VF",
-			LinkSpeed:       "100Gb/s",
-			PortState:       "Active",
-			FirmwareVersion: "20.99.0000",
-			NodeGUID:        fmt.Sprintf("0000:0000:0000:%04x", i+1),
-			PortGUID:        fmt.Sprintf("0000:0000:0000:%04x", i+1),
-			NUMANode:        0,
-			PCIAddress:      fmt.Sprintf("0000:00:00.%d", i),
-			ParentDevice:    "sim_mlx5_0",
-			NetDevices:      []string{vfNetdev},
-		})
+// portHasRDMA reports whether RDMA traffic can run over a port: always on
+// InfiniBand, and on Ethernet only with RoCE GIDs. Backends that cannot read
+// the GID table still report GID 0.
+func portHasRDMA(port ibverbs.PortInfo) bool {
+	if port.LinkLayer == ibverbs.LinkLayerInfiniBand {
+		return true
 	}
+	return len(port.GIDs) > 0 || port.GID != [16]byte{}
+}
 
-	devices := db.entriesToDevices(entries)
-	db.updateStore(entries)
-	return devices
+// portNetDevices orders the netdevs of a PCI function so that the one of the
+// port comes first. On RoCE that is the netdev its GIDs belong to, which
+// matters for functions with a netdev per port.
+func portNetDevices(port ibverbs.PortInfo, netdevs []string) []string {
+	var gidNetdev string
+	for _, g := range port.GIDs {
+		if g.NetDevice != "" {
+			gidNetdev = g.NetDevice
+			break
+		}
+	}
+	i := slices.Index(netdevs, gidNetdev)
+	if gidNetdev == "" || i <= 0 {
+		return netdevs
+	}
+	ordered := []string{gidNetdev}
+	ordered = append(ordered, netdevs[:i]...)
+	return append(ordered, netdevs[i+1:]...)
 }
 
 // createDummyInterface creates a Linux dummy network interface for testing.
@@ -371,25 +755,28 @@ func (db *DB) scanSimulated(ctx context.Context) []resourceapi.Device {
 func createDummyInterface(ctx context.Context, name string) {
 	logger := klog.FromContext(ctx)
 	// Check if already exists
-	if err := exec.Command("ip", "link", "show", name).Run(); err == nil {
+	if _, err := netlink.LinkByName(name); err == nil {
 		return // already exists
 	}
-	cmd := exec.Command("ip", "link", "add", name, "type", "dummy")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		logger.Error(err, "Failed to create dummy interface", "name", name, "output", string(out))
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := netlink.LinkAdd(dummy); err != nil {
+		logger.Error(err, "Failed to create dummy interface", "name", name)
 		return
 	}
-	cmd = exec.Command("ip", "link", "set", name, "up")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		logger.Error(err, "Failed to bring up dummy interface", "name", name, "output", string(out))
+	if err := netlink.LinkSetUp(dummy); err != nil {
+		logger.Error(err, "Failed to bring up dummy interface", "name", name)
 	}
 	logger.V(2).Info("Created dummy interface", "name", name)
 }
 
 // entriesToDevices converts DeviceEntry slice to DRA Device slice.
 func (db *DB) entriesToDevices(entries []DeviceEntry) []resourceapi.Device {
+	now := time.Now()
 	var devices []resourceapi.Device
 	for _, e := range entries {
+		if e.AttachedVF {
+			continue
+		}
 		dev := resourceapi.Device{
 			Name: e.DeviceName,
 			Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
@@ -401,7 +788,7 @@ func (db *DB) entriesToDevices(entries []DeviceEntry) []resourceapi.Device {
 					StringValue: ptr.To(e.PCIAddress),
 				},
 				resourceapi.QualifiedName(apis.AttrRDMA): {
-					BoolValue: ptr.To(true),
+					BoolValue: ptr.To(e.RDMA),
 				},
 
 				// IB-specific attributes
@@ -414,6 +801,9 @@ func (db *DB) entriesToDevices(entries []DeviceEntry) []resourceapi.Device {
 				resourceapi.QualifiedName(AttrIBPortState): {
 					StringValue: ptr.To(e.PortState),
 				},
+				resourceapi.QualifiedName(AttrIBPhysState): {
+					StringValue: ptr.To(e.PhysState),
+				},
 				resourceapi.QualifiedName(AttrIBFirmwareVersion): {
 					StringValue: ptr.To(e.FirmwareVersion),
 				},
@@ -427,6 +817,7 @@ func (db *DB) entriesToDevices(entries []DeviceEntry) []resourceapi.Device {
 					StringValue: ptr.To(e.IBDevName),
 				},
 			},
+			Taints: db.deviceTaints(e, now),
 		}
 
 		// Network interface name (DRANET standard attribute).
@@ -442,45 +833,166 @@ func (db *DB) entriesToDevices(entries []DeviceEntry) []resourceapi.Device {
 			}
 		}
 
+		if e.LinkRateMbps > 0 {
+			dev.Attributes[resourceapi.QualifiedName(AttrIBLinkRateMbps)] = resourceapi.DeviceAttribute{
+				IntValue: ptr.To(e.LinkRateMbps),
+			}
+			dev.Attributes[resourceapi.QualifiedName(AttrIBLinkWidth)] = resourceapi.DeviceAttribute{
+				StringValue: ptr.To(e.LinkWidth),
+			}
+			dev.Attributes[resourceapi.QualifiedName(AttrIBSpeedGeneration)] = resourceapi.DeviceAttribute{
+				StringValue: ptr.To(e.SpeedGeneration),
+			}
+		}
+
+		if e.LinkLayer != "" {
+			dev.Attributes[resourceapi.QualifiedName(AttrIBLinkLayer)] = resourceapi.DeviceAttribute{
+				StringValue: ptr.To(e.LinkLayer),
+			}
+		}
+
+		if e.RoCEv2GIDIndex >= 0 {
+			dev.Attributes[resourceapi.QualifiedName(AttrIBRoCEv2GIDIndex)] = resourceapi.DeviceAttribute{
+				IntValue: ptr.To(int64(e.RoCEv2GIDIndex)),
+			}
+		}
+
+		if e.VendorID != 0 {
+			dev.Attributes[resourceapi.QualifiedName(AttrIBVendorID)] = resourceapi.DeviceAttribute{
+				StringValue: ptr.To(fmt.Sprintf("0x%04x", e.VendorID)),
+			}
+			dev.Attributes[resourceapi.QualifiedName(AttrIBVendorPartID)] = resourceapi.DeviceAttribute{
+				IntValue: ptr.To(int64(e.VendorPartID)),
+			}
+		}
+
+		if e.PCIe != nil {
+			addPCIeTopology(&dev, e.PCIe)
+		}
+
+		if e.Caps != nil {
+			addCapabilities(&dev, e.Caps)
+		}
+
+		if e.OnDemandVFs > 0 {
+			addVFCapacity(&dev, e.OnDemandVFs)
+		}
+
+		if db.rdmaNetnsMode != "" {
+			dev.Attributes[resourceapi.QualifiedName(AttrIBRDMANetnsMode)] = resourceapi.DeviceAttribute{
+				StringValue: ptr.To(db.rdmaNetnsMode),
+			}
+		}
+
 		devices = append(devices, dev)
 	}
 	return devices
 }
 
-// updateStore replaces the device store with the latest scan results.
+// addPCIeTopology publishes where the PCI function of a device sits in the
+// PCIe hierarchy. The root port is left out for the DRA limit of 32
+// attributes and capacities per device, which a RoCE port with all other
+// attributes reaches; the standard PCIe root attribute is what other DRA
+// drivers publish for their devices to be matched against.
+func addPCIeTopology(dev *resourceapi.Device, topo *sysfs.PCIeTopology) {
+	if topo.IOMMUGroup >= 0 {
+		dev.Attributes[resourceapi.QualifiedName(AttrIBIOMMUGroup)] = resourceapi.DeviceAttribute{
+			IntValue: ptr.To(int64(topo.IOMMUGroup)),
+		}
+	}
+	dev.Attributes[deviceattribute.StandardDeviceAttributePCIeRoot] = resourceapi.DeviceAttribute{
+		StringValue: ptr.To(topo.RootComplex),
+	}
+	if topo.Switch != "" {
+		dev.Attributes[resourceapi.QualifiedName(AttrIBPCIeSwitch)] = resourceapi.DeviceAttribute{
+			StringValue: ptr.To(topo.Switch),
+		}
+	}
+	if topo.LinkSpeed != "" {
+		dev.Attributes[resourceapi.QualifiedName(AttrIBPCIeLinkSpeed)] = resourceapi.DeviceAttribute{
+			StringValue: ptr.To(topo.LinkSpeed),
+		}
+		dev.Attributes[resourceapi.QualifiedName(AttrIBPCIeLinkWidth)] = resourceapi.DeviceAttribute{
+			IntValue: ptr.To(int64(topo.LinkWidth)),
+		}
+	}
+}
+
+// addCapabilities publishes a selection of the HCA capabilities of a device.
+// The DRA limit of 32 attributes and capacities per device leaves no room for
+// all of them.
+func addCapabilities(dev *resourceapi.Device, caps *ibverbs.DeviceCaps) {
+	dev.Attributes[resourceapi.QualifiedName(AttrIBMaxQP)] = resourceapi.DeviceAttribute{
+		IntValue: ptr.To(int64(caps.MaxQP)),
+	}
+	dev.Attributes[resourceapi.QualifiedName(AttrIBAtomicCap)] = resourceapi.DeviceAttribute{
+		StringValue: ptr.To(caps.AtomicCap.String()),
+	}
+	dev.Attributes[resourceapi.QualifiedName(AttrIBODPSupported)] = resourceapi.DeviceAttribute{
+		BoolValue: ptr.To(caps.ODP),
+	}
+	if caps.DC != nil {
+		dev.Attributes[resourceapi.QualifiedName(AttrIBDCSupported)] = resourceapi.DeviceAttribute{
+			BoolValue: ptr.To(*caps.DC),
+		}
+	}
+	dev.Attributes[resourceapi.QualifiedName(AttrIBTagMatchingSupported)] = resourceapi.DeviceAttribute{
+		BoolValue: ptr.To(caps.TagMatching),
+	}
+	if dev.Capacity == nil {
+		dev.Capacity = make(map[resourceapi.QualifiedName]resourceapi.DeviceCapacity)
+	}
+	dev.Capacity[resourceapi.QualifiedName(CapacityIBDeviceMemory)] = resourceapi.DeviceCapacity{
+		Value: *resource.NewQuantity(int64(min(caps.MaxDeviceMemory, math.MaxInt64)), resource.BinarySI),
+	}
+}
+
+// addVFCapacity lets a PF whose VFs are attached on demand be allocated many
+// times over, each allocation consuming one of its VFs, or all of them to
+// take the PF itself.
+func addVFCapacity(dev *resourceapi.Device, totalVFs int) {
+	valid := []resource.Quantity{*resource.NewQuantity(1, resource.DecimalSI)}
+	if totalVFs > 1 {
+		valid = append(valid, *resource.NewQuantity(int64(totalVFs), resource.DecimalSI))
+	}
+	dev.AllowMultipleAllocations = ptr.To(true)
+	if dev.Capacity == nil {
+		dev.Capacity = make(map[resourceapi.QualifiedName]resourceapi.DeviceCapacity)
+	}
+	dev.Capacity[resourceapi.QualifiedName(CapacityIBVFs)] = resourceapi.DeviceCapacity{
+		Value: *resource.NewQuantity(int64(totalVFs), resource.DecimalSI),
+		RequestPolicy: &resourceapi.CapacityRequestPolicy{
+			Default:     ptr.To(valid[0]),
+			ValidValues: valid,
+		},
+	}
+}
+
+// updateStore replaces the device store with the latest scan results and
+// records port health transitions for device taints.
 func (db *DB) updateStore(entries []DeviceEntry) {
+	healthCheckAt := db.updatePortHealth(entries, time.Now())
+
+	metrics.InventoryDevices.Reset()
+	for _, e := range entries {
+		metrics.InventoryDevices.WithLabelValues(e.Type, e.PortState).Inc()
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	db.deviceStore = make(map[string]DeviceEntry, len(entries))
 	for _, e := range entries {
 		db.deviceStore[e.DeviceName] = e
 	}
+	db.healthCheckAt = healthCheckAt
 }
 
-// provisionVFs auto-creates VFs on all SR-IOV capable PFs.
-func (db *DB) provisionVFs(ctx context.Context) error {
-	logger := klog.FromContext(ctx)
-
-	pfs, err := sriov.DiscoverSRIOVPFs()
-	if err != nil {
-		return fmt.Errorf("discover SR-IOV PFs: %w", err)
-	}
-	if len(pfs) == 0 {
-		logger.Info("IB inventory: no SR-IOV capable PFs found")
-		return nil
-	}
-
-	for _, pf := range pfs {
-		desired := db.numVFs
-		if desired > pf.TotalVFs {
-			desired = pf.TotalVFs
-		}
-		logger.Info("Provisioning VFs", "pf", pf.IBDevName, "pciAddr", pf.PCIAddress, "desired", desired)
-		if err := sriov.ProvisionVFs(ctx, pf.PCIAddress, desired); err != nil {
-			return fmt.Errorf("provision VFs on %s: %w", pf.PCIAddress, err)
-		}
-	}
-	return nil
+// nextHealthCheck returns when a pending link-down taint becomes due, or the
+// zero time if there is none.
+func (db *DB) nextHealthCheck() time.Time {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.healthCheckAt
 }
 
 // sanitizeDeviceName converts a device name to be RFC 1123 DNS label compliant.
@@ -0,0 +1,298 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/dranet/pkg/apis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/dynamic-resource-allocation/deviceattribute"
+	"k8s.io/utils/ptr"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+// fakeBackend is an ibverbs.Backend returning a fixed device list.
+type fakeBackend struct {
+	devices []ibverbs.DeviceInfo
+	err     error
+}
+
+func (f *fakeBackend) Name() string { return "fake" }
+
+func (f *fakeBackend) ListDevices() ([]ibverbs.DeviceInfo, error) { return f.devices, f.err }
+
+func TestScanUsesDiscoveryBackend(t *testing.T) {
+	backend := &fakeBackend{devices: []ibverbs.DeviceInfo{{
+		Name:            "mlx5_0",
+		NodeGUID:        0xec0d9a0300786a4c,
+		FirmwareVersion: "20.39.1002",
+		VendorID:        0x15b3,
+		DeviceID:        0x1021,
+		Caps: &ibverbs.DeviceCaps{
+			MaxQP:           131072,
+			AtomicCap:       ibverbs.AtomicCapHCA,
+			ODP:             true,
+			DC:              ptr.To(true),
+			MaxDeviceMemory: 128 << 10,
+		},
+		Ports: []ibverbs.PortInfo{{
+			PortNum:     1,
+			State:       ibverbs.PortStateActive,
+			PhysState:   ibverbs.PhysPortStateLinkUp,
+			ActiveSpeed: ibverbs.LinkSpeedHDR,
+			ActiveWidth: 2,
+			LinkLayer:   ibverbs.LinkLayerInfiniBand,
+		}},
+	}}}
+	db := New(WithDiscoveryBackend(backend), WithRDMANetnsMode("exclusive"))
+
+	devices, err := db.scan(context.Background())
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Equal(t, "mlx5-0-port1", devices[0].Name)
+	attrs := devices[0].Attributes
+	assert.Equal(t, "exclusive", *attrs[AttrIBRDMANetnsMode].StringValue)
+	assert.Equal(t, int64(200000), *attrs[AttrIBLinkRateMbps].IntValue)
+	assert.Equal(t, "4X", *attrs[AttrIBLinkWidth].StringValue)
+	assert.Equal(t, "HDR", *attrs[AttrIBSpeedGeneration].StringValue)
+	assert.Equal(t, "0x15b3", *attrs[AttrIBVendorID].StringValue)
+	assert.Equal(t, int64(0x1021), *attrs[AttrIBVendorPartID].IntValue)
+	assert.Equal(t, int64(131072), *attrs[AttrIBMaxQP].IntValue)
+	assert.Equal(t, "HCA", *attrs[AttrIBAtomicCap].StringValue)
+	assert.True(t, *attrs[AttrIBODPSupported].BoolValue)
+	assert.True(t, *attrs[AttrIBDCSupported].BoolValue)
+	assert.False(t, *attrs[AttrIBTagMatchingSupported].BoolValue)
+	memory := devices[0].Capacity[CapacityIBDeviceMemory].Value
+	assert.Equal(t, "128Ki", memory.String())
+	assert.LessOrEqual(t, len(attrs)+len(devices[0].Capacity), resourceapi.ResourceSliceMaxAttributesAndCapacitiesPerDevice)
+
+	entry, ok := db.GetDeviceEntry("mlx5-0-port1")
+	require.True(t, ok)
+	assert.Equal(t, "mlx5_0", entry.IBDevName)
+	assert.Equal(t, "200Gb/s", entry.LinkSpeed)
+	assert.Equal(t, "Active", entry.PortState)
+	assert.Equal(t, "ec0d9a0300786a4c", entry.NodeGUID)
+
+	// DC support is left out when it cannot be probed.
+	backend.devices[0].Caps.DC = nil
+	devices, err = db.scan(context.Background())
+	require.NoError(t, err)
+	assert.NotContains(t, devices[0].Attributes, resourceapi.QualifiedName(AttrIBDCSupported))
+
+	scanErrors := testutil.ToFloat64(metrics.InventoryScanErrors)
+	backend.err = errors.New("boom")
+	_, err = db.scan(context.Background())
+	assert.ErrorContains(t, err, "fake backend")
+	assert.Equal(t, scanErrors+1, testutil.ToFloat64(metrics.InventoryScanErrors))
+}
+
+func TestScanFixture(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX7, 0x86, 1, 0))
+
+	db := New(
+		WithDiscoveryBackend(ibverbs.NewSysfsBackend(tree.Root)),
+		WithSysfs(sysfs.New(tree.Root)),
+	)
+	devices, err := db.scan(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, devices, 4)
+
+	tests := []struct {
+		device       string
+		typ          string
+		parentDevice string
+		numaNode     int
+		pciAddress   string
+		netDevice    string
+		linkSpeed    string
+	}{
+		{device: "mlx5-0-port1", typ: "PF", numaNode: 0, pciAddress: "0000:3b:00.0", netDevice: "ibp59s0", linkSpeed: "200Gb/s"},
+		{device: "mlx5-1-port1", typ: "VF", parentDevice: "mlx5_0", numaNode: 0, pciAddress: "0000:3b:00.1", netDevice: "ibp59s0v0", linkSpeed: "200Gb/s"},
+		{device: "mlx5-2-port1", typ: "VF", parentDevice: "mlx5_0", numaNode: 0, pciAddress: "0000:3b:00.2", netDevice: "ibp59s0v1", linkSpeed: "200Gb/s"},
+		{device: "mlx5-3-port1", typ: "PF", numaNode: 1, pciAddress: "0000:86:00.0", netDevice: "ibp134s0", linkSpeed: "400Gb/s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.device, func(t *testing.T) {
+			e, ok := db.GetDeviceEntry(tt.device)
+			require.True(t, ok)
+			assert.Equal(t, tt.typ, e.Type)
+			assert.Equal(t, tt.parentDevice, e.ParentDevice)
+			assert.Equal(t, tt.numaNode, e.NUMANode)
+			assert.Equal(t, tt.pciAddress, e.PCIAddress)
+			assert.Equal(t, []string{tt.netDevice}, e.NetDevices)
+			assert.Equal(t, tt.linkSpeed, e.LinkSpeed)
+			assert.Equal(t, "Active", e.PortState)
+		})
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.InventoryDevices.WithLabelValues("VF", "Active")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.InventoryDevices.WithLabelValues("PF", "Active")))
+
+	assert.Equal(t, []metrics.Port{
+		{Device: "mlx5-0-port1", IBDevName: "mlx5_0", PortNum: 1},
+		{Device: "mlx5-1-port1", IBDevName: "mlx5_1", PortNum: 1},
+		{Device: "mlx5-2-port1", IBDevName: "mlx5_2", PortNum: 1},
+		{Device: "mlx5-3-port1", IBDevName: "mlx5_3", PortNum: 1},
+	}, db.Ports())
+}
+
+func TestScanPCIeTopology(t *testing.T) {
+	// A ConnectX-7 with a VF below a PCIe switch, and a ConnectX-6 below a
+	// root port.
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddBridge("0000:00:01.0", ""))
+	require.NoError(t, tree.AddBridge("0000:01:00.0", "0000:00:01.0"))
+	require.NoError(t, tree.AddBridge("0000:02:00.0", "0000:01:00.0"))
+	require.NoError(t, tree.AddHCABelow("0000:02:00.0", fakesysfs.ConnectX7, 0x03, 0, 1))
+	require.NoError(t, tree.AddBridge("0000:00:02.0", ""))
+	require.NoError(t, tree.AddHCABelow("0000:00:02.0", fakesysfs.ConnectX6, 0x04, 0, 0))
+
+	db := New(
+		WithDiscoveryBackend(ibverbs.NewSysfsBackend(tree.Root)),
+		WithSysfs(sysfs.New(tree.Root)),
+	)
+	devices, err := db.scan(context.Background())
+	require.NoError(t, err)
+	require.Len(t, devices, 3)
+
+	tests := []struct {
+		iommuGroup int64
+		pcieSwitch *string
+		linkSpeed  string
+	}{
+		{iommuGroup: 0, pcieSwitch: ptr.To("0000:01:00.0"), linkSpeed: "32.0 GT/s PCIe"},
+		{iommuGroup: 1, pcieSwitch: ptr.To("0000:01:00.0"), linkSpeed: "32.0 GT/s PCIe"},
+		{iommuGroup: 2, linkSpeed: "16.0 GT/s PCIe"},
+	}
+	for i, tt := range tests {
+		t.Run(devices[i].Name, func(t *testing.T) {
+			attrs := devices[i].Attributes
+			assert.Equal(t, tt.iommuGroup, *attrs[AttrIBIOMMUGroup].IntValue)
+			assert.Equal(t, "pci0000:00", *attrs[deviceattribute.StandardDeviceAttributePCIeRoot].StringValue)
+			assert.Equal(t, tt.pcieSwitch, attrs[AttrIBPCIeSwitch].StringValue)
+			assert.Equal(t, tt.linkSpeed, *attrs[AttrIBPCIeLinkSpeed].StringValue)
+			assert.Equal(t, int64(16), *attrs[AttrIBPCIeLinkWidth].IntValue)
+		})
+	}
+}
+
+func TestScanAttributeLimit(t *testing.T) {
+	// A RoCE port with capabilities, below a PCIe switch, has every
+	// attribute set.
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddBridge("0000:00:01.0", ""))
+	require.NoError(t, tree.AddBridge("0000:01:00.0", "0000:00:01.0"))
+	require.NoError(t, tree.AddBridge("0000:02:00.0", "0000:01:00.0"))
+	require.NoError(t, tree.AddHCABelow("0000:02:00.0", fakesysfs.ConnectX7, 0x03, 0, 1))
+
+	var gid [16]byte
+	copy(gid[:], net.ParseIP("fe80::a288:c2ff:fe11:2233"))
+	backend := &fakeBackend{devices: []ibverbs.DeviceInfo{{
+		Name:     "mlx5_1",
+		VendorID: 0x15b3,
+		DeviceID: 0x101e,
+		Caps:     &ibverbs.DeviceCaps{MaxQP: 131072, DC: ptr.To(true)},
+		Ports: []ibverbs.PortInfo{{
+			PortNum:     1,
+			State:       ibverbs.PortStateActive,
+			ActiveSpeed: ibverbs.LinkSpeedNDR,
+			ActiveWidth: 2,
+			LinkLayer:   ibverbs.LinkLayerEthernet,
+			GID:         gid,
+			GIDs:        []ibverbs.GIDEntry{{Index: 1, GID: gid, Type: ibverbs.GIDTypeRoCEv2, NetDevice: "ibp3s0v0"}},
+		}},
+	}}}
+	db := New(
+		WithDiscoveryBackend(backend),
+		WithSysfs(sysfs.New(tree.Root)),
+		WithRDMANetnsMode("exclusive"),
+	)
+	devices, err := db.scan(context.Background())
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Contains(t, devices[0].Attributes, resourceapi.QualifiedName(AttrIBParentDevice))
+	assert.Contains(t, devices[0].Attributes, resourceapi.QualifiedName(AttrIBPCIeSwitch))
+	assert.Contains(t, devices[0].Attributes, deviceattribute.StandardDeviceAttributePCIeRoot)
+	assert.Equal(t, resourceapi.ResourceSliceMaxAttributesAndCapacitiesPerDevice, len(devices[0].Attributes)+len(devices[0].Capacity))
+}
+
+func TestScanLinkLayers(t *testing.T) {
+	var linkLocal, ipv4 [16]byte
+	copy(linkLocal[:], net.ParseIP("fe80::a288:c2ff:fe11:2233"))
+	copy(ipv4[:], net.ParseIP("192.0.2.10").To16())
+	backend := &fakeBackend{devices: []ibverbs.DeviceInfo{{
+		Name: "mlx5_0",
+		Ports: []ibverbs.PortInfo{
+			{PortNum: 1, LinkLayer: ibverbs.LinkLayerInfiniBand},
+			{PortNum: 2, LinkLayer: ibverbs.LinkLayerEthernet, GID: linkLocal, GIDs: []ibverbs.GIDEntry{
+				{Index: 0, GID: linkLocal, Type: ibverbs.GIDTypeRoCEv1, NetDevice: "ens3f1"},
+				{Index: 1, GID: linkLocal, Type: ibverbs.GIDTypeRoCEv2, NetDevice: "ens3f1"},
+				{Index: 2, GID: ipv4, Type: ibverbs.GIDTypeRoCEv1, NetDevice: "ens3f1"},
+				{Index: 3, GID: ipv4, Type: ibverbs.GIDTypeRoCEv2, NetDevice: "ens3f1"},
+			}},
+			// RoCE disabled: no GIDs.
+			{PortNum: 3, LinkLayer: ibverbs.LinkLayerEthernet},
+		},
+	}}}
+	db := New(WithDiscoveryBackend(backend))
+	devices, err := db.scan(context.Background())
+	require.NoError(t, err)
+	require.Len(t, devices, 3)
+
+	tests := []struct {
+		linkLayer string
+		rdma      bool
+		gidIndex  *int64
+	}{
+		{linkLayer: "InfiniBand", rdma: true},
+		{linkLayer: "Ethernet", rdma: true, gidIndex: ptr.To[int64](3)},
+		{linkLayer: "Ethernet", rdma: false},
+	}
+	for i, tt := range tests {
+		t.Run(devices[i].Name, func(t *testing.T) {
+			attrs := devices[i].Attributes
+			assert.Equal(t, tt.linkLayer, *attrs[AttrIBLinkLayer].StringValue)
+			assert.Equal(t, tt.rdma, *attrs[apis.AttrRDMA].BoolValue)
+			assert.Equal(t, tt.gidIndex, attrs[AttrIBRoCEv2GIDIndex].IntValue)
+		})
+	}
+}
+
+func TestPortNetDevices(t *testing.T) {
+	roce := ibverbs.PortInfo{GIDs: []ibverbs.GIDEntry{{Type: ibverbs.GIDTypeRoCEv1, NetDevice: "ens3f1"}}}
+	assert.Equal(t, []string{"ens3f1", "ens3f0", "ens3f2"}, portNetDevices(roce, []string{"ens3f0", "ens3f1", "ens3f2"}))
+	assert.Equal(t, []string{"ens3f1", "ens3f0"}, portNetDevices(roce, []string{"ens3f1", "ens3f0"}))
+	assert.Equal(t, []string{"ens3f0"}, portNetDevices(roce, []string{"ens3f0"}), "GID netdev not on the function")
+	assert.Equal(t, []string{"ibp59s0"}, portNetDevices(ibverbs.PortInfo{}, []string{"ibp59s0"}))
+}
@@ -0,0 +1,429 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sriov"
+)
+
+// A PF whose VFs are attached on demand is published by itself, with its VFs
+// as consumable capacity. Every allocation of it is a share: one that
+// consumes all VFs takes the PF, the others get a VF each. AddShare attaches
+// the VF of a share when its claim is prepared, keyed by claim UID and share
+// ID, so that preparing it again keeps the same VF. GetNetInterfaceName hands
+// out the VF of a share that is still on the host, and RemoveShare detaches
+// it once it is back. DRANET does not tell which claim GetNetInterfaceName is
+// called for, so when the claims of several pods are prepared at the same
+// time, the VF of a share may go to the pod of another share of the PF. The
+// VFs of a PF are interchangeable, and each is handed to one pod only.
+
+// onDemandPF is a PF whose VFs are attached on demand.
+type onDemandPF struct {
+	pf    sriov.PFInfo
+	guids *sriov.GUIDPolicy
+}
+
+// provisionOnDemand sets pf up to attach its VFs on demand. VFs it already
+// has are left as they are until an allocation of the PF is released.
+func (db *DB) provisionOnDemand(ctx context.Context, pf sriov.PFInfo, rule *sriov.PolicyRule) error {
+	klog.FromContext(ctx).Info("Attaching VFs on demand", "pf", pf.IBDevName, "pciAddr", pf.PCIAddress, "current", pf.CurrentVFs, "total", pf.TotalVFs, "rule", rule.Name)
+	if err := sriov.EnableOnDemandVFs(db.sysfs, pf.PCIAddress); err != nil {
+		return fmt.Errorf("enable on-demand VFs on %s: %w", pf.PCIAddress, err)
+	}
+
+	db.mu.Lock()
+	db.onDemandPFs[pf.PCIAddress] = onDemandPF{pf: pf, guids: rule.VFGUIDs}
+	db.mu.Unlock()
+	db.clearDeferred(pf)
+	return nil
+}
+
+// markOnDemand sets the VF capacity of the PFs whose VFs are attached on
+// demand and marks their VFs as attached.
+func (db *DB) markOnDemand(entries []DeviceEntry) []DeviceEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if len(db.onDemandPFs) == 0 {
+		return entries
+	}
+
+	onDemand := make(map[string]bool)
+	for i, e := range entries {
+		if od, ok := db.onDemandPFs[e.PCIAddress]; ok && e.Type == "PF" {
+			entries[i].OnDemandVFs = od.pf.TotalVFs
+			onDemand[e.IBDevName] = true
+		}
+	}
+	for i, e := range entries {
+		if e.ParentDevice != "" && onDemand[e.ParentDevice] {
+			entries[i].AttachedVF = true
+		}
+	}
+	return entries
+}
+
+// share is an allocation share of an on-demand PF.
+type share struct {
+	// whole is set if the share consumes all VFs of the PF, and vf is the
+	// PCI address of the VF attached for it otherwise.
+	whole bool
+	vf    string
+	// handedOut orders the shares by when GetNetInterfaceName last handed
+	// out their VF, 0 if it never did.
+	handedOut uint64
+	// restored is set if the share was restored from the checkpoint and
+	// has not been added again since.
+	restored bool
+}
+
+// shareKey returns the key of an allocation share in DB.shares.
+func shareKey(claimUID types.UID, shareID string) string {
+	return string(claimUID) + "/" + shareID
+}
+
+// AddShare records an allocation share of a PF whose VFs are attached on
+// demand, and attaches a VF for it unless it consumes all VFs of the PF.
+// consumed is the capacity the share consumes. Adding a share again keeps
+// its VF, as does adding one restored from the checkpoint.
+func (db *DB) AddShare(ctx context.Context, deviceName string, claimUID types.UID, shareID string, consumed map[resourceapi.QualifiedName]resource.Quantity) error {
+	key := shareKey(claimUID, shareID)
+	if db.adoptShare(deviceName, key) {
+		return nil
+	}
+
+	entry, ok := db.GetDeviceEntry(deviceName)
+	if !ok {
+		return fmt.Errorf("IB device %s not found in inventory", deviceName)
+	}
+	if entry.OnDemandVFs == 0 {
+		return fmt.Errorf("IB device %s does not attach VFs on demand", deviceName)
+	}
+	vfs := consumed[resourceapi.QualifiedName(CapacityIBVFs)]
+
+	if vfs.Value() >= int64(entry.OnDemandVFs) {
+		db.mu.Lock()
+		if db.shares[deviceName] == nil {
+			db.shares[deviceName] = make(map[string]share)
+		}
+		db.shares[deviceName][key] = share{whole: true}
+		db.mu.Unlock()
+		db.saveCheckpoint()
+		return nil
+	}
+	return db.attachVF(ctx, entry, key)
+}
+
+// adoptShare reports whether the share with the given key of a device was
+// restored from the checkpoint, and marks it as added again if so.
+func (db *DB) adoptShare(deviceName, key string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s, ok := db.shares[deviceName][key]
+	if !ok || !s.restored {
+		return false
+	}
+	s.restored = false
+	db.shares[deviceName][key] = s
+	return true
+}
+
+// RemoveShare forgets an allocation share recorded by AddShare and detaches
+// the VFs no longer needed.
+func (db *DB) RemoveShare(ctx context.Context, deviceName string, claimUID types.UID, shareID string) error {
+	db.mu.Lock()
+	delete(db.shares[deviceName], shareKey(claimUID, shareID))
+	if len(db.shares[deviceName]) == 0 {
+		delete(db.shares, deviceName)
+	}
+	db.mu.Unlock()
+	db.saveCheckpoint()
+
+	entry, ok := db.GetDeviceEntry(deviceName)
+	if !ok || entry.OnDemandVFs == 0 {
+		return nil
+	}
+	return db.detachUnusedVFs(ctx, entry)
+}
+
+// attachVF records the share with the given key of an on-demand PF with a VF
+// of its own: the one it has if it is still attached, else an attached VF on
+// the host that no share or pod has, else a newly attached one.
+func (db *DB) attachVF(ctx context.Context, pf DeviceEntry, key string) error {
+	db.onDemandMu.Lock()
+	defer db.onDemandMu.Unlock()
+
+	db.mu.RLock()
+	od, ok := db.onDemandPFs[pf.PCIAddress]
+	prev, added := db.shares[pf.DeviceName][key]
+	taken := db.shareVFs(pf.DeviceName)
+	maps.Copy(taken, db.handedOutPCIAddresses())
+	db.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("IB device %s does not attach VFs on demand", pf.DeviceName)
+	}
+
+	attached, free, err := db.attachedVFs(pf.PCIAddress)
+	if err != nil {
+		return fmt.Errorf("list VFs of IB device %s: %w", pf.DeviceName, err)
+	}
+	if added && slices.Contains(attached, prev.vf) {
+		return nil
+	}
+
+	vf := ""
+	for _, f := range free {
+		if !taken[f] {
+			vf = f
+			break
+		}
+	}
+	if vf == "" {
+		if vf, err = sriov.AttachVF(ctx, db.sysfs, od.pf, od.guids); err != nil {
+			return fmt.Errorf("attach VF of IB device %s: %w", pf.DeviceName, err)
+		}
+	}
+
+	db.mu.Lock()
+	if db.shares[pf.DeviceName] == nil {
+		db.shares[pf.DeviceName] = make(map[string]share)
+	}
+	db.shares[pf.DeviceName][key] = share{vf: vf}
+	db.mu.Unlock()
+	db.saveCheckpoint()
+	klog.FromContext(ctx).V(2).Info("IB inventory: VF attached for share", "device", pf.DeviceName, "share", key, "vf", vf)
+	return nil
+}
+
+// detachAllUnusedVFs detaches the VFs no longer needed on every on-demand
+// PF, e.g. once a pod has returned its VF to the host.
+func (db *DB) detachAllUnusedVFs(ctx context.Context) {
+	db.mu.RLock()
+	var pfs []DeviceEntry
+	for _, e := range db.deviceStore {
+		if e.OnDemandVFs > 0 {
+			pfs = append(pfs, e)
+		}
+	}
+	db.mu.RUnlock()
+
+	for _, pf := range pfs {
+		if err := db.detachUnusedVFs(ctx, pf); err != nil {
+			klog.FromContext(ctx).Error(err, "IB inventory: failed to detach unused VFs", "device", pf.DeviceName)
+		}
+	}
+}
+
+// detachUnusedVFs detaches the attached VFs of an on-demand PF that are on
+// the host and belong to no share. The VFs are destroyed once none is
+// attached and the PF has no shares left.
+func (db *DB) detachUnusedVFs(ctx context.Context, pf DeviceEntry) error {
+	db.onDemandMu.Lock()
+	defer db.onDemandMu.Unlock()
+
+	db.mu.RLock()
+	_, ok := db.onDemandPFs[pf.PCIAddress]
+	shares := len(db.shares[pf.DeviceName])
+	needed := db.shareVFs(pf.DeviceName)
+	db.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	attached, free, err := db.attachedVFs(pf.PCIAddress)
+	if err != nil {
+		return fmt.Errorf("list VFs of IB device %s: %w", pf.DeviceName, err)
+	}
+
+	var errs []error
+	detached := 0
+	for _, vf := range free {
+		if needed[vf] {
+			continue
+		}
+		if err := sriov.DetachVF(ctx, db.sysfs, vf); err != nil {
+			errs = append(errs, fmt.Errorf("detach VF %s of IB device %s: %w", vf, pf.DeviceName, err))
+			continue
+		}
+		detached++
+		db.forgetHandouts(vf)
+	}
+	if len(errs) > 0 || detached < len(attached) || shares > 0 {
+		return errors.Join(errs...)
+	}
+
+	numVFs, err := db.sysfs.GetSRIOVNumVFs(pf.PCIAddress)
+	if err != nil || numVFs == 0 {
+		return err
+	}
+	klog.FromContext(ctx).Info("IB inventory: destroying unused on-demand VFs", "device", pf.DeviceName, "pciAddr", pf.PCIAddress, "count", numVFs)
+	if err := sriov.DestroyVFs(db.sysfs, pf.PCIAddress); err != nil {
+		return fmt.Errorf("destroy VFs of IB device %s: %w", pf.DeviceName, err)
+	}
+	return nil
+}
+
+// vfNetInterfaceName implements GetNetInterfaceName for an on-demand PF: the
+// netdev of the PF if a share takes it whole, and otherwise that of the VF of
+// a share that is still on the host. Shares never handed out go first, then
+// the one handed out longest ago, so that a retry gets the same VF unless
+// the claims of other pods are being prepared. The handout is recorded under
+// the device name of the VF.
+func (db *DB) vfNetInterfaceName(ctx context.Context, pf DeviceEntry) (string, error) {
+	db.mu.RLock()
+	shares := maps.Clone(db.shares[pf.DeviceName])
+	db.mu.RUnlock()
+
+	if len(shares) == 0 {
+		return "", fmt.Errorf("IB device %s: no allocation of it is prepared", pf.DeviceName)
+	}
+	for _, s := range shares {
+		if !s.whole {
+			continue
+		}
+		ifName, err := db.netInterfaceName(pf.DeviceName)
+		if err != nil {
+			return "", err
+		}
+		db.recordHandout(ctx, pf.DeviceName, ifName)
+		return ifName, nil
+	}
+
+	db.onDemandMu.Lock()
+	defer db.onDemandMu.Unlock()
+
+	_, free, err := db.attachedVFs(pf.PCIAddress)
+	if err != nil {
+		return "", fmt.Errorf("list VFs of IB device %s: %w", pf.DeviceName, err)
+	}
+	key, ok := nextShare(shares, free)
+	if !ok {
+		return "", fmt.Errorf("IB device %s: the VFs of all its allocations are in pods", pf.DeviceName)
+	}
+	vf := shares[key].vf
+	netdevs, err := db.sysfs.ListNetDevices(vf)
+	if err != nil {
+		return "", fmt.Errorf("IB device %s: list netdevs of VF %s: %w", pf.DeviceName, vf, err)
+	}
+	if len(netdevs) == 0 {
+		return "", fmt.Errorf("IB device %s: VF %s has no network interfaces", pf.DeviceName, vf)
+	}
+	ibDev, err := db.sysfs.FindIBDeviceByPCI(vf)
+	if err != nil {
+		return "", fmt.Errorf("IB device %s: find RDMA device of VF %s: %w", pf.DeviceName, vf, err)
+	}
+
+	db.mu.Lock()
+	db.handoutSeq++
+	if s, ok := db.shares[pf.DeviceName][key]; ok {
+		s.handedOut = db.handoutSeq
+		db.shares[pf.DeviceName][key] = s
+	}
+	db.mu.Unlock()
+
+	device := sanitizeDeviceName(fmt.Sprintf("%s-port%d", ibDev, pf.PortNum))
+	db.recordLinkHandout(ctx, device, handout{IBDevName: ibDev, PortNum: pf.PortNum, PCIAddress: vf}, netdevs[0])
+	klog.FromContext(ctx).Info("IB inventory: handing out VF", "device", pf.DeviceName, "share", key, "vf", vf, "netdev", netdevs[0])
+	return netdevs[0], nil
+}
+
+// nextShare returns the key of the share whose VF to hand out next among
+// those whose VF is in free: one never handed out, else the one handed out
+// longest ago.
+func nextShare(shares map[string]share, free []string) (string, bool) {
+	next := ""
+	for _, key := range slices.Sorted(maps.Keys(shares)) {
+		s := shares[key]
+		if s.vf == "" || !slices.Contains(free, s.vf) {
+			continue
+		}
+		if next == "" || s.handedOut < shares[next].handedOut {
+			next = key
+		}
+	}
+	return next, next != ""
+}
+
+// attachedVFs returns the VFs of a PF that are bound to a driver and, among
+// them, those whose netdev is on the host rather than in a pod.
+func (db *DB) attachedVFs(pfPCIAddr string) (attached, free []string, err error) {
+	vfs, err := db.sysfs.ListVFs(pfPCIAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, vf := range vfs {
+		driver, err := db.sysfs.GetPCIDriver(vf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if driver == "" {
+			continue
+		}
+		attached = append(attached, vf)
+		if netdevs, err := db.sysfs.ListNetDevices(vf); err == nil && len(netdevs) > 0 {
+			free = append(free, vf)
+		}
+	}
+	return attached, free, nil
+}
+
+// handedOutPCIAddresses returns the PCI addresses of the devices handed out.
+// db.mu must be held.
+func (db *DB) handedOutPCIAddresses() map[string]bool {
+	handedOut := make(map[string]bool, len(db.handouts))
+	for _, h := range db.handouts {
+		if h.PCIAddress != "" {
+			handedOut[h.PCIAddress] = true
+		}
+	}
+	return handedOut
+}
+
+// forgetHandouts drops the handouts of a detached VF. They are left over from
+// a retried GetNetInterfaceName whose netdev never went to a pod.
+func (db *DB) forgetHandouts(vfPCIAddr string) {
+	db.mu.Lock()
+	for device, h := range db.handouts {
+		if h.PCIAddress == vfPCIAddr {
+			delete(db.handouts, device)
+		}
+	}
+	db.mu.Unlock()
+	db.saveCheckpoint()
+}
+
+// shareVFs returns the VFs of the shares of an on-demand PF. db.mu must be
+// held.
+func (db *DB) shareVFs(deviceName string) map[string]bool {
+	vfs := make(map[string]bool)
+	for _, s := range db.shares[deviceName] {
+		if s.vf != "" {
+			vfs[s.vf] = true
+		}
+	}
+	return vfs
+}
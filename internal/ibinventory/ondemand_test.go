@@ -0,0 +1,182 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/netns"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sriov"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+func TestOnDemandVFs(t *testing.T) {
+	ctx := context.Background()
+	// A PF that had two VFs provisioned before it was switched to on-demand.
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	fs := sysfs.New(tree.Root)
+
+	db := New(
+		WithDiscoveryBackend(ibverbs.NewSysfsBackend(tree.Root)),
+		WithSysfs(fs),
+		WithSRIOVPolicy(&sriov.Policy{Rules: []sriov.PolicyRule{
+			{Name: "cx6", Match: sriov.PFSelector{PartIDs: []uint32{0x101b}}, OnDemand: true},
+		}}),
+	)
+	db.links = newFakeLinks(
+		netns.LinkState{Name: "ibp59s0", HardwareAddr: "00:00:00:01"},
+		netns.LinkState{Name: "ibp59s0v0", HardwareAddr: "00:00:00:02"},
+	)
+	require.NoError(t, db.provisionVFs(ctx))
+	autoprobe, err := os.ReadFile(fs.Path("bus/pci/devices/0000:3b:00.0/sriov_drivers_autoprobe"))
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(autoprobe))
+
+	// Only the PF is published, with its VFs as capacity.
+	devices, err := db.scan(ctx)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	pf := devices[0]
+	assert.Equal(t, "mlx5-0-port1", pf.Name)
+	assert.Equal(t, true, *pf.AllowMultipleAllocations)
+	vfs := pf.Capacity[CapacityIBVFs]
+	assert.Equal(t, int64(16), vfs.Value.Value())
+	require.NotNil(t, vfs.RequestPolicy)
+	assert.Equal(t, int64(1), vfs.RequestPolicy.Default.Value())
+	assert.Len(t, vfs.RequestPolicy.ValidValues, 2)
+
+	_, err = db.GetNetInterfaceName("mlx5-0-port1")
+	assert.ErrorContains(t, err, "no allocation of it is prepared")
+
+	// Preparing a share attaches a VF, which is handed to the pod.
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.1", ""))
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.2", ""))
+	oneVF := map[resourceapi.QualifiedName]resource.Quantity{CapacityIBVFs: resource.MustParse("1")}
+	require.NoError(t, db.AddShare(ctx, "mlx5-0-port1", "uid-1", "share-1", oneVF))
+	bound, err := os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/bind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.1", string(bound))
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.1", "mlx5_core"))
+
+	// Preparing it again, and retrying, keeps the VF.
+	require.NoError(t, db.AddShare(ctx, "mlx5-0-port1", "uid-1", "share-1", oneVF))
+	for range 2 {
+		ifName, err := db.GetNetInterfaceName("mlx5-0-port1")
+		require.NoError(t, err)
+		assert.Equal(t, "ibp59s0v0", ifName)
+	}
+	assert.Equal(t, handout{IBDevName: "mlx5_1", PortNum: 1, PCIAddress: "0000:3b:00.1", Link: netns.LinkState{Name: "ibp59s0v0", HardwareAddr: "00:00:00:02"}}, db.handouts["mlx5-1-port1"])
+	bound, err = os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/bind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.1", string(bound), "no other VF is attached")
+
+	// The VF stays attached while it is in the pod, even once its share is
+	// released.
+	vfNet := fs.Path("bus/pci/devices/0000:3b:00.1/net")
+	require.NoError(t, os.Rename(vfNet, vfNet+".pod"))
+	require.NoError(t, db.RemoveShare(ctx, "mlx5-0-port1", "uid-1", "share-1"))
+	unbound, err := os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/unbind"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(unbound), "0000:3b:00.1")
+
+	// Back on the host it is detached, and the VFs are destroyed.
+	require.NoError(t, os.Rename(vfNet+".pod", vfNet))
+	db.detachAllUnusedVFs(ctx)
+	unbound, err = os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/unbind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.1", string(unbound))
+	assert.Empty(t, db.handouts)
+	numVFs, err := fs.GetSRIOVNumVFs("0000:3b:00.0")
+	require.NoError(t, err)
+	assert.Equal(t, 0, numVFs)
+
+	// A share that consumes all VFs gets the PF.
+	allVFs := map[resourceapi.QualifiedName]resource.Quantity{CapacityIBVFs: resource.MustParse("16")}
+	require.NoError(t, db.AddShare(ctx, "mlx5-0-port1", "uid-2", "share-1", allVFs))
+	ifName, err := db.GetNetInterfaceName("mlx5-0-port1")
+	require.NoError(t, err)
+	assert.Equal(t, "ibp59s0", ifName)
+	assert.Contains(t, db.handouts, "mlx5-0-port1")
+}
+
+func TestOnDemandVFsOfConcurrentClaims(t *testing.T) {
+	ctx := context.Background()
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	fs := sysfs.New(tree.Root)
+
+	db := New(
+		WithDiscoveryBackend(ibverbs.NewSysfsBackend(tree.Root)),
+		WithSysfs(fs),
+		WithSRIOVPolicy(&sriov.Policy{Rules: []sriov.PolicyRule{
+			{Name: "cx6", Match: sriov.PFSelector{PartIDs: []uint32{0x101b}}, OnDemand: true},
+		}}),
+	)
+	db.links = newFakeLinks(
+		netns.LinkState{Name: "ibp59s0v0", HardwareAddr: "00:00:00:02"},
+		netns.LinkState{Name: "ibp59s0v1", HardwareAddr: "00:00:00:03"},
+	)
+	require.NoError(t, db.provisionVFs(ctx))
+	_, err = db.scan(ctx)
+	require.NoError(t, err)
+
+	// The claims of two pods are prepared before either pod starts; their
+	// shares keep the VFs that are already attached.
+	oneVF := map[resourceapi.QualifiedName]resource.Quantity{CapacityIBVFs: resource.MustParse("1")}
+	require.NoError(t, db.AddShare(ctx, "mlx5-0-port1", "uid-1", "share-1", oneVF))
+	require.NoError(t, db.AddShare(ctx, "mlx5-0-port1", "uid-2", "share-1", oneVF))
+	assert.Equal(t, share{vf: "0000:3b:00.1"}, db.shares["mlx5-0-port1"]["uid-1/share-1"])
+	assert.Equal(t, share{vf: "0000:3b:00.2"}, db.shares["mlx5-0-port1"]["uid-2/share-1"])
+
+	// Each pod gets a VF of its own, however often DRANET asks.
+	first, err := db.GetNetInterfaceName("mlx5-0-port1")
+	require.NoError(t, err)
+	second, err := db.GetNetInterfaceName("mlx5-0-port1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ibp59s0v0", "ibp59s0v1"}, []string{first, second})
+
+	// Once one VF is in a pod, the other one is handed out on every retry.
+	vfNet := fs.Path("bus/pci/devices/0000:3b:00.1/net")
+	require.NoError(t, os.Rename(vfNet, vfNet+".pod"))
+	for range 2 {
+		ifName, err := db.GetNetInterfaceName("mlx5-0-port1")
+		require.NoError(t, err)
+		assert.Equal(t, "ibp59s0v1", ifName)
+	}
+
+	require.NoError(t, os.Rename(fs.Path("bus/pci/devices/0000:3b:00.2/net"), fs.Path("bus/pci/devices/0000:3b:00.2/net.pod")))
+	_, err = db.GetNetInterfaceName("mlx5-0-port1")
+	assert.ErrorContains(t, err, "the VFs of all its allocations are in pods")
+	for _, vf := range []string{"0000:3b:00.1", "0000:3b:00.2"} {
+		driver, err := fs.GetPCIDriver(vf)
+		require.NoError(t, err)
+		assert.Equal(t, "mlx5_core", driver, vf)
+	}
+}
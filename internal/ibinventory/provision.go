@@ -0,0 +1,321 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sriov"
+)
+
+const (
+	// EventReasonVFResetDeferred is the reason of the Warning event recorded
+	// on the node when the VF count of a PF is not changed because some of
+	// its VFs are in use.
+	EventReasonVFResetDeferred = "IBVFResetDeferred"
+	// EventReasonVFsProvisioned is the reason of the Normal event recorded
+	// once deferred VF provisioning has completed.
+	EventReasonVFsProvisioned = "IBVFsProvisioned"
+)
+
+// deferredPF is a PF whose VF count is to be changed once none of its VFs
+// is in use anymore.
+type deferredPF struct {
+	desired   int
+	allocated []string
+}
+
+// provisionVFs auto-creates VFs on all SR-IOV capable PFs. PFs with VFs in
+// use are deferred until provisionDeferredVFs finds them released.
+func (db *DB) provisionVFs(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+
+	pfs, err := sriov.DiscoverSRIOVPFs(db.sysfs)
+	if err != nil {
+		return fmt.Errorf("discover SR-IOV PFs: %w", err)
+	}
+	if len(pfs) == 0 {
+		logger.Info("IB inventory: no SR-IOV capable PFs found")
+		return nil
+	}
+
+	var errs []error
+	for _, pf := range pfs {
+		if err := db.provisionPF(ctx, pf); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// provisionDeferredVFs retries the PFs deferred by provisionVFs.
+func (db *DB) provisionDeferredVFs(ctx context.Context) {
+	db.mu.RLock()
+	pending := len(db.deferredPFs)
+	db.mu.RUnlock()
+	if pending == 0 {
+		return
+	}
+
+	pfs, err := sriov.DiscoverSRIOVPFs(db.sysfs)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "IB inventory: failed to discover SR-IOV PFs")
+		return
+	}
+	for _, pf := range pfs {
+		db.mu.RLock()
+		_, deferred := db.deferredPFs[pf.PCIAddress]
+		db.mu.RUnlock()
+		if !deferred {
+			continue
+		}
+		if err := db.provisionPF(ctx, pf); err != nil {
+			klog.FromContext(ctx).Error(err, "IB inventory: failed to provision deferred VFs", "pf", pf.IBDevName)
+		}
+	}
+}
+
+// provisionPF sets the VF count of pf as decided by desiredVFs, and the GUIDs
+// of its VFs if the SR-IOV policy asks for it. Changing the count destroys
+// every VF of the PF, so it is deferred while any of them is allocated. PFs
+// whose VFs the policy attaches on demand are left to provisionOnDemand.
+func (db *DB) provisionPF(ctx context.Context, pf sriov.PFInfo) error {
+	logger := klog.FromContext(ctx)
+
+	if r := db.sriovPolicy.Match(pf); r != nil && r.OnDemand {
+		return db.provisionOnDemand(ctx, pf, r)
+	}
+
+	desired, rule, ok := db.desiredVFs(pf)
+	if !ok {
+		logger.Info("Leaving VFs as they are", "pf", pf.IBDevName, "pciAddr", pf.PCIAddress, "current", pf.CurrentVFs, "rule", rule)
+		db.clearDeferred(pf)
+		return nil
+	}
+
+	if desired != pf.CurrentVFs && pf.CurrentVFs > 0 {
+		allocated, err := db.reserveForReset(pf)
+		if err != nil {
+			return fmt.Errorf("find allocated VFs of %s: %w", pf.PCIAddress, err)
+		}
+		if len(allocated) > 0 {
+			db.deferProvisioning(ctx, pf, desired, allocated)
+			return nil
+		}
+		defer db.releaseReset(pf)
+	}
+
+	logger.Info("Provisioning VFs", "pf", pf.IBDevName, "pciAddr", pf.PCIAddress, "desired", desired, "rule", rule)
+	if err := sriov.ProvisionVFs(ctx, db.sysfs, pf.PCIAddress, desired); err != nil {
+		return fmt.Errorf("provision VFs on %s: %w", pf.PCIAddress, err)
+	}
+	if db.clearDeferred(pf) {
+		db.recordNodeEvent(corev1.EventTypeNormal, EventReasonVFsProvisioned,
+			"Provisioned %d VFs on %s (%s) now that its VFs are no longer in use", desired, pf.IBDevName, pf.PCIAddress)
+	}
+
+	if r := db.sriovPolicy.Match(pf); r != nil && r.VFGUIDs != nil {
+		if err := sriov.AssignVFGUIDs(ctx, db.sysfs, pf, r.VFGUIDs, db.vfInUse); err != nil {
+			return fmt.Errorf("assign VF GUIDs on %s: %w", pf.PCIAddress, err)
+		}
+	}
+	return nil
+}
+
+// desiredVFs returns the number of VFs to provision on pf and the name of
+// the SR-IOV policy rule that decided it, or false if pf is to be left
+// alone.
+func (db *DB) desiredVFs(pf sriov.PFInfo) (int, string, bool) {
+	desired, rule := db.numVFs, ""
+	if r := db.sriovPolicy.Match(pf); r != nil {
+		if r.Skip {
+			return 0, r.Name, false
+		}
+		desired, rule = *r.NumVFs, r.Name
+	} else if desired == 0 {
+		return 0, "", false
+	}
+	return min(desired, pf.TotalVFs), rule, true
+}
+
+// reserveForReset returns the allocated VFs of pf. If there are none, pf is
+// marked as being reset until releaseReset, so that none of its VFs is
+// handed to a pod in the meantime.
+func (db *DB) reserveForReset(pf sriov.PFInfo) ([]string, error) {
+	vfs, err := db.sysfs.ListVFs(pf.PCIAddress)
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := db.claimedVFs(pf.PCIAddress, vfs)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	allocated := db.allocatedVFs(vfs, claimed)
+	if len(allocated) == 0 {
+		db.resettingPFs[pf.IBDevName] = true
+	}
+	return allocated, nil
+}
+
+// releaseReset undoes reserveForReset.
+func (db *DB) releaseReset(pf sriov.PFInfo) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.resettingPFs, pf.IBDevName)
+}
+
+// vfInUse reports whether the VF at pciAddress is handed to a pod or
+// configured for a prepared claim. A VF whose driver cannot be read is
+// assumed to be in use.
+func (db *DB) vfInUse(pciAddress string) bool {
+	pf, err := db.sysfs.GetParentPF(pciAddress)
+	if err != nil {
+		return true
+	}
+	claimed, err := db.claimedVFs(pf, []string{pciAddress})
+	if err != nil {
+		return true
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.allocatedVFs([]string{pciAddress}, claimed)) > 0
+}
+
+// claimedVFs returns the VFs among vfs that are bound to another driver than
+// their PF, e.g. vfio-pci by the config of a claim, or whose netdev is not on
+// the host, i.e. in a pod. Handouts and deviceConfigs may be lost when the
+// plugin restarts without a checkpoint, but the binding and the netdev
+// namespace are not.
+func (db *DB) claimedVFs(pfPCIAddr string, vfs []string) ([]string, error) {
+	pfDriver, err := db.sysfs.GetPCIDriver(pfPCIAddr)
+	if err != nil {
+		return nil, err
+	}
+	var claimed []string
+	for _, vf := range vfs {
+		driver, err := db.sysfs.GetPCIDriver(vf)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case driver == "":
+		case driver != pfDriver:
+			claimed = append(claimed, vf)
+		default:
+			// Like attachedVFs, a VF of the PF driver without a netdev on
+			// the host has it moved to a pod.
+			if netdevs, err := db.sysfs.ListNetDevices(vf); err != nil || len(netdevs) == 0 {
+				claimed = append(claimed, vf)
+			}
+		}
+	}
+	return claimed, nil
+}
+
+// allocatedVFs returns the devices among the VFs with the given PCI
+// addresses that are handed to a pod or configured for a prepared claim,
+// along with the claimed VFs, by device name if they are in the inventory
+// and by PCI address otherwise. db.mu must be held.
+func (db *DB) allocatedVFs(vfs, claimed []string) []string {
+	isVF := func(device, pciAddress string) bool {
+		if pciAddress == "" {
+			pciAddress = db.deviceStore[device].PCIAddress
+		}
+		return pciAddress != "" && slices.Contains(vfs, pciAddress)
+	}
+
+	var devices []string
+	for device, h := range db.handouts {
+		if isVF(device, h.PCIAddress) {
+			devices = append(devices, device)
+		}
+	}
+	for device := range db.deviceConfigs {
+		if isVF(device, "") {
+			devices = append(devices, device)
+		}
+	}
+	for _, pciAddress := range claimed {
+		devices = append(devices, db.deviceAt(pciAddress))
+	}
+	slices.Sort(devices)
+	return slices.Compact(devices)
+}
+
+// deviceAt returns the name of the device at pciAddress, or pciAddress if it
+// is not in the inventory. db.mu must be held.
+func (db *DB) deviceAt(pciAddress string) string {
+	for name, e := range db.deviceStore {
+		if e.PCIAddress == pciAddress {
+			return name
+		}
+	}
+	return pciAddress
+}
+
+// deferProvisioning records that the VF count of pf is to be changed to
+// desired once the allocated VFs are released. The node event is only
+// recorded when the PF becomes blocked or the count or VFs change.
+func (db *DB) deferProvisioning(ctx context.Context, pf sriov.PFInfo, desired int, allocated []string) {
+	d := deferredPF{desired: desired, allocated: allocated}
+	db.mu.Lock()
+	prev, ok := db.deferredPFs[pf.PCIAddress]
+	db.deferredPFs[pf.PCIAddress] = d
+	db.mu.Unlock()
+
+	metrics.VFResetBlocked.WithLabelValues(pf.PCIAddress).Set(float64(len(allocated)))
+	if ok && prev.desired == d.desired && slices.Equal(prev.allocated, d.allocated) {
+		return
+	}
+	klog.FromContext(ctx).Info("IB inventory: deferring VF provisioning while VFs are in use",
+		"pf", pf.IBDevName, "pciAddr", pf.PCIAddress, "current", pf.CurrentVFs, "desired", desired, "allocated", allocated)
+	db.recordNodeEvent(corev1.EventTypeWarning, EventReasonVFResetDeferred,
+		"Not changing the VF count of %s (%s) from %d to %d while VFs are in use: %s",
+		pf.IBDevName, pf.PCIAddress, pf.CurrentVFs, desired, strings.Join(allocated, ", "))
+}
+
+// clearDeferred forgets that pf was deferred and reports whether it was.
+func (db *DB) clearDeferred(pf sriov.PFInfo) bool {
+	db.mu.Lock()
+	_, ok := db.deferredPFs[pf.PCIAddress]
+	delete(db.deferredPFs, pf.PCIAddress)
+	db.mu.Unlock()
+
+	if ok {
+		metrics.VFResetBlocked.WithLabelValues(pf.PCIAddress).Set(0)
+	}
+	return ok
+}
+
+// recordNodeEvent records an event on the node if an event recorder is set.
+func (db *DB) recordNodeEvent(eventType, reason, messageFmt string, args ...any) {
+	if db.recorder == nil {
+		return
+	}
+	db.recorder.Eventf(db.nodeRef, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sriov"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+func TestDesiredVFs(t *testing.T) {
+	policy := &sriov.Policy{Rules: []sriov.PolicyRule{
+		{Name: "storage", Match: sriov.PFSelector{PCIAddresses: []string{"0000:86:00.0"}}, Skip: true},
+		{Name: "cx7", Match: sriov.PFSelector{PartIDs: []uint32{0x1021}}, NumVFs: ptr.To(8)},
+	}}
+	cx6 := sriov.PFInfo{PCIAddress: "0000:3b:00.0", PartID: 0x101b, TotalVFs: 16}
+	cx7 := sriov.PFInfo{PCIAddress: "0000:5e:00.0", PartID: 0x1021, TotalVFs: 4}
+	storage := sriov.PFInfo{PCIAddress: "0000:86:00.0", PartID: 0x1021, TotalVFs: 16}
+
+	tests := []struct {
+		name          string
+		numVFs        int
+		policy        *sriov.Policy
+		pf            sriov.PFInfo
+		wantVFs       int
+		wantRule      string
+		wantProvision bool
+	}{
+		{name: "no policy", numVFs: 4, pf: cx6, wantVFs: 4, wantProvision: true},
+		{name: "no policy, capped", numVFs: 20, pf: cx6, wantVFs: 16, wantProvision: true},
+		{name: "nothing to do", pf: cx6},
+		{name: "unmatched PF falls back to numVFs", numVFs: 2, policy: policy, pf: cx6, wantVFs: 2, wantProvision: true},
+		{name: "unmatched PF without numVFs", policy: policy, pf: cx6},
+		{name: "rule capped at total VFs", numVFs: 2, policy: policy, pf: cx7, wantVFs: 4, wantRule: "cx7", wantProvision: true},
+		{name: "skipped", numVFs: 2, policy: policy, pf: storage, wantRule: "storage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := New(WithNumVFs(tt.numVFs), WithSRIOVPolicy(tt.policy))
+			n, rule, ok := db.desiredVFs(tt.pf)
+			assert.Equal(t, tt.wantVFs, n)
+			assert.Equal(t, tt.wantRule, rule)
+			assert.Equal(t, tt.wantProvision, ok)
+		})
+	}
+}
+
+func TestProvisionVFsDefersWhileVFsInUse(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX7, 0x86, 1, 0))
+	fs := sysfs.New(tree.Root)
+
+	recorder := record.NewFakeRecorder(10)
+	db := New(
+		WithSysfs(fs),
+		WithEventRecorder(recorder, "node-a"),
+		WithSRIOVPolicy(&sriov.Policy{Rules: []sriov.PolicyRule{
+			{Name: "storage", Match: sriov.PFSelector{PartIDs: []uint32{0x1021}}, Skip: true},
+			{Name: "compute", Match: sriov.PFSelector{IBDevNames: []string{"mlx5_*"}}, NumVFs: ptr.To(4)},
+		}}),
+	)
+	// One VF is in a pod, the other is configured for a prepared claim.
+	db.handouts["mlx5-1-port1"] = handout{IBDevName: "mlx5_1", PCIAddress: "0000:3b:00.1"}
+	db.deviceStore["mlx5-2-port1"] = DeviceEntry{DeviceName: "mlx5-2-port1", PCIAddress: "0000:3b:00.2"}
+	db.deviceConfigs["mlx5-2-port1"] = deviceConfig{}
+
+	require.NoError(t, db.provisionVFs(context.Background()))
+	for pf, want := range map[string]int{"0000:3b:00.0": 2, "0000:86:00.0": 0} {
+		n, err := fs.GetSRIOVNumVFs(pf)
+		require.NoError(t, err)
+		assert.Equal(t, want, n, pf)
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.VFResetBlocked.WithLabelValues("0000:3b:00.0")))
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Warning IBVFResetDeferred Not changing the VF count of mlx5_0 (0000:3b:00.0) from 2 to 4 while VFs are in use: mlx5-1-port1, mlx5-2-port1", <-recorder.Events)
+
+	// Retrying while nothing changed doesn't repeat the event.
+	db.provisionDeferredVFs(context.Background())
+	assert.Empty(t, recorder.Events)
+
+	// Once the VFs are released and the PF is at the desired count, the
+	// deferral is over.
+	delete(db.handouts, "mlx5-1-port1")
+	delete(db.deviceConfigs, "mlx5-2-port1")
+	require.NoError(t, os.WriteFile(filepath.Join(tree.Root, "bus/pci/devices/0000:3b:00.0/sriov_numvfs"), []byte("4"), 0o644))
+	db.provisionDeferredVFs(context.Background())
+	assert.Empty(t, db.deferredPFs)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.VFResetBlocked.WithLabelValues("0000:3b:00.0")))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Normal IBVFsProvisioned Provisioned 4 VFs on mlx5_0")
+}
+
+func TestProvisionVFsDefersWhileVFsBoundElsewhere(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	fs := sysfs.New(tree.Root)
+
+	// After a restart, nothing tells that a VF bound to vfio-pci for a
+	// prepared claim is in use but the binding.
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.2", "vfio-pci"))
+	recorder := record.NewFakeRecorder(10)
+	db := New(WithSysfs(fs), WithEventRecorder(recorder, "node-a"), WithNumVFs(4))
+	assert.False(t, db.vfInUse("0000:3b:00.1"))
+	assert.True(t, db.vfInUse("0000:3b:00.2"))
+
+	require.NoError(t, db.provisionVFs(context.Background()))
+	n, err := fs.GetSRIOVNumVFs("0000:3b:00.0")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "while VFs are in use: 0000:3b:00.2")
+
+	// Unbound on-demand VFs are not in use.
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.2", ""))
+	assert.False(t, db.vfInUse("0000:3b:00.2"))
+}
+
+func TestProvisionVFsDefersWhileNetdevInPod(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	fs := sysfs.New(tree.Root)
+
+	// After a restart without a checkpoint, nothing tells that a VF is
+	// handed to a pod but its netdev being gone from the host.
+	vfNet := fs.Path("bus/pci/devices/0000:3b:00.1/net")
+	require.NoError(t, os.Rename(vfNet, vfNet+".pod"))
+	recorder := record.NewFakeRecorder(10)
+	db := New(WithSysfs(fs), WithEventRecorder(recorder, "node-a"), WithNumVFs(4))
+	assert.True(t, db.vfInUse("0000:3b:00.1"))
+	assert.False(t, db.vfInUse("0000:3b:00.2"))
+
+	require.NoError(t, db.provisionVFs(context.Background()))
+	n, err := fs.GetSRIOVNumVFs("0000:3b:00.0")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "while VFs are in use: 0000:3b:00.1")
+
+	require.NoError(t, os.Rename(vfNet+".pod", vfNet))
+	assert.False(t, db.vfInUse("0000:3b:00.1"))
+}
+
+func TestNoHandoutsWhileResetting(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+
+	db := New(
+		WithDiscoveryBackend(ibverbs.NewSysfsBackend(tree.Root)),
+		WithSysfs(sysfs.New(tree.Root)),
+	)
+	_, err = db.scan(context.Background())
+	require.NoError(t, err)
+
+	pfs, err := sriov.DiscoverSRIOVPFs(db.sysfs)
+	require.NoError(t, err)
+	require.Len(t, pfs, 1)
+	allocated, err := db.reserveForReset(pfs[0])
+	require.NoError(t, err)
+	assert.Empty(t, allocated)
+
+	_, err = db.netInterfaceName("mlx5-1-port1")
+	assert.ErrorContains(t, err, "the VFs of mlx5_0 are being re-created")
+	_, err = db.netInterfaceName("mlx5-0-port1")
+	assert.NoError(t, err, "the PF itself is not reset")
+
+	db.releaseReset(pfs[0])
+	_, err = db.netInterfaceName("mlx5-1-port1")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,464 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibconfig"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/netns"
+)
+
+// handout records a netdev handed to a pod and the RDMA device that goes
+// with it. PCIAddress, the address of the device, and PortNum, its port, are
+// empty in checkpoints written by older versions. VFIO is set for the
+// placeholder netdev of a VF bound to vfio-pci, which has no RDMA device.
+type handout struct {
+	IBDevName  string          `json:"ibDevName"`
+	PortNum    int             `json:"portNum,omitempty"`
+	PCIAddress string          `json:"pciAddress,omitempty"`
+	VFIO       bool            `json:"vfio,omitempty"`
+	Link       netns.LinkState `json:"link"`
+}
+
+// checkpoint is the content of the checkpoint file.
+type checkpoint struct {
+	// Handouts is keyed by DRA device name.
+	Handouts map[string]handout `json:"handouts"`
+	// PodNetNs maps pod keys to network namespace paths.
+	PodNetNs map[string]string `json:"podNetNs"`
+	// Configs holds the claim configs applied to devices, keyed by DRA
+	// device name.
+	Configs map[string]savedConfig `json:"configs,omitempty"`
+	// Shares holds the allocation shares of on-demand PFs, keyed by DRA
+	// device name and shareKey.
+	Shares map[string]map[string]savedShare `json:"shares,omitempty"`
+}
+
+// savedConfig records a claim config applied to a device.
+type savedConfig struct {
+	ClaimUID types.UID        `json:"claimUID"`
+	Result   *ibconfig.Result `json:"result"`
+	// Entry is the inventory entry of a VF bound to vfio-pci, which scans
+	// do not find until it is bound back to mlx5_core.
+	Entry *DeviceEntry `json:"entry,omitempty"`
+}
+
+// savedShare records an allocation share of an on-demand PF.
+type savedShare struct {
+	Whole bool   `json:"whole,omitempty"`
+	VF    string `json:"vf,omitempty"`
+}
+
+// hostLinks moves netdevs and RDMA devices between pod network namespaces
+// and the host, and manages the placeholder netdevs of VFs bound to
+// vfio-pci. It is faked in tests.
+type hostLinks interface {
+	AddDummy(name string) error
+	DeleteDummy(name string) error
+	GetLinkState(name string) (netns.LinkState, error)
+	RestoreLink(ctx context.Context, state netns.LinkState) (bool, error)
+	LinkInNetns(nsPath string, state netns.LinkState) (bool, error)
+	ReturnNetdevToHost(ctx context.Context, nsPath string, state netns.LinkState) (bool, error)
+	ReturnRDMADevToHost(ctx context.Context, nsPath, rdmaDev string) (bool, error)
+}
+
+// netnsLinks implements hostLinks with the netns package.
+type netnsLinks struct{}
+
+func (netnsLinks) AddDummy(name string) error {
+	if _, err := netlink.LinkByName(name); err == nil {
+		return nil
+	}
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := netlink.LinkAdd(dummy); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(dummy)
+}
+
+func (netnsLinks) DeleteDummy(name string) error {
+	link, err := netlink.LinkByName(name)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return netlink.LinkDel(link)
+}
+
+func (netnsLinks) GetLinkState(name string) (netns.LinkState, error) {
+	return netns.GetLinkState(name)
+}
+
+func (netnsLinks) RestoreLink(ctx context.Context, state netns.LinkState) (bool, error) {
+	return netns.RestoreLink(ctx, state)
+}
+
+func (netnsLinks) LinkInNetns(nsPath string, state netns.LinkState) (bool, error) {
+	return netns.LinkInNetns(nsPath, state)
+}
+
+func (netnsLinks) ReturnNetdevToHost(ctx context.Context, nsPath string, state netns.LinkState) (bool, error) {
+	return netns.ReturnNetdevToHost(ctx, nsPath, state)
+}
+
+func (netnsLinks) ReturnRDMADevToHost(ctx context.Context, nsPath, rdmaDev string) (bool, error) {
+	return netns.ReturnRDMADevToHost(ctx, nsPath, rdmaDev)
+}
+
+// recordHandout records the state of the netdev of a device before DRANET
+// moves it into a pod.
+func (db *DB) recordHandout(ctx context.Context, deviceName, ifName string) {
+	db.mu.RLock()
+	entry := db.deviceStore[deviceName]
+	db.mu.RUnlock()
+	db.recordLinkHandout(ctx, deviceName, handout{IBDevName: entry.IBDevName, PortNum: entry.PortNum, PCIAddress: entry.PCIAddress}, ifName)
+}
+
+// recordLinkHandout records h, with the state of netdev ifName, as handed out
+// for a device.
+func (db *DB) recordLinkHandout(ctx context.Context, deviceName string, h handout, ifName string) {
+	db.mu.RLock()
+	prev, ok := db.handouts[deviceName]
+	db.mu.RUnlock()
+	// On a retry the netdev may already be in the pod; keep what was
+	// recorded while it was still on the host.
+	if ok && prev.Link.Name == ifName {
+		return
+	}
+
+	state, err := db.links.GetLinkState(ifName)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "IB inventory: netdev will not be returned to the host after use", "device", deviceName, "netdev", ifName)
+		return
+	}
+
+	db.mu.Lock()
+	h.Link = state
+	db.handouts[deviceName] = h
+	db.mu.Unlock()
+	db.saveCheckpoint()
+}
+
+// returnHandouts moves the netdevs and RDMA devices handed out to the pod
+// with network namespace netNs back to the host, restoring the original
+// netdev name and admin state. VFs bound to vfio-pci are bound back to
+// mlx5_core instead, see releaseVFIO.
+func (db *DB) returnHandouts(ctx context.Context, podKey, netNs string) {
+	logger := klog.FromContext(ctx)
+
+	db.mu.RLock()
+	handouts := maps.Clone(db.handouts)
+	db.mu.RUnlock()
+
+	for device, h := range handouts {
+		start := time.Now()
+		found, err := db.links.ReturnNetdevToHost(ctx, netNs, h.Link)
+		observeReturn(metrics.KindNetdev, start, found, err)
+		if err != nil {
+			logger.Error(err, "IB inventory: failed to return netdev to the host", "device", device, "netdev", h.Link.Name, "pod", podKey)
+		}
+		if !found {
+			continue
+		}
+		if h.VFIO {
+			db.releaseVFIO(ctx, device, h)
+		} else {
+			start = time.Now()
+			moved, err := db.links.ReturnRDMADevToHost(ctx, netNs, h.IBDevName)
+			observeReturn(metrics.KindRDMA, start, moved, err)
+			if err != nil {
+				logger.Error(err, "IB inventory: failed to return RDMA device to the host", "device", device, "rdmaDev", h.IBDevName, "pod", podKey)
+			}
+		}
+		logger.Info("IB inventory: returned device to the host", "device", device, "netdev", h.Link.Name, "pod", podKey)
+
+		db.mu.Lock()
+		delete(db.handouts, device)
+		db.mu.Unlock()
+		db.saveCheckpoint()
+	}
+}
+
+// observeReturn records the duration or failure of returning a device of kind
+// to the host, started at start, unless the device was not in the pod.
+func observeReturn(kind string, start time.Time, moved bool, err error) {
+	switch {
+	case err != nil:
+		metrics.NetnsReturnFailures.WithLabelValues(kind).Inc()
+	case moved:
+		metrics.NetnsReturnDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	}
+}
+
+// reconcileHandouts loads the checkpoint and returns to the host the devices
+// of pods that went away while the plugin was not running. When a network
+// namespace is destroyed the kernel moves physical netdevs back to the host
+// by itself, but possibly under another name and down, so only their name
+// and admin state need to be restored.
+func (db *DB) reconcileHandouts(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	cp, ok := db.readCheckpoint(logger)
+	if !ok {
+		return
+	}
+
+	podNetNs := make(map[string]string)
+	for podKey, nsPath := range cp.PodNetNs {
+		if _, err := os.Stat(nsPath); err == nil {
+			podNetNs[podKey] = nsPath
+		}
+	}
+
+	handouts := make(map[string]handout)
+	for device, h := range cp.Handouts {
+		if inUse(db.links, podNetNs, h) {
+			handouts[device] = h
+			continue
+		}
+		restored, err := db.links.RestoreLink(ctx, h.Link)
+		switch {
+		case err != nil:
+			logger.Error(err, "IB inventory: failed to restore orphaned netdev", "device", device, "netdev", h.Link.Name)
+		case restored:
+			logger.Info("IB inventory: restored orphaned netdev", "device", device, "netdev", h.Link.Name)
+		default:
+			logger.Info("IB inventory: netdev handed to a pod is gone", "device", device, "netdev", h.Link.Name, "hardwareAddr", h.Link.HardwareAddr)
+		}
+	}
+
+	db.mu.Lock()
+	maps.Copy(db.podNetNsStore, podNetNs)
+	maps.Copy(db.handouts, handouts)
+	db.mu.Unlock()
+	db.saveCheckpoint()
+}
+
+// readCheckpoint reads the checkpoint file, if there is one.
+func (db *DB) readCheckpoint(logger klog.Logger) (checkpoint, bool) {
+	if db.checkpointPath == "" {
+		return checkpoint{}, false
+	}
+	data, err := os.ReadFile(db.checkpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint{}, false
+	} else if err != nil {
+		logger.Error(err, "IB inventory: failed to read checkpoint", "path", db.checkpointPath)
+		return checkpoint{}, false
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		logger.Error(err, "IB inventory: ignoring corrupt checkpoint", "path", db.checkpointPath)
+		return checkpoint{}, false
+	}
+	return cp, true
+}
+
+// restoreClaims loads the claim configs and allocation shares from the
+// checkpoint, so that the ones of claims released while the plugin was not
+// running can be undone: IPoIB children deleted, VFs bound back to mlx5_core
+// and detached. They are marked as restored until the claim tracker applies
+// or adds them again for a claim that still holds them, and ReleaseRestored
+// releases the others. It is called by New, before the tracker starts.
+func (db *DB) restoreClaims() {
+	cp, ok := db.readCheckpoint(klog.Background())
+	if !ok {
+		return
+	}
+	for device, saved := range cp.Configs {
+		if saved.Result == nil {
+			continue
+		}
+		db.deviceConfigs[device] = deviceConfig{result: saved.Result, claimUID: saved.ClaimUID, restored: true}
+		if saved.Entry != nil {
+			db.deviceStore[device] = *saved.Entry
+		}
+	}
+	for device, shares := range cp.Shares {
+		db.shares[device] = make(map[string]share, len(shares))
+		for key, s := range shares {
+			db.shares[device][key] = share{whole: s.Whole, vf: s.VF, restored: true}
+		}
+	}
+}
+
+// RestoredClaims returns the UIDs of the claims whose configs or allocation
+// shares were restored from the checkpoint and have not been applied or added
+// again since.
+func (db *DB) RestoredClaims() []types.UID {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	claims := make(map[types.UID]bool)
+	for _, configured := range db.deviceConfigs {
+		if configured.restored {
+			claims[configured.claimUID] = true
+		}
+	}
+	for _, shares := range db.shares {
+		for key, s := range shares {
+			if s.restored {
+				claimUID, _, _ := strings.Cut(key, "/")
+				claims[types.UID(claimUID)] = true
+			}
+		}
+	}
+	return slices.Sorted(maps.Keys(claims))
+}
+
+// ReleaseRestored releases the configs and allocation shares restored from
+// the checkpoint that have not been applied or added again since, those of
+// claims released while the plugin was not running.
+func (db *DB) ReleaseRestored(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+
+	type restoredShare struct{ device, key string }
+	db.mu.RLock()
+	var devices []string
+	for device, configured := range db.deviceConfigs {
+		if configured.restored {
+			devices = append(devices, device)
+		}
+	}
+	var shares []restoredShare
+	for device, deviceShares := range db.shares {
+		for key, s := range deviceShares {
+			if s.restored {
+				shares = append(shares, restoredShare{device: device, key: key})
+			}
+		}
+	}
+	db.mu.RUnlock()
+
+	var errs []error
+	for _, device := range devices {
+		if err := db.ReleaseDeviceConfig(ctx, device); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info("IB inventory: released config of a claim released while not running", "device", device)
+	}
+	for _, s := range shares {
+		claimUID, shareID, _ := strings.Cut(s.key, "/")
+		if err := db.RemoveShare(ctx, s.device, types.UID(claimUID), shareID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info("IB inventory: removed share of a claim released while not running", "device", s.device, "share", s.key)
+	}
+	return errors.Join(errs...)
+}
+
+// inUse reports whether the netdev of h is in the network namespace of one of
+// the pods.
+func inUse(links hostLinks, podNetNs map[string]string, h handout) bool {
+	for _, nsPath := range podNetNs {
+		if in, err := links.LinkInNetns(nsPath, h.Link); err == nil && in {
+			return true
+		}
+	}
+	return false
+}
+
+// saveCheckpoint writes the checkpoint file. The state is encoded under db.mu
+// and written outside of it, so that a slow disk does not hold up the
+// inventory; checkpointMu keeps the last state written last. The caller must
+// not hold db.mu.
+func (db *DB) saveCheckpoint() {
+	if db.checkpointPath == "" {
+		return
+	}
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+
+	db.mu.RLock()
+	data, err := json.Marshal(db.currentCheckpoint())
+	db.mu.RUnlock()
+	if err == nil {
+		err = writeFileAtomic(db.checkpointPath, data)
+	}
+	if err != nil {
+		klog.Background().Error(err, "IB inventory: failed to write checkpoint", "path", db.checkpointPath)
+	}
+}
+
+// currentCheckpoint returns the state to write to the checkpoint file. Configs
+// that were rejected leave nothing to undo and are not saved. db.mu must be
+// held.
+func (db *DB) currentCheckpoint() checkpoint {
+	cp := checkpoint{Handouts: db.handouts, PodNetNs: db.podNetNsStore}
+	for device, configured := range db.deviceConfigs {
+		if configured.result == nil {
+			continue
+		}
+		saved := savedConfig{ClaimUID: configured.claimUID, Result: configured.result}
+		if entry, ok := db.deviceStore[device]; ok && configured.result.VFIO != nil {
+			saved.Entry = &entry
+		}
+		if cp.Configs == nil {
+			cp.Configs = make(map[string]savedConfig)
+		}
+		cp.Configs[device] = saved
+	}
+	for device, shares := range db.shares {
+		if cp.Shares == nil {
+			cp.Shares = make(map[string]map[string]savedShare)
+		}
+		cp.Shares[device] = make(map[string]savedShare, len(shares))
+		for key, s := range shares {
+			cp.Shares[device][key] = savedShare{Whole: s.whole, VF: s.vf}
+		}
+	}
+	return cp
+}
+
+// writeFileAtomic replaces path with data, so that a crash leaves either the
+// old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/netns"
+)
+
+// fakeLinks tracks which network namespace each netdev, identified by
+// hardware address, is in. The host is "".
+type fakeLinks struct {
+	host     map[string]netns.LinkState
+	netnsOf  map[string]string
+	restored []string
+	rdma     []string
+	// rdmaErr fails the returns of RDMA devices.
+	rdmaErr error
+	// dummies are the names of the dummy netdevs on the host.
+	dummies []string
+}
+
+func newFakeLinks(states ...netns.LinkState) *fakeLinks {
+	l := &fakeLinks{host: make(map[string]netns.LinkState), netnsOf: make(map[string]string)}
+	for _, s := range states {
+		l.host[s.Name] = s
+		l.netnsOf[s.HardwareAddr] = ""
+	}
+	return l
+}
+
+func (l *fakeLinks) AddDummy(name string) error {
+	if _, ok := l.host[name]; !ok {
+		l.host[name] = netns.LinkState{Name: name, HardwareAddr: "dummy-" + name, Up: true}
+		l.netnsOf["dummy-"+name] = ""
+		l.dummies = append(l.dummies, name)
+	}
+	return nil
+}
+
+func (l *fakeLinks) DeleteDummy(name string) error {
+	s, ok := l.host[name]
+	if !ok || l.netnsOf[s.HardwareAddr] != "" {
+		return nil
+	}
+	delete(l.host, name)
+	delete(l.netnsOf, s.HardwareAddr)
+	l.dummies = slices.DeleteFunc(l.dummies, func(d string) bool { return d == name })
+	return nil
+}
+
+func (l *fakeLinks) GetLinkState(name string) (netns.LinkState, error) {
+	s, ok := l.host[name]
+	if !ok {
+		return netns.LinkState{}, os.ErrNotExist
+	}
+	return s, nil
+}
+
+func (l *fakeLinks) RestoreLink(_ context.Context, state netns.LinkState) (bool, error) {
+	ns, ok := l.netnsOf[state.HardwareAddr]
+	if !ok || ns != "" {
+		return false, nil
+	}
+	l.restored = append(l.restored, state.Name)
+	return true, nil
+}
+
+func (l *fakeLinks) LinkInNetns(nsPath string, state netns.LinkState) (bool, error) {
+	ns, ok := l.netnsOf[state.HardwareAddr]
+	return ok && ns == nsPath, nil
+}
+
+func (l *fakeLinks) ReturnNetdevToHost(ctx context.Context, nsPath string, state netns.LinkState) (bool, error) {
+	if in, _ := l.LinkInNetns(nsPath, state); !in {
+		return false, nil
+	}
+	l.netnsOf[state.HardwareAddr] = ""
+	return l.RestoreLink(ctx, state)
+}
+
+func (l *fakeLinks) ReturnRDMADevToHost(_ context.Context, _ string, rdmaDev string) (bool, error) {
+	if l.rdmaErr != nil {
+		return false, l.rdmaErr
+	}
+	l.rdma = append(l.rdma, rdmaDev)
+	return true, nil
+}
+
+var (
+	linkA = netns.LinkState{Name: "ibp59s0v0", HardwareAddr: "00:00:01:07:fe:80:00:00:00:00:00:00:ec:0d:9a:03:00:3b:00:02", Up: true}
+	linkB = netns.LinkState{Name: "ibp59s0v1", HardwareAddr: "00:00:01:07:fe:80:00:00:00:00:00:00:ec:0d:9a:03:00:3b:00:03", Up: false}
+)
+
+func readCheckpoint(t *testing.T, path string) checkpoint {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var cp checkpoint
+	require.NoError(t, json.Unmarshal(data, &cp))
+	return cp
+}
+
+// returnCount returns the number of successful returns of devices of kind to
+// the host.
+func returnCount(t *testing.T, kind string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, metrics.NetnsReturnDuration.WithLabelValues(kind).(prometheus.Metric).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestReturnDevicesOnPodTeardown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	links := newFakeLinks(linkA, linkB)
+	db := New(WithCheckpointFile(path))
+	db.links = links
+	db.deviceStore["mlx5-1-port1"] = DeviceEntry{DeviceName: "mlx5-1-port1", IBDevName: "mlx5_1", NetDevices: []string{"ibp59s0v0"}}
+	db.deviceStore["mlx5-2-port1"] = DeviceEntry{DeviceName: "mlx5-2-port1", IBDevName: "mlx5_2", NetDevices: []string{"ibp59s0v1"}}
+
+	// DRANET resolves the netdev, then moves it into the pod.
+	db.AddPodNetNs("default/pod-a", "/var/run/netns/pod-a")
+	_, err := db.GetNetInterfaceName("mlx5-1-port1")
+	require.NoError(t, err)
+	links.netnsOf[linkA.HardwareAddr] = "/var/run/netns/pod-a"
+
+	cp := readCheckpoint(t, path)
+	assert.Equal(t, map[string]handout{"mlx5-1-port1": {IBDevName: "mlx5_1", Link: linkA}}, cp.Handouts)
+	assert.Equal(t, map[string]string{"default/pod-a": "/var/run/netns/pod-a"}, cp.PodNetNs)
+
+	// Tearing down another pod leaves the device alone.
+	db.AddPodNetNs("default/pod-b", "/var/run/netns/pod-b")
+	db.RemovePodNetNs("default/pod-b")
+	assert.Equal(t, "/var/run/netns/pod-a", links.netnsOf[linkA.HardwareAddr])
+
+	netdevReturns, rdmaReturns := returnCount(t, metrics.KindNetdev), returnCount(t, metrics.KindRDMA)
+	db.RemovePodNetNs("default/pod-a")
+	assert.Empty(t, links.netnsOf[linkA.HardwareAddr])
+	assert.Equal(t, []string{"ibp59s0v0"}, links.restored)
+	assert.Equal(t, []string{"mlx5_1"}, links.rdma)
+	assert.Equal(t, netdevReturns+1, returnCount(t, metrics.KindNetdev))
+	assert.Equal(t, rdmaReturns+1, returnCount(t, metrics.KindRDMA))
+
+	cp = readCheckpoint(t, path)
+	assert.Empty(t, cp.Handouts)
+	assert.Empty(t, cp.PodNetNs)
+}
+
+func TestPortsOfDevicesInPods(t *testing.T) {
+	links := newFakeLinks(linkA, linkB)
+	db := New()
+	db.links = links
+	db.deviceStore["mlx5-1-port1"] = DeviceEntry{DeviceName: "mlx5-1-port1", IBDevName: "mlx5_1", PortNum: 1, NetDevices: []string{"ibp59s0v0"}}
+	db.deviceStore["mlx5-2-port1"] = DeviceEntry{DeviceName: "mlx5-2-port1", IBDevName: "mlx5_2", PortNum: 1, NetDevices: []string{"ibp59s0v1"}}
+	db.AddPodNetNs("default/pod-a", "/var/run/netns/pod-a")
+	_, err := db.GetNetInterfaceName("mlx5-1-port1")
+	require.NoError(t, err)
+	links.netnsOf[linkA.HardwareAddr] = "/var/run/netns/pod-a"
+
+	// In exclusive RDMA netns mode the next scan no longer finds the device
+	// handed to the pod; its counters are in the pod.
+	delete(db.deviceStore, "mlx5-1-port1")
+	assert.Equal(t, []metrics.Port{
+		{Device: "mlx5-1-port1", IBDevName: "mlx5_1", PortNum: 1, NetNs: "/var/run/netns/pod-a"},
+		{Device: "mlx5-2-port1", IBDevName: "mlx5_2", PortNum: 1},
+	}, db.Ports())
+}
+
+func TestReturnFailureObserved(t *testing.T) {
+	links := newFakeLinks(linkA)
+	links.rdmaErr = errors.New("device busy")
+	db := New()
+	db.links = links
+	db.deviceStore["mlx5-1-port1"] = DeviceEntry{DeviceName: "mlx5-1-port1", IBDevName: "mlx5_1", NetDevices: []string{"ibp59s0v0"}}
+
+	db.AddPodNetNs("default/pod-a", "/var/run/netns/pod-a")
+	_, err := db.GetNetInterfaceName("mlx5-1-port1")
+	require.NoError(t, err)
+	links.netnsOf[linkA.HardwareAddr] = "/var/run/netns/pod-a"
+
+	failures := metrics.NetnsReturnFailures.WithLabelValues(metrics.KindRDMA)
+	before := testutil.ToFloat64(failures)
+	db.RemovePodNetNs("default/pod-a")
+	assert.Equal(t, before+1, testutil.ToFloat64(failures))
+	assert.Empty(t, links.netnsOf[linkA.HardwareAddr], "the netdev is returned regardless")
+}
+
+func TestReconcileHandouts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint.json")
+	liveNs := filepath.Join(dir, "pod-a")
+	require.NoError(t, os.WriteFile(liveNs, nil, 0o644))
+
+	data, err := json.Marshal(checkpoint{
+		Handouts: map[string]handout{
+			"mlx5-1-port1": {IBDevName: "mlx5_1", Link: linkA},
+			"mlx5-2-port1": {IBDevName: "mlx5_2", Link: linkB},
+		},
+		PodNetNs: map[string]string{
+			"default/pod-a": liveNs,
+			"default/pod-b": filepath.Join(dir, "pod-b"),
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	// Pod A is still running with device 1; pod B went away while the
+	// plugin was down and the kernel returned device 2 to the host.
+	links := newFakeLinks()
+	links.netnsOf[linkA.HardwareAddr] = liveNs
+	links.netnsOf[linkB.HardwareAddr] = ""
+
+	db := New(WithCheckpointFile(path))
+	db.links = links
+	db.reconcileHandouts(context.Background())
+
+	assert.Equal(t, []string{"ibp59s0v1"}, links.restored)
+	assert.Equal(t, liveNs, db.GetPodNetNs("default/pod-a"))
+	assert.Empty(t, db.GetPodNetNs("default/pod-b"))
+	cp := readCheckpoint(t, path)
+	assert.Equal(t, map[string]handout{"mlx5-1-port1": {IBDevName: "mlx5_1", Link: linkA}}, cp.Handouts)
+}
+
+func TestSharesRestoredAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	data, err := json.Marshal(checkpoint{
+		Shares: map[string]map[string]savedShare{
+			"mlx5-0-port1": {
+				"uid-1/share-1": {VF: "0000:3b:00.1"},
+				"uid-2/share-1": {VF: "0000:3b:00.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+
+	db := New(WithCheckpointFile(path))
+	assert.Equal(t, []types.UID{"uid-1", "uid-2"}, db.RestoredClaims())
+
+	// The share of a claim still allocated keeps its VF, and the one of a
+	// claim released while the plugin was down is removed.
+	require.NoError(t, db.AddShare(ctx, "mlx5-0-port1", "uid-1", "share-1", nil))
+	assert.Equal(t, []types.UID{"uid-2"}, db.RestoredClaims())
+	require.NoError(t, db.ReleaseRestored(ctx))
+	assert.Empty(t, db.RestoredClaims())
+	assert.Equal(t, map[string]share{"uid-1/share-1": {vf: "0000:3b:00.1"}}, db.shares["mlx5-0-port1"])
+	cp := readCheckpoint(t, path)
+	assert.Equal(t, map[string]map[string]savedShare{"mlx5-0-port1": {"uid-1/share-1": {VF: "0000:3b:00.1"}}}, cp.Shares)
+}
+
+func TestCheckpointWrittenOutsideLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	db := New(WithCheckpointFile(path))
+
+	// While a checkpoint write is stuck, the inventory stays usable.
+	db.checkpointMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.AddPodNetNs("default/pod-a", "/var/run/netns/pod-a")
+	}()
+	assert.Eventually(t, func() bool {
+		return db.GetPodNetNs("default/pod-a") != ""
+	}, time.Second, 10*time.Millisecond)
+	_, ok := db.GetDeviceEntry("mlx5-1-port1")
+	assert.False(t, ok)
+
+	db.checkpointMu.Unlock()
+	<-done
+	cp := readCheckpoint(t, path)
+	assert.Equal(t, map[string]string{"default/pod-a": "/var/run/netns/pod-a"}, cp.PodNetNs)
+}
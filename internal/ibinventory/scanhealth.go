@@ -0,0 +1,83 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"fmt"
+	"time"
+)
+
+// scanFailureThreshold is how many scans in a row must fail before the
+// inventory is reported unhealthy.
+const scanFailureThreshold = 3
+
+// scanHealth records the outcome of the scans of the inventory loop.
+type scanHealth struct {
+	// started is when Run started and lastSuccess when a scan last
+	// succeeded.
+	started     time.Time
+	lastSuccess time.Time
+	// failures counts the scans that failed since lastSuccess, the last
+	// one with lastErr.
+	failures int
+	lastErr  error
+}
+
+// recordScan records the outcome of a scan that ended at now.
+func (db *DB) recordScan(err error, now time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err != nil {
+		db.scans.failures++
+		db.scans.lastErr = err
+		return
+	}
+	db.scans.lastSuccess = now
+	db.scans.failures = 0
+	db.scans.lastErr = nil
+}
+
+// CheckScans returns an error if the inventory loop is not keeping the
+// published devices up to date: no scan has succeeded within staleness, or
+// since Run started if there has not been one yet, or the last few scans
+// failed. It returns nil until Run starts.
+func (db *DB) CheckScans(staleness time.Duration) error {
+	return db.checkScans(staleness, time.Now())
+}
+
+func (db *DB) checkScans(staleness time.Duration, now time.Time) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s := db.scans
+	if s.started.IsZero() {
+		return nil
+	}
+	if s.failures >= scanFailureThreshold {
+		return fmt.Errorf("last %d IB inventory scans failed: %w", s.failures, s.lastErr)
+	}
+	since := s.lastSuccess
+	if since.IsZero() {
+		since = s.started
+	}
+	if age := now.Sub(since); age > staleness {
+		if s.lastSuccess.IsZero() {
+			return fmt.Errorf("no IB inventory scan completed in the %v since startup", age.Truncate(time.Second))
+		}
+		return fmt.Errorf("last IB inventory scan completed %v ago", age.Truncate(time.Second))
+	}
+	return nil
+}
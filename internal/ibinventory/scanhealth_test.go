@@ -0,0 +1,68 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckScans(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	boom := errors.New("ibv_get_device_list: no such device")
+
+	tests := []struct {
+		name     string
+		started  bool
+		success  bool
+		failures int
+		now      time.Time
+		wantErr  string
+	}{
+		{name: "not running", now: start.Add(time.Hour)},
+		{name: "first scan pending", started: true, now: start.Add(time.Minute)},
+		{name: "first scan overdue", started: true, now: start.Add(11 * time.Minute), wantErr: "no IB inventory scan completed in the 11m0s since startup"},
+		{name: "fresh", started: true, success: true, now: start.Add(5 * time.Minute)},
+		{name: "stale", started: true, success: true, now: start.Add(20 * time.Minute), wantErr: "last IB inventory scan completed 20m0s ago"},
+		{name: "occasional failure", started: true, success: true, failures: 2, now: start.Add(time.Minute)},
+		{name: "failing", started: true, success: true, failures: 3, now: start.Add(time.Minute), wantErr: "last 3 IB inventory scans failed: ibv_get_device_list: no such device"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := New()
+			if tt.started {
+				db.scans.started = start
+			}
+			if tt.success {
+				db.recordScan(nil, start)
+			}
+			for range tt.failures {
+				db.recordScan(boom, start)
+			}
+
+			err := db.checkScans(10*time.Minute, tt.now)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+// setupSimulation switches discovery to a fake sysfs tree generated from the
+// simulated topology, unless real IB devices are present. The returned
+// function removes the tree.
+func (db *DB) setupSimulation(ctx context.Context) (func(), error) {
+	logger := klog.FromContext(ctx)
+
+	if devices, err := db.backend.ListDevices(); err == nil && len(devices) > 0 {
+		logger.Info("IB inventory: real IB devices found, not simulating", "deviceCount", len(devices))
+		return func() {}, nil
+	}
+
+	root, err := os.MkdirTemp("", "dra-ib-sim-sysfs-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(root) }
+
+	netdevs, err := db.useSimulatedTree(root)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	// DRANET requires real netlink-resolvable interfaces to move into pod
+	// netns, so back every simulated netdev with a dummy interface.
+	for _, netdev := range netdevs {
+		createDummyInterface(ctx, netdev)
+	}
+	logger.Info("IB inventory: simulating IB devices", "sysfsRoot", root, "netdevCount", len(netdevs))
+	return cleanup, nil
+}
+
+// useSimulatedTree generates the simulated topology below root and points
+// discovery at it. It returns the netdevs of the simulated devices.
+func (db *DB) useSimulatedTree(root string) ([]string, error) {
+	tree, err := fakesysfs.New(root)
+	if err != nil {
+		return nil, err
+	}
+	netdevs, err := tree.AddTopology(db.simTopology)
+	if err != nil {
+		return nil, fmt.Errorf("generate fake sysfs: %w", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.backend = ibverbs.NewSysfsBackend(root)
+	db.sysfs = sysfs.New(root)
+	db.simulated = true
+	return netdevs, nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+)
+
+func TestSimulatedTopology(t *testing.T) {
+	topo := &fakesysfs.Topology{HCAs: []fakesysfs.TopologyHCA{
+		{
+			Model:      "ConnectX-7",
+			PCIAddress: "0000:3b:00.0",
+			NUMANode:   0,
+			Ports:      []fakesysfs.TopologyPort{{}, {State: "Down"}},
+			NumVFs:     1,
+		},
+		{
+			PCIAddress: "0000:86:00.0",
+			NUMANode:   1,
+			Ports:      []fakesysfs.TopologyPort{{Speed: "EDR", Width: "1X"}},
+		},
+	}}
+	require.NoError(t, topo.Validate())
+
+	db := New(WithDiscoveryBackend(&fakeBackend{}), WithSimTopology(topo))
+	netdevs, err := db.useSimulatedTree(t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"simib0", "simib1", "simib2", "simib3", "simib4"}, netdevs)
+
+	devices, err := db.scan(context.Background())
+	require.NoError(t, err)
+	require.Len(t, devices, 5)
+
+	tests := []struct {
+		device     string
+		typ        string
+		parent     string
+		pciAddress string
+		numaNode   int
+		linkSpeed  string
+		portState  string
+		tainted    bool
+	}{
+		{device: "sim-mlx5-0-port1", typ: "PF", pciAddress: "0000:3b:00.0", numaNode: 0, linkSpeed: "400Gb/s", portState: "Active"},
+		{device: "sim-mlx5-1-port1", typ: "PF", pciAddress: "0000:3b:00.1", numaNode: 0, linkSpeed: "400Gb/s", portState: "Down", tainted: true},
+		{device: "sim-mlx5-2-port1", typ: "VF", parent: "sim_mlx5_0", pciAddress: "0000:3b:00.2", numaNode: 0, linkSpeed: "400Gb/s", portState: "Active"},
+		{device: "sim-mlx5-3-port1", typ: "VF", parent: "sim_mlx5_1", pciAddress: "0000:3b:00.3", numaNode: 0, linkSpeed: "400Gb/s", portState: "Down", tainted: true},
+		{device: "sim-mlx5-4-port1", typ: "PF", pciAddress: "0000:86:00.0", numaNode: 1, linkSpeed: "25Gb/s", portState: "Active"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.device, func(t *testing.T) {
+			e, ok := db.GetDeviceEntry(tt.device)
+			require.True(t, ok)
+			assert.Equal(t, tt.typ, e.Type)
+			assert.Equal(t, tt.parent, e.ParentDevice)
+			assert.Equal(t, tt.pciAddress, e.PCIAddress)
+			assert.Equal(t, tt.numaNode, e.NUMANode)
+			assert.Equal(t, tt.linkSpeed, e.LinkSpeed)
+			assert.Equal(t, tt.portState, e.PortState)
+			assert.Equal(t, tt.tainted, len(db.deviceTaints(e, time.Now())) > 0)
+		})
+	}
+}
+
+func TestSimulatedDefaultTopology(t *testing.T) {
+	db := New(WithDiscoveryBackend(&fakeBackend{}), WithNumSimDevices(2))
+	netdevs, err := db.useSimulatedTree(t.TempDir())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"simib0", "simib1", "simib2"}, netdevs)
+
+	_, err = db.scan(context.Background())
+	require.NoError(t, err)
+
+	pf, ok := db.GetDeviceEntry("sim-mlx5-0-port1")
+	require.True(t, ok)
+	assert.Equal(t, "PF", pf.Type)
+	assert.Equal(t, "100Gb/s", pf.LinkSpeed)
+	assert.Equal(t, "20.99.0000", pf.FirmwareVersion)
+	assert.Equal(t, []string{"simib0"}, pf.NetDevices)
+
+	vf, ok := db.GetDeviceEntry("sim-mlx5-2-port1")
+	require.True(t, ok)
+	assert.Equal(t, "VF", vf.Type)
+	assert.Equal(t, "sim_mlx5_0", vf.ParentDevice)
+	assert.Equal(t, "0000:00:00.2", vf.PCIAddress)
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"fmt"
+
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+)
+
+// DeviceStatus describes an allocated device for the status of its claim: the
+// IB details of the port with the P_Key and MTU programmed by the claim
+// config, or the IOMMU group of a VF bound to vfio-pci. The netdev handed to
+// the pod is reported by DRANET.
+func (db *DB) DeviceStatus(deviceName string) (*configapi.IbDeviceStatus, error) {
+	db.mu.RLock()
+	entry, ok := db.deviceStore[deviceName]
+	configured := db.deviceConfigs[deviceName]
+	fs := db.sysfs
+	db.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("IB device %s not found in inventory", deviceName)
+	}
+
+	status := configapi.NewIbDeviceStatus()
+	status.IBDevName = entry.IBDevName
+	status.Port = entry.PortNum
+	status.LID = entry.LID
+	status.PortGID = entry.PortGUID
+	status.NodeGUID = entry.NodeGUID
+	status.MTU = configapi.IbMTU(entry.ActiveMTU)
+	status.LinkLayer = entry.LinkLayer
+	if entry.RoCEv2GIDIndex >= 0 {
+		status.RoCEv2GIDIndex = ptr.To(entry.RoCEv2GIDIndex)
+	}
+
+	pkeyIndex := 0
+	if res := configured.result; res != nil {
+		if res.PkeyIndex >= 0 {
+			pkeyIndex = res.PkeyIndex
+		}
+		if res.MTU != 0 {
+			status.MTU = res.MTU
+		}
+		if res.VFIO != nil {
+			status.IOMMUGroup = ptr.To(res.VFIO.IOMMUGroup)
+		}
+	}
+	if pkeys, err := fs.GetPkeyTable(entry.IBDevName, entry.PortNum); err == nil && pkeyIndex < len(pkeys) {
+		status.Pkey = pkeys[pkeyIndex]
+	}
+	return status, nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/utils/ptr"
+
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibconfig"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+func TestDeviceStatus(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 1))
+	require.NoError(t, os.WriteFile(filepath.Join(tree.Root, "class/infiniband/mlx5_1/ports/1/pkeys/1"), []byte("0x8001"), 0o644))
+
+	db := New(WithSysfs(sysfs.New(tree.Root)))
+	db.deviceStore["mlx5-1-port1"] = DeviceEntry{
+		DeviceName: "mlx5-1-port1",
+		IBDevName:  "mlx5_1",
+		PortNum:    1,
+		PortGUID:   "fe80:0000:0000:0000:ec0d:9a03:003b:0002",
+		NodeGUID:   "ec0d9a03003b0002",
+		LID:        0x1a,
+		ActiveMTU:  4096,
+		LinkLayer:  "InfiniBand",
+		RDMA:       true,
+		NetDevices: []string{"ibp59s0v0"},
+
+		RoCEv2GIDIndex: -1,
+	}
+
+	_, err = db.DeviceStatus("mlx5-9-port1")
+	assert.ErrorContains(t, err, "not found in inventory")
+
+	status, err := db.DeviceStatus("mlx5-1-port1")
+	require.NoError(t, err)
+	want := configapi.NewIbDeviceStatus()
+	want.IBDevName = "mlx5_1"
+	want.Port = 1
+	want.LID = 0x1a
+	want.PortGID = "fe80:0000:0000:0000:ec0d:9a03:003b:0002"
+	want.NodeGUID = "ec0d9a03003b0002"
+	want.Pkey = 0xffff
+	want.MTU = configapi.MTU4096
+	want.LinkLayer = "InfiniBand"
+	assert.Equal(t, want, status)
+
+	// The claim config selects the P_Key and the MTU.
+	db.deviceConfigs["mlx5-1-port1"] = deviceConfig{result: &ibconfig.Result{NetDevice: "ibp59s0v0.8001", PkeyIndex: 1, MTU: configapi.MTU2048}}
+	status, err = db.DeviceStatus("mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(0x8001), status.Pkey)
+	assert.Equal(t, configapi.MTU2048, status.MTU)
+
+	// A rejected config leaves the port's defaults.
+	db.RejectDeviceConfig("mlx5-1-port1", errors.New("pkey 0x8002 is not in the P_Key table"))
+	status, err = db.DeviceStatus("mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Equal(t, "mlx5_1", status.IBDevName)
+	assert.Equal(t, uint16(0xffff), status.Pkey)
+	assert.Equal(t, configapi.MTU4096, status.MTU)
+}
+
+func TestDeviceStatusRoCE(t *testing.T) {
+	db := New()
+	db.deviceStore["mlx5-1-port1"] = DeviceEntry{
+		DeviceName: "mlx5-1-port1",
+		IBDevName:  "mlx5_1",
+		PortNum:    1,
+		LinkLayer:  "Ethernet",
+		RDMA:       true,
+		NetDevices: []string{"ens3f0v0"},
+
+		RoCEv2GIDIndex: 3,
+	}
+
+	status, err := db.DeviceStatus("mlx5-1-port1")
+	require.NoError(t, err)
+	assert.Equal(t, "Ethernet", status.LinkLayer)
+	assert.Equal(t, ptr.To(3), status.RoCEv2GIDIndex)
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"time"
+
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+)
+
+const (
+	// TaintIBPortNotActive is set with effect NoSchedule on devices whose IB
+	// port is not in the Active state. Its value is the port state.
+	TaintIBPortNotActive = "dra.net/ibPortNotActive"
+	// TaintIBLinkDown is set with effect NoExecute on devices whose physical
+	// link has been down for longer than the configured grace period. Its
+	// value is the physical port state.
+	TaintIBLinkDown = "dra.net/ibLinkDown"
+
+	defaultLinkDownGracePeriod = 5 * time.Minute
+)
+
+// portHealth records since when a device has been observed unhealthy, so
+// that the taints published for it keep a stable TimeAdded across scans.
+type portHealth struct {
+	notActiveSince time.Time
+	linkDownSince  time.Time
+}
+
+// linkDown reports whether the physical link of the port is lost or in an
+// error state, as opposed to merely not being configured by the SM yet.
+func linkDown(e DeviceEntry) bool {
+	switch e.PhysState {
+	case ibverbs.PhysPortStateDisabled.String(),
+		ibverbs.PhysPortStateLinkErrorRecovery.String(),
+		ibverbs.PhysPortStatePhyTest.String():
+		return true
+	case ibverbs.PhysPortStateLinkUp.String():
+		return false
+	}
+	// Sleep/Polling/Training, or unknown: the link is only considered down
+	// once the logical port state agrees.
+	return e.PortState != ibverbs.PortStateActive.String()
+}
+
+// updatePortHealth records the health transitions observed in a scan and
+// returns the earliest time at which a pending NoExecute taint becomes due,
+// or the zero time if there is none.
+func (db *DB) updatePortHealth(entries []DeviceEntry, now time.Time) time.Time {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	health := make(map[string]portHealth, len(entries))
+	var next time.Time
+	for _, e := range entries {
+		h := db.portHealth[e.DeviceName]
+		if e.PortState == ibverbs.PortStateActive.String() {
+			h.notActiveSince = time.Time{}
+		} else if h.notActiveSince.IsZero() {
+			h.notActiveSince = now
+		}
+		if !linkDown(e) {
+			h.linkDownSince = time.Time{}
+		} else if h.linkDownSince.IsZero() {
+			h.linkDownSince = now
+		}
+		if !h.linkDownSince.IsZero() {
+			due := h.linkDownSince.Add(db.linkDownGracePeriod)
+			if due.After(now) && (next.IsZero() || due.Before(next)) {
+				next = due
+			}
+		}
+		health[e.DeviceName] = h
+	}
+	db.portHealth = health
+	return next
+}
+
+// deviceTaints returns the DRA device taints for an entry based on the health
+// recorded by updatePortHealth.
+func (db *DB) deviceTaints(e DeviceEntry, now time.Time) []resourceapi.DeviceTaint {
+	db.mu.RLock()
+	h := db.portHealth[e.DeviceName]
+	db.mu.RUnlock()
+
+	var taints []resourceapi.DeviceTaint
+	if !h.notActiveSince.IsZero() {
+		taints = append(taints, resourceapi.DeviceTaint{
+			Key:       TaintIBPortNotActive,
+			Value:     e.PortState,
+			Effect:    resourceapi.DeviceTaintEffectNoSchedule,
+			TimeAdded: &metav1.Time{Time: h.notActiveSince.Truncate(time.Second)},
+		})
+	}
+	if !h.linkDownSince.IsZero() {
+		due := h.linkDownSince.Add(db.linkDownGracePeriod)
+		if !due.After(now) {
+			taints = append(taints, resourceapi.DeviceTaint{
+				Key:       TaintIBLinkDown,
+				Value:     e.PhysState,
+				Effect:    resourceapi.DeviceTaintEffectNoExecute,
+				TimeAdded: &metav1.Time{Time: due.Truncate(time.Second)},
+			})
+		}
+	}
+	return taints
+}
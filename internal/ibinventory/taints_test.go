@@ -0,0 +1,69 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	resourceapi "k8s.io/api/resource/v1"
+)
+
+func TestDeviceTaints(t *testing.T) {
+	db := New(WithLinkDownGracePeriod(time.Minute))
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	healthy := DeviceEntry{DeviceName: "mlx5-0-port1", PortState: "Active", PhysState: "LinkUp"}
+	initPort := DeviceEntry{DeviceName: "mlx5-0-port1", PortState: "Init", PhysState: "LinkUp"}
+	down := DeviceEntry{DeviceName: "mlx5-0-port1", PortState: "Down", PhysState: "Polling"}
+
+	db.updatePortHealth([]DeviceEntry{healthy}, start)
+	assert.Empty(t, db.deviceTaints(healthy, start))
+
+	// Waiting for the SM: NoSchedule only, no matter how long it lasts.
+	next := db.updatePortHealth([]DeviceEntry{initPort}, start)
+	assert.True(t, next.IsZero())
+	taints := db.deviceTaints(initPort, start.Add(time.Hour))
+	require.Len(t, taints, 1)
+	assert.Equal(t, TaintIBPortNotActive, taints[0].Key)
+	assert.Equal(t, "Init", taints[0].Value)
+	assert.Equal(t, resourceapi.DeviceTaintEffectNoSchedule, taints[0].Effect)
+
+	// Link lost: NoExecute once the grace period has passed, with a
+	// TimeAdded that doesn't move between scans.
+	now := start.Add(10 * time.Second)
+	next = db.updatePortHealth([]DeviceEntry{down}, now)
+	assert.Equal(t, now.Add(time.Minute), next)
+	assert.Len(t, db.deviceTaints(down, now), 1)
+
+	later := now.Add(2 * time.Minute)
+	next = db.updatePortHealth([]DeviceEntry{down}, later)
+	assert.True(t, next.IsZero())
+	taints = db.deviceTaints(down, later)
+	require.Len(t, taints, 2)
+	assert.Equal(t, start, taints[0].TimeAdded.Time, "NoSchedule taint keeps its original time")
+	assert.Equal(t, TaintIBLinkDown, taints[1].Key)
+	assert.Equal(t, resourceapi.DeviceTaintEffectNoExecute, taints[1].Effect)
+	assert.Equal(t, now.Add(time.Minute), taints[1].TimeAdded.Time)
+
+	// Recovery clears everything.
+	db.updatePortHealth([]DeviceEntry{healthy}, later)
+	assert.Empty(t, db.deviceTaints(healthy, later))
+}
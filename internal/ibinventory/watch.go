@@ -0,0 +1,231 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ueventGroupKernel is the multicast group on which the kernel emits
+	// kobject uevents (as opposed to udev's re-broadcast on group 2).
+	ueventGroupKernel = 1
+	// rdmaNLGroupNotify is RDMA_NL_GROUP_NOTIFY from <rdma/rdma_netlink.h>.
+	// The kernel publishes RDMA device register/unregister and netdev
+	// attach/detach notifications on it.
+	rdmaNLGroupNotify = 4
+
+	// netlinkRecvBufSize is large enough for a single uevent or RDMA netlink
+	// notification.
+	netlinkRecvBufSize = 16 * 1024
+)
+
+// watchEvents subscribes to the kernel notifications that indicate the IB
+// inventory may have changed and signals trigger whenever a relevant one
+// arrives. The sources are:
+//
+//   - kobject uevents for the infiniband, net and pci subsystems, which cover
+//     hot-plugged HCAs and VFs appearing or disappearing after a write to
+//     sriov_numvfs;
+//   - RDMA netlink notifications for RDMA device (un)registration;
+//   - rtnetlink link updates for netdevs in the inventory, whose carrier
+//     follows the IB port state.
+//
+// Events only trigger a rescan and are not mapped to the devices they are
+// about. A full scan is cheap: one pass over sysfs or verbs for the few
+// devices of a node, with the DC probe cached per device, and bursts are
+// debounced into a single scan. Scoping it would not save much, because an
+// event about one device changes the attributes of others: a write to
+// sriov_numvfs adds or removes VFs and changes the ibVFs capacity of their
+// PF, and ibParentDevice and ibPCIeSwitch relate devices to each other.
+// Dropped events (ENOBUFS) also need a full scan. publish only sends the
+// ResourceSlice when a device changed.
+//
+// It returns false if no source could be opened, in which case the caller
+// should rely on polling alone.
+func (db *DB) watchEvents(ctx context.Context, trigger chan<- struct{}) bool {
+	logger := klog.FromContext(ctx)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	sources := 0
+
+	if fd, err := netlinkSubscribe(unix.NETLINK_KOBJECT_UEVENT, ueventGroupKernel); err != nil {
+		logger.Error(err, "IB inventory: cannot subscribe to kobject uevents")
+	} else {
+		sources++
+		go readNetlink(ctx, fd, func(msg []byte) {
+			if msg == nil {
+				notify()
+				return
+			}
+			ev := parseUevent(msg)
+			if relevantUevent(ev) {
+				logger.V(4).Info("IB inventory: uevent", "action", ev["ACTION"], "subsystem", ev["SUBSYSTEM"], "devpath", ev["DEVPATH"])
+				notify()
+			}
+		})
+	}
+
+	if fd, err := netlinkSubscribe(unix.NETLINK_RDMA, rdmaNLGroupNotify); err != nil {
+		// RDMA_NL_GROUP_NOTIFY only exists on recent kernels.
+		logger.V(2).Info("IB inventory: RDMA netlink notifications unavailable", "err", err)
+	} else {
+		sources++
+		go readNetlink(ctx, fd, func([]byte) {
+			logger.V(4).Info("IB inventory: RDMA netlink notification")
+			notify()
+		})
+	}
+
+	updates := make(chan netlink.LinkUpdate, 64)
+	err := netlink.LinkSubscribeWithOptions(updates, ctx.Done(), netlink.LinkSubscribeOptions{
+		ErrorCallback: func(err error) {
+			logger.V(2).Info("IB inventory: rtnetlink subscription error", "err", err)
+		},
+	})
+	if err != nil {
+		logger.Error(err, "IB inventory: cannot subscribe to rtnetlink link updates")
+	} else {
+		sources++
+		go func() {
+			for u := range updates {
+				if u.Link == nil {
+					continue
+				}
+				name := u.Link.Attrs().Name
+				if db.hasNetDevice(name) {
+					logger.V(4).Info("IB inventory: link update", "netdev", name, "operState", u.Link.Attrs().OperState.String())
+					notify()
+				}
+			}
+		}()
+	}
+
+	return sources > 0
+}
+
+// hasNetDevice reports whether a netdev with the given name belongs to any
+// device currently in the inventory.
+func (db *DB) hasNetDevice(name string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, e := range db.deviceStore {
+		for _, nd := range e.NetDevices {
+			if nd == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseUevent parses a kernel kobject uevent of the form
+// "ACTION@DEVPATH\0KEY=VALUE\0...". Messages re-broadcast by udev (which start
+// with "libudev") are ignored.
+func parseUevent(msg []byte) map[string]string {
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) == 0 || !bytes.Contains(fields[0], []byte("@")) {
+		return nil
+	}
+	ev := make(map[string]string, len(fields))
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(string(f), "=")
+		if ok {
+			ev[k] = v
+		}
+	}
+	return ev
+}
+
+// relevantUevent reports whether a uevent may change the IB inventory: an
+// RDMA device, a non-virtual netdev or a PCI function coming or going.
+func relevantUevent(ev map[string]string) bool {
+	action := ev["ACTION"]
+	switch ev["SUBSYSTEM"] {
+	case "infiniband", "infiniband_verbs":
+		return action == "add" || action == "remove" || action == "change"
+	case "net":
+		if strings.Contains(ev["DEVPATH"], "/virtual/") {
+			return false
+		}
+		return action == "add" || action == "remove" || action == "move"
+	case "pci":
+		return action == "add" || action == "remove" || action == "bind" || action == "unbind"
+	}
+	return false
+}
+
+// netlinkSubscribe opens a netlink socket of the given protocol bound to a
+// single multicast group. A receive timeout is set so that readers can notice
+// context cancellation.
+func netlinkSubscribe(proto, group int) (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return -1, fmt.Errorf("open netlink socket (proto %d): %w", proto, err)
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: 1 << (group - 1),
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("bind netlink socket (proto %d, group %d): %w", proto, group, err)
+	}
+	tv := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("set netlink receive timeout: %w", err)
+	}
+	return fd, nil
+}
+
+// readNetlink reads messages from fd and passes each to handle until ctx is
+// cancelled, then closes fd.
+func readNetlink(ctx context.Context, fd int, handle func([]byte)) {
+	defer unix.Close(fd)
+	buf := make([]byte, netlinkRecvBufSize)
+	for ctx.Err() == nil {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			// ENOBUFS means events were dropped; signal with a nil
+			// message so that the handler rescans to be safe.
+			if errors.Is(err, unix.ENOBUFS) {
+				handle(nil)
+				continue
+			}
+			klog.FromContext(ctx).Error(err, "IB inventory: netlink receive failed, stopping watcher")
+			return
+		}
+		handle(buf[:n])
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibinventory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func uevent(fields ...string) []byte {
+	return []byte(strings.Join(fields, "\x00") + "\x00")
+}
+
+func TestParseUevent(t *testing.T) {
+	ev := parseUevent(uevent(
+		"add@/devices/pci0000:00/0000:00:02.0/0000:3b:00.2/infiniband/mlx5_2",
+		"ACTION=add",
+		"DEVPATH=/devices/pci0000:00/0000:00:02.0/0000:3b:00.2/infiniband/mlx5_2",
+		"SUBSYSTEM=infiniband",
+		"NAME=mlx5_2",
+	))
+	assert.Equal(t, "add", ev["ACTION"])
+	assert.Equal(t, "infiniband", ev["SUBSYSTEM"])
+	assert.Equal(t, "mlx5_2", ev["NAME"])
+
+	assert.Nil(t, parseUevent(uevent("libudev", "ACTION=add")))
+}
+
+func TestRelevantUevent(t *testing.T) {
+	tests := map[string]struct {
+		event    map[string]string
+		relevant bool
+	}{
+		"IB device added": {
+			event:    map[string]string{"ACTION": "add", "SUBSYSTEM": "infiniband"},
+			relevant: true,
+		},
+		"VF created": {
+			event:    map[string]string{"ACTION": "add", "SUBSYSTEM": "pci", "DEVPATH": "/devices/pci0000:00/0000:3b:00.2"},
+			relevant: true,
+		},
+		"IPoIB netdev removed": {
+			event:    map[string]string{"ACTION": "remove", "SUBSYSTEM": "net", "DEVPATH": "/devices/pci0000:00/0000:3b:00.2/net/ib2"},
+			relevant: true,
+		},
+		"veth created": {
+			event:    map[string]string{"ACTION": "add", "SUBSYSTEM": "net", "DEVPATH": "/devices/virtual/net/veth1234"},
+			relevant: false,
+		},
+		"unrelated subsystem": {
+			event:    map[string]string{"ACTION": "add", "SUBSYSTEM": "block"},
+			relevant: false,
+		},
+		"empty": {
+			event:    nil,
+			relevant: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.relevant, relevantUevent(test.event))
+		})
+	}
+}
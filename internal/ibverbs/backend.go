@@ -0,0 +1,84 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibverbs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Names of the discovery backends accepted by NewBackend.
+const (
+	// BackendAuto selects libibverbs when it is compiled in and sysfs
+	// otherwise.
+	BackendAuto = "auto"
+	// BackendVerbs queries devices through libibverbs.
+	BackendVerbs = "ibverbs"
+	// BackendSysfs reads devices from /sys/class/infiniband.
+	BackendSysfs = "sysfs"
+)
+
+// ErrVerbsUnavailable is returned when the libibverbs backend is requested
+// from a binary built without cgo or with the noibverbs build tag.
+var ErrVerbsUnavailable = errors.New("libibverbs support not compiled in")
+
+// Backend discovers IB devices and their port attributes.
+type Backend interface {
+	// Name returns the backend name as accepted by NewBackend.
+	Name() string
+	// ListDevices enumerates all IB devices on the host.
+	ListDevices() ([]DeviceInfo, error)
+}
+
+// NewBackend returns the discovery backend with the given name. An empty name
+// is the same as BackendAuto. sysRoot is the sysfs mount point used by the
+// sysfs backend; empty means DefaultSysfsRoot.
+func NewBackend(name, sysRoot string) (Backend, error) {
+	switch name {
+	case "", BackendAuto:
+		if verbsAvailable {
+			return verbsBackend{}, nil
+		}
+		return NewSysfsBackend(sysRoot), nil
+	case BackendVerbs:
+		if !verbsAvailable {
+			return nil, fmt.Errorf("discovery backend %q: %w", name, ErrVerbsUnavailable)
+		}
+		return verbsBackend{}, nil
+	case BackendSysfs:
+		return NewSysfsBackend(sysRoot), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery backend %q, must be one of %q, %q or %q",
+			name, BackendAuto, BackendVerbs, BackendSysfs)
+	}
+}
+
+// DefaultBackend returns the libibverbs backend if it is compiled in and the
+// sysfs backend otherwise.
+func DefaultBackend() Backend {
+	if verbsAvailable {
+		return verbsBackend{}
+	}
+	return NewSysfsBackend("")
+}
+
+// verbsBackend is the Backend wrapping the package-level ListDevices.
+type verbsBackend struct{}
+
+func (verbsBackend) Name() string { return BackendVerbs }
+
+func (verbsBackend) ListDevices() ([]DeviceInfo, error) { return ListDevices() }
@@ -0,0 +1,24 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ibverbs discovers InfiniBand devices and queries their port
+// attributes. Two backends are available behind the Backend interface: one
+// using libibverbs via cgo, and a pure-Go one reading /sys/class/infiniband.
+//
+// The libibverbs backend is only compiled in when cgo is enabled and the
+// noibverbs build tag is not set, so that CGO_ENABLED=0 produces a static,
+// sysfs-only binary.
+package ibverbs
@@ -1,3 +1,5 @@
+//go:build cgo && !noibverbs
+
 /*
  * Copyright The Kubernetes Authors.
  *
@@ -14,12 +16,13 @@
  * limitations under the License.
  */
 
-// Package ibverbs provides Go bindings to libibverbs for InfiniBand device
-// discovery and attribute querying via cgo.
 package ibverbs
 
 /*
-#cgo LDFLAGS: -libverbs
+#cgo LDFLAGS: -libverbs -lmlx5
+#include <endian.h>
+#include <errno.h>
+#include <infiniband/mlx5dv.h>
 #include <infiniband/verbs.h>
 #include <stdlib.h>
 #include <string.h>
@@ -34,6 +37,12 @@ static void put_device_list(struct ibv_device **list) {
     ibv_free_device_list(list);
 }
 
+// Helper to get the node GUID in host byte order. ibv_get_device_guid
+// returns it in network byte order.
+static uint64_t get_device_guid(struct ibv_device *dev) {
+    return be64toh(ibv_get_device_guid(dev));
+}
+
 // Wrapper for ibv_query_port to work around struct compatibility issues
 // in newer rdma-core versions.
 static int query_port_compat(struct ibv_context *ctx, uint8_t port_num,
@@ -42,7 +51,9 @@ static int query_port_compat(struct ibv_context *ctx, uint8_t port_num,
                              int *active_speed,
                              int *active_width,
                              uint16_t *lid,
-                             uint8_t *link_layer) {
+                             uint8_t *link_layer,
+                             uint8_t *phys_state,
+                             int *gid_tbl_len) {
     struct ibv_port_attr attr;
     memset(&attr, 0, sizeof(attr));
     int rc = ibv_query_port(ctx, port_num, &attr);
@@ -53,146 +64,71 @@ static int query_port_compat(struct ibv_context *ctx, uint8_t port_num,
         *active_width = attr.active_width;
         *lid = attr.lid;
         *link_layer = attr.link_layer;
+        *phys_state = attr.phys_state;
+        *gid_tbl_len = attr.gid_tbl_len;
     }
     return rc;
 }
+
+// Probe for the Dynamically Connected transport, which verbs has no
+// capability bit for, by creating a DC initiator QP through mlx5dv.
+// Returns 1 if the device supports it, 0 if it does not, and -1 if that
+// cannot be determined, e.g. for devices of other providers.
+static int probe_dc(struct ibv_context *ctx) {
+    struct ibv_pd *pd;
+    struct ibv_cq *cq;
+    struct ibv_qp *qp;
+    struct ibv_qp_init_attr_ex attr;
+    struct mlx5dv_qp_init_attr dv_attr;
+    int ret = -1;
+
+    if (!mlx5dv_is_supported(ctx->device))
+        return -1;
+    pd = ibv_alloc_pd(ctx);
+    if (!pd)
+        return -1;
+    cq = ibv_create_cq(ctx, 1, NULL, NULL, 0);
+    if (!cq)
+        goto out_pd;
+
+    memset(&attr, 0, sizeof(attr));
+    attr.qp_type = IBV_QPT_DRIVER;
+    attr.send_cq = cq;
+    attr.recv_cq = cq;
+    attr.pd = pd;
+    attr.comp_mask = IBV_QP_INIT_ATTR_PD;
+    attr.cap.max_send_wr = 1;
+    attr.cap.max_send_sge = 1;
+    memset(&dv_attr, 0, sizeof(dv_attr));
+    dv_attr.comp_mask = MLX5DV_QP_INIT_ATTR_MASK_DC;
+    dv_attr.dc_init_attr.dc_type = MLX5DV_DCTYPE_DCI;
+
+    qp = mlx5dv_create_qp(ctx, &attr, &dv_attr);
+    if (qp) {
+        ret = 1;
+        ibv_destroy_qp(qp);
+    } else if (errno == EOPNOTSUPP) {
+        ret = 0;
+    }
+    ibv_destroy_cq(cq);
+out_pd:
+    ibv_dealloc_pd(pd);
+    return ret;
+}
 */
 import "C"
 
 import (
 	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"unsafe"
 )
 
-// PortState represents the state of an IB port.
-type PortState int
-
-const (
-	PortStateNOP    PortState = 0
-	PortStateDown   PortState = 1
-	PortStateInit   PortState = 2
-	PortStateArmed  PortState = 3
-	PortStateActive PortState = 4
-)
-
-func (s PortState) String() string {
-	switch s {
-	case PortStateDown:
-		return "Down"
-	case PortStateInit:
-		return "Init"
-	case PortStateArmed:
-		return "Armed"
-	case PortStateActive:
-		return "Active"
-	default:
-		return "Unknown"
-	}
-}
-
-// LinkSpeed represents the link speed.
-type LinkSpeed int
-
-func (s LinkSpeed) String() string {
-	// Map active_speed values to human-readable strings.
-	// These correspond to IB spec speed values.
-	switch s {
-	case 1:
-		return "2.5Gb/s"
-	case 2:
-		return "5Gb/s"
-	case 4, 8:
-		return "10Gb/s"
-	case 16:
-		return "14Gb/s"
-	case 32:
-		return "25Gb/s"
-	case 64:
-		return "50Gb/s"
-	case 128:
-		return "100Gb/s"
-	case 256:
-		return "200Gb/s"
-	case 512:
-		return "400Gb/s"
-	default:
-		return fmt.Sprintf("%dGb/s", s)
-	}
-}
-
-// PortInfo holds information about an IB port.
-type PortInfo struct {
-	PortNum     int
-	State       PortState
-	ActiveSpeed LinkSpeed
-	ActiveWidth int
-	LID         uint16
-	ActiveMTU   int
-	GID         [16]byte
-	LinkLayer   string
-}
-
-// EffectiveSpeed returns the effective port speed in Gb/s taking width into account.
-func (p *PortInfo) EffectiveSpeed() string {
-	// Width mapping: 1=1x, 2=4x, 4=8x, 8=12x
-	widthMultiplier := 1
-	switch p.ActiveWidth {
-	case 1:
-		widthMultiplier = 1
-	case 2:
-		widthMultiplier = 4
-	case 4:
-		widthMultiplier = 8
-	case 8:
-		widthMultiplier = 12
-	}
-
-	// Get base speed in Gb/s
-	baseSpeed := 0
-	switch int(p.ActiveSpeed) {
-	case 1:
-		baseSpeed = 2 // SDR: 2.5 Gb/s
-	case 2:
-		baseSpeed = 5 // DDR: 5 Gb/s
-	case 4:
-		baseSpeed = 10 // QDR: 10 Gb/s
-	case 8:
-		baseSpeed = 10 // FDR10: 10 Gb/s
-	case 16:
-		baseSpeed = 14 // FDR: 14 Gb/s
-	case 32:
-		baseSpeed = 25 // EDR: 25 Gb/s
-	case 64:
-		baseSpeed = 50 // HDR: 50 Gb/s
-	case 128:
-		baseSpeed = 100 // NDR: 100 Gb/s
-	case 256:
-		baseSpeed = 200 // XDR: 200 Gb/s
-	default:
-		return fmt.Sprintf("%dGb/s", int(p.ActiveSpeed)*widthMultiplier)
-	}
-
-	totalSpeed := baseSpeed * widthMultiplier
-	return fmt.Sprintf("%dGb/s", totalSpeed)
-}
-
-// DeviceInfo holds information about a single IB device.
-type DeviceInfo struct {
-	Name            string
-	NodeGUID        uint64
-	FirmwareVersion string
-	NumPorts        int
-	Ports           []PortInfo
-	NodeType        int // IBV_NODE_CA, IBV_NODE_SWITCH, etc.
-	TransportType   int
-	VendorID        uint32
-	DeviceID        uint32
-}
-
-// NodeGUIDString returns the node GUID as a formatted string.
-func (d *DeviceInfo) NodeGUIDString() string {
-	return fmt.Sprintf("%016x", d.NodeGUID)
-}
+// verbsAvailable reports whether the libibverbs backend is compiled in.
+const verbsAvailable = true
 
 // ListDevices enumerates all InfiniBand devices on the host using libibverbs.
 func ListDevices() ([]DeviceInfo, error) {
@@ -236,37 +172,93 @@ func queryDevice(dev *C.struct_ibv_device) (*DeviceInfo, error) {
 	defer C.ibv_close_device(ctx)
 
 	name := C.GoString(C.ibv_get_device_name(dev))
-
-	var deviceAttr C.struct_ibv_device_attr
-	if rc := C.ibv_query_device(ctx, &deviceAttr); rc != 0 {
-		return nil, fmt.Errorf("ibv_query_device failed for %s: %d", name, rc)
+	devPath := C.GoString(&dev.ibdev_path[0])
+	nodeGUID := uint64(C.get_device_guid(dev))
+
+	// ibv_query_device_ex falls back to ibv_query_device, leaving the
+	// extended attributes zero, for providers that don't implement it.
+	var attrEx C.struct_ibv_device_attr_ex
+	if rc := C.ibv_query_device_ex(ctx, nil, &attrEx); rc != 0 {
+		return nil, fmt.Errorf("ibv_query_device_ex failed for %s: %d", name, rc)
 	}
+	deviceAttr := &attrEx.orig_attr
 
 	info := &DeviceInfo{
 		Name:            name,
-		NodeGUID:        uint64(C.ibv_get_device_guid(dev)),
+		NodeGUID:        nodeGUID,
 		FirmwareVersion: C.GoString(&deviceAttr.fw_ver[0]),
 		NumPorts:        int(deviceAttr.phys_port_cnt),
 		VendorID:        uint32(deviceAttr.vendor_id),
 		DeviceID:        uint32(deviceAttr.vendor_part_id),
+		Caps: &DeviceCaps{
+			MaxQP:           int(deviceAttr.max_qp),
+			MaxCQ:           int(deviceAttr.max_cq),
+			MaxMR:           int(deviceAttr.max_mr),
+			MaxMRSize:       uint64(deviceAttr.max_mr_size),
+			AtomicCap:       AtomicCap(deviceAttr.atomic_cap),
+			ODP:             attrEx.odp_caps.general_caps&C.IBV_ODP_SUPPORT != 0,
+			DC:              probeDC(ctx, name, nodeGUID),
+			TagMatching:     attrEx.tm_caps.max_num_tags > 0,
+			MaxDeviceMemory: uint64(attrEx.max_dm_size),
+		},
 	}
 
 	info.NodeType = int(dev.node_type)
 	info.TransportType = int(dev.transport_type)
 
 	// Query each port
+	gidTblLen := 0
 	for port := 1; port <= info.NumPorts; port++ {
-		portInfo, err := queryPort(ctx, port)
+		portInfo, tblLen, err := queryPort(ctx, devPath, port)
 		if err != nil {
 			continue
 		}
+		gidTblLen += tblLen
 		info.Ports = append(info.Ports, *portInfo)
 	}
 
+	gids := queryGIDTable(ctx, gidTblLen)
+	for i := range info.Ports {
+		info.Ports[i].GIDs = gids[info.Ports[i].PortNum]
+	}
+
 	return info, nil
 }
 
-func queryPort(ctx *C.struct_ibv_context, portNum int) (*PortInfo, error) {
+// queryGIDTable returns the populated GID table entries of all ports of a
+// device by port number. maxEntries is the sum of the table sizes of the
+// ports. Errors, e.g. from rdma-core versions without ibv_query_gid_table,
+// leave the tables empty.
+func queryGIDTable(ctx *C.struct_ibv_context, maxEntries int) map[int][]GIDEntry {
+	if maxEntries <= 0 {
+		return nil
+	}
+	entries := make([]C.struct_ibv_gid_entry, maxEntries)
+	n := C.ibv_query_gid_table(ctx, &entries[0], C.size_t(maxEntries), 0)
+	if n <= 0 {
+		return nil
+	}
+
+	gids := make(map[int][]GIDEntry)
+	for _, e := range entries[:n] {
+		g := GIDEntry{
+			Index: int(e.gid_index),
+			Type:  GIDType(e.gid_type),
+		}
+		copy(g.GID[:], (*[16]byte)(unsafe.Pointer(&e.gid))[:])
+		if e.ndev_ifindex != 0 {
+			if iface, err := net.InterfaceByIndex(int(e.ndev_ifindex)); err == nil {
+				g.NetDevice = iface.Name
+			}
+		}
+		gids[int(e.port_num)] = append(gids[int(e.port_num)], g)
+	}
+	return gids
+}
+
+// queryPort returns the attributes of a port and the size of its GID table.
+// devPath is the sysfs directory of the device.
+func queryPort(ctx *C.struct_ibv_context, devPath string, portNum int) (*PortInfo, int, error) {
 	var (
 		state       C.enum_ibv_port_state
 		activeMTU   C.int
@@ -274,19 +266,22 @@ func queryPort(ctx *C.struct_ibv_context, portNum int) (*PortInfo, error) {
 		activeWidth C.int
 		lid         C.uint16_t
 		linkLayer   C.uint8_t
+		physState   C.uint8_t
+		gidTblLen   C.int
 	)
 
 	rc := C.query_port_compat(ctx, C.uint8_t(portNum),
-		&state, &activeMTU, &activeSpeed, &activeWidth, &lid, &linkLayer)
+		&state, &activeMTU, &activeSpeed, &activeWidth, &lid, &linkLayer, &physState, &gidTblLen)
 	if rc != 0 {
-		return nil, fmt.Errorf("ibv_query_port failed for port %d: %d", portNum, rc)
+		return nil, 0, fmt.Errorf("ibv_query_port failed for port %d: %d", portNum, rc)
 	}
 
 	pi := &PortInfo{
 		PortNum:     portNum,
 		State:       PortState(state),
+		PhysState:   PhysPortState(physState),
 		ActiveSpeed: LinkSpeed(activeSpeed),
-		ActiveWidth: int(activeWidth),
+		ActiveWidth: LinkWidth(activeWidth),
 		LID:         uint16(lid),
 		ActiveMTU:   mtuEnumToBytes(int(activeMTU)),
 	}
@@ -294,11 +289,19 @@ func queryPort(ctx *C.struct_ibv_context, portNum int) (*PortInfo, error) {
 	// Determine link layer
 	switch linkLayer {
 	case C.IBV_LINK_LAYER_INFINIBAND:
-		pi.LinkLayer = "InfiniBand"
+		pi.LinkLayer = LinkLayerInfiniBand
 	case C.IBV_LINK_LAYER_ETHERNET:
-		pi.LinkLayer = "Ethernet"
+		pi.LinkLayer = LinkLayerEthernet
 	default:
-		pi.LinkLayer = "Unknown"
+		pi.LinkLayer = LinkLayerUnknown
+	}
+
+	// XDR does not fit the 8-bit active_speed, and rdma-core releases
+	// without active_speed_ex report it as 0. The kernel's rate has it.
+	if pi.ActiveSpeed == 0 {
+		if rate, err := readSysfsString(filepath.Join(devPath, "ports", strconv.Itoa(portNum), "rate")); err == nil {
+			pi.ActiveSpeed, pi.ActiveWidth, _ = parseRate(rate)
+		}
 	}
 
 	// Query GID at index 0
@@ -308,7 +311,47 @@ func queryPort(ctx *C.struct_ibv_context, portNum int) (*PortInfo, error) {
 		copy(pi.GID[:], raw[:])
 	}
 
-	return pi, nil
+	return pi, int(gidTblLen), nil
+}
+
+// dcKey identifies a device across scans. VFs may share the all-zero node
+// GUID, so the name is part of it.
+type dcKey struct {
+	name     string
+	nodeGUID uint64
+}
+
+// dcProbes caches the outcome of probe_dc, which allocates a PD, a CQ and a
+// QP on the device, so that it runs once per device rather than on every
+// scan.
+var dcProbes = struct {
+	sync.Mutex
+	supported map[dcKey]bool
+}{supported: make(map[dcKey]bool)}
+
+// probeDC reports whether the device supports the Dynamically Connected
+// transport, or nil if that cannot be determined. Only determined outcomes
+// are cached, so a failure to allocate the probe's resources is retried on
+// the next scan.
+func probeDC(ctx *C.struct_ibv_context, name string, nodeGUID uint64) *bool {
+	key := dcKey{name: name, nodeGUID: nodeGUID}
+	dcProbes.Lock()
+	defer dcProbes.Unlock()
+	if supported, ok := dcProbes.supported[key]; ok {
+		return &supported
+	}
+
+	var supported bool
+	switch C.probe_dc(ctx) {
+	case 1:
+		supported = true
+	case 0:
+		supported = false
+	default:
+		return nil
+	}
+	dcProbes.supported[key] = supported
+	return &supported
 }
 
 // mtuEnumToBytes converts IBV MTU enum to byte value.
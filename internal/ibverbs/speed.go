@@ -0,0 +1,176 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibverbs
+
+import (
+	"strconv"
+	"strings"
+)
+
+// LinkSpeed is the per-lane speed of a port, as encoded in the active_speed
+// and active_speed_ex fields of ibv_port_attr after the LinkSpeedActive and
+// LinkSpeedExtActive fields of the IBA PortInfo.
+type LinkSpeed int
+
+const (
+	LinkSpeedSDR   LinkSpeed = 1
+	LinkSpeedDDR   LinkSpeed = 2
+	LinkSpeedQDR   LinkSpeed = 4
+	LinkSpeedFDR10 LinkSpeed = 8
+	LinkSpeedFDR   LinkSpeed = 16
+	LinkSpeedEDR   LinkSpeed = 32
+	LinkSpeedHDR   LinkSpeed = 64
+	LinkSpeedNDR   LinkSpeed = 128
+	LinkSpeedXDR   LinkSpeed = 256
+)
+
+// linkSpeeds maps each speed to its generation and nominal per-lane data
+// rate in Mb/s, the one the kernel reports in ports/N/rate. The signaling
+// rate is higher from FDR10 on because of line coding and FEC, e.g. 106.25
+// Gb/s for an NDR lane.
+var linkSpeeds = []struct {
+	speed      LinkSpeed
+	generation string
+	laneMbps   int64
+}{
+	{LinkSpeedSDR, "SDR", 2500},
+	{LinkSpeedDDR, "DDR", 5000},
+	{LinkSpeedQDR, "QDR", 10000},
+	{LinkSpeedFDR10, "FDR10", 10000},
+	{LinkSpeedFDR, "FDR", 14000},
+	{LinkSpeedEDR, "EDR", 25000},
+	{LinkSpeedHDR, "HDR", 50000},
+	{LinkSpeedNDR, "NDR", 100000},
+	{LinkSpeedXDR, "XDR", 200000},
+}
+
+// ParseLinkSpeed returns the speed of a generation name, e.g. "NDR".
+func ParseLinkSpeed(generation string) (LinkSpeed, bool) {
+	for _, ls := range linkSpeeds {
+		if ls.generation == generation {
+			return ls.speed, true
+		}
+	}
+	return 0, false
+}
+
+// Generation returns the name of the speed generation, e.g. "NDR", or
+// "Unknown".
+func (s LinkSpeed) Generation() string {
+	for _, ls := range linkSpeeds {
+		if ls.speed == s {
+			return ls.generation
+		}
+	}
+	return "Unknown"
+}
+
+// LaneMbps returns the nominal data rate of a lane in Mb/s, or 0 for an
+// unknown speed.
+func (s LinkSpeed) LaneMbps() int64 {
+	for _, ls := range linkSpeeds {
+		if ls.speed == s {
+			return ls.laneMbps
+		}
+	}
+	return 0
+}
+
+// String returns the per-lane data rate, e.g. "100Gb/s" for NDR.
+func (s LinkSpeed) String() string {
+	if mbps := s.LaneMbps(); mbps > 0 {
+		return formatMbps(mbps)
+	}
+	return "Unknown"
+}
+
+// LinkWidth is the width of a port, as encoded in the active_width field of
+// ibv_port_attr.
+type LinkWidth int
+
+const (
+	LinkWidth1X  LinkWidth = 1
+	LinkWidth4X  LinkWidth = 2
+	LinkWidth8X  LinkWidth = 4
+	LinkWidth12X LinkWidth = 8
+	LinkWidth2X  LinkWidth = 16
+)
+
+// linkWidths maps each width to its number of lanes.
+var linkWidths = []struct {
+	width LinkWidth
+	lanes int
+}{
+	{LinkWidth1X, 1},
+	{LinkWidth2X, 2},
+	{LinkWidth4X, 4},
+	{LinkWidth8X, 8},
+	{LinkWidth12X, 12},
+}
+
+// ParseLinkWidth returns the width for its name, e.g. "4X".
+func ParseLinkWidth(name string) (LinkWidth, bool) {
+	lanes, err := strconv.Atoi(strings.TrimSuffix(name, "X"))
+	if err != nil || !strings.HasSuffix(name, "X") {
+		return 0, false
+	}
+	for _, lw := range linkWidths {
+		if lw.lanes == lanes {
+			return lw.width, true
+		}
+	}
+	return 0, false
+}
+
+// Lanes returns the number of lanes, or 0 for an unknown width.
+func (w LinkWidth) Lanes() int {
+	for _, lw := range linkWidths {
+		if lw.width == w {
+			return lw.lanes
+		}
+	}
+	return 0
+}
+
+// String returns the name of the width, e.g. "4X", or "Unknown".
+func (w LinkWidth) String() string {
+	if lanes := w.Lanes(); lanes > 0 {
+		return strconv.Itoa(lanes) + "X"
+	}
+	return "Unknown"
+}
+
+// RateMbps returns the nominal data rate of the port in Mb/s, the per-lane
+// rate times the number of lanes, or 0 if the speed or width is unknown.
+func (p *PortInfo) RateMbps() int64 {
+	return p.ActiveSpeed.LaneMbps() * int64(p.ActiveWidth.Lanes())
+}
+
+// EffectiveSpeed returns the nominal data rate of the port, e.g. "200Gb/s"
+// for 4X HDR, or "Unknown".
+func (p *PortInfo) EffectiveSpeed() string {
+	if mbps := p.RateMbps(); mbps > 0 {
+		return formatMbps(mbps)
+	}
+	return "Unknown"
+}
+
+// formatMbps formats a data rate in Gb/s without trailing zeros, e.g.
+// "2.5Gb/s".
+func formatMbps(mbps int64) string {
+	return strconv.FormatFloat(float64(mbps)/1000, 'f', -1, 64) + "Gb/s"
+}
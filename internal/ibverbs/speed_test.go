@@ -0,0 +1,75 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibverbs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortRate(t *testing.T) {
+	tests := []struct {
+		speed      LinkSpeed
+		width      LinkWidth
+		generation string
+		mbps       int64
+		effective  string
+	}{
+		{speed: LinkSpeedSDR, width: LinkWidth1X, generation: "SDR", mbps: 2500, effective: "2.5Gb/s"},
+		{speed: LinkSpeedQDR, width: LinkWidth4X, generation: "QDR", mbps: 40000, effective: "40Gb/s"},
+		{speed: LinkSpeedFDR10, width: LinkWidth4X, generation: "FDR10", mbps: 40000, effective: "40Gb/s"},
+		{speed: LinkSpeedFDR, width: LinkWidth4X, generation: "FDR", mbps: 56000, effective: "56Gb/s"},
+		{speed: LinkSpeedEDR, width: LinkWidth4X, generation: "EDR", mbps: 100000, effective: "100Gb/s"},
+		{speed: LinkSpeedHDR, width: LinkWidth2X, generation: "HDR", mbps: 100000, effective: "100Gb/s"},
+		{speed: LinkSpeedHDR, width: LinkWidth4X, generation: "HDR", mbps: 200000, effective: "200Gb/s"},
+		{speed: LinkSpeedNDR, width: LinkWidth8X, generation: "NDR", mbps: 800000, effective: "800Gb/s"},
+		{speed: LinkSpeedXDR, width: LinkWidth4X, generation: "XDR", mbps: 800000, effective: "800Gb/s"},
+		{speed: LinkSpeedHDR, width: LinkWidth12X, generation: "HDR", mbps: 600000, effective: "600Gb/s"},
+		{speed: 512, width: LinkWidth4X, generation: "Unknown", effective: "Unknown"},
+		{speed: LinkSpeedNDR, width: 3, generation: "NDR", effective: "Unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.width, tt.generation), func(t *testing.T) {
+			p := PortInfo{ActiveSpeed: tt.speed, ActiveWidth: tt.width}
+			assert.Equal(t, tt.generation, tt.speed.Generation())
+			assert.Equal(t, tt.mbps, p.RateMbps())
+			assert.Equal(t, tt.effective, p.EffectiveSpeed())
+		})
+	}
+}
+
+func TestParseLinkSpeedAndWidth(t *testing.T) {
+	for _, name := range []string{"SDR", "DDR", "QDR", "FDR10", "FDR", "EDR", "HDR", "NDR", "XDR"} {
+		speed, ok := ParseLinkSpeed(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, name, speed.Generation())
+	}
+	_, ok := ParseLinkSpeed("GDR")
+	assert.False(t, ok)
+
+	for _, name := range []string{"1X", "2X", "4X", "8X", "12X"} {
+		width, ok := ParseLinkWidth(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, name, width.String())
+	}
+	for _, name := range []string{"3X", "4", "X", ""} {
+		_, ok := ParseLinkWidth(name)
+		assert.False(t, ok, name)
+	}
+}
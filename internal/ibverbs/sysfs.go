@@ -0,0 +1,329 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibverbs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultSysfsRoot is the sysfs mount point on a live system.
+const DefaultSysfsRoot = "/sys"
+
+const (
+	// nodeTypeRNIC is the node_type of iWARP devices (RDMA_NODE_RNIC).
+	nodeTypeRNIC = 4
+	// transportIWARP is IBV_TRANSPORT_IWARP; IB and RoCE devices use
+	// IBV_TRANSPORT_IB, which is 0.
+	transportIWARP = 1
+
+	// roceHeaderBytes is the per-packet overhead the kernel subtracts from
+	// the netdev MTU to get the RoCE path MTU: GRH, UDP, BTH, XRC ETH,
+	// AtomicETH and ICRC.
+	roceHeaderBytes = 40 + 8 + 12 + 4 + 28 + 4
+	// ipoibHeaderBytes is the IPoIB encapsulation header in datagram mode.
+	ipoibHeaderBytes = 4
+)
+
+// SysfsBackend is a Backend that reads device and port attributes from
+// /sys/class/infiniband instead of opening the devices through libibverbs.
+// It needs neither cgo nor access to /dev/infiniband.
+//
+// sysfs does not expose device capabilities, so DeviceInfo.Caps is nil. Nor
+// does it expose the active MTU of a port. It is derived from the MTU of the
+// port's netdev for RoCE and for IPoIB in datagram mode, and left 0
+// otherwise.
+type SysfsBackend struct {
+	root string
+}
+
+// NewSysfsBackend returns a sysfs backend reading IB devices from the class
+// directory of the sysfs tree mounted at sysRoot, or at DefaultSysfsRoot if
+// sysRoot is empty.
+func NewSysfsBackend(sysRoot string) *SysfsBackend {
+	if sysRoot == "" {
+		sysRoot = DefaultSysfsRoot
+	}
+	return &SysfsBackend{root: filepath.Join(sysRoot, "class", "infiniband")}
+}
+
+// Name implements Backend.
+func (b *SysfsBackend) Name() string { return BackendSysfs }
+
+// ListDevices enumerates all InfiniBand devices found in sysfs.
+func (b *SysfsBackend) ListDevices() ([]DeviceInfo, error) {
+	entries, err := os.ReadDir(b.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", b.root, err)
+	}
+
+	var devices []DeviceInfo
+	for _, entry := range entries {
+		devInfo, err := b.readDevice(entry.Name())
+		if err != nil {
+			// Don't fail on a single device, same as ibv_get_device_list.
+			continue
+		}
+		devices = append(devices, *devInfo)
+	}
+	return devices, nil
+}
+
+func (b *SysfsBackend) readDevice(name string) (*DeviceInfo, error) {
+	devPath := filepath.Join(b.root, name)
+
+	guid, err := readSysfsString(filepath.Join(devPath, "node_guid"))
+	if err != nil {
+		return nil, err
+	}
+	nodeGUID, err := strconv.ParseUint(strings.ReplaceAll(guid, ":", ""), 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse node_guid of %s: %w", name, err)
+	}
+
+	fwVer, _ := readSysfsString(filepath.Join(devPath, "fw_ver"))
+	info := &DeviceInfo{
+		Name:            name,
+		NodeGUID:        nodeGUID,
+		FirmwareVersion: fwVer,
+		NodeType:        readSysfsEnum(filepath.Join(devPath, "node_type")),
+		VendorID:        uint32(readSysfsUint(filepath.Join(devPath, "device", "vendor"))),
+		DeviceID:        uint32(readSysfsUint(filepath.Join(devPath, "device", "device"))),
+	}
+	if info.NodeType == nodeTypeRNIC {
+		info.TransportType = transportIWARP
+	}
+
+	portEntries, err := os.ReadDir(filepath.Join(devPath, "ports"))
+	if err != nil {
+		return nil, fmt.Errorf("read ports of %s: %w", name, err)
+	}
+	var portNums []int
+	for _, pe := range portEntries {
+		if n, err := strconv.Atoi(pe.Name()); err == nil {
+			portNums = append(portNums, n)
+		}
+	}
+	sort.Ints(portNums)
+	info.NumPorts = len(portNums)
+
+	for _, port := range portNums {
+		portInfo, err := readPort(devPath, port)
+		if err != nil {
+			continue
+		}
+		info.Ports = append(info.Ports, *portInfo)
+	}
+
+	return info, nil
+}
+
+func readPort(devPath string, portNum int) (*PortInfo, error) {
+	portPath := filepath.Join(devPath, "ports", strconv.Itoa(portNum))
+
+	state, err := readSysfsString(filepath.Join(portPath, "state"))
+	if err != nil {
+		return nil, err
+	}
+
+	pi := &PortInfo{
+		PortNum:   portNum,
+		State:     PortState(parseSysfsEnum(state)),
+		PhysState: PhysPortState(readSysfsEnum(filepath.Join(portPath, "phys_state"))),
+		LID:       uint16(readSysfsUint(filepath.Join(portPath, "lid"))),
+		LinkLayer: LinkLayerUnknown,
+	}
+
+	if rate, err := readSysfsString(filepath.Join(portPath, "rate")); err == nil {
+		pi.ActiveSpeed, pi.ActiveWidth, _ = parseRate(rate)
+	}
+	if ll, err := readSysfsString(filepath.Join(portPath, "link_layer")); err == nil && ll != "" {
+		pi.LinkLayer = ll
+	}
+	pi.GIDs = readGIDTable(portPath, pi.LinkLayer)
+	if len(pi.GIDs) > 0 && pi.GIDs[0].Index == 0 {
+		pi.GID = pi.GIDs[0].GID
+	}
+	pi.ActiveMTU = netdevActiveMTU(devPath, portNum, pi.LinkLayer)
+
+	return pi, nil
+}
+
+// readGIDTable reads the populated entries of the GID table of a port, in
+// index order. Unused entries read as the all-zero GID.
+//
+// The kernel reports the type of both InfiniBand and RoCE v1 GIDs as
+// "IB/RoCE v1", so the link layer tells them apart.
+func readGIDTable(portPath, linkLayer string) []GIDEntry {
+	entries, err := os.ReadDir(filepath.Join(portPath, "gids"))
+	if err != nil {
+		return nil
+	}
+	var indexes []int
+	for _, e := range entries {
+		if i, err := strconv.Atoi(e.Name()); err == nil {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	var gids []GIDEntry
+	for _, i := range indexes {
+		idx := strconv.Itoa(i)
+		s, err := readSysfsString(filepath.Join(portPath, "gids", idx))
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		g := GIDEntry{Index: i, Type: GIDTypeIB}
+		copy(g.GID[:], ip.To16())
+		if linkLayer == LinkLayerEthernet {
+			g.Type = GIDTypeRoCEv1
+			// Reading ndevs of an InfiniBand GID fails, so only look for
+			// one on RoCE.
+			g.NetDevice, _ = readSysfsString(filepath.Join(portPath, "gid_attrs", "ndevs", idx))
+		}
+		if t, _ := readSysfsString(filepath.Join(portPath, "gid_attrs", "types", idx)); t == "RoCE v2" {
+			g.Type = GIDTypeRoCEv2
+		}
+		gids = append(gids, g)
+	}
+	return gids
+}
+
+// parseRate parses the contents of ports/N/rate, e.g. "100 Gb/sec (4X EDR)"
+// or "2.5 Gb/sec (1X)", into the active_speed and active_width encodings.
+func parseRate(rate string) (LinkSpeed, LinkWidth, error) {
+	start := strings.IndexByte(rate, '(')
+	end := strings.LastIndexByte(rate, ')')
+	if start < 0 || end < start {
+		return 0, 0, fmt.Errorf("malformed rate %q", rate)
+	}
+	fields := strings.Fields(rate[start+1 : end])
+	if len(fields) == 0 {
+		return 0, 0, fmt.Errorf("malformed rate %q", rate)
+	}
+
+	width, ok := ParseLinkWidth(fields[0])
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown width in rate %q", rate)
+	}
+
+	// SDR ports have no speed suffix.
+	speed := LinkSpeedSDR
+	if len(fields) > 1 {
+		if speed, ok = ParseLinkSpeed(fields[1]); !ok {
+			return 0, width, fmt.Errorf("unknown speed in rate %q", rate)
+		}
+	}
+	return speed, width, nil
+}
+
+// netdevActiveMTU derives the active IB MTU of a port from the MTU of its
+// netdev, the same way the kernel does for RoCE. For IPoIB this only works in
+// datagram mode, where the netdev MTU is the IB MTU minus the IPoIB header.
+// It returns 0 if the MTU cannot be determined.
+func netdevActiveMTU(devPath string, portNum int, linkLayer string) int {
+	netPath := filepath.Join(devPath, "device", "net")
+	entries, err := os.ReadDir(netPath)
+	if err != nil {
+		return 0
+	}
+	for _, entry := range entries {
+		ifPath := filepath.Join(netPath, entry.Name())
+		// dev_port is zero-based, and absent on single-port devices.
+		if devPort := readSysfsUint(filepath.Join(ifPath, "dev_port")); int(devPort) != portNum-1 {
+			continue
+		}
+		mtu := int(readSysfsUint(filepath.Join(ifPath, "mtu")))
+		switch linkLayer {
+		case LinkLayerEthernet:
+			return ibMTUFloor(mtu - roceHeaderBytes)
+		case LinkLayerInfiniBand:
+			if mode, _ := readSysfsString(filepath.Join(ifPath, "mode")); mode != "datagram" {
+				return 0
+			}
+			return ibMTUFloor(mtu + ipoibHeaderBytes)
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+// ibMTUFloor returns the largest IB MTU not exceeding n bytes, or 0.
+func ibMTUFloor(n int) int {
+	for _, mtu := range []int{4096, 2048, 1024, 512, 256} {
+		if n >= mtu {
+			return mtu
+		}
+	}
+	return 0
+}
+
+// readSysfsString reads a sysfs attribute and trims surrounding whitespace.
+func readSysfsString(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readSysfsUint reads a decimal or 0x-prefixed hex sysfs attribute, returning
+// 0 if it is missing or malformed.
+func readSysfsUint(path string) uint64 {
+	s, err := readSysfsString(path)
+	if err != nil {
+		return 0
+	}
+	v, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// readSysfsEnum reads a sysfs attribute of the form "4: ACTIVE" and returns
+// the numeric value, or 0 if it is missing or malformed.
+func readSysfsEnum(path string) int {
+	s, err := readSysfsString(path)
+	if err != nil {
+		return 0
+	}
+	return parseSysfsEnum(s)
+}
+
+func parseSysfsEnum(s string) int {
+	num, _, _ := strings.Cut(s, ":")
+	v, err := strconv.Atoi(strings.TrimSpace(num))
+	if err != nil {
+		return 0
+	}
+	return v
+}
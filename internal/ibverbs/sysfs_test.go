@@ -0,0 +1,202 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibverbs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSysfs(t *testing.T, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content+"\n"), 0o644))
+	}
+}
+
+func TestSysfsBackendListDevices(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "class", "infiniband")
+	pci := filepath.Join(dir, "devices")
+
+	writeSysfs(t, map[string]string{
+		// ConnectX-6 on an IB fabric, IPoIB in datagram mode.
+		filepath.Join(root, "mlx5_0", "node_guid"):                       "ec0d:9a03:0078:6a4c",
+		filepath.Join(root, "mlx5_0", "fw_ver"):                          "20.39.1002",
+		filepath.Join(root, "mlx5_0", "node_type"):                       "1: CA",
+		filepath.Join(root, "mlx5_0", "ports", "1", "state"):             "4: ACTIVE",
+		filepath.Join(root, "mlx5_0", "ports", "1", "phys_state"):        "5: LinkUp",
+		filepath.Join(root, "mlx5_0", "ports", "1", "rate"):              "200 Gb/sec (4X HDR)",
+		filepath.Join(root, "mlx5_0", "ports", "1", "lid"):               "0x1a",
+		filepath.Join(root, "mlx5_0", "ports", "1", "link_layer"):        "InfiniBand",
+		filepath.Join(root, "mlx5_0", "ports", "1", "gids", "0"):         "fe80:0000:0000:0000:ec0d:9a03:0078:6a4c",
+		filepath.Join(pci, "0000:3b:00.0", "vendor"):                     "0x15b3",
+		filepath.Join(pci, "0000:3b:00.0", "device"):                     "0x101b",
+		filepath.Join(pci, "0000:3b:00.0", "net", "ibp59s0", "mtu"):      "2044",
+		filepath.Join(pci, "0000:3b:00.0", "net", "ibp59s0", "mode"):     "datagram",
+		filepath.Join(pci, "0000:3b:00.0", "net", "ibp59s0", "dev_port"): "0",
+
+		// ConnectX-7 in RoCE mode with a link that is down.
+		filepath.Join(root, "mlx5_1", "node_guid"):                "a088:c203:0011:2233",
+		filepath.Join(root, "mlx5_1", "fw_ver"):                   "28.39.1002",
+		filepath.Join(root, "mlx5_1", "node_type"):                "1: CA",
+		filepath.Join(root, "mlx5_1", "ports", "1", "state"):      "1: DOWN",
+		filepath.Join(root, "mlx5_1", "ports", "1", "phys_state"): "3: Disabled",
+		filepath.Join(root, "mlx5_1", "ports", "1", "rate"):       "2.5 Gb/sec (1X)",
+		filepath.Join(root, "mlx5_1", "ports", "1", "lid"):        "0x0",
+		filepath.Join(root, "mlx5_1", "ports", "1", "link_layer"): "Ethernet",
+		// Link-local and IPv4 GIDs, each as RoCE v1 and v2, and an
+		// unused entry.
+		filepath.Join(root, "mlx5_1", "ports", "1", "gids", "0"):               "fe80:0000:0000:0000:a288:c2ff:fe11:2233",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gids", "1"):               "fe80:0000:0000:0000:a288:c2ff:fe11:2233",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gids", "2"):               "0000:0000:0000:0000:0000:ffff:c000:020a",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gids", "3"):               "0000:0000:0000:0000:0000:ffff:c000:020a",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gids", "4"):               "0000:0000:0000:0000:0000:0000:0000:0000",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gid_attrs", "types", "0"): "IB/RoCE v1",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gid_attrs", "types", "1"): "RoCE v2",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gid_attrs", "types", "2"): "IB/RoCE v1",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gid_attrs", "types", "3"): "RoCE v2",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gid_attrs", "ndevs", "0"): "ens3f0",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gid_attrs", "ndevs", "1"): "ens3f0",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gid_attrs", "ndevs", "2"): "ens3f0",
+		filepath.Join(root, "mlx5_1", "ports", "1", "gid_attrs", "ndevs", "3"): "ens3f0",
+		filepath.Join(pci, "0000:5e:00.0", "vendor"):                           "0x15b3",
+		filepath.Join(pci, "0000:5e:00.0", "device"):                           "0x1021",
+		filepath.Join(pci, "0000:5e:00.0", "net", "ens3f0", "mtu"):             "1500",
+
+		// Not a device: no node_guid.
+		filepath.Join(root, "broken", "ports", "1", "state"): "4: ACTIVE",
+	})
+	require.NoError(t, os.Symlink(filepath.Join(pci, "0000:3b:00.0"), filepath.Join(root, "mlx5_0", "device")))
+	require.NoError(t, os.Symlink(filepath.Join(pci, "0000:5e:00.0"), filepath.Join(root, "mlx5_1", "device")))
+
+	devices, err := NewSysfsBackend(dir).ListDevices()
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+
+	ib := devices[0]
+	assert.Equal(t, "mlx5_0", ib.Name)
+	assert.Equal(t, "ec0d9a0300786a4c", ib.NodeGUIDString())
+	assert.Equal(t, "20.39.1002", ib.FirmwareVersion)
+	assert.Equal(t, 1, ib.NodeType)
+	assert.Equal(t, 0, ib.TransportType)
+	assert.Equal(t, uint32(0x15b3), ib.VendorID)
+	assert.Equal(t, uint32(0x101b), ib.DeviceID)
+	assert.Nil(t, ib.Caps, "sysfs has no device capabilities")
+	assert.Equal(t, 1, ib.NumPorts)
+	require.Len(t, ib.Ports, 1)
+	assert.Equal(t, PortInfo{
+		PortNum:     1,
+		State:       PortStateActive,
+		PhysState:   PhysPortStateLinkUp,
+		ActiveSpeed: LinkSpeedHDR,
+		ActiveWidth: 2,
+		LID:         0x1a,
+		ActiveMTU:   2048,
+		GID:         [16]byte{0xfe, 0x80, 8: 0xec, 0x0d, 0x9a, 0x03, 0x00, 0x78, 0x6a, 0x4c},
+		GIDs: []GIDEntry{{
+			Index: 0,
+			GID:   [16]byte{0xfe, 0x80, 8: 0xec, 0x0d, 0x9a, 0x03, 0x00, 0x78, 0x6a, 0x4c},
+			Type:  GIDTypeIB,
+		}},
+		LinkLayer: "InfiniBand",
+	}, ib.Ports[0])
+	assert.Equal(t, -1, ib.Ports[0].DefaultRoCEv2GIDIndex())
+	assert.Equal(t, "200Gb/s", ib.Ports[0].EffectiveSpeed())
+
+	roce := devices[1]
+	assert.Equal(t, "mlx5_1", roce.Name)
+	require.Len(t, roce.Ports, 1)
+	assert.Equal(t, PortStateDown, roce.Ports[0].State)
+	assert.Equal(t, PhysPortStateDisabled, roce.Ports[0].PhysState)
+	assert.Equal(t, LinkSpeedSDR, roce.Ports[0].ActiveSpeed)
+	assert.Equal(t, LinkWidth1X, roce.Ports[0].ActiveWidth)
+	assert.Equal(t, "Ethernet", roce.Ports[0].LinkLayer)
+	assert.Equal(t, 1024, roce.Ports[0].ActiveMTU)
+	gids := roce.Ports[0].GIDs
+	require.Len(t, gids, 4)
+	for i, want := range []GIDType{GIDTypeRoCEv1, GIDTypeRoCEv2, GIDTypeRoCEv1, GIDTypeRoCEv2} {
+		assert.Equal(t, i, gids[i].Index)
+		assert.Equal(t, want, gids[i].Type, "GID %d", i)
+		assert.Equal(t, "ens3f0", gids[i].NetDevice)
+	}
+	assert.Equal(t, "192.0.2.10", gids[3].IP().String())
+	assert.Equal(t, gids[0].GID, roce.Ports[0].GID)
+	assert.Equal(t, 3, roce.Ports[0].DefaultRoCEv2GIDIndex())
+}
+
+func TestSysfsBackendNoDevices(t *testing.T) {
+	devices, err := NewSysfsBackend(filepath.Join(t.TempDir(), "missing")).ListDevices()
+	require.NoError(t, err)
+	assert.Empty(t, devices)
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		speed   LinkSpeed
+		width   LinkWidth
+		wantErr bool
+	}{
+		{rate: "2.5 Gb/sec (1X)", speed: LinkSpeedSDR, width: LinkWidth1X},
+		{rate: "56 Gb/sec (4X FDR)", speed: LinkSpeedFDR, width: LinkWidth4X},
+		{rate: "100 Gb/sec (4X EDR)", speed: LinkSpeedEDR, width: LinkWidth4X},
+		{rate: "100 Gb/sec (2X HDR)", speed: LinkSpeedHDR, width: LinkWidth2X},
+		{rate: "400 Gb/sec (4X NDR)", speed: LinkSpeedNDR, width: LinkWidth4X},
+		{rate: "600 Gb/sec (12X HDR)", speed: LinkSpeedHDR, width: LinkWidth12X},
+		{rate: "800 Gb/sec (4X XDR)", speed: LinkSpeedXDR, width: LinkWidth4X},
+		{rate: "invalid", wantErr: true},
+		{rate: "10 Gb/sec (3X)", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rate, func(t *testing.T) {
+			speed, width, err := parseRate(tt.rate)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.speed, speed)
+			assert.Equal(t, tt.width, width)
+		})
+	}
+}
+
+func TestNewBackend(t *testing.T) {
+	b, err := NewBackend(BackendSysfs, "")
+	require.NoError(t, err)
+	assert.Equal(t, BackendSysfs, b.Name())
+
+	b, err = NewBackend("", "")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultBackend().Name(), b.Name())
+
+	_, err = NewBackend(BackendVerbs, "")
+	if verbsAvailable {
+		assert.NoError(t, err)
+	} else {
+		assert.ErrorIs(t, err, ErrVerbsUnavailable)
+	}
+
+	_, err = NewBackend("rdma", "")
+	assert.Error(t, err)
+}
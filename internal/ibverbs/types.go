@@ -0,0 +1,237 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibverbs
+
+import (
+	"fmt"
+	"net"
+)
+
+// PortState represents the state of an IB port.
+type PortState int
+
+const (
+	PortStateNOP    PortState = 0
+	PortStateDown   PortState = 1
+	PortStateInit   PortState = 2
+	PortStateArmed  PortState = 3
+	PortStateActive PortState = 4
+)
+
+func (s PortState) String() string {
+	switch s {
+	case PortStateDown:
+		return "Down"
+	case PortStateInit:
+		return "Init"
+	case PortStateArmed:
+		return "Armed"
+	case PortStateActive:
+		return "Active"
+	default:
+		return "Unknown"
+	}
+}
+
+// PhysPortState represents the physical state of an IB port as defined by
+// the IBA PortPhysicalState field.
+type PhysPortState int
+
+const (
+	PhysPortStateSleep             PhysPortState = 1
+	PhysPortStatePolling           PhysPortState = 2
+	PhysPortStateDisabled          PhysPortState = 3
+	PhysPortStateTraining          PhysPortState = 4
+	PhysPortStateLinkUp            PhysPortState = 5
+	PhysPortStateLinkErrorRecovery PhysPortState = 6
+	PhysPortStatePhyTest           PhysPortState = 7
+)
+
+func (s PhysPortState) String() string {
+	switch s {
+	case PhysPortStateSleep:
+		return "Sleep"
+	case PhysPortStatePolling:
+		return "Polling"
+	case PhysPortStateDisabled:
+		return "Disabled"
+	case PhysPortStateTraining:
+		return "PortConfigurationTraining"
+	case PhysPortStateLinkUp:
+		return "LinkUp"
+	case PhysPortStateLinkErrorRecovery:
+		return "LinkErrorRecovery"
+	case PhysPortStatePhyTest:
+		return "PhyTest"
+	default:
+		return "Unknown"
+	}
+}
+
+// Port link layers as reported by ibv_port_attr and ports/N/link_layer.
+const (
+	LinkLayerInfiniBand = "InfiniBand"
+	LinkLayerEthernet   = "Ethernet"
+	LinkLayerUnknown    = "Unknown"
+)
+
+// GIDType is the type of a GID table entry, as in ibv_gid_type.
+type GIDType int
+
+const (
+	GIDTypeIB     GIDType = 0
+	GIDTypeRoCEv1 GIDType = 1
+	GIDTypeRoCEv2 GIDType = 2
+)
+
+func (t GIDType) String() string {
+	switch t {
+	case GIDTypeIB:
+		return "IB"
+	case GIDTypeRoCEv1:
+		return "RoCE v1"
+	case GIDTypeRoCEv2:
+		return "RoCE v2"
+	default:
+		return "Unknown"
+	}
+}
+
+// GIDEntry is a populated entry of a port's GID table.
+type GIDEntry struct {
+	Index int
+	GID   [16]byte
+	Type  GIDType
+	// NetDevice is the netdev the GID belongs to, empty on InfiniBand.
+	NetDevice string
+}
+
+// IP returns the IP address a RoCE GID is derived from, in its 4-byte form
+// for IPv4-mapped GIDs, or nil for InfiniBand GIDs.
+func (g GIDEntry) IP() net.IP {
+	if g.Type == GIDTypeIB {
+		return nil
+	}
+	ip := net.IP(g.GID[:])
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// PortInfo holds information about an IB port.
+type PortInfo struct {
+	PortNum     int
+	State       PortState
+	PhysState   PhysPortState
+	ActiveSpeed LinkSpeed
+	ActiveWidth LinkWidth
+	LID         uint16
+	ActiveMTU   int
+	// GID is the entry at index 0 of the GID table, which holds the port
+	// GUID on InfiniBand.
+	GID [16]byte
+	// GIDs are the populated entries of the GID table, in index order.
+	GIDs      []GIDEntry
+	LinkLayer string
+}
+
+// DefaultRoCEv2GIDIndex returns the GID index RoCE v2 traffic should use by
+// default, or -1 if the port has no RoCE v2 GID. Like the NCCL and UCX
+// defaults, it prefers a GID derived from an IPv4 address, then one derived
+// from a global IPv6 address, then any RoCE v2 GID, e.g. the link-local one.
+func (p *PortInfo) DefaultRoCEv2GIDIndex() int {
+	best, bestRank := -1, 0
+	for _, g := range p.GIDs {
+		if g.Type != GIDTypeRoCEv2 {
+			continue
+		}
+		rank := 1
+		if ip := g.IP(); ip.To4() != nil {
+			rank = 3
+		} else if ip.IsGlobalUnicast() {
+			rank = 2
+		}
+		if rank > bestRank {
+			best, bestRank = g.Index, rank
+		}
+	}
+	return best
+}
+
+// AtomicCap is the atomic operation support of a device, as in
+// ibv_atomic_cap.
+type AtomicCap int
+
+const (
+	AtomicCapNone   AtomicCap = 0
+	AtomicCapHCA    AtomicCap = 1
+	AtomicCapGlobal AtomicCap = 2
+)
+
+func (a AtomicCap) String() string {
+	switch a {
+	case AtomicCapNone:
+		return "None"
+	case AtomicCapHCA:
+		return "HCA"
+	case AtomicCapGlobal:
+		return "Global"
+	default:
+		return "Unknown"
+	}
+}
+
+// DeviceCaps holds the capabilities of a device from ibv_query_device_ex.
+type DeviceCaps struct {
+	MaxQP     int
+	MaxCQ     int
+	MaxMR     int
+	MaxMRSize uint64
+	AtomicCap AtomicCap
+	// ODP is set if the device supports on-demand paging.
+	ODP bool
+	// DC reports whether the device supports the Dynamically Connected
+	// transport. Verbs has no capability bit for it, so it is probed
+	// through mlx5dv, and nil for devices where that is not possible.
+	DC *bool
+	// TagMatching is set if the device offloads MPI tag matching.
+	TagMatching bool
+	// MaxDeviceMemory is the size of the on-device memory that can be
+	// allocated with ibv_alloc_dm, 0 if there is none.
+	MaxDeviceMemory uint64
+}
+
+// DeviceInfo holds information about a single IB device.
+type DeviceInfo struct {
+	Name            string
+	NodeGUID        uint64
+	FirmwareVersion string
+	NumPorts        int
+	Ports           []PortInfo
+	NodeType        int // IBV_NODE_CA, IBV_NODE_SWITCH, etc.
+	TransportType   int
+	VendorID        uint32
+	DeviceID        uint32
+	// Caps is nil if the backend cannot query device capabilities.
+	Caps *DeviceCaps
+}
+
+// NodeGUIDString returns the node GUID as a formatted string.
+func (d *DeviceInfo) NodeGUIDString() string {
+	return fmt.Sprintf("%016x", d.NodeGUID)
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ibverbs
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gidEntry(index int, typ GIDType, ip string) GIDEntry {
+	g := GIDEntry{Index: index, Type: typ}
+	copy(g.GID[:], net.ParseIP(ip).To16())
+	return g
+}
+
+func TestDefaultRoCEv2GIDIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		gids []GIDEntry
+		want int
+	}{
+		{name: "no GIDs", want: -1},
+		{
+			name: "InfiniBand",
+			gids: []GIDEntry{gidEntry(0, GIDTypeIB, "fe80::ec0d:9a03:78:6a4c")},
+			want: -1,
+		},
+		{
+			name: "RoCE v1 only",
+			gids: []GIDEntry{gidEntry(0, GIDTypeRoCEv1, "fe80::a288:c2ff:fe11:2233")},
+			want: -1,
+		},
+		{
+			name: "link-local only",
+			gids: []GIDEntry{
+				gidEntry(0, GIDTypeRoCEv1, "fe80::a288:c2ff:fe11:2233"),
+				gidEntry(1, GIDTypeRoCEv2, "fe80::a288:c2ff:fe11:2233"),
+			},
+			want: 1,
+		},
+		{
+			name: "global IPv6 over link-local",
+			gids: []GIDEntry{
+				gidEntry(1, GIDTypeRoCEv2, "fe80::a288:c2ff:fe11:2233"),
+				gidEntry(3, GIDTypeRoCEv2, "2001:db8::10"),
+			},
+			want: 3,
+		},
+		{
+			name: "IPv4 over IPv6",
+			gids: []GIDEntry{
+				gidEntry(1, GIDTypeRoCEv2, "fe80::a288:c2ff:fe11:2233"),
+				gidEntry(3, GIDTypeRoCEv2, "2001:db8::10"),
+				gidEntry(4, GIDTypeRoCEv1, "192.0.2.10"),
+				gidEntry(5, GIDTypeRoCEv2, "192.0.2.10"),
+				gidEntry(7, GIDTypeRoCEv2, "192.0.2.11"),
+			},
+			want: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := PortInfo{GIDs: tt.gids}
+			assert.Equal(t, tt.want, p.DefaultRoCEv2GIDIndex())
+		})
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of the result label of WebhookAdmissions.
+const (
+	AdmissionAllowed = "allowed"
+	AdmissionDenied  = "denied"
+	AdmissionError   = "error"
+)
+
+// Values of the kind label of NetnsReturnDuration and NetnsReturnFailures.
+const (
+	KindNetdev = "netdev"
+	KindRDMA   = "rdma"
+)
+
+var (
+	// InventoryScanDuration and InventoryScanErrors track the scans of the
+	// IB inventory. InventoryLastScan is when the last scan succeeded, for
+	// alerting on an inventory that stopped updating.
+	InventoryScanDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "ib",
+		Subsystem: "inventory",
+		Name:      "scan_duration_seconds",
+		Help:      "Duration of IB device discovery scans.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	InventoryScanErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ib",
+		Subsystem: "inventory",
+		Name:      "scan_errors_total",
+		Help:      "IB device discovery scans that failed.",
+	})
+	InventoryLastScan = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ib",
+		Subsystem: "inventory",
+		Name:      "last_successful_scan_timestamp_seconds",
+		Help:      "Unix time of the last successful IB device discovery scan.",
+	})
+	// InventoryDevices counts the discovered devices by type, PF or VF, and
+	// port state.
+	InventoryDevices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ib",
+		Subsystem: "inventory",
+		Name:      "published_devices",
+		Help:      "IB devices published in the ResourceSlice, by type and port state.",
+	}, []string{"type", "state"})
+
+	// VFProvisionAttempts, VFProvisionFailures and VFProvisionDuration
+	// track the creation of SR-IOV VFs, by PF PCI address.
+	VFProvisionAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ib",
+		Subsystem: "sriov",
+		Name:      "vf_provisioning_attempts_total",
+		Help:      "Attempts to provision the VFs of a PF.",
+	}, []string{"pf"})
+	VFProvisionFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ib",
+		Subsystem: "sriov",
+		Name:      "vf_provisioning_failures_total",
+		Help:      "Failed attempts to provision the VFs of a PF.",
+	}, []string{"pf"})
+	VFProvisionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ib",
+		Subsystem: "sriov",
+		Name:      "vf_provisioning_duration_seconds",
+		Help:      "Duration of attempts to provision the VFs of a PF, including waiting for them to appear.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 8),
+	}, []string{"pf"})
+	// VFResetBlocked is the number of allocated VFs that keep the VF count
+	// of a PF from being changed, 0 once it is.
+	VFResetBlocked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ib",
+		Subsystem: "sriov",
+		Name:      "vf_reset_blocking_vfs",
+		Help:      "Allocated VFs that defer changing the VF count of a PF until they are released.",
+	}, []string{"pf"})
+
+	// NetnsReturnDuration and NetnsReturnFailures track the netdevs and
+	// RDMA devices the plugin moves back to the host when a pod is torn
+	// down, by kind. The moves into pods are done by DRANET.
+	NetnsReturnDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ib",
+		Subsystem: "netns",
+		Name:      "return_duration_seconds",
+		Help:      "Duration of successful returns of devices from pod network namespaces to the host.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind"})
+	NetnsReturnFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ib",
+		Subsystem: "netns",
+		Name:      "return_failures_total",
+		Help:      "Failed returns of devices from pod network namespaces to the host.",
+	}, []string{"kind"})
+
+	// WebhookAdmissions counts the admission requests handled by the
+	// webhook, by result.
+	WebhookAdmissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ib",
+		Subsystem: "webhook",
+		Name:      "admission_requests_total",
+		Help:      "Admission requests handled by the webhook, by result: allowed, denied, or error for requests that could not be evaluated.",
+	}, []string{"result"})
+)
+
+// PluginCollectors returns the operational metrics of the kubelet plugin.
+func PluginCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		InventoryScanDuration,
+		InventoryScanErrors,
+		InventoryLastScan,
+		InventoryDevices,
+		VFProvisionAttempts,
+		VFProvisionFailures,
+		VFProvisionDuration,
+		VFResetBlocked,
+		NetnsReturnDuration,
+		NetnsReturnFailures,
+	}
+}
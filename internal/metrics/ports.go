@@ -0,0 +1,187 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/netns"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+// Port is an IB port published as a DRA device.
+type Port struct {
+	// Device is the DRA device name.
+	Device    string
+	IBDevName string
+	PortNum   int
+	// NetNs is the network namespace of the pod the RDMA device was moved
+	// to in exclusive RDMA netns mode, where its counters are, and empty
+	// while the device is on the host.
+	NetNs string
+}
+
+// Owner identifies the ResourceClaim a device is allocated to.
+type Owner struct {
+	Namespace string
+	Claim     string
+	// Pods are the pods the claim is reserved for.
+	Pods []string
+}
+
+// PortLister lists the IB ports published as DRA devices, including those
+// handed to pods.
+type PortLister interface {
+	Ports() []Port
+}
+
+// OwnerLookup finds the claim a device is allocated to.
+type OwnerLookup interface {
+	// DeviceOwner returns the owner of device, or false if it is not
+	// allocated.
+	DeviceOwner(device string) (Owner, bool)
+}
+
+// portLabels are the labels of every port metric. namespace, claim and pod
+// are empty while the device is not allocated.
+var portLabels = []string{"device", "node", "ib_device", "port", "namespace", "claim", "pod"}
+
+// portCounter maps a file below ports/<n>/counters to a metric.
+type portCounter struct {
+	file string
+	desc *prometheus.Desc
+	// scale converts the counter to the unit of the metric.
+	scale uint64
+}
+
+func newPortCounter(file, name, help string, scale uint64) portCounter {
+	return portCounter{
+		file:  file,
+		desc:  prometheus.NewDesc(prometheus.BuildFQName("ib", "port", name), help, portLabels, nil),
+		scale: scale,
+	}
+}
+
+// portCounters are the IBA PortCounters exported for every port. The data
+// counters count 4-octet words.
+var portCounters = []portCounter{
+	newPortCounter("port_xmit_data", "transmit_bytes_total", "Data octets transmitted on the port.", 4),
+	newPortCounter("port_rcv_data", "receive_bytes_total", "Data octets received on the port.", 4),
+	newPortCounter("port_xmit_packets", "transmit_packets_total", "Packets transmitted on the port.", 1),
+	newPortCounter("port_rcv_packets", "receive_packets_total", "Packets received on the port.", 1),
+	newPortCounter("symbol_error", "symbol_errors_total", "Minor link errors detected on one or more physical lanes.", 1),
+	newPortCounter("link_downed", "link_downed_total", "Times the port failed link error recovery and downed the link.", 1),
+	newPortCounter("link_error_recovery", "link_error_recovery_total", "Times the port completed link error recovery.", 1),
+	newPortCounter("port_rcv_errors", "receive_errors_total", "Packets with errors received on the port.", 1),
+	newPortCounter("port_rcv_remote_physical_errors", "receive_remote_physical_errors_total", "Packets received with the EBP delimiter marking a remote physical error.", 1),
+	newPortCounter("port_xmit_discards", "transmit_discards_total", "Outbound packets discarded because the port was down or congested.", 1),
+	newPortCounter("port_xmit_wait", "transmit_wait_total", "Ticks during which the port had data to transmit but no flow-control credits.", 1),
+	newPortCounter("local_link_integrity_errors", "local_link_integrity_errors_total", "Times the local physical link error threshold was exceeded.", 1),
+	newPortCounter("excessive_buffer_overrun_errors", "excessive_buffer_overrun_errors_total", "Times consecutive receive buffer overruns exceeded the threshold.", 1),
+}
+
+var hwCounterDesc = prometheus.NewDesc(
+	prometheus.BuildFQName("ib", "port", "hw_counter_total"),
+	"Driver-specific counter of the port from hw_counters.",
+	append([]string{"counter"}, portLabels...), nil,
+)
+
+// PortCollector exports the performance counters of the published IB ports,
+// read from sysfs on every scrape.
+type PortCollector struct {
+	fs     sysfs.FS
+	node   string
+	ports  PortLister
+	owners OwnerLookup
+	// netnsSysfs calls fn with the sysfs of a pod network namespace.
+	netnsSysfs func(nsPath string, fn func(fs sysfs.FS) error) error
+}
+
+var _ prometheus.Collector = &PortCollector{}
+
+// NewPortCollector returns a collector for the counters of the ports of
+// node. owners may be nil, in which case no port is reported as allocated.
+func NewPortCollector(fs sysfs.FS, node string, ports PortLister, owners OwnerLookup) *PortCollector {
+	return &PortCollector{fs: fs, node: node, ports: ports, owners: owners, netnsSysfs: podSysfs}
+}
+
+// podSysfs calls fn with a sysfs mounted in the network namespace nsPath.
+func podSysfs(nsPath string, fn func(fs sysfs.FS) error) error {
+	return netns.WithSysfs(nsPath, func(root string) error {
+		return fn(sysfs.New(root))
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (c *PortCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, pc := range portCounters {
+		ch <- pc.desc
+	}
+	ch <- hwCounterDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *PortCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, port := range c.ports.Ports() {
+		counters, err := c.portCounters(port)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(portCounters[0].desc, err)
+			continue
+		}
+		labels := c.labels(port)
+		for _, pc := range portCounters {
+			val, ok := counters.Counters[pc.file]
+			if !ok {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(pc.desc, prometheus.CounterValue, float64(val*pc.scale), labels...)
+		}
+		for name, val := range counters.HWCounters {
+			ch <- prometheus.MustNewConstMetric(hwCounterDesc, prometheus.CounterValue, float64(val), append([]string{name}, labels...)...)
+		}
+	}
+}
+
+// portCounters reads the counters of port, from the sysfs of the pod it is
+// in if its RDMA device was moved there.
+func (c *PortCollector) portCounters(port Port) (*sysfs.PortCounters, error) {
+	if port.NetNs == "" {
+		return c.fs.GetPortCounters(port.IBDevName, port.PortNum)
+	}
+	var counters *sysfs.PortCounters
+	err := c.netnsSysfs(port.NetNs, func(fs sysfs.FS) error {
+		var err error
+		counters, err = fs.GetPortCounters(port.IBDevName, port.PortNum)
+		return err
+	})
+	return counters, err
+}
+
+// labels returns the values of portLabels for port.
+func (c *PortCollector) labels(port Port) []string {
+	var owner Owner
+	if c.owners != nil {
+		owner, _ = c.owners.DeviceOwner(port.Device)
+	}
+	return []string{
+		port.Device, c.node, port.IBDevName, strconv.Itoa(port.PortNum),
+		owner.Namespace, owner.Claim, strings.Join(owner.Pods, ","),
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+type fakePorts []Port
+
+func (p fakePorts) Ports() []Port { return p }
+
+type fakeOwners map[string]Owner
+
+func (o fakeOwners) DeviceOwner(device string) (Owner, bool) {
+	owner, ok := o[device]
+	return owner, ok
+}
+
+func TestPortCollector(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 1))
+	require.NoError(t, tree.SetPortCounter("mlx5_0", 1, "counters/port_xmit_data", 250))
+	require.NoError(t, tree.SetPortCounter("mlx5_1", 1, "counters/port_rcv_data", 1000))
+	require.NoError(t, tree.SetPortCounter("mlx5_1", 1, "counters/symbol_error", 2))
+	require.NoError(t, tree.SetPortCounter("mlx5_1", 1, "hw_counters/out_of_buffer", 5))
+
+	c := NewPortCollector(sysfs.New(tree.Root), "node-a",
+		fakePorts{
+			{Device: "mlx5-0-port1", IBDevName: "mlx5_0", PortNum: 1},
+			{Device: "mlx5-1-port1", IBDevName: "mlx5_1", PortNum: 1},
+		},
+		fakeOwners{"mlx5-1-port1": {Namespace: "team-a", Claim: "job-ib", Pods: []string{"job-0"}}},
+	)
+
+	const want = `
+# HELP ib_port_hw_counter_total Driver-specific counter of the port from hw_counters.
+# TYPE ib_port_hw_counter_total counter
+ib_port_hw_counter_total{claim="job-ib",counter="out_of_buffer",device="mlx5-1-port1",ib_device="mlx5_1",namespace="team-a",node="node-a",pod="job-0",port="1"} 5
+# HELP ib_port_receive_bytes_total Data octets received on the port.
+# TYPE ib_port_receive_bytes_total counter
+ib_port_receive_bytes_total{claim="",device="mlx5-0-port1",ib_device="mlx5_0",namespace="",node="node-a",pod="",port="1"} 0
+ib_port_receive_bytes_total{claim="job-ib",device="mlx5-1-port1",ib_device="mlx5_1",namespace="team-a",node="node-a",pod="job-0",port="1"} 4000
+# HELP ib_port_symbol_errors_total Minor link errors detected on one or more physical lanes.
+# TYPE ib_port_symbol_errors_total counter
+ib_port_symbol_errors_total{claim="",device="mlx5-0-port1",ib_device="mlx5_0",namespace="",node="node-a",pod="",port="1"} 0
+ib_port_symbol_errors_total{claim="job-ib",device="mlx5-1-port1",ib_device="mlx5_1",namespace="team-a",node="node-a",pod="job-0",port="1"} 2
+# HELP ib_port_transmit_bytes_total Data octets transmitted on the port.
+# TYPE ib_port_transmit_bytes_total counter
+ib_port_transmit_bytes_total{claim="",device="mlx5-0-port1",ib_device="mlx5_0",namespace="",node="node-a",pod="",port="1"} 1000
+ib_port_transmit_bytes_total{claim="job-ib",device="mlx5-1-port1",ib_device="mlx5_1",namespace="team-a",node="node-a",pod="job-0",port="1"} 0
+`
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(want),
+		"ib_port_hw_counter_total",
+		"ib_port_receive_bytes_total",
+		"ib_port_symbol_errors_total",
+		"ib_port_transmit_bytes_total",
+	))
+	assert.Equal(t, 2*len(portCounters)+1, testutil.CollectAndCount(c))
+}
+
+func TestPortCollectorAllocatedPortInPod(t *testing.T) {
+	// In exclusive RDMA netns mode the RDMA device of an allocated port is
+	// only in the sysfs of its pod.
+	host, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	pod, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, pod.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 1))
+	require.NoError(t, pod.SetPortCounter("mlx5_1", 1, "counters/port_rcv_data", 1000))
+
+	c := NewPortCollector(sysfs.New(host.Root), "node-a",
+		fakePorts{{Device: "mlx5-1-port1", IBDevName: "mlx5_1", PortNum: 1, NetNs: "/var/run/netns/job-0"}},
+		fakeOwners{"mlx5-1-port1": {Namespace: "team-a", Claim: "job-ib", Pods: []string{"job-0"}}},
+	)
+	var netNs []string
+	c.netnsSysfs = func(nsPath string, fn func(fs sysfs.FS) error) error {
+		netNs = append(netNs, nsPath)
+		return fn(sysfs.New(pod.Root))
+	}
+
+	const want = `
+# HELP ib_port_receive_bytes_total Data octets received on the port.
+# TYPE ib_port_receive_bytes_total counter
+ib_port_receive_bytes_total{claim="job-ib",device="mlx5-1-port1",ib_device="mlx5_1",namespace="team-a",node="node-a",pod="job-0",port="1"} 4000
+`
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(want), "ib_port_receive_bytes_total"))
+	assert.Equal(t, []string{"/var/run/netns/job-0"}, netNs)
+}
+
+func TestPortCollectorMissingPort(t *testing.T) {
+	c := NewPortCollector(sysfs.New(t.TempDir()), "node-a",
+		fakePorts{{Device: "mlx5-0-port1", IBDevName: "mlx5_0", PortNum: 1}}, nil)
+	reg, err := NewRegistry(c)
+	require.NoError(t, err)
+
+	// The other metrics are still gathered.
+	families, err := reg.Gather()
+	assert.ErrorContains(t, err, "mlx5_0")
+	assert.NotEmpty(t, families)
+}
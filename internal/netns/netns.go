@@ -17,115 +17,364 @@
 // Package netns provides helpers for moving InfiniBand network devices and
 // RDMA devices between Linux network namespaces. This is used to isolate
 // IB devices for containers.
+//
+// Devices are moved with rtnetlink and RDMA netlink. Failures are returned as
+// *Error, which wraps the errno reported by the kernel, so that callers can
+// test for unix.ENODEV, unix.EBUSY or unix.EOPNOTSUPP with errors.Is, and for
+// ErrAlreadyInNetns when a device has been moved before.
 package netns
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os/exec"
-	"strconv"
-	"strings"
 
+	"github.com/vishvananda/netlink"
+	vnetns "github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 )
 
+// ErrAlreadyInNetns is wrapped by the errors of the move functions when the
+// device is not in the source network namespace because it is already in the
+// target one.
+var ErrAlreadyInNetns = errors.New("already in target network namespace")
+
+// Error records an operation on a device that failed.
+type Error struct {
+	// Op is the operation, e.g. "move netdev".
+	Op string
+	// Device is the netdev or RDMA device, if any.
+	Device string
+	// Err is the errno reported by the kernel, ErrAlreadyInNetns, or another
+	// error when the failure did not come from the kernel.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Device == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Device, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError returns an *Error for err, translating the errors of the netlink
+// library that do not carry an errno.
+func newError(op, device string, err error) error {
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		err = unix.ENODEV
+	}
+	// No RDMA netlink in the kernel, i.e. ib_core is not loaded.
+	if errors.Is(err, unix.EPROTONOSUPPORT) {
+		err = unix.EOPNOTSUPP
+	}
+	return &Error{Op: op, Device: device, Err: err}
+}
+
 // MoveNetdevToContainerNetns moves a network device into a container's network
-// namespace identified by the container's PID. This is typically called from
-// a CDI createRuntime hook.
+// namespace identified by the container's PID, and brings it up there. This is
+// typically called from a CDI createRuntime hook.
+//
+// If the netdev is already in the container's namespace, it is only brought
+// up and an error wrapping ErrAlreadyInNetns is returned, so that the move can
+// be retried and repeated for every container of a pod.
 func MoveNetdevToContainerNetns(ctx context.Context, netdev string, containerPID int) error {
+	target, err := pidNetns(containerPID)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	return moveNetdevTo(ctx, netdev, target)
+}
+
+func moveNetdevTo(ctx context.Context, netdev string, target vnetns.NsHandle) error {
 	logger := klog.FromContext(ctx)
-	logger.V(2).Info("Moving netdev to container netns", "netdev", netdev, "pid", containerPID)
 
-	// ip link set <netdev> netns <pid>
-	cmd := exec.Command("ip", "link", "set", netdev, "netns", strconv.Itoa(containerPID))
-	output, err := cmd.CombinedOutput()
+	h, err := netlink.NewHandleAt(target)
 	if err != nil {
-		return fmt.Errorf("move netdev %s to netns of pid %d: %w (output: %s)", netdev, containerPID, err, strings.TrimSpace(string(output)))
+		return newError("open netlink socket", "", err)
 	}
+	defer h.Close()
 
-	// Bring up the interface inside the container netns
-	cmd = exec.Command("nsenter", "-t", strconv.Itoa(containerPID), "-n", "--",
-		"ip", "link", "set", netdev, "up")
-	output, err = cmd.CombinedOutput()
+	link, err := netlink.LinkByName(netdev)
 	if err != nil {
-		return fmt.Errorf("bring up netdev %s in container netns: %w (output: %s)", netdev, err, strings.TrimSpace(string(output)))
+		inTarget, _ := netdevIn(h, netdev)
+		if !inTarget {
+			return newError("get netdev", netdev, err)
+		}
+		logger.V(2).Info("Netdev already in target netns", "netdev", netdev)
+		if err := setNetdevUp(h, netdev); err != nil {
+			return err
+		}
+		return &Error{Op: "move netdev", Device: netdev, Err: ErrAlreadyInNetns}
 	}
 
-	return nil
+	// The kernel flushes the addresses of a netdev that changes namespace.
+	// RoCE needs them in the pod: its GIDs are derived from them.
+	addrs, err := linkAddrs(&netlink.Handle{}, link)
+	if err != nil {
+		return newError("list addresses of netdev", netdev, err)
+	}
+
+	logger.V(2).Info("Moving netdev to target netns", "netdev", netdev, "addrs", len(addrs))
+	if err := netlink.LinkSetNsFd(link, int(target)); err != nil {
+		return newError("move netdev", netdev, err)
+	}
+	if err := setNetdevUp(h, netdev); err != nil {
+		return err
+	}
+	return addAddrs(h, netdev, addrs)
 }
 
-// MoveNetdevToHostNetns moves a network device back to the host (init) network
-// namespace. This is called during device unprepare / cleanup.
+// MoveNetdevToHostNetns moves a network device from a container's network
+// namespace back to the host (current) network namespace. This is called
+// during device unprepare / cleanup. If the netdev is already in the host
+// namespace, an error wrapping ErrAlreadyInNetns is returned.
 func MoveNetdevToHostNetns(ctx context.Context, netdev string, containerPID int) error {
-	logger := klog.FromContext(ctx)
-	logger.V(2).Info("Moving netdev back to host netns", "netdev", netdev, "pid", containerPID)
+	source, err := pidNetns(containerPID)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	return moveNetdevFrom(ctx, netdev, source)
+}
+
+func moveNetdevFrom(ctx context.Context, netdev string, source vnetns.NsHandle) error {
+	h, err := netlink.NewHandleAt(source)
+	if err != nil {
+		return newError("open netlink socket", "", err)
+	}
+	defer h.Close()
 
-	// nsenter into container netns, then move device to PID 1's netns (host)
-	cmd := exec.Command("nsenter", "-t", strconv.Itoa(containerPID), "-n", "--",
-		"ip", "link", "set", netdev, "netns", "1")
-	output, err := cmd.CombinedOutput()
+	link, err := h.LinkByName(netdev)
 	if err != nil {
-		return fmt.Errorf("move netdev %s back to host netns: %w (output: %s)", netdev, err, strings.TrimSpace(string(output)))
+		if inHost, _ := netdevIn(&netlink.Handle{}, netdev); inHost {
+			return &Error{Op: "move netdev", Device: netdev, Err: ErrAlreadyInNetns}
+		}
+		return newError("get netdev", netdev, err)
 	}
 
+	hostNs, err := vnetns.Get()
+	if err != nil {
+		return newError("open host netns", "", err)
+	}
+	defer hostNs.Close()
+
+	klog.FromContext(ctx).V(2).Info("Moving netdev back to host netns", "netdev", netdev)
+	if err := h.LinkSetNsFd(link, int(hostNs)); err != nil {
+		return newError("move netdev", netdev, err)
+	}
 	return nil
 }
 
 // MoveRDMADevToContainerNetns moves an RDMA device into a container's network
 // namespace. Requires the host RDMA subsystem to be in "exclusive" netns mode
-// (rdma system set netns exclusive).
+// (see EnsureRDMAExclusiveMode); in shared mode the kernel refuses the move
+// with EOPNOTSUPP. If the device is already in the container's namespace, an
+// error wrapping ErrAlreadyInNetns is returned.
 func MoveRDMADevToContainerNetns(ctx context.Context, rdmaDev string, containerPID int) error {
-	logger := klog.FromContext(ctx)
-	logger.V(2).Info("Moving RDMA device to container netns", "rdmaDev", rdmaDev, "pid", containerPID)
+	target, err := pidNetns(containerPID)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	return moveRDMADevTo(ctx, rdmaDev, target)
+}
 
-	// rdma dev set <rdmaDev> netns <pid>
-	cmd := exec.Command("rdma", "dev", "set", rdmaDev, "netns", strconv.Itoa(containerPID))
-	output, err := cmd.CombinedOutput()
+func moveRDMADevTo(ctx context.Context, rdmaDev string, target vnetns.NsHandle) error {
+	link, err := rdmaLinkByName(&netlink.Handle{}, rdmaDev)
+	if errors.Is(err, unix.ENODEV) {
+		if inTarget, _ := rdmaDevInNetns(rdmaDev, target); inTarget {
+			return &Error{Op: "move RDMA device", Device: rdmaDev, Err: ErrAlreadyInNetns}
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("move RDMA device %s to netns of pid %d: %w (output: %s)", rdmaDev, containerPID, err, strings.TrimSpace(string(output)))
+		return err
 	}
 
+	klog.FromContext(ctx).V(2).Info("Moving RDMA device to target netns", "rdmaDev", rdmaDev)
+	if err := netlink.RdmaLinkSetNsFd(link, uint32(target)); err != nil {
+		return newError("move RDMA device", rdmaDev, err)
+	}
 	return nil
 }
 
+// NetdevInContainerNetns reports whether a network device exists in the
+// network namespace of the container identified by containerPID.
+func NetdevInContainerNetns(netdev string, containerPID int) (bool, error) {
+	ns, err := pidNetns(containerPID)
+	if err != nil {
+		return false, err
+	}
+	defer ns.Close()
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return false, newError("open netlink socket", "", err)
+	}
+	defer h.Close()
+	return netdevIn(h, netdev)
+}
+
+// RDMADevInContainerNetns reports whether an RDMA device is visible in the
+// network namespace of the container identified by containerPID. In shared
+// RDMA netns mode every device is visible everywhere.
+func RDMADevInContainerNetns(rdmaDev string, containerPID int) (bool, error) {
+	ns, err := pidNetns(containerPID)
+	if err != nil {
+		return false, err
+	}
+	defer ns.Close()
+	return rdmaDevInNetns(rdmaDev, ns)
+}
+
+// RDMANetnsMode returns the network namespace mode of the RDMA subsystem,
+// "shared" or "exclusive". Kernels without RDMA netns support, or without
+// ib_core loaded, fail with EOPNOTSUPP.
+func RDMANetnsMode() (string, error) {
+	return rdmaNetnsMode(&netlink.Handle{})
+}
+
 // EnsureRDMAExclusiveMode sets the RDMA subsystem to exclusive network
-// namespace mode. In this mode, RDMA devices are isolated per-netns.
+// namespace mode. In this mode, RDMA devices are isolated per-netns. The
+// kernel refuses the change with EBUSY while network namespaces other than
+// the initial one exist.
 func EnsureRDMAExclusiveMode(ctx context.Context) error {
 	logger := klog.FromContext(ctx)
 
-	// Check current mode
-	cmd := exec.Command("rdma", "system")
-	output, err := cmd.CombinedOutput()
+	mode, err := rdmaNetnsMode(&netlink.Handle{})
 	if err != nil {
-		return fmt.Errorf("query rdma system mode: %w (output: %s)", err, strings.TrimSpace(string(output)))
+		return err
 	}
-
-	if strings.Contains(string(output), "exclusive") {
+	if mode == "exclusive" {
 		logger.V(2).Info("RDMA subsystem already in exclusive netns mode")
 		return nil
 	}
 
 	logger.Info("Setting RDMA subsystem to exclusive netns mode")
-	cmd = exec.Command("rdma", "system", "set", "netns", "exclusive")
-	output, err = cmd.CombinedOutput()
+	if err := netlink.RdmaSystemSetNetnsMode("exclusive"); err != nil {
+		return newError("set RDMA netns mode", "", err)
+	}
+	return nil
+}
+
+func pidNetns(pid int) (vnetns.NsHandle, error) {
+	ns, err := vnetns.GetFromPid(pid)
 	if err != nil {
-		return fmt.Errorf("set rdma netns exclusive: %w (output: %s)", err, strings.TrimSpace(string(output)))
+		return ns, fmt.Errorf("open netns of pid %d: %w", pid, err)
 	}
+	return ns, nil
+}
 
+func setNetdevUp(h *netlink.Handle, netdev string) error {
+	link, err := h.LinkByName(netdev)
+	if err != nil {
+		return newError("get netdev", netdev, err)
+	}
+	if err := h.LinkSetUp(link); err != nil {
+		return newError("bring up netdev", netdev, err)
+	}
 	return nil
 }
 
-// GenerateMoveNetdevCommand returns the command and args that should be used
-// as a CDI hook to move a network device into a container's namespace.
-// The pluginBinary is the path to the DRA plugin binary which is re-invoked
-// as a helper.
-func GenerateMoveNetdevCommand(pluginBinary, netdev, rdmaDev string) (string, []string) {
-	args := []string{
-		"move-netdev",
-		"--netdev", netdev,
+// linkAddrs returns the global addresses of a link. Link-local addresses are
+// left out, the kernel assigns them itself.
+func linkAddrs(h *netlink.Handle, link netlink.Link) ([]netlink.Addr, error) {
+	all, err := h.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []netlink.Addr
+	for _, addr := range all {
+		if addr.Scope == unix.RT_SCOPE_UNIVERSE {
+			addrs = append(addrs, addr)
+		}
 	}
-	if rdmaDev != "" {
-		args = append(args, "--rdma-dev", rdmaDev)
+	return addrs, nil
+}
+
+// addAddrs adds addresses taken from another link, possibly in another
+// namespace, to a netdev.
+func addAddrs(h *netlink.Handle, netdev string, addrs []netlink.Addr) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	link, err := h.LinkByName(netdev)
+	if err != nil {
+		return newError("get netdev", netdev, err)
+	}
+	for _, addr := range addrs {
+		// The label names the old link, and flags such as tentative are
+		// the kernel's to set.
+		addr.Label = ""
+		addr.Flags = 0
+		if err := h.AddrReplace(link, &addr); err != nil {
+			return newError("add address "+addr.IPNet.String()+" to netdev", netdev, err)
+		}
+	}
+	return nil
+}
+
+func netdevIn(h *netlink.Handle, netdev string) (bool, error) {
+	_, err := h.LinkByName(netdev)
+	if err == nil {
+		return true, nil
+	}
+	err = newError("get netdev", netdev, err)
+	if errors.Is(err, unix.ENODEV) {
+		return false, nil
+	}
+	return false, err
+}
+
+func rdmaDevInNetns(rdmaDev string, ns vnetns.NsHandle) (bool, error) {
+	h, err := netlink.NewHandleAt(ns, unix.NETLINK_RDMA)
+	if err != nil {
+		return false, newError("open RDMA netlink socket", "", err)
+	}
+	defer h.Close()
+
+	_, err = rdmaLinkByName(h, rdmaDev)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, unix.ENODEV) {
+		return false, nil
+	}
+	return false, err
+}
+
+// rdmaLinkByName is netlink's RdmaLinkByName with an ENODEV error when the
+// device does not exist.
+func rdmaLinkByName(h *netlink.Handle, rdmaDev string) (*netlink.RdmaLink, error) {
+	links, err := h.RdmaLinkList()
+	if err != nil {
+		return nil, newError("list RDMA devices", "", err)
+	}
+	for _, link := range links {
+		if link.Attrs.Name == rdmaDev {
+			return link, nil
+		}
+	}
+	return nil, &Error{Op: "get RDMA device", Device: rdmaDev, Err: unix.ENODEV}
+}
+
+// rdmaNetnsMode returns the netns mode of the RDMA subsystem, "shared" or
+// "exclusive". Kernels without RDMA netns support fail with EOPNOTSUPP.
+func rdmaNetnsMode(h *netlink.Handle) (string, error) {
+	mode, err := h.RdmaSystemGetNetnsMode()
+	if err != nil {
+		var errno unix.Errno
+		if !errors.As(err, &errno) {
+			// The kernel answered without the netns mode attribute.
+			err = unix.EOPNOTSUPP
+		}
+		return "", newError("query RDMA netns mode", "", err)
 	}
-	return pluginBinary, args
+	return mode, nil
 }
@@ -0,0 +1,166 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	vnetns "github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// withTestNetns switches the test goroutine into a throwaway "host" network
+// namespace and returns it together with a second, "container", namespace.
+// It skips the test unless it can create network namespaces.
+func withTestNetns(t *testing.T) (host, container vnetns.NsHandle) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("creating network namespaces requires root")
+	}
+
+	// The thread is left locked: if the namespace cannot be restored, the
+	// runtime drops the thread when the test goroutine exits.
+	runtime.LockOSThread()
+	orig, err := vnetns.Get()
+	require.NoError(t, err)
+	container, err = vnetns.New()
+	if err != nil {
+		orig.Close()
+		t.Skipf("create netns: %v", err)
+	}
+	host, err = vnetns.New()
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		if err := vnetns.Set(orig); err == nil {
+			runtime.UnlockOSThread()
+		}
+		host.Close()
+		container.Close()
+		orig.Close()
+	})
+	return host, container
+}
+
+func addDummy(t *testing.T, name string) {
+	t.Helper()
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	err := netlink.LinkAdd(dummy)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skipf("dummy links not supported by the kernel: %v", err)
+	}
+	require.NoError(t, err)
+}
+
+func TestMoveNetdev(t *testing.T) {
+	_, container := withTestNetns(t)
+	ctx := context.Background()
+	addDummy(t, "ibtest0")
+	dummy, err := netlink.LinkByName("ibtest0")
+	require.NoError(t, err)
+	addr, err := netlink.ParseAddr("192.0.2.10/24")
+	require.NoError(t, err)
+	require.NoError(t, netlink.AddrAdd(dummy, addr))
+
+	require.NoError(t, moveNetdevTo(ctx, "ibtest0", container))
+
+	h, err := netlink.NewHandleAt(container)
+	require.NoError(t, err)
+	defer h.Close()
+	link, err := h.LinkByName("ibtest0")
+	require.NoError(t, err, "netdev must be in the container netns")
+	assert.NotZero(t, link.Attrs().Flags&unix.IFF_UP, "netdev must be up")
+	addrs, err := h.AddrList(link, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.Len(t, addrs, 1, "address must move with the netdev")
+	assert.Equal(t, "192.0.2.10/24", addrs[0].IPNet.String())
+	_, err = netlink.LinkByName("ibtest0")
+	assert.Error(t, err, "netdev must be gone from the host netns")
+
+	// Moving again only reports that it has been moved before.
+	err = moveNetdevTo(ctx, "ibtest0", container)
+	assert.ErrorIs(t, err, ErrAlreadyInNetns)
+
+	require.NoError(t, moveNetdevFrom(ctx, "ibtest0", container))
+	_, err = netlink.LinkByName("ibtest0")
+	assert.NoError(t, err, "netdev must be back in the host netns")
+
+	err = moveNetdevFrom(ctx, "ibtest0", container)
+	assert.ErrorIs(t, err, ErrAlreadyInNetns)
+}
+
+func TestMoveMissingDevice(t *testing.T) {
+	_, container := withTestNetns(t)
+	ctx := context.Background()
+
+	err := moveNetdevTo(ctx, "nosuchdev", container)
+	assert.ErrorIs(t, err, unix.ENODEV)
+	assert.NotErrorIs(t, err, ErrAlreadyInNetns)
+
+	err = moveNetdevFrom(ctx, "nosuchdev", container)
+	assert.ErrorIs(t, err, unix.ENODEV)
+
+	// Without ib_core there is no RDMA netlink at all.
+	err = moveRDMADevTo(ctx, "mlx5_nosuchdev", container)
+	assert.True(t, errors.Is(err, unix.ENODEV) || errors.Is(err, unix.EOPNOTSUPP), "unexpected error: %v", err)
+	var nsErr *Error
+	assert.ErrorAs(t, err, &nsErr)
+}
+
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+		wantMsg string
+	}{
+		{
+			name:    "link not found",
+			err:     netlink.LinkNotFoundError{},
+			wantErr: unix.ENODEV,
+			wantMsg: "get netdev ib0: no such device",
+		},
+		{
+			name:    "no RDMA netlink",
+			err:     unix.EPROTONOSUPPORT,
+			wantErr: unix.EOPNOTSUPP,
+			wantMsg: "get netdev ib0: operation not supported",
+		},
+		{
+			name:    "errno",
+			err:     unix.EBUSY,
+			wantErr: unix.EBUSY,
+			wantMsg: "get netdev ib0: device or resource busy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newError("get netdev", "ib0", tt.err)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.EqualError(t, err, tt.wantMsg)
+		})
+	}
+
+	assert.EqualError(t, newError("set RDMA netns mode", "", unix.EBUSY), "set RDMA netns mode: device or resource busy")
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	vnetns "github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// LinkState identifies a netdev by its hardware address, which survives
+// moves between namespaces and renames, and records the name, admin state
+// and global addresses to restore when it comes back to the host.
+type LinkState struct {
+	Name         string `json:"name"`
+	HardwareAddr string `json:"hardwareAddr"`
+	Up           bool   `json:"up"`
+	// Addrs are in CIDR notation. The kernel flushes them when the netdev
+	// changes namespace.
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// GetLinkState returns the state of a netdev in the current network
+// namespace.
+func GetLinkState(name string) (LinkState, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return LinkState{}, fmt.Errorf("get link %s: %w", name, err)
+	}
+	attrs := link.Attrs()
+	if len(attrs.HardwareAddr) == 0 {
+		return LinkState{}, fmt.Errorf("link %s has no hardware address", name)
+	}
+	addrs, err := linkAddrs(&netlink.Handle{}, link)
+	if err != nil {
+		return LinkState{}, fmt.Errorf("list addresses of link %s: %w", name, err)
+	}
+	state := LinkState{
+		Name:         name,
+		HardwareAddr: attrs.HardwareAddr.String(),
+		Up:           attrs.Flags&net.FlagUp != 0,
+	}
+	for _, addr := range addrs {
+		state.Addrs = append(state.Addrs, addr.IPNet.String())
+	}
+	return state, nil
+}
+
+// LinkInNetns reports whether the netdev of state is in the network namespace
+// at nsPath. A namespace that no longer exists contains nothing.
+func LinkInNetns(nsPath string, state LinkState) (bool, error) {
+	h, closeNs, err := handleAt(nsPath)
+	if err != nil || h == nil {
+		return false, err
+	}
+	defer closeNs()
+
+	link, err := linkByHardwareAddr(h, state.HardwareAddr)
+	return link != nil, err
+}
+
+// ReturnNetdevToHost moves the netdev of state from the network namespace at
+// nsPath to the current one, then restores its name, admin state and
+// addresses. It returns false if the netdev is not in that namespace.
+func ReturnNetdevToHost(ctx context.Context, nsPath string, state LinkState) (bool, error) {
+	h, closeNs, err := handleAt(nsPath)
+	if err != nil || h == nil {
+		return false, err
+	}
+	defer closeNs()
+
+	link, err := linkByHardwareAddr(h, state.HardwareAddr)
+	if err != nil || link == nil {
+		return false, err
+	}
+
+	hostNs, err := vnetns.Get()
+	if err != nil {
+		return false, fmt.Errorf("get host netns: %w", err)
+	}
+	defer hostNs.Close()
+
+	klog.FromContext(ctx).V(2).Info("Moving netdev back to host netns", "netdev", link.Attrs().Name, "netns", nsPath)
+	// The name used in the pod may clash in the host; it is restored below.
+	if err := h.LinkSetDown(link); err != nil {
+		return false, fmt.Errorf("set %s down in netns %s: %w", link.Attrs().Name, nsPath, err)
+	}
+	if err := h.LinkSetNsFd(link, int(hostNs)); err != nil {
+		return false, fmt.Errorf("move %s from netns %s to host: %w", link.Attrs().Name, nsPath, err)
+	}
+	if _, err := RestoreLink(ctx, state); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// RestoreLink restores the name, admin state and addresses of the netdev of
+// state in the current network namespace. It returns false if the netdev is not there.
+func RestoreLink(ctx context.Context, state LinkState) (bool, error) {
+	h := &netlink.Handle{}
+	link, err := linkByHardwareAddr(h, state.HardwareAddr)
+	if err != nil || link == nil {
+		return false, err
+	}
+
+	if name := link.Attrs().Name; name != state.Name {
+		klog.FromContext(ctx).V(2).Info("Restoring netdev name", "netdev", name, "name", state.Name)
+		if err := h.LinkSetDown(link); err != nil {
+			return true, fmt.Errorf("set %s down: %w", name, err)
+		}
+		if err := h.LinkSetName(link, state.Name); err != nil {
+			return true, fmt.Errorf("rename %s to %s: %w", name, state.Name, err)
+		}
+	}
+	if state.Up {
+		err = h.LinkSetUp(link)
+	} else {
+		err = h.LinkSetDown(link)
+	}
+	if err != nil {
+		return true, fmt.Errorf("restore admin state of %s: %w", state.Name, err)
+	}
+	for _, cidr := range state.Addrs {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			return true, fmt.Errorf("restore address of %s: %w", state.Name, err)
+		}
+		if err := h.AddrReplace(link, addr); err != nil {
+			return true, fmt.Errorf("restore address %s of %s: %w", cidr, state.Name, err)
+		}
+	}
+	return true, nil
+}
+
+// ReturnRDMADevToHost moves an RDMA device from the network namespace at
+// nsPath to the current one. It returns false if the device is not in that
+// namespace, which is always the case unless the RDMA subsystem is in
+// exclusive netns mode.
+func ReturnRDMADevToHost(ctx context.Context, nsPath, rdmaDev string) (bool, error) {
+	mode, err := rdmaNetnsMode(&netlink.Handle{})
+	if err != nil {
+		return false, err
+	}
+	if mode != "exclusive" {
+		return false, nil
+	}
+
+	h, closeNs, err := handleAt(nsPath, unix.NETLINK_RDMA)
+	if err != nil || h == nil {
+		return false, err
+	}
+	defer closeNs()
+
+	links, err := h.RdmaLinkList()
+	if err != nil {
+		return false, fmt.Errorf("list RDMA devices in netns %s: %w", nsPath, err)
+	}
+	for _, link := range links {
+		if link.Attrs.Name != rdmaDev {
+			continue
+		}
+		hostNs, err := vnetns.Get()
+		if err != nil {
+			return false, fmt.Errorf("get host netns: %w", err)
+		}
+		defer hostNs.Close()
+
+		klog.FromContext(ctx).V(2).Info("Moving RDMA device back to host netns", "rdmaDev", rdmaDev, "netns", nsPath)
+		if err := h.RdmaLinkSetNsFd(link, uint32(hostNs)); err != nil {
+			return false, fmt.Errorf("move RDMA device %s from netns %s to host: %w", rdmaDev, nsPath, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// handleAt returns a netlink handle in the network namespace at nsPath, or a
+// nil handle if the namespace no longer exists.
+func handleAt(nsPath string, families ...int) (*netlink.Handle, func(), error) {
+	ns, err := vnetns.GetFromPath(nsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("open netns %s: %w", nsPath, err)
+	}
+	h, err := netlink.NewHandleAt(ns, families...)
+	if err != nil {
+		ns.Close()
+		return nil, nil, fmt.Errorf("netlink handle in netns %s: %w", nsPath, err)
+	}
+	return h, func() {
+		h.Close()
+		ns.Close()
+	}, nil
+}
+
+func linkByHardwareAddr(h *netlink.Handle, hwAddr string) (netlink.Link, error) {
+	addr, err := net.ParseMAC(hwAddr)
+	if err != nil {
+		return nil, fmt.Errorf("parse hardware address %q: %w", hwAddr, err)
+	}
+	links, err := h.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("list links: %w", err)
+	}
+	for _, link := range links {
+		if bytes.Equal(link.Attrs().HardwareAddr, addr) {
+			return link, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package netns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	vnetns "github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// WithSysfs calls fn with the root of a sysfs mounted in the network
+// namespace at nsPath. In exclusive RDMA netns mode an RDMA device moved into
+// a pod is only visible in the sysfs of its namespace, not in the one of the
+// host. The mount is made in a private mount namespace on a thread of its
+// own, which is discarded afterwards.
+func WithSysfs(nsPath string, fn func(root string) error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		// The thread is not unlocked, so that it exits with the goroutine
+		// instead of running others in the namespaces entered below.
+		runtime.LockOSThread()
+		errCh <- withSysfs(nsPath, fn)
+	}()
+	return <-errCh
+}
+
+func withSysfs(nsPath string, fn func(root string) error) error {
+	ns, err := vnetns.GetFromPath(nsPath)
+	if err != nil {
+		return fmt.Errorf("open netns %s: %w", nsPath, err)
+	}
+	defer ns.Close()
+
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("unshare mount namespace: %w", err)
+	}
+	// Keep the mount below from propagating to the host.
+	if err := unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	if err := vnetns.Set(ns); err != nil {
+		return fmt.Errorf("enter netns %s: %w", nsPath, err)
+	}
+
+	// sysfs shows the devices of the network namespace it is mounted in.
+	root, err := os.MkdirTemp("", "netns-sysfs-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(root) }()
+	if err := unix.Mount("sysfs", root, "sysfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount sysfs of netns %s: %w", nsPath, err)
+	}
+	defer func() { _ = unix.Unmount(root, unix.MNT_DETACH) }()
+	return fn(root)
+}
@@ -22,9 +22,12 @@ package ib
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
+	"golang.org/x/sys/unix"
 	resourceapi "k8s.io/api/resource/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/dynamic-resource-allocation/resourceslice"
@@ -33,16 +36,23 @@ import (
 	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
 	cdispec "tags.cncf.io/container-device-interface/specs-go"
 
-	configapi "github.com/MartinForReal/dra-example-driver/api/example.com/resource/ib/v1alpha1"
-	"github.com/MartinForReal/dra-example-driver/internal/ibverbs"
-	"github.com/MartinForReal/dra-example-driver/internal/netns"
-	"github.com/MartinForReal/dra-example-driver/internal/profiles"
-	"github.com/MartinForReal/dra-example-driver/internal/sriov"
-	"github.com/MartinForReal/dra-example-driver/internal/sysfs"
+	configapi "github.com/kubernetes-sigs/dra-example-driver/api/example.com/resource/ib/v1alpha1"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibconfig"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibverbs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/netns"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/profiles"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sriov"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
 )
 
 const ProfileName = "ib"
 
+// HookPath is where the CDI hook helper, the plugin binary itself, is found.
+// The container runtime runs hooks in the host mount namespace, so it is a
+// host path: the init container of the kubelet plugin DaemonSet copies the
+// binary there from the image.
+const HookPath = "/opt/dra-ib/bin/dra-example-kubeletplugin"
+
 // DeviceEntry holds the combined ibverbs + sysfs info for a single IB port
 // that will be published as an allocatable device.
 type DeviceEntry struct {
@@ -80,6 +90,10 @@ type Profile struct {
 	numVFs        int
 	numSimDevices int
 
+	// configurator programs IbConfig on allocated devices. The zero Profile,
+	// used for validation only, falls back to the host sysfs.
+	configurator *ibconfig.Configurator
+
 	// devices is populated after EnumerateDevices.
 	devices []DeviceEntry
 }
@@ -92,6 +106,7 @@ func NewProfile(nodeName string, numVFs int, numSimDevices int) *Profile {
 		nodeName:      nodeName,
 		numVFs:        numVFs,
 		numSimDevices: numSimDevices,
+		configurator:  ibconfig.New(sysfs.Default),
 	}
 }
 
@@ -247,7 +262,7 @@ func (p *Profile) EnumerateDevices(ctx context.Context) (resourceslice.DriverRes
 func (p Profile) provisionVFs(ctx context.Context) error {
 	logger := klog.FromContext(ctx)
 
-	pfs, err := sriov.DiscoverSRIOVPFs()
+	pfs, err := sriov.DiscoverSRIOVPFs(sysfs.Default)
 	if err != nil {
 		return fmt.Errorf("discover SR-IOV PFs: %w", err)
 	}
@@ -263,7 +278,7 @@ func (p Profile) provisionVFs(ctx context.Context) error {
 			desired = pf.TotalVFs
 		}
 		logger.Info("Provisioning VFs", "pf", pf.IBDevName, "pciAddr", pf.PCIAddress, "desired", desired, "totalVFs", pf.TotalVFs)
-		if err := sriov.ProvisionVFs(ctx, pf.PCIAddress, desired); err != nil {
+		if err := sriov.ProvisionVFs(ctx, sysfs.Default, pf.PCIAddress, desired); err != nil {
 			return fmt.Errorf("provision VFs on %s: %w", pf.PCIAddress, err)
 		}
 	}
@@ -292,16 +307,22 @@ func (p Profile) ApplyConfig(config runtime.Object, results []*resourceapi.Devic
 		config = configapi.DefaultIbConfig()
 	}
 	if config, ok := config.(*configapi.IbConfig); ok {
-		return applyIbConfig(config, results)
+		configurator := p.configurator
+		if configurator == nil {
+			configurator = ibconfig.New(sysfs.Default)
+		}
+		return applyIbConfig(context.Background(), configurator, config, results)
 	}
 	return nil, fmt.Errorf("runtime object is not a recognized configuration")
 }
 
-// applyIbConfig applies the IB configuration to allocated devices and returns
-// CDI container edits for each device. The edits include environment variables
-// describing the device and CDI hooks to move the netdev into the container's
-// network namespace at runtime.
-func applyIbConfig(config *configapi.IbConfig, results []*resourceapi.DeviceRequestAllocationResult) (profiles.PerDeviceCDIContainerEdits, error) {
+// applyIbConfig programs the IB configuration on the allocated devices and
+// returns CDI container edits for each device. The edits include environment
+// variables describing the device as configured and CDI hooks to move the
+// netdev into the container's network namespace at runtime, or in VFIO mode
+// the VFIO device nodes of the VF. If any device cannot be configured, the
+// devices configured so far are restored and an error is returned.
+func applyIbConfig(ctx context.Context, configurator *ibconfig.Configurator, config *configapi.IbConfig, results []*resourceapi.DeviceRequestAllocationResult) (profiles.PerDeviceCDIContainerEdits, error) {
 	perDeviceEdits := make(profiles.PerDeviceCDIContainerEdits)
 
 	if err := config.Normalize(); err != nil {
@@ -312,19 +333,50 @@ func applyIbConfig(config *configapi.IbConfig, results []*resourceapi.DeviceRequ
 		return nil, fmt.Errorf("error validating IB config: %w", err)
 	}
 
+	var applied []*ibconfig.Result
+	rollback := func() {
+		for _, res := range applied {
+			if err := configurator.Remove(ctx, res); err != nil {
+				klog.FromContext(ctx).Error(err, "Failed to restore IB device", "netdev", res.NetDevice)
+			}
+		}
+	}
+
+	var vfioDevices, vfioAddresses []string
 	for i, result := range results {
 		envs := []string{
 			fmt.Sprintf("IB_DEVICE_%d=%s", i, result.Device),
 		}
 
 		// Parse IB device name and port from the device name (e.g., "mlx5_0-port1")
+		var netDev string
+		var vfio *ibconfig.VFIOBinding
 		parts := strings.SplitN(result.Device, "-port", 2)
 		if len(parts) == 2 {
 			envs = append(envs, fmt.Sprintf("IB_DEVICE_%d_IBDEV=%s", i, parts[0]))
 			envs = append(envs, fmt.Sprintf("IB_DEVICE_%d_PORT=%s", i, parts[1]))
+
+			res, err := applyDeviceConfig(ctx, configurator, parts[0], parts[1], config)
+			if err != nil {
+				rollback()
+				return nil, fmt.Errorf("apply IB config to device %s: %w", result.Device, err)
+			}
+			applied = append(applied, res)
+			netDev = res.NetDevice
+			if res.NetDevice != "" {
+				envs = append(envs, fmt.Sprintf("IB_DEVICE_%d_NETDEV=%s", i, res.NetDevice))
+			}
+			if res.PkeyIndex >= 0 {
+				envs = append(envs, fmt.Sprintf("IB_DEVICE_%d_PKEY_INDEX=%d", i, res.PkeyIndex))
+			}
+			if vfio = res.VFIO; vfio != nil {
+				envs = append(envs, fmt.Sprintf("IB_DEVICE_%d_PCI_ADDRESS=%s", i, vfio.PCIAddress))
+				vfioDevices = append(vfioDevices, result.Device)
+				vfioAddresses = append(vfioAddresses, vfio.PCIAddress)
+			}
 		}
 
-		// Config-specific env vars
+		// Config-specific env vars, matching what was programmed above.
 		if config.Pkey != nil {
 			envs = append(envs, fmt.Sprintf("IB_DEVICE_%d_PKEY=0x%04X", i, *config.Pkey))
 		}
@@ -339,29 +391,38 @@ func applyIbConfig(config *configapi.IbConfig, results []*resourceapi.DeviceRequ
 			Env: envs,
 		}
 
+		// A VF bound to vfio-pci has no netdev to move; the VMM in the
+		// container opens its IOMMU group instead.
+		if vfio != nil {
+			for _, path := range vfio.DeviceNodes() {
+				edits.DeviceNodes = append(edits.DeviceNodes, &cdispec.DeviceNode{Path: path})
+			}
+			perDeviceEdits[result.Device] = &cdiapi.ContainerEdits{ContainerEdits: edits}
+			continue
+		}
+
 		// Add CDI hooks to move netdev into container namespace at runtime.
 		// The hook is executed by the container runtime at createRuntime time.
 		// We use the plugin binary itself as the hook helper — it's re-invoked
-		// with the "move-netdev" subcommand.
-		//
-		// The actual netdev name is determined at prepare time (stored in the
-		// checkpoint) and the hook args include it. We add a placeholder here
-		// that gets resolved when the CDI spec is written.
-		//
-		// For now, we inject the IB device/port info as env vars. The actual
-		// netdev move happens via the CDI hook configured at CDI spec write time.
-		hookPath := "/usr/bin/dra-example-kubeletplugin"
+		// with the "move-netdev" subcommand, which reads the container PID from
+		// the OCI state on stdin.
 		if len(parts) == 2 {
 			ibDevName := parts[0]
+			args := []string{
+				HookPath,
+				"move-netdev",
+				"--ib-dev", ibDevName,
+			}
+			// Move only the netdev selected by the config, e.g. the IPoIB
+			// child for the requested P_Key, and not its parent.
+			if netDev != "" {
+				args = append(args, "--netdev", netDev)
+			}
 			edits.Hooks = []*cdispec.Hook{
 				{
 					HookName: "createRuntime",
-					Path:     hookPath,
-					Args: []string{
-						hookPath,
-						"move-netdev",
-						"--ib-dev", ibDevName,
-					},
+					Path:     HookPath,
+					Args:     args,
 				},
 			}
 		}
@@ -369,9 +430,31 @@ func applyIbConfig(config *configapi.IbConfig, results []*resourceapi.DeviceRequ
 		perDeviceEdits[result.Device] = &cdiapi.ContainerEdits{ContainerEdits: edits}
 	}
 
+	// Every device carries the full list, as the edits of all devices end up
+	// in the same container.
+	if len(vfioAddresses) > 0 {
+		env := fmt.Sprintf("%s=%s", ibconfig.VFIOResourceEnv, strings.Join(vfioAddresses, ","))
+		for _, device := range vfioDevices {
+			perDeviceEdits[device].Env = append(perDeviceEdits[device].Env, env)
+		}
+	}
+
 	return perDeviceEdits, nil
 }
 
+// applyDeviceConfig programs config on one port of an IB device.
+func applyDeviceConfig(ctx context.Context, configurator *ibconfig.Configurator, ibDevName, port string, config *configapi.IbConfig) (*ibconfig.Result, error) {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", port, err)
+	}
+	dev, err := configurator.LookupDevice(ibDevName, portNum)
+	if err != nil {
+		return nil, err
+	}
+	return configurator.Apply(ctx, dev, config)
+}
+
 // enumerateSimulatedDevices creates fake IB device entries for testing.
 func (p *Profile) enumerateSimulatedDevices() (resourceslice.DriverResources, error) {
 	var entries []DeviceEntry
@@ -472,25 +555,55 @@ func (p *Profile) GetDeviceEntryByName(name string) (*DeviceEntry, bool) {
 // MoveNetdevHookHelper is the function called when the plugin binary is
 // invoked with the "move-netdev" subcommand by a CDI hook. It moves the
 // IB netdev and RDMA device into the specified container's network namespace.
-func MoveNetdevHookHelper(ctx context.Context, ibDevName string, containerPID int) error {
+// netDevs are the netdevs to move; if empty, all netdevs of the IB device
+// found in the host netns are moved. It can be called again for the same
+// container, or for another container of the same pod, and then only
+// verifies that the devices have been moved.
+func MoveNetdevHookHelper(ctx context.Context, ibDevName string, netDevs []string, containerPID int) error {
 	logger := klog.FromContext(ctx)
 
-	// Find network devices for this IB device
-	devInfo, err := sysfs.GetIBDeviceInfo(ibDevName)
-	if err != nil {
-		return fmt.Errorf("get sysfs info for %s: %w", ibDevName, err)
+	if len(netDevs) == 0 {
+		// Find network devices for this IB device
+		devInfo, err := sysfs.GetIBDeviceInfo(ibDevName)
+		if err != nil {
+			return fmt.Errorf("get sysfs info for %s: %w", ibDevName, err)
+		}
+		netDevs = devInfo.NetDevices
+	}
+	if len(netDevs) == 0 {
+		inContainer, err := netns.RDMADevInContainerNetns(ibDevName, containerPID)
+		if err != nil {
+			return fmt.Errorf("look up IB device %s in container netns: %w", ibDevName, err)
+		}
+		if inContainer {
+			logger.V(2).Info("IB device already in container netns", "ibDev", ibDevName, "pid", containerPID)
+			return nil
+		}
+		return fmt.Errorf("no netdev of IB device %s found in the host netns", ibDevName)
 	}
 
-	for _, netDev := range devInfo.NetDevices {
-		if err := netns.MoveNetdevToContainerNetns(ctx, netDev, containerPID); err != nil {
-			return fmt.Errorf("move netdev %s: %w", netDev, err)
+	for _, netDev := range netDevs {
+		err := netns.MoveNetdevToContainerNetns(ctx, netDev, containerPID)
+		if errors.Is(err, netns.ErrAlreadyInNetns) {
+			logger.V(2).Info("Netdev already in container netns", "netdev", netDev, "pid", containerPID)
+		} else if err != nil {
+			return err
 		}
 	}
 
 	// Move RDMA device
-	if err := netns.MoveRDMADevToContainerNetns(ctx, ibDevName, containerPID); err != nil {
+	err := netns.MoveRDMADevToContainerNetns(ctx, ibDevName, containerPID)
+	switch {
+	case err == nil:
+	case errors.Is(err, netns.ErrAlreadyInNetns):
+		logger.V(2).Info("RDMA device already in container netns", "rdmaDev", ibDevName, "pid", containerPID)
+	case errors.Is(err, unix.EOPNOTSUPP):
+		// Shared RDMA netns mode, or no RDMA netns support in the kernel:
+		// the device stays visible in every netns.
+		logger.V(2).Info("RDMA device cannot be moved, leaving it shared", "rdmaDev", ibDevName, "err", err)
+	default:
+		// Non-fatal: the netdev has been moved and the device stays usable.
 		logger.Error(err, "Failed to move RDMA device to container netns, continuing", "rdmaDev", ibDevName)
-		// Non-fatal: RDMA namespace move may not be supported on all kernels
 	}
 
 	return nil
@@ -0,0 +1,192 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package rdmamode checks at startup that the RDMA subsystem of the node is in
+// exclusive network namespace mode, in which an RDMA device moved into a pod
+// is only visible there. In shared mode every RDMA device is visible in every
+// pod, whatever has been allocated to it. The outcome is reported as a Node
+// condition.
+package rdmamode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/netns"
+)
+
+// Policy is what to do when the RDMA subsystem is not in exclusive mode.
+type Policy string
+
+const (
+	// PolicyEnforce switches the RDMA subsystem to exclusive mode, and fails
+	// if that is not possible.
+	PolicyEnforce Policy = "enforce"
+	// PolicyWarn reports the mode and logs a warning if it is not exclusive.
+	PolicyWarn Policy = "warn"
+	// PolicyIgnore does not check the mode at all.
+	PolicyIgnore Policy = "ignore"
+)
+
+// RDMA netns modes, as reported by "rdma system".
+const (
+	ModeExclusive = "exclusive"
+	ModeShared    = "shared"
+)
+
+const (
+	// NodeConditionRDMANetnsExclusive is True when the RDMA subsystem of the
+	// node is in exclusive netns mode, False when it is in shared mode, and
+	// Unknown when the mode cannot be determined.
+	NodeConditionRDMANetnsExclusive corev1.NodeConditionType = "RDMANetnsExclusive"
+
+	// Reasons of NodeConditionRDMANetnsExclusive.
+	ReasonExclusive    = "Exclusive"
+	ReasonSwitched     = "SwitchedToExclusive"
+	ReasonShared       = "Shared"
+	ReasonSwitchFailed = "SwitchFailed"
+	ReasonUnsupported  = "Unsupported"
+	ReasonQueryFailed  = "QueryFailed"
+)
+
+// ParsePolicy parses the value of the --rdma-netns-mode-policy flag.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyEnforce, PolicyWarn, PolicyIgnore:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid RDMA netns mode policy %q, must be one of %q, %q or %q", s, PolicyEnforce, PolicyWarn, PolicyIgnore)
+}
+
+// System queries and changes the RDMA netns mode.
+type System interface {
+	NetnsMode() (string, error)
+	SetExclusive(ctx context.Context) error
+}
+
+// HostSystem is the RDMA subsystem of the host, driven through RDMA netlink.
+type HostSystem struct{}
+
+func (HostSystem) NetnsMode() (string, error) {
+	return netns.RDMANetnsMode()
+}
+
+func (HostSystem) SetExclusive(ctx context.Context) error {
+	return netns.EnsureRDMAExclusiveMode(ctx)
+}
+
+// Status is the outcome of Check.
+type Status struct {
+	// Mode is the netns mode of the RDMA subsystem after Check, or empty if
+	// it is unknown.
+	Mode    string
+	Reason  string
+	Message string
+}
+
+// Check queries the RDMA netns mode and applies policy to it, which must not
+// be PolicyIgnore. With PolicyEnforce, an error is returned along with the
+// status if the mode is not exclusive in the end.
+func Check(ctx context.Context, policy Policy, sys System) (Status, error) {
+	logger := klog.FromContext(ctx)
+
+	mode, err := sys.NetnsMode()
+	if err != nil {
+		status := Status{Reason: ReasonQueryFailed, Message: err.Error()}
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			status = Status{Reason: ReasonUnsupported, Message: "The kernel does not support RDMA network namespaces, or ib_core is not loaded."}
+		}
+		if policy == PolicyEnforce {
+			return status, fmt.Errorf("query RDMA netns mode: %w", err)
+		}
+		logger.Error(err, "RDMA netns mode: cannot query, RDMA devices may not be isolated between pods")
+		return status, nil
+	}
+
+	switch {
+	case mode == ModeExclusive:
+		logger.V(2).Info("RDMA netns mode: exclusive")
+		return Status{Mode: mode, Reason: ReasonExclusive, Message: "RDMA devices are only visible in the netns they are moved to."}, nil
+	case policy == PolicyWarn:
+		logger.Error(nil, "RDMA netns mode: not exclusive, RDMA devices are visible in every pod regardless of allocation", "mode", mode)
+		return Status{Mode: mode, Reason: ReasonShared, Message: "RDMA devices are visible in every network namespace."}, nil
+	}
+
+	if err := sys.SetExclusive(ctx); err != nil {
+		msg := fmt.Sprintf("Cannot switch the RDMA subsystem to exclusive netns mode: %v.", err)
+		if errors.Is(err, unix.EBUSY) {
+			// The kernel only allows the switch while no other netns exists.
+			msg += " Network namespaces other than the host's exist; load ib_core with netns_mode=0 to boot in exclusive mode."
+		}
+		return Status{Mode: mode, Reason: ReasonSwitchFailed, Message: msg}, fmt.Errorf("enforce RDMA netns exclusive mode: %w", err)
+	}
+	logger.Info("RDMA netns mode: switched to exclusive", "previousMode", mode)
+	return Status{Mode: ModeExclusive, Reason: ReasonSwitched, Message: fmt.Sprintf("The RDMA subsystem was switched from %s to exclusive netns mode.", mode)}, nil
+}
+
+// conditionStatus maps the mode to the status of the Node condition.
+func (s Status) conditionStatus() corev1.ConditionStatus {
+	switch s.Mode {
+	case ModeExclusive:
+		return corev1.ConditionTrue
+	case "":
+		return corev1.ConditionUnknown
+	}
+	return corev1.ConditionFalse
+}
+
+// ReportNodeCondition sets NodeConditionRDMANetnsExclusive on the node from
+// status with server-side apply, owned by fieldManager. The transition time
+// is kept if the condition status did not change.
+func ReportNodeCondition(ctx context.Context, clientset kubernetes.Interface, nodeName, fieldManager string, status Status) error {
+	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get node %s: %w", nodeName, err)
+	}
+
+	now := metav1.NewTime(time.Now())
+	transition := now
+	for _, c := range node.Status.Conditions {
+		if c.Type == NodeConditionRDMANetnsExclusive && c.Status == status.conditionStatus() {
+			transition = c.LastTransitionTime
+		}
+	}
+
+	nodeApply := corev1apply.Node(nodeName).
+		WithStatus(corev1apply.NodeStatus().
+			WithConditions(corev1apply.NodeCondition().
+				WithType(NodeConditionRDMANetnsExclusive).
+				WithStatus(status.conditionStatus()).
+				WithReason(status.Reason).
+				WithMessage(status.Message).
+				WithLastHeartbeatTime(now).
+				WithLastTransitionTime(transition)))
+	_, err = clientset.CoreV1().Nodes().ApplyStatus(ctx, nodeApply,
+		metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	if err != nil {
+		return fmt.Errorf("update status of node %s: %w", nodeName, err)
+	}
+	return nil
+}
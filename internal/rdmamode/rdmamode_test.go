@@ -0,0 +1,178 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rdmamode
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeSystem is an RDMA subsystem in a given mode.
+type fakeSystem struct {
+	mode      string
+	queryErr  error
+	switchErr error
+	switched  bool
+}
+
+func (s *fakeSystem) NetnsMode() (string, error) {
+	return s.mode, s.queryErr
+}
+
+func (s *fakeSystem) SetExclusive(context.Context) error {
+	if s.switchErr != nil {
+		return s.switchErr
+	}
+	s.switched = true
+	s.mode = ModeExclusive
+	return nil
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, s := range []string{"enforce", "warn", "ignore"} {
+		p, err := ParsePolicy(s)
+		require.NoError(t, err)
+		assert.Equal(t, Policy(s), p)
+	}
+	_, err := ParsePolicy("strict")
+	assert.ErrorContains(t, err, `invalid RDMA netns mode policy "strict"`)
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       Policy
+		sys          *fakeSystem
+		wantMode     string
+		wantReason   string
+		wantSwitched bool
+		wantErr      bool
+	}{
+		{
+			name:       "exclusive",
+			policy:     PolicyEnforce,
+			sys:        &fakeSystem{mode: ModeExclusive},
+			wantMode:   ModeExclusive,
+			wantReason: ReasonExclusive,
+		},
+		{
+			name:       "shared, warn",
+			policy:     PolicyWarn,
+			sys:        &fakeSystem{mode: ModeShared},
+			wantMode:   ModeShared,
+			wantReason: ReasonShared,
+		},
+		{
+			name:         "shared, enforce",
+			policy:       PolicyEnforce,
+			sys:          &fakeSystem{mode: ModeShared},
+			wantMode:     ModeExclusive,
+			wantReason:   ReasonSwitched,
+			wantSwitched: true,
+		},
+		{
+			name:       "shared, enforce, other netns exist",
+			policy:     PolicyEnforce,
+			sys:        &fakeSystem{mode: ModeShared, switchErr: unix.EBUSY},
+			wantMode:   ModeShared,
+			wantReason: ReasonSwitchFailed,
+			wantErr:    true,
+		},
+		{
+			name:       "unsupported, warn",
+			policy:     PolicyWarn,
+			sys:        &fakeSystem{queryErr: unix.EOPNOTSUPP},
+			wantReason: ReasonUnsupported,
+		},
+		{
+			name:       "unsupported, enforce",
+			policy:     PolicyEnforce,
+			sys:        &fakeSystem{queryErr: unix.EOPNOTSUPP},
+			wantReason: ReasonUnsupported,
+			wantErr:    true,
+		},
+		{
+			name:       "query failed, warn",
+			policy:     PolicyWarn,
+			sys:        &fakeSystem{queryErr: unix.EPERM},
+			wantReason: ReasonQueryFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := Check(context.Background(), tt.policy, tt.sys)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantMode, status.Mode)
+			assert.Equal(t, tt.wantReason, status.Reason)
+			assert.NotEmpty(t, status.Message)
+			assert.Equal(t, tt.wantSwitched, tt.sys.switched)
+		})
+	}
+}
+
+func TestReportNodeCondition(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}})
+
+	condition := func() corev1.NodeCondition {
+		t.Helper()
+		node, err := client.CoreV1().Nodes().Get(ctx, "node-a", metav1.GetOptions{})
+		require.NoError(t, err)
+		for _, c := range node.Status.Conditions {
+			if c.Type == NodeConditionRDMANetnsExclusive {
+				return c
+			}
+		}
+		require.Fail(t, "no RDMANetnsExclusive condition")
+		return corev1.NodeCondition{}
+	}
+
+	shared := Status{Mode: ModeShared, Reason: ReasonShared, Message: "shared"}
+	require.NoError(t, ReportNodeCondition(ctx, client, "node-a", "test", shared))
+	c := condition()
+	assert.Equal(t, corev1.ConditionFalse, c.Status)
+	assert.Equal(t, ReasonShared, c.Reason)
+
+	// The transition time only moves when the condition status changes.
+	transition := metav1.NewTime(c.LastTransitionTime.Add(-time.Hour))
+	node, err := client.CoreV1().Nodes().Get(ctx, "node-a", metav1.GetOptions{})
+	require.NoError(t, err)
+	node.Status.Conditions[0].LastTransitionTime = transition
+	_, err = client.CoreV1().Nodes().UpdateStatus(ctx, node, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, ReportNodeCondition(ctx, client, "node-a", "test", shared))
+	assert.Equal(t, transition.Unix(), condition().LastTransitionTime.Unix())
+
+	unknown := Status{Reason: ReasonUnsupported, Message: "unsupported"}
+	require.NoError(t, ReportNodeCondition(ctx, client, "node-a", "test", unknown))
+	c = condition()
+	assert.Equal(t, corev1.ConditionUnknown, c.Status)
+	assert.NotEqual(t, transition.Unix(), c.LastTransitionTime.Unix())
+}
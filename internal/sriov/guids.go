@@ -0,0 +1,209 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sriov
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+// Modes of a GUIDPolicy.
+const (
+	// GUIDsFromPF derives the GUIDs of the VFs from the node GUID of their
+	// PF.
+	GUIDsFromPF = "FromPF"
+	// GUIDsFromPrefix builds the GUIDs of the VFs from a configured prefix
+	// and the PCI address of their PF.
+	GUIDsFromPrefix = "Prefix"
+)
+
+// Link state policies of a VF.
+const (
+	LinkPolicyFollow = "Follow"
+	LinkPolicyUp     = "Up"
+)
+
+// localGUIDBit marks a GUID as locally administered, so that derived GUIDs
+// never clash with the GUIDs assigned by the HCA vendor.
+const localGUIDBit = 0x02 << 56
+
+var guidPrefixRE = regexp.MustCompile(`^[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){3}$`)
+
+// GUIDPolicy assigns stable node and port GUIDs to the VFs of a PF, so that
+// they survive reboots and can be used in the partition configuration of
+// the subnet manager. The node and port GUID of a VF are the same.
+type GUIDPolicy struct {
+	// Mode is "FromPF" or "Prefix".
+	//
+	// In FromPF mode, a GUID keeps the OUI and the lower 3 bytes of the node
+	// GUID of the PF, with the locally administered bit set, and has the VF
+	// index plus one in the 2 bytes in between.
+	//
+	// In Prefix mode, a GUID is Prefix followed by the PCI bus and
+	// device/function of the PF and the VF index in 2 bytes. Prefix must
+	// then be unique per node, e.g. with one rule per node.
+	Mode string `json:"mode"`
+	// Prefix is the upper 4 bytes of the GUIDs in Prefix mode, e.g.
+	// "02:00:00:01".
+	Prefix string `json:"prefix,omitempty"`
+	// LinkPolicy is the link state policy of the VFs: "Follow" (default)
+	// the state of the PF port, or "Up".
+	LinkPolicy string `json:"linkPolicy,omitempty"`
+}
+
+// Validate checks the mode, prefix and link policy.
+func (g *GUIDPolicy) Validate() error {
+	var errs []error
+	switch g.Mode {
+	case GUIDsFromPF:
+		if g.Prefix != "" {
+			errs = append(errs, errors.New("prefix is only used in Prefix mode"))
+		}
+	case GUIDsFromPrefix:
+		if !guidPrefixRE.MatchString(g.Prefix) {
+			errs = append(errs, fmt.Errorf("malformed prefix %q, want 4 bytes like 02:00:00:01", g.Prefix))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown mode %q, want %s or %s", g.Mode, GUIDsFromPF, GUIDsFromPrefix))
+	}
+	switch g.LinkPolicy {
+	case "", LinkPolicyFollow, LinkPolicyUp:
+	default:
+		errs = append(errs, fmt.Errorf("unknown link policy %q, want %s or %s", g.LinkPolicy, LinkPolicyFollow, LinkPolicyUp))
+	}
+	return errors.Join(errs...)
+}
+
+// VFGUID returns the GUID of VF number vf of pf.
+func (g *GUIDPolicy) VFGUID(pf PFInfo, vf int) (uint64, error) {
+	if vf < 0 || vf >= 0xffff {
+		return 0, fmt.Errorf("VF index %d out of range", vf)
+	}
+	switch g.Mode {
+	case GUIDsFromPF:
+		pfGUID, err := parseGUID(pf.NodeGUID)
+		if err != nil {
+			return 0, fmt.Errorf("node GUID of PF %s: %w", pf.PCIAddress, err)
+		}
+		if pfGUID == 0 {
+			return 0, fmt.Errorf("PF %s has no node GUID", pf.PCIAddress)
+		}
+		return pfGUID&^(0xffff<<24) | localGUIDBit | uint64(vf+1)<<24, nil
+	case GUIDsFromPrefix:
+		prefix, err := parseGUID(g.Prefix)
+		if err != nil {
+			return 0, err
+		}
+		var bus, dev, fn uint64
+		if _, err := fmt.Sscanf(pf.PCIAddress[strings.Index(pf.PCIAddress, ":")+1:], "%x:%x.%x", &bus, &dev, &fn); err != nil {
+			return 0, fmt.Errorf("parse PCI address %s: %w", pf.PCIAddress, err)
+		}
+		return prefix<<32 | bus<<24 | (dev<<3|fn)<<16 | uint64(vf), nil
+	}
+	return 0, fmt.Errorf("unknown mode %q", g.Mode)
+}
+
+// AssignVFGUIDs sets the GUIDs and link policy of the VFs of pf according to
+// policy. VFs for which skip returns true, e.g. because they are in use, are
+// left alone. VFs whose configuration changes are rebound to their driver
+// for it to take effect.
+func AssignVFGUIDs(ctx context.Context, fs sysfs.FS, pf PFInfo, policy *GUIDPolicy, skip func(vfPCIAddr string) bool) error {
+	logger := klog.FromContext(ctx)
+
+	numVFs, err := fs.GetSRIOVNumVFs(pf.PCIAddress)
+	if err != nil {
+		return fmt.Errorf("get sriov_numvfs for %s: %w", pf.PCIAddress, err)
+	}
+	linkPolicy := policy.LinkPolicy
+	if linkPolicy == "" {
+		linkPolicy = LinkPolicyFollow
+	}
+
+	var errs []error
+	for vf := range numVFs {
+		vfAddr, err := fs.GetVFPCIAddress(pf.PCIAddress, vf)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if skip != nil && skip(vfAddr) {
+			logger.Info("Not assigning GUIDs to VF in use", "pf", pf.PCIAddress, "vf", vfAddr)
+			continue
+		}
+		guid, err := policy.VFGUID(pf, vf)
+		if err != nil {
+			return err
+		}
+		want := sysfs.VFConfig{NodeGUID: formatGUID(guid), PortGUID: formatGUID(guid), Policy: linkPolicy}
+
+		current, err := fs.GetVFConfig(pf.PCIAddress, vf)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("PF %s does not support setting VF GUIDs", pf.PCIAddress)
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if strings.EqualFold(current.NodeGUID, want.NodeGUID) && strings.EqualFold(current.PortGUID, want.PortGUID) &&
+			current.Policy == want.Policy {
+			continue
+		}
+
+		if err := fs.SetVFConfig(pf.PCIAddress, vf, want); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := fs.RebindPCIDriver(vfAddr); err != nil {
+			errs = append(errs, fmt.Errorf("rebind VF %s for its GUIDs to take effect: %w", vfAddr, err))
+			continue
+		}
+		logger.Info("Assigned VF GUIDs", "pf", pf.PCIAddress, "vf", vfAddr, "guid", want.NodeGUID, "linkPolicy", linkPolicy)
+	}
+	return errors.Join(errs...)
+}
+
+// parseGUID parses a GUID or GUID prefix in any of the formats used by
+// sysfs, e.g. ec0d:9a03:0078:6a4c or ec:0d:9a:03:00:78:6a:4c.
+func parseGUID(s string) (uint64, error) {
+	hex := strings.ReplaceAll(s, ":", "")
+	if hex == "" || len(hex) > 16 {
+		return 0, fmt.Errorf("malformed GUID %q", s)
+	}
+	guid, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed GUID %q", s)
+	}
+	return guid, nil
+}
+
+// formatGUID formats a GUID the way the sriov/<n> files of mlx5 PFs do, e.g.
+// ee:0d:9a:00:01:78:6a:4c.
+func formatGUID(guid uint64) string {
+	b := make([]string, 8)
+	for i := range b {
+		b[i] = fmt.Sprintf("%02x", byte(guid>>(56-8*i)))
+	}
+	return strings.Join(b, ":")
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sriov
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+func TestVFGUID(t *testing.T) {
+	pf := PFInfo{PCIAddress: "0000:3b:00.1", NodeGUID: "ec0d:9a03:0078:6a4c"}
+
+	tests := []struct {
+		name    string
+		policy  GUIDPolicy
+		pf      PFInfo
+		vf      int
+		want    uint64
+		wantErr string
+	}{
+		{name: "from PF", policy: GUIDPolicy{Mode: GUIDsFromPF}, pf: pf, vf: 0, want: 0xee0d9a0001786a4c},
+		{name: "from PF, last VF", policy: GUIDPolicy{Mode: GUIDsFromPF}, pf: pf, vf: 126, want: 0xee0d9a007f786a4c},
+		{name: "from PF without GUID", policy: GUIDPolicy{Mode: GUIDsFromPF}, pf: PFInfo{PCIAddress: "0000:3b:00.1", NodeGUID: "0000:0000:0000:0000"}, wantErr: "no node GUID"},
+		{name: "prefix", policy: GUIDPolicy{Mode: GUIDsFromPrefix, Prefix: "02:00:00:01"}, pf: pf, vf: 3, want: 0x020000013b010003},
+		{name: "prefix, VF index above 255", policy: GUIDPolicy{Mode: GUIDsFromPrefix, Prefix: "02:00:00:01"}, pf: pf, vf: 300, want: 0x020000013b01012c},
+		{name: "VF index out of range", policy: GUIDPolicy{Mode: GUIDsFromPF}, pf: pf, vf: 0xffff, wantErr: "out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guid, err := tt.policy.VFGUID(tt.pf, tt.vf)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, guid, "%016x", guid)
+		})
+	}
+}
+
+func TestAssignVFGUIDs(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	fs := sysfs.New(tree.Root)
+	pfs, err := DiscoverSRIOVPFs(fs)
+	require.NoError(t, err)
+	require.Len(t, pfs, 1)
+
+	policy := &GUIDPolicy{Mode: GUIDsFromPF}
+	inUse := func(vf string) bool { return vf == "0000:3b:00.2" }
+	require.NoError(t, AssignVFGUIDs(t.Context(), fs, pfs[0], policy, inUse))
+
+	c, err := fs.GetVFConfig("0000:3b:00.0", 0)
+	require.NoError(t, err)
+	assert.Equal(t, &sysfs.VFConfig{NodeGUID: "ee:0d:9a:00:01:00:00:01", PortGUID: "ee:0d:9a:00:01:00:00:01", Policy: LinkPolicyFollow}, c)
+	c, err = fs.GetVFConfig("0000:3b:00.0", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Down", c.Policy, "VF in use is left alone")
+	bound, err := os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/bind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.1", string(bound), "VF is rebound for its GUIDs to take effect")
+
+	// Nothing to do the second time: the VF is not rebound.
+	require.NoError(t, os.WriteFile(fs.Path("bus/pci/drivers/mlx5_core/bind"), nil, 0o644))
+	require.NoError(t, AssignVFGUIDs(t.Context(), fs, pfs[0], policy, inUse))
+	bound, err = os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/bind"))
+	require.NoError(t, err)
+	assert.Empty(t, bound)
+}
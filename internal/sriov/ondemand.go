@@ -0,0 +1,121 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sriov
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+// A PF with on-demand VFs has no VF bound to a driver until one is needed.
+// Its VFs are created with driver autoprobing disabled, so that they have no
+// IB device or netdev, and AttachVF binds them one at a time.
+
+// EnableOnDemandVFs disables driver autoprobing on a PF, so that the VFs
+// created by AttachVF stay unbound until they are attached. Existing VFs are
+// left as they are.
+func EnableOnDemandVFs(fs sysfs.FS, pfPCIAddr string) error {
+	return fs.SetSRIOVDriversAutoprobe(pfPCIAddr, false)
+}
+
+// AttachVF binds the first unbound VF of pf to the driver of the PF and waits
+// for its netdev to appear. If pf has no VFs yet, all sriov_totalvfs of them
+// are created first, with the GUIDs of guids if it is not nil.
+func AttachVF(ctx context.Context, fs sysfs.FS, pf PFInfo, guids *GUIDPolicy) (string, error) {
+	logger := klog.FromContext(ctx)
+
+	driver, err := fs.GetPCIDriver(pf.PCIAddress)
+	if err != nil {
+		return "", err
+	}
+	if driver == "" {
+		return "", fmt.Errorf("PF %s is not bound to a driver", pf.PCIAddress)
+	}
+
+	numVFs, err := fs.GetSRIOVNumVFs(pf.PCIAddress)
+	if err != nil {
+		return "", fmt.Errorf("get sriov_numvfs for %s: %w", pf.PCIAddress, err)
+	}
+	if numVFs == 0 {
+		if err := EnableOnDemandVFs(fs, pf.PCIAddress); err != nil {
+			return "", err
+		}
+		if err := ProvisionVFs(ctx, fs, pf.PCIAddress, pf.TotalVFs); err != nil {
+			return "", err
+		}
+		if guids != nil {
+			if err := AssignVFGUIDs(ctx, fs, pf, guids, nil); err != nil {
+				return "", fmt.Errorf("assign VF GUIDs on %s: %w", pf.PCIAddress, err)
+			}
+		}
+		numVFs = pf.TotalVFs
+	}
+
+	for vf := range numVFs {
+		vfAddr, err := fs.GetVFPCIAddress(pf.PCIAddress, vf)
+		if err != nil {
+			return "", err
+		}
+		vfDriver, err := fs.GetPCIDriver(vfAddr)
+		if err != nil {
+			return "", err
+		}
+		if vfDriver != "" {
+			continue
+		}
+
+		if err := fs.BindPCIDriver(vfAddr, driver); err != nil {
+			return "", err
+		}
+		if err := waitForNetDevice(fs, vfAddr); err != nil {
+			return "", err
+		}
+		logger.Info("Attached VF", "pf", pf.PCIAddress, "vf", vfAddr, "driver", driver)
+		return vfAddr, nil
+	}
+	return "", fmt.Errorf("all %d VFs of %s are attached", numVFs, pf.PCIAddress)
+}
+
+// DetachVF unbinds a VF attached by AttachVF from its driver.
+func DetachVF(ctx context.Context, fs sysfs.FS, vfPCIAddr string) error {
+	if err := fs.UnbindPCIDriver(vfPCIAddr); err != nil {
+		return err
+	}
+	klog.FromContext(ctx).Info("Detached VF", "vf", vfPCIAddr)
+	return nil
+}
+
+// waitForNetDevice polls sysfs until a netdev of a PCI device appears or a
+// timeout is reached.
+func waitForNetDevice(fs sysfs.FS, pciAddr string) error {
+	deadline := time.Now().Add(vfSettleTimeout)
+	for {
+		netdevs, err := fs.ListNetDevices(pciAddr)
+		if err == nil && len(netdevs) > 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timed out waiting for a netdev of %s", pciAddr)
+		}
+		time.Sleep(vfPollInterval)
+	}
+}
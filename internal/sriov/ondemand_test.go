@@ -0,0 +1,62 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sriov
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+func TestAttachVF(t *testing.T) {
+	// A PF whose two VFs were created without autoprobing, the first of
+	// them attached since.
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.2", ""))
+	fs := sysfs.New(tree.Root)
+	pfs, err := DiscoverSRIOVPFs(fs)
+	require.NoError(t, err)
+	require.Len(t, pfs, 1)
+
+	require.NoError(t, EnableOnDemandVFs(fs, "0000:3b:00.0"))
+	autoprobe, err := os.ReadFile(fs.Path("bus/pci/devices/0000:3b:00.0/sriov_drivers_autoprobe"))
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(autoprobe))
+
+	vf, err := AttachVF(t.Context(), fs, pfs[0], nil)
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.2", vf)
+	bound, err := os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/bind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.2", string(bound))
+
+	require.NoError(t, tree.SetPCIDriver("0000:3b:00.2", "mlx5_core"))
+	_, err = AttachVF(t.Context(), fs, pfs[0], nil)
+	assert.ErrorContains(t, err, "all 2 VFs of 0000:3b:00.0 are attached")
+
+	require.NoError(t, DetachVF(t.Context(), fs, "0000:3b:00.2"))
+	unbound, err := os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core/unbind"))
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.2", string(unbound))
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sriov
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Policy decides how many VFs to provision on each SR-IOV PF of a node. It
+// is usually loaded from a YAML or JSON file with LoadPolicy.
+type Policy struct {
+	// Rules are matched against every PF in order and the first matching
+	// rule applies.
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule sets the VF count of the PFs it matches, creates their VFs on
+// demand, or opts them out of provisioning. Exactly one of NumVFs, Skip and
+// OnDemand must be set.
+type PolicyRule struct {
+	// Name identifies the rule in logs.
+	Name string `json:"name,omitempty"`
+	// NodeSelector restricts the rule to nodes with all of these labels.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Match selects the PFs the rule applies to. An empty selector matches
+	// every PF.
+	Match PFSelector `json:"match,omitempty"`
+	// NumVFs is the number of VFs to provision on matching PFs, capped at
+	// their sriov_totalvfs. 0 removes their VFs.
+	NumVFs *int `json:"numVFs,omitempty"`
+	// Skip leaves the VFs of matching PFs as they are, e.g. for a storage
+	// rail whose VFs are managed by other software.
+	Skip bool `json:"skip,omitempty"`
+	// OnDemand publishes matching PFs once, with their VFs as consumable
+	// capacity, instead of pre-creating VFs. A VF is attached when an
+	// allocation of the PF is prepared and detached when it is released,
+	// and the PF itself is handed out to allocations that consume all of
+	// its VFs.
+	OnDemand bool `json:"onDemand,omitempty"`
+	// VFGUIDs assigns stable GUIDs to the VFs of matching PFs. Without it
+	// the VFs keep the GUIDs set by the firmware, often zero.
+	VFGUIDs *GUIDPolicy `json:"vfGUIDs,omitempty"`
+}
+
+// PFSelector matches a PF if every non-empty field has a value that
+// matches the PF.
+type PFSelector struct {
+	// PCIAddresses are PCI addresses, or patterns like "0000:3b:*" in the
+	// syntax of path.Match.
+	PCIAddresses []string `json:"pciAddresses,omitempty"`
+	// IBDevNames are IB device names, or patterns like "mlx5_*".
+	IBDevNames []string `json:"ibDevNames,omitempty"`
+	// PartIDs are PCI device IDs, e.g. 0x1021 for a ConnectX-7.
+	PartIDs []uint32 `json:"partIDs,omitempty"`
+	// NUMANodes are NUMA nodes of the PF.
+	NUMANodes []int `json:"numaNodes,omitempty"`
+}
+
+// LoadPolicy reads and validates a YAML or JSON SR-IOV policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read SR-IOV policy: %w", err)
+	}
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("parse SR-IOV policy %s: %w", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid SR-IOV policy %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Validate checks that every rule either sets a non-negative VF count, skips
+// its PFs or creates their VFs on demand, and that its patterns and GUID
+// policy are well-formed.
+func (p *Policy) Validate() error {
+	var errs []error
+	for i, r := range p.Rules {
+		actions := 0
+		for _, set := range []bool{r.NumVFs != nil, r.Skip, r.OnDemand} {
+			if set {
+				actions++
+			}
+		}
+		switch {
+		case actions > 1:
+			errs = append(errs, fmt.Errorf("rules[%d]: numVFs, skip and onDemand are mutually exclusive", i))
+		case actions == 0:
+			errs = append(errs, fmt.Errorf("rules[%d]: one of numVFs, skip or onDemand is required", i))
+		case r.NumVFs != nil && *r.NumVFs < 0:
+			errs = append(errs, fmt.Errorf("rules[%d]: negative numVFs", i))
+		case r.Skip && r.VFGUIDs != nil:
+			errs = append(errs, fmt.Errorf("rules[%d]: vfGUIDs and skip are mutually exclusive", i))
+		}
+		if r.VFGUIDs != nil {
+			if err := r.VFGUIDs.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d].vfGUIDs: %w", i, err))
+			}
+		}
+		for _, pattern := range slices.Concat(r.Match.PCIAddresses, r.Match.IBDevNames) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d]: malformed pattern %q", i, pattern))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ForNode returns the rules of p that apply to a node with the given labels.
+func (p *Policy) ForNode(labels map[string]string) *Policy {
+	node := &Policy{}
+	for _, r := range p.Rules {
+		matches := true
+		for k, v := range r.NodeSelector {
+			if value, ok := labels[k]; !ok || value != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			node.Rules = append(node.Rules, r)
+		}
+	}
+	return node
+}
+
+// Match returns the first rule that matches pf, or nil if there is none or
+// p is nil. NodeSelector is not considered; see ForNode.
+func (p *Policy) Match(pf PFInfo) *PolicyRule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		if p.Rules[i].Match.matches(pf) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (s PFSelector) matches(pf PFInfo) bool {
+	return matchesPattern(s.PCIAddresses, pf.PCIAddress) &&
+		matchesPattern(s.IBDevNames, pf.IBDevName) &&
+		(len(s.PartIDs) == 0 || slices.Contains(s.PartIDs, pf.PartID)) &&
+		(len(s.NUMANodes) == 0 || slices.Contains(s.NUMANodes, pf.NUMANode))
+}
+
+// matchesPattern reports whether name matches one of patterns, or patterns
+// is empty.
+func matchesPattern(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sriov
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/utils/ptr"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	p, err := LoadPolicy("../../demo/sriov-policy.yaml")
+	require.NoError(t, err)
+	require.Len(t, p.Rules, 4)
+	assert.True(t, p.Rules[0].Skip)
+	assert.Equal(t, []uint32{0x1021}, p.Rules[1].Match.PartIDs)
+	assert.Equal(t, 8, *p.Rules[1].NumVFs)
+	assert.Equal(t, &GUIDPolicy{Mode: GUIDsFromPF}, p.Rules[1].VFGUIDs)
+	assert.True(t, p.Rules[2].OnDemand)
+
+	// The GPU rule only applies to GPU nodes.
+	assert.Len(t, p.ForNode(nil).Rules, 3)
+	assert.Len(t, p.ForNode(map[string]string{"nvidia.com/gpu.present": "true"}).Rules, 4)
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{name: "unknown field", yaml: "rules:\n- numVF: 2", wantErr: "unknown field"},
+		{name: "no action", yaml: "rules:\n- name: a", wantErr: "one of numVFs, skip or onDemand is required"},
+		{name: "both actions", yaml: "rules:\n- numVFs: 2\n  skip: true", wantErr: "mutually exclusive"},
+		{name: "on demand with numVFs", yaml: "rules:\n- numVFs: 2\n  onDemand: true", wantErr: "mutually exclusive"},
+		{name: "negative numVFs", yaml: "rules:\n- numVFs: -1", wantErr: "negative numVFs"},
+		{name: "bad pattern", yaml: "rules:\n- numVFs: 2\n  match:\n    ibDevNames: [\"mlx5_[\"]", wantErr: "malformed pattern"},
+		{name: "skip with GUIDs", yaml: "rules:\n- skip: true\n  vfGUIDs:\n    mode: FromPF", wantErr: "vfGUIDs and skip are mutually exclusive"},
+		{name: "bad GUID mode", yaml: "rules:\n- numVFs: 2\n  vfGUIDs:\n    mode: Random", wantErr: "unknown mode"},
+		{name: "bad GUID prefix", yaml: "rules:\n- numVFs: 2\n  vfGUIDs:\n    mode: Prefix\n    prefix: \"02:00\"", wantErr: "malformed prefix"},
+		{name: "bad link policy", yaml: "rules:\n- numVFs: 2\n  vfGUIDs:\n    mode: FromPF\n    linkPolicy: Down", wantErr: "unknown link policy"},
+		{name: "GUIDs", yaml: "rules:\n- numVFs: 2\n  vfGUIDs:\n    mode: Prefix\n    prefix: \"02:00:00:01\"\n    linkPolicy: Up"},
+		{name: "remove VFs", yaml: "rules:\n- numVFs: 0"},
+		{name: "on demand", yaml: "rules:\n- onDemand: true\n  vfGUIDs:\n    mode: FromPF"},
+		{name: "empty", yaml: "rules: []"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "policy.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.yaml), 0o644))
+			_, err := LoadPolicy(path)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	p := &Policy{Rules: []PolicyRule{
+		{Name: "storage", Match: PFSelector{PCIAddresses: []string{"0000:86:00.0"}}, Skip: true},
+		{Name: "cx7-numa1", Match: PFSelector{PartIDs: []uint32{0x1021}, NUMANodes: []int{1}}, NumVFs: ptr.To(8)},
+		{Name: "bus-3b", Match: PFSelector{PCIAddresses: []string{"0000:3b:*"}, IBDevNames: []string{"mlx5_0", "mlx5_1"}}, NumVFs: ptr.To(4)},
+	}}
+
+	tests := []struct {
+		name string
+		pf   PFInfo
+		want string
+	}{
+		{name: "opted out", pf: PFInfo{PCIAddress: "0000:86:00.0", IBDevName: "mlx5_3", PartID: 0x1021, NUMANode: 1}, want: "storage"},
+		{name: "all fields match", pf: PFInfo{PCIAddress: "0000:af:00.0", IBDevName: "mlx5_4", PartID: 0x1021, NUMANode: 1}, want: "cx7-numa1"},
+		{name: "pattern", pf: PFInfo{PCIAddress: "0000:3b:00.1", IBDevName: "mlx5_1", PartID: 0x1021}, want: "bus-3b"},
+		{name: "one field differs", pf: PFInfo{PCIAddress: "0000:3b:00.0", IBDevName: "mlx5_2"}},
+		{name: "no match", pf: PFInfo{PCIAddress: "0000:5e:00.0", IBDevName: "mlx5_5", PartID: 0x101b}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := p.Match(tt.pf)
+			if tt.want == "" {
+				assert.Nil(t, r)
+				return
+			}
+			require.NotNil(t, r)
+			assert.Equal(t, tt.want, r.Name)
+		})
+	}
+
+	var none *Policy
+	assert.Nil(t, none.Match(PFInfo{}))
+}
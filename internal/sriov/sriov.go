@@ -25,7 +25,8 @@ import (
 
 	"k8s.io/klog/v2"
 
-	"github.com/MartinForReal/dra-example-driver/internal/sysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
 )
 
 const (
@@ -39,13 +40,18 @@ const (
 type PFInfo struct {
 	PCIAddress string
 	IBDevName  string
+	// NodeGUID is formatted like in sysfs, e.g. ec0d:9a03:0078:6a4c, and
+	// PartID is the PCI device ID, e.g. 0x1021 for a ConnectX-7.
+	NodeGUID   string
+	PartID     uint32
+	NUMANode   int
 	TotalVFs   int
 	CurrentVFs int
 }
 
-// DiscoverSRIOVPFs finds all IB PFs on the host that support SR-IOV.
-func DiscoverSRIOVPFs() ([]PFInfo, error) {
-	ibDevices, err := sysfs.ListIBDevices()
+// DiscoverSRIOVPFs finds all IB PFs in fs that support SR-IOV.
+func DiscoverSRIOVPFs(fs sysfs.FS) ([]PFInfo, error) {
+	ibDevices, err := fs.ListIBDevices()
 	if err != nil {
 		return nil, fmt.Errorf("list IB devices: %w", err)
 	}
@@ -58,6 +64,9 @@ func DiscoverSRIOVPFs() ([]PFInfo, error) {
 		pfs = append(pfs, PFInfo{
 			PCIAddress: dev.PCIAddress,
 			IBDevName:  dev.Name,
+			PartID:     dev.PCIDeviceID,
+			NUMANode:   dev.NUMANode,
+			NodeGUID:   dev.NodeGUID,
 			TotalVFs:   dev.SRIOVTotalVFs,
 			CurrentVFs: dev.SRIOVNumVFs,
 		})
@@ -71,11 +80,21 @@ func DiscoverSRIOVPFs() ([]PFInfo, error) {
 // sysfs requires writing 0 before changing the count).
 //
 // This is a startup-time operation: the pool of VFs is pre-created and then
-// treated as a fixed inventory.
-func ProvisionVFs(ctx context.Context, pfPCIAddr string, desired int) error {
+// treated as a fixed inventory. AttachVF creates the VFs of PFs whose VFs are
+// attached on demand instead.
+func ProvisionVFs(ctx context.Context, fs sysfs.FS, pfPCIAddr string, desired int) (err error) {
 	logger := klog.FromContext(ctx)
 
-	totalVFs, err := sysfs.GetSRIOVTotalVFs(pfPCIAddr)
+	start := time.Now()
+	metrics.VFProvisionAttempts.WithLabelValues(pfPCIAddr).Inc()
+	defer func() {
+		metrics.VFProvisionDuration.WithLabelValues(pfPCIAddr).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.VFProvisionFailures.WithLabelValues(pfPCIAddr).Inc()
+		}
+	}()
+
+	totalVFs, err := fs.GetSRIOVTotalVFs(pfPCIAddr)
 	if err != nil {
 		return fmt.Errorf("get sriov_totalvfs for %s: %w", pfPCIAddr, err)
 	}
@@ -84,7 +103,7 @@ func ProvisionVFs(ctx context.Context, pfPCIAddr string, desired int) error {
 		return fmt.Errorf("requested %d VFs exceeds maximum %d for PF %s", desired, totalVFs, pfPCIAddr)
 	}
 
-	currentVFs, err := sysfs.GetSRIOVNumVFs(pfPCIAddr)
+	currentVFs, err := fs.GetSRIOVNumVFs(pfPCIAddr)
 	if err != nil {
 		return fmt.Errorf("get sriov_numvfs for %s: %w", pfPCIAddr, err)
 	}
@@ -97,7 +116,7 @@ func ProvisionVFs(ctx context.Context, pfPCIAddr string, desired int) error {
 	// Must reset to 0 before changing
 	if currentVFs > 0 {
 		logger.Info("Resetting existing VFs before reprovisioning", "pf", pfPCIAddr, "current", currentVFs, "desired", desired)
-		if err := sysfs.SetSRIOVNumVFs(pfPCIAddr, 0); err != nil {
+		if err := fs.SetSRIOVNumVFs(pfPCIAddr, 0); err != nil {
 			return fmt.Errorf("reset sriov_numvfs to 0 for %s: %w", pfPCIAddr, err)
 		}
 		// Brief pause after destroying VFs
@@ -105,12 +124,12 @@ func ProvisionVFs(ctx context.Context, pfPCIAddr string, desired int) error {
 	}
 
 	logger.Info("Creating VFs", "pf", pfPCIAddr, "count", desired)
-	if err := sysfs.SetSRIOVNumVFs(pfPCIAddr, desired); err != nil {
+	if err := fs.SetSRIOVNumVFs(pfPCIAddr, desired); err != nil {
 		return fmt.Errorf("set sriov_numvfs to %d for %s: %w", desired, pfPCIAddr, err)
 	}
 
 	// Wait for VFs to appear
-	if err := waitForVFs(pfPCIAddr, desired); err != nil {
+	if err := waitForVFs(fs, pfPCIAddr, desired); err != nil {
 		return fmt.Errorf("VFs did not appear for %s: %w", pfPCIAddr, err)
 	}
 
@@ -119,20 +138,20 @@ func ProvisionVFs(ctx context.Context, pfPCIAddr string, desired int) error {
 }
 
 // DestroyVFs removes all VFs for the given PF.
-func DestroyVFs(pfPCIAddr string) error {
-	return sysfs.SetSRIOVNumVFs(pfPCIAddr, 0)
+func DestroyVFs(fs sysfs.FS, pfPCIAddr string) error {
+	return fs.SetSRIOVNumVFs(pfPCIAddr, 0)
 }
 
 // GetVFPCIAddresses returns the PCI addresses of all VFs belonging to the PF.
-func GetVFPCIAddresses(pfPCIAddr string) ([]string, error) {
-	return sysfs.ListVFs(pfPCIAddr)
+func GetVFPCIAddresses(fs sysfs.FS, pfPCIAddr string) ([]string, error) {
+	return fs.ListVFs(pfPCIAddr)
 }
 
 // waitForVFs polls sysfs until the expected number of VFs appear or a timeout is reached.
-func waitForVFs(pfPCIAddr string, expected int) error {
+func waitForVFs(fs sysfs.FS, pfPCIAddr string, expected int) error {
 	deadline := time.Now().Add(vfSettleTimeout)
 	for time.Now().Before(deadline) {
-		vfs, err := sysfs.ListVFs(pfPCIAddr)
+		vfs, err := fs.ListVFs(pfPCIAddr)
 		if err == nil && len(vfs) >= expected {
 			return nil
 		}
@@ -0,0 +1,54 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sriov
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/metrics"
+	"github.com/kubernetes-sigs/dra-example-driver/internal/sysfs"
+)
+
+func TestDiscoverSRIOVPFs(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX7, 0x86, 1, 0))
+	fs := sysfs.New(tree.Root)
+
+	pfs, err := DiscoverSRIOVPFs(fs)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []PFInfo{
+		{PCIAddress: "0000:3b:00.0", IBDevName: "mlx5_0", PartID: 0x101b, NUMANode: 0, NodeGUID: "ec0d:9a03:0000:0001", TotalVFs: 16, CurrentVFs: 2},
+		{PCIAddress: "0000:86:00.0", IBDevName: "mlx5_3", PartID: 0x1021, NUMANode: 1, NodeGUID: "ec0d:9a03:0000:0004", TotalVFs: 16, CurrentVFs: 0},
+	}, pfs)
+
+	vfs, err := GetVFPCIAddresses(fs, "0000:3b:00.0")
+	require.NoError(t, err)
+	assert.Len(t, vfs, 2)
+
+	// Already at the desired count: nothing is written.
+	require.NoError(t, ProvisionVFs(t.Context(), fs, "0000:3b:00.0", 2))
+	assert.Error(t, ProvisionVFs(t.Context(), fs, "0000:3b:00.0", 17))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.VFProvisionAttempts.WithLabelValues("0000:3b:00.0")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.VFProvisionFailures.WithLabelValues("0000:3b:00.0")))
+}
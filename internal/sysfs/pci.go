@@ -0,0 +1,166 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sysfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const busPCIDrivers = "bus/pci/drivers"
+
+// GetPCIDriver returns the name of the driver bound to a PCI device, or ""
+// if there is none.
+func (fs FS) GetPCIDriver(pciAddr string) (string, error) {
+	driverPath, err := filepath.EvalSymlinks(filepath.Join(fs.pciPath(pciAddr), "driver"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("resolve driver of %s: %w", pciAddr, err)
+	}
+	return filepath.Base(driverPath), nil
+}
+
+// HasPCIDriver reports whether driver is loaded, i.e. PCI devices can be
+// bound to it.
+func (fs FS) HasPCIDriver(driver string) bool {
+	_, err := os.Stat(fs.Path(busPCIDrivers, driver))
+	return err == nil
+}
+
+// SetPCIDriverOverride makes the kernel bind a PCI device only to driver from
+// now on, or to any matching driver again if driver is empty.
+func (fs FS) SetPCIDriverOverride(pciAddr, driver string) error {
+	// A newline clears the override.
+	if err := os.WriteFile(filepath.Join(fs.pciPath(pciAddr), "driver_override"), []byte(driver+"\n"), 0o200); err != nil {
+		return fmt.Errorf("set driver override of %s to %q: %w", pciAddr, driver, err)
+	}
+	return nil
+}
+
+// GetIOMMUGroup returns the IOMMU group of a PCI device. It returns an error
+// satisfying os.IsNotExist if the device is in none, e.g. because the IOMMU
+// is disabled.
+func (fs FS) GetIOMMUGroup(pciAddr string) (int, error) {
+	groupPath, err := filepath.EvalSymlinks(filepath.Join(fs.pciPath(pciAddr), "iommu_group"))
+	if err != nil {
+		return -1, err
+	}
+	group, err := strconv.Atoi(filepath.Base(groupPath))
+	if err != nil {
+		return -1, fmt.Errorf("parse IOMMU group of %s: %w", pciAddr, err)
+	}
+	return group, nil
+}
+
+// PCIeTopology describes where a PCI device sits in the PCIe hierarchy.
+type PCIeTopology struct {
+	// RootComplex is the PCI root complex, e.g. "pci0000:00".
+	RootComplex string
+	// Switch is the PCI address of the upstream port of the PCIe switch
+	// closest to the device, empty if the device is not below a switch.
+	Switch string
+	// LinkSpeed is the current link speed, e.g. "16.0 GT/s PCIe", and
+	// LinkWidth the number of lanes. VFs report the link of their PF. Both
+	// are empty if the speed is unknown.
+	LinkSpeed string
+	LinkWidth int
+	// IOMMUGroup is the IOMMU group of the device, -1 if it is in none.
+	IOMMUGroup int
+}
+
+// GetPCIeTopology walks the PCI hierarchy above a device up to its root
+// complex.
+func (fs FS) GetPCIeTopology(pciAddr string) (*PCIeTopology, error) {
+	devPath, err := filepath.EvalSymlinks(fs.pciPath(pciAddr))
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", pciAddr, err)
+	}
+	devicesPath, err := filepath.EvalSymlinks(fs.Path("devices"))
+	if err != nil {
+		return nil, fmt.Errorf("resolve sysfs devices: %w", err)
+	}
+	rel, err := filepath.Rel(devicesPath, devPath)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", pciAddr, err)
+	}
+	// E.g. pci0000:00/<root port>/<switch upstream port>/<switch
+	// downstream port>/<device>.
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "pci") {
+		return nil, fmt.Errorf("%s is not below a PCI root complex", pciAddr)
+	}
+	topo := &PCIeTopology{RootComplex: parts[0], IOMMUGroup: -1}
+	bridges := parts[1 : len(parts)-1]
+	if len(bridges) >= 3 {
+		topo.Switch = bridges[len(bridges)-2]
+	}
+
+	linkPath := devPath
+	if pfPath, err := filepath.EvalSymlinks(filepath.Join(devPath, "physfn")); err == nil {
+		linkPath = pfPath
+	}
+	if speed := readStringFile(filepath.Join(linkPath, "current_link_speed")); speed != "" && !strings.HasPrefix(speed, "Unknown") {
+		topo.LinkSpeed = speed
+		topo.LinkWidth = readIntFile(filepath.Join(linkPath, "current_link_width"), 0)
+	}
+
+	if group, err := fs.GetIOMMUGroup(pciAddr); err == nil {
+		topo.IOMMUGroup = group
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return topo, nil
+}
+
+// UnbindPCIDriver unbinds a PCI device from its driver, if it has one.
+func (fs FS) UnbindPCIDriver(pciAddr string) error {
+	driver, err := fs.GetPCIDriver(pciAddr)
+	if err != nil || driver == "" {
+		return err
+	}
+	if err := os.WriteFile(fs.Path(busPCIDrivers, driver, "unbind"), []byte(pciAddr), 0o200); err != nil {
+		return fmt.Errorf("unbind %s from %s: %w", pciAddr, driver, err)
+	}
+	return nil
+}
+
+// BindPCIDriver binds an unbound PCI device to driver.
+func (fs FS) BindPCIDriver(pciAddr, driver string) error {
+	if err := os.WriteFile(fs.Path(busPCIDrivers, driver, "bind"), []byte(pciAddr), 0o200); err != nil {
+		return fmt.Errorf("bind %s to %s: %w", pciAddr, driver, err)
+	}
+	return nil
+}
+
+// RebindPCIDriver unbinds a PCI device from its driver and binds it again,
+// e.g. for the driver to pick up a new configuration. Devices without a
+// driver are left alone.
+func (fs FS) RebindPCIDriver(pciAddr string) error {
+	driver, err := fs.GetPCIDriver(pciAddr)
+	if err != nil || driver == "" {
+		return err
+	}
+	if err := fs.UnbindPCIDriver(pciAddr); err != nil {
+		return err
+	}
+	return fs.BindPCIDriver(pciAddr, driver)
+}
@@ -19,6 +19,7 @@
 package sysfs
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -27,11 +28,42 @@ import (
 )
 
 const (
-	sysClassInfiniband = "/sys/class/infiniband"
-	sysClassNet        = "/sys/class/net"
-	sysBusPCI          = "/sys/bus/pci/devices"
+	// DefaultRoot is the sysfs mount point on a live system.
+	DefaultRoot = "/sys"
+
+	classInfiniband = "class/infiniband"
+	classNet        = "class/net"
+	busPCIDevices   = "bus/pci/devices"
 )
 
+// FS gives access to a sysfs tree mounted at Root. Using a root other than
+// DefaultRoot allows discovery to run against a fixture tree.
+type FS struct {
+	// Root is the sysfs mount point, e.g. /sys.
+	Root string
+}
+
+// Default is the FS of the host, mounted at DefaultRoot.
+var Default = New(DefaultRoot)
+
+// New returns an FS rooted at root, or at DefaultRoot if root is empty.
+func New(root string) FS {
+	if root == "" {
+		root = DefaultRoot
+	}
+	return FS{Root: root}
+}
+
+// Path returns the absolute path of a sysfs entry below the root, e.g.
+// Path("class", "infiniband").
+func (fs FS) Path(elem ...string) string {
+	return filepath.Join(append([]string{fs.Root}, elem...)...)
+}
+
+func (fs FS) pciPath(pciAddr string) string {
+	return fs.Path(busPCIDevices, pciAddr)
+}
+
 // IBDeviceInfo holds information gathered from sysfs about an IB device.
 type IBDeviceInfo struct {
 	// Name is the IB device name (e.g., mlx5_0).
@@ -40,6 +72,9 @@ type IBDeviceInfo struct {
 	PCIAddress string
 	// NUMANode is the NUMA node affinity (-1 if unknown).
 	NUMANode int
+	// PCIDeviceID is the PCI device ID, which is the vendor part ID of
+	// Mellanox HCAs, e.g. 0x101b (0 if unknown).
+	PCIDeviceID uint32
 	// IsPF is true if this is a Physical Function.
 	IsPF bool
 	// IsVF is true if this is a Virtual Function.
@@ -60,18 +95,24 @@ type IBDeviceInfo struct {
 
 // ListIBDevices discovers all InfiniBand devices from sysfs.
 func ListIBDevices() ([]IBDeviceInfo, error) {
-	entries, err := os.ReadDir(sysClassInfiniband)
+	return Default.ListIBDevices()
+}
+
+// ListIBDevices discovers all InfiniBand devices below the FS root.
+func (fs FS) ListIBDevices() ([]IBDeviceInfo, error) {
+	classPath := fs.Path(classInfiniband)
+	entries, err := os.ReadDir(classPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("read %s: %w", sysClassInfiniband, err)
+		return nil, fmt.Errorf("read %s: %w", classPath, err)
 	}
 
 	var devices []IBDeviceInfo
 	for _, entry := range entries {
 		devName := entry.Name()
-		info, err := GetIBDeviceInfo(devName)
+		info, err := fs.GetIBDeviceInfo(devName)
 		if err != nil {
 			continue
 		}
@@ -82,7 +123,13 @@ func ListIBDevices() ([]IBDeviceInfo, error) {
 
 // GetIBDeviceInfo reads detailed information about a single IB device from sysfs.
 func GetIBDeviceInfo(devName string) (*IBDeviceInfo, error) {
-	devPath := filepath.Join(sysClassInfiniband, devName)
+	return Default.GetIBDeviceInfo(devName)
+}
+
+// GetIBDeviceInfo reads detailed information about a single IB device below
+// the FS root.
+func (fs FS) GetIBDeviceInfo(devName string) (*IBDeviceInfo, error) {
+	devPath := fs.Path(classInfiniband, devName)
 
 	info := &IBDeviceInfo{
 		Name:      devName,
@@ -98,6 +145,7 @@ func GetIBDeviceInfo(devName string) (*IBDeviceInfo, error) {
 
 		// Read NUMA node
 		info.NUMANode = readIntFile(filepath.Join(pciPath, "numa_node"), -1)
+		info.PCIDeviceID = uint32(readHexFile(filepath.Join(pciPath, "device")))
 
 		// Determine PF/VF status
 		info.IsPF = isPF(pciPath)
@@ -138,42 +186,100 @@ func GetIBDeviceInfo(devName string) (*IBDeviceInfo, error) {
 	}
 
 	// Find associated network devices
-	info.NetDevices = findNetDevices(devName)
+	info.NetDevices = fs.findNetDevices(devName)
 
 	return info, nil
 }
 
 // GetSRIOVTotalVFs returns the total number of VFs supported by a PCI device.
 func GetSRIOVTotalVFs(pciAddr string) (int, error) {
-	path := filepath.Join(sysBusPCI, pciAddr, "sriov_totalvfs")
-	return readIntFileErr(path)
+	return Default.GetSRIOVTotalVFs(pciAddr)
+}
+
+// GetSRIOVTotalVFs returns the total number of VFs supported by a PCI device.
+func (fs FS) GetSRIOVTotalVFs(pciAddr string) (int, error) {
+	return readIntFileErr(filepath.Join(fs.pciPath(pciAddr), "sriov_totalvfs"))
 }
 
 // GetSRIOVNumVFs returns the current number of VFs enabled for a PCI device.
 func GetSRIOVNumVFs(pciAddr string) (int, error) {
-	path := filepath.Join(sysBusPCI, pciAddr, "sriov_numvfs")
-	return readIntFileErr(path)
+	return Default.GetSRIOVNumVFs(pciAddr)
+}
+
+// GetSRIOVNumVFs returns the current number of VFs enabled for a PCI device.
+func (fs FS) GetSRIOVNumVFs(pciAddr string) (int, error) {
+	return readIntFileErr(filepath.Join(fs.pciPath(pciAddr), "sriov_numvfs"))
 }
 
 // SetSRIOVNumVFs sets the number of VFs for a PCI device.
 func SetSRIOVNumVFs(pciAddr string, count int) error {
-	path := filepath.Join(sysBusPCI, pciAddr, "sriov_numvfs")
+	return Default.SetSRIOVNumVFs(pciAddr, count)
+}
+
+// SetSRIOVNumVFs sets the number of VFs for a PCI device.
+func (fs FS) SetSRIOVNumVFs(pciAddr string, count int) error {
+	path := filepath.Join(fs.pciPath(pciAddr), "sriov_numvfs")
 	return os.WriteFile(path, []byte(strconv.Itoa(count)), 0644)
 }
 
+// SetSRIOVDriversAutoprobe sets whether VFs created on a PF are bound to a
+// driver right away. Without autoprobing, VFs have no IB device or netdev
+// until they are bound explicitly.
+func (fs FS) SetSRIOVDriversAutoprobe(pfPCIAddr string, autoprobe bool) error {
+	value := "0"
+	if autoprobe {
+		value = "1"
+	}
+	if err := os.WriteFile(filepath.Join(fs.pciPath(pfPCIAddr), "sriov_drivers_autoprobe"), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("set sriov_drivers_autoprobe of %s: %w", pfPCIAddr, err)
+	}
+	return nil
+}
+
+// ListNetDevices returns the netdevs of a PCI device in the network
+// namespace sysfs is mounted in, i.e. not those moved into a pod.
+func (fs FS) ListNetDevices(pciAddr string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(fs.pciPath(pciAddr), "net"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	netDevs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		netDevs = append(netDevs, entry.Name())
+	}
+	return netDevs, nil
+}
+
 // IsPF checks if the given PCI device is a Physical Function that supports SR-IOV.
 func IsPF(pciAddr string) bool {
-	return isPF(filepath.Join(sysBusPCI, pciAddr))
+	return Default.IsPF(pciAddr)
+}
+
+// IsPF checks if the given PCI device is a Physical Function that supports SR-IOV.
+func (fs FS) IsPF(pciAddr string) bool {
+	return isPF(fs.pciPath(pciAddr))
 }
 
 // IsVF checks if the given PCI device is a Virtual Function.
 func IsVF(pciAddr string) bool {
-	return isVF(filepath.Join(sysBusPCI, pciAddr))
+	return Default.IsVF(pciAddr)
+}
+
+// IsVF checks if the given PCI device is a Virtual Function.
+func (fs FS) IsVF(pciAddr string) bool {
+	return isVF(fs.pciPath(pciAddr))
 }
 
 // GetParentPF returns the PCI address of the parent PF for a VF.
 func GetParentPF(vfPCIAddr string) (string, error) {
-	physfnLink := filepath.Join(sysBusPCI, vfPCIAddr, "physfn")
+	return Default.GetParentPF(vfPCIAddr)
+}
+
+// GetParentPF returns the PCI address of the parent PF for a VF.
+func (fs FS) GetParentPF(vfPCIAddr string) (string, error) {
+	physfnLink := filepath.Join(fs.pciPath(vfPCIAddr), "physfn")
 	pfPath, err := filepath.EvalSymlinks(physfnLink)
 	if err != nil {
 		return "", fmt.Errorf("read physfn symlink for %s: %w", vfPCIAddr, err)
@@ -183,7 +289,12 @@ func GetParentPF(vfPCIAddr string) (string, error) {
 
 // ListVFs returns the PCI addresses of all VFs belonging to a PF.
 func ListVFs(pfPCIAddr string) ([]string, error) {
-	pfPath := filepath.Join(sysBusPCI, pfPCIAddr)
+	return Default.ListVFs(pfPCIAddr)
+}
+
+// ListVFs returns the PCI addresses of all VFs belonging to a PF.
+func (fs FS) ListVFs(pfPCIAddr string) ([]string, error) {
+	pfPath := fs.pciPath(pfPCIAddr)
 	entries, err := os.ReadDir(pfPath)
 	if err != nil {
 		return nil, fmt.Errorf("read %s: %w", pfPath, err)
@@ -205,15 +316,79 @@ func ListVFs(pfPCIAddr string) ([]string, error) {
 	return vfs, nil
 }
 
+// GetVFPCIAddress returns the PCI address of VF number vf of a PF, as
+// numbered by the virtfn<n> links of the PF.
+func (fs FS) GetVFPCIAddress(pfPCIAddr string, vf int) (string, error) {
+	vfPath, err := filepath.EvalSymlinks(filepath.Join(fs.pciPath(pfPCIAddr), "virtfn"+strconv.Itoa(vf)))
+	if err != nil {
+		return "", fmt.Errorf("resolve VF %d of %s: %w", vf, pfPCIAddr, err)
+	}
+	return filepath.Base(vfPath), nil
+}
+
+// VFConfig is the configuration of a VF that the mlx5 PF driver exposes in
+// the sriov/<n> directory of the PF.
+type VFConfig struct {
+	// NodeGUID and PortGUID are formatted like ee:0d:9a:00:01:78:6a:4c.
+	NodeGUID string
+	PortGUID string
+	// Policy is the link state policy: "Down", "Up" or "Follow" the PF.
+	Policy string
+}
+
+// GetVFConfig reads the configuration of VF number vf of a PF. PF drivers
+// other than mlx5 return an error satisfying os.IsNotExist.
+func (fs FS) GetVFConfig(pfPCIAddr string, vf int) (*VFConfig, error) {
+	dir := fs.vfConfigPath(pfPCIAddr, vf)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	return &VFConfig{
+		NodeGUID: readStringFile(filepath.Join(dir, "node")),
+		PortGUID: readStringFile(filepath.Join(dir, "port")),
+		Policy:   readStringFile(filepath.Join(dir, "policy")),
+	}, nil
+}
+
+// SetVFConfig writes the non-empty fields of c to the configuration of VF
+// number vf of a PF. GUIDs only take effect once the VF is bound to its
+// driver again.
+func (fs FS) SetVFConfig(pfPCIAddr string, vf int, c VFConfig) error {
+	dir := fs.vfConfigPath(pfPCIAddr, vf)
+	for _, f := range []struct{ name, value string }{
+		{"node", c.NodeGUID},
+		{"port", c.PortGUID},
+		{"policy", c.Policy},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.name), []byte(f.value), 0o644); err != nil {
+			return fmt.Errorf("set %s of VF %d of %s: %w", f.name, vf, pfPCIAddr, err)
+		}
+	}
+	return nil
+}
+
+func (fs FS) vfConfigPath(pfPCIAddr string, vf int) string {
+	return filepath.Join(fs.pciPath(pfPCIAddr), "sriov", strconv.Itoa(vf))
+}
+
 // FindIBDeviceByPCI finds the InfiniBand device name for a given PCI address.
 func FindIBDeviceByPCI(pciAddr string) (string, error) {
-	entries, err := os.ReadDir(sysClassInfiniband)
+	return Default.FindIBDeviceByPCI(pciAddr)
+}
+
+// FindIBDeviceByPCI finds the InfiniBand device name for a given PCI address.
+func (fs FS) FindIBDeviceByPCI(pciAddr string) (string, error) {
+	classPath := fs.Path(classInfiniband)
+	entries, err := os.ReadDir(classPath)
 	if err != nil {
-		return "", fmt.Errorf("read %s: %w", sysClassInfiniband, err)
+		return "", fmt.Errorf("read %s: %w", classPath, err)
 	}
 
 	for _, entry := range entries {
-		devLink := filepath.Join(sysClassInfiniband, entry.Name(), "device")
+		devLink := filepath.Join(classPath, entry.Name(), "device")
 		resolved, err := filepath.EvalSymlinks(devLink)
 		if err != nil {
 			continue
@@ -225,9 +400,168 @@ func FindIBDeviceByPCI(pciAddr string) (string, error) {
 	return "", fmt.Errorf("no IB device found for PCI address %s", pciAddr)
 }
 
+// GetPkeyTable returns the P_Key table of an IB port, indexed like the
+// hardware table. Unused entries are 0.
+func (fs FS) GetPkeyTable(ibDevName string, port int) ([]uint16, error) {
+	pkeysPath := fs.Path(classInfiniband, ibDevName, "ports", strconv.Itoa(port), "pkeys")
+	entries, err := os.ReadDir(pkeysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	table := make([]uint16, len(entries))
+	for _, e := range entries {
+		idx, err := strconv.Atoi(e.Name())
+		if err != nil || idx < 0 || idx >= len(table) {
+			continue
+		}
+		val, err := strconv.ParseUint(readStringFile(filepath.Join(pkeysPath, e.Name())), 0, 16)
+		if err != nil {
+			continue
+		}
+		table[idx] = uint16(val)
+	}
+	return table, nil
+}
+
+// GetPortLinkLayer returns the link layer of an IB port, "InfiniBand" or
+// "Ethernet".
+func (fs FS) GetPortLinkLayer(ibDevName string, port int) (string, error) {
+	data, err := os.ReadFile(fs.Path(classInfiniband, ibDevName, "ports", strconv.Itoa(port), "link_layer"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// PortCounters holds the performance counters of an IB port.
+type PortCounters struct {
+	// Counters are the IBA PortCounters from ports/<n>/counters, keyed by
+	// file name, e.g. port_xmit_data. The data counters count 4-octet words.
+	Counters map[string]uint64
+	// HWCounters are the driver-specific counters from ports/<n>/hw_counters,
+	// e.g. out_of_buffer on mlx5. Nil if the driver has none.
+	HWCounters map[string]uint64
+}
+
+// GetPortCounters reads the performance counters of an IB port. Counters
+// that cannot be parsed, e.g. those the hardware does not implement, are
+// left out.
+func (fs FS) GetPortCounters(ibDevName string, port int) (*PortCounters, error) {
+	portPath := fs.Path(classInfiniband, ibDevName, "ports", strconv.Itoa(port))
+	counters, err := readCounterDir(filepath.Join(portPath, "counters"))
+	if err != nil {
+		return nil, err
+	}
+	hwCounters, err := readCounterDir(filepath.Join(portPath, "hw_counters"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &PortCounters{Counters: counters, HWCounters: hwCounters}, nil
+}
+
+// readCounterDir reads every counter file of dir. The lifespan file of
+// hw_counters configures how long the driver caches values; it is not a
+// counter.
+func readCounterDir(dir string) (map[string]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[string]uint64, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == "lifespan" {
+			continue
+		}
+		val, err := strconv.ParseUint(readStringFile(filepath.Join(dir, e.Name())), 10, 64)
+		if err != nil {
+			continue
+		}
+		counters[e.Name()] = val
+	}
+	return counters, nil
+}
+
+// GetVFPkeyIndexes returns the virtual P_Key table of a VF as indexes into
+// the P_Key table of its PF, with -1 for unmapped entries. Only drivers that
+// expose an iov directory on the PF IB device support this; others return an
+// error satisfying os.IsNotExist.
+func (fs FS) GetVFPkeyIndexes(pfIBDevName, vfPCIAddr string, port int) ([]int, error) {
+	dir := fs.vfPkeyIdxPath(pfIBDevName, vfPCIAddr, port)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make([]int, len(entries))
+	for _, e := range entries {
+		vIdx, err := strconv.Atoi(e.Name())
+		if err != nil || vIdx < 0 || vIdx >= len(indexes) {
+			continue
+		}
+		// Unmapped entries read "none".
+		pfIdx, err := strconv.Atoi(readStringFile(filepath.Join(dir, e.Name())))
+		if err != nil {
+			pfIdx = -1
+		}
+		indexes[vIdx] = pfIdx
+	}
+	return indexes, nil
+}
+
+// SetVFPkeyIndex maps entry vIdx of the virtual P_Key table of a VF to entry
+// pfIdx of the P_Key table of its PF, or unmaps it if pfIdx is -1.
+func (fs FS) SetVFPkeyIndex(pfIBDevName, vfPCIAddr string, port, vIdx, pfIdx int) error {
+	path := filepath.Join(fs.vfPkeyIdxPath(pfIBDevName, vfPCIAddr, port), strconv.Itoa(vIdx))
+	value := "none"
+	if pfIdx >= 0 {
+		value = strconv.Itoa(pfIdx)
+	}
+	return os.WriteFile(path, []byte(value), 0o644)
+}
+
+// GetTrafficClass returns the default traffic class used by the port for
+// RDMA traffic, or -1 if none is set. Only the MLNX_OFED drivers expose it;
+// with others it returns an error satisfying os.IsNotExist.
+func (fs FS) GetTrafficClass(ibDevName string, port int) (int, error) {
+	data, err := os.ReadFile(fs.trafficClassPath(ibDevName, port))
+	if err != nil {
+		return -1, err
+	}
+	// The file reads e.g. "Global tclass=106", or nothing if unset.
+	_, value, found := strings.Cut(string(data), "tclass=")
+	if !found {
+		return -1, nil
+	}
+	tclass, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || tclass < 0 {
+		return -1, nil
+	}
+	return tclass, nil
+}
+
+// SetTrafficClass sets the default traffic class used by the port for RDMA
+// traffic, or clears it if tclass is -1. It returns an error satisfying
+// os.IsNotExist if the driver does not support it, see GetTrafficClass.
+func (fs FS) SetTrafficClass(ibDevName string, port int, tclass int) error {
+	path := fs.trafficClassPath(ibDevName, port)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(fmt.Sprintf("tclass=%d", tclass)), 0o644)
+}
+
+func (fs FS) trafficClassPath(ibDevName string, port int) string {
+	return fs.Path(classInfiniband, ibDevName, "tc", strconv.Itoa(port), "traffic_class")
+}
+
+func (fs FS) vfPkeyIdxPath(pfIBDevName, vfPCIAddr string, port int) string {
+	return fs.Path(classInfiniband, pfIBDevName, "iov", vfPCIAddr, "ports", strconv.Itoa(port), "pkey_idx")
+}
+
 // findNetDevices returns network interface names associated with an IB device.
-func findNetDevices(ibDevName string) []string {
-	netPath := filepath.Join(sysClassInfiniband, ibDevName, "device", "net")
+func (fs FS) findNetDevices(ibDevName string) []string {
+	netPath := fs.Path(classInfiniband, ibDevName, "device", "net")
 	entries, err := os.ReadDir(netPath)
 	if err != nil {
 		return nil
@@ -268,6 +602,15 @@ func readIntFileErr(path string) (int, error) {
 	return strconv.Atoi(strings.TrimSpace(string(data)))
 }
 
+// readHexFile reads a number like "0x101b", returning 0 on error.
+func readHexFile(path string) uint64 {
+	v, err := strconv.ParseUint(readStringFile(path), 0, 32)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
 func readStringFile(path string) string {
 	data, err := os.ReadFile(path)
 	if err != nil {
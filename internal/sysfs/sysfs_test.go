@@ -0,0 +1,259 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sysfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/fakesysfs"
+)
+
+// newFixture builds a host with a ConnectX-6 PF with two VFs on NUMA node 0
+// and a ConnectX-7 PF without VFs on NUMA node 1.
+func newFixture(t *testing.T) FS {
+	t.Helper()
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX6, 0x3b, 0, 2))
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX7, 0x86, 1, 0))
+	return New(tree.Root)
+}
+
+func TestListIBDevices(t *testing.T) {
+	fs := newFixture(t)
+
+	devices, err := fs.ListIBDevices()
+	require.NoError(t, err)
+
+	byName := make(map[string]IBDeviceInfo)
+	for _, d := range devices {
+		byName[d.Name] = d
+	}
+	require.Len(t, byName, 4)
+
+	tests := []struct {
+		name       string
+		pciAddress string
+		numaNode   int
+		deviceID   uint32
+		isPF       bool
+		isVF       bool
+		totalVFs   int
+		numVFs     int
+		parentPF   string
+		netDevices []string
+	}{
+		{name: "mlx5_0", pciAddress: "0000:3b:00.0", numaNode: 0, deviceID: 0x101b, isPF: true, totalVFs: 16, numVFs: 2, netDevices: []string{"ibp59s0"}},
+		{name: "mlx5_1", pciAddress: "0000:3b:00.1", numaNode: 0, deviceID: 0x101c, isVF: true, parentPF: "0000:3b:00.0", netDevices: []string{"ibp59s0v0"}},
+		{name: "mlx5_2", pciAddress: "0000:3b:00.2", numaNode: 0, deviceID: 0x101c, isVF: true, parentPF: "0000:3b:00.0", netDevices: []string{"ibp59s0v1"}},
+		{name: "mlx5_3", pciAddress: "0000:86:00.0", numaNode: 1, deviceID: 0x1021, isPF: true, totalVFs: 16, netDevices: []string{"ibp134s0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := byName[tt.name]
+			require.True(t, ok)
+			assert.Equal(t, tt.pciAddress, d.PCIAddress)
+			assert.Equal(t, tt.numaNode, d.NUMANode)
+			assert.Equal(t, tt.deviceID, d.PCIDeviceID)
+			assert.Equal(t, tt.isPF, d.IsPF)
+			assert.Equal(t, tt.isVF, d.IsVF)
+			assert.Equal(t, tt.totalVFs, d.SRIOVTotalVFs)
+			assert.Equal(t, tt.numVFs, d.SRIOVNumVFs)
+			assert.Equal(t, tt.parentPF, d.ParentPF)
+			assert.Equal(t, tt.netDevices, d.NetDevices)
+			assert.NotEmpty(t, d.PortGUIDs[1])
+		})
+	}
+}
+
+func TestSRIOVLayout(t *testing.T) {
+	fs := newFixture(t)
+
+	vfs, err := fs.ListVFs("0000:3b:00.0")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"0000:3b:00.1", "0000:3b:00.2"}, vfs)
+
+	parent, err := fs.GetParentPF("0000:3b:00.2")
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.0", parent)
+
+	assert.True(t, fs.IsPF("0000:86:00.0"))
+	assert.False(t, fs.IsVF("0000:86:00.0"))
+	assert.True(t, fs.IsVF("0000:3b:00.1"))
+
+	ibDev, err := fs.FindIBDeviceByPCI("0000:86:00.0")
+	require.NoError(t, err)
+	assert.Equal(t, "mlx5_3", ibDev)
+
+	require.NoError(t, fs.SetSRIOVNumVFs("0000:86:00.0", 4))
+	n, err := fs.GetSRIOVNumVFs("0000:86:00.0")
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	vf, err := fs.GetVFPCIAddress("0000:3b:00.0", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "0000:3b:00.2", vf)
+}
+
+func TestVFConfig(t *testing.T) {
+	fs := newFixture(t)
+
+	c, err := fs.GetVFConfig("0000:3b:00.0", 1)
+	require.NoError(t, err)
+	assert.Equal(t, &VFConfig{NodeGUID: "00:00:00:00:00:00:00:00", PortGUID: "00:00:00:00:00:00:00:00", Policy: "Down"}, c)
+
+	require.NoError(t, fs.SetVFConfig("0000:3b:00.0", 1, VFConfig{NodeGUID: "ee:0d:9a:00:02:00:00:01", Policy: "Follow"}))
+	c, err = fs.GetVFConfig("0000:3b:00.0", 1)
+	require.NoError(t, err)
+	assert.Equal(t, &VFConfig{NodeGUID: "ee:0d:9a:00:02:00:00:01", PortGUID: "00:00:00:00:00:00:00:00", Policy: "Follow"}, c)
+
+	_, err = fs.GetVFConfig("0000:86:00.0", 0)
+	assert.True(t, os.IsNotExist(err), "PF without VFs")
+}
+
+func TestPCIDriver(t *testing.T) {
+	fs := newFixture(t)
+
+	driver, err := fs.GetPCIDriver("0000:3b:00.1")
+	require.NoError(t, err)
+	assert.Equal(t, "mlx5_core", driver)
+
+	require.NoError(t, fs.RebindPCIDriver("0000:3b:00.1"))
+	for _, file := range []string{"unbind", "bind"} {
+		data, err := os.ReadFile(fs.Path("bus/pci/drivers/mlx5_core", file))
+		require.NoError(t, err)
+		assert.Equal(t, "0000:3b:00.1", string(data), file)
+	}
+
+	driver, err = New(t.TempDir()).GetPCIDriver("0000:3b:00.1")
+	require.NoError(t, err)
+	assert.Empty(t, driver, "no such device")
+
+	assert.True(t, fs.HasPCIDriver("mlx5_core"))
+	assert.False(t, fs.HasPCIDriver("vfio-pci"))
+	require.NoError(t, fs.SetPCIDriverOverride("0000:3b:00.1", "vfio-pci"))
+	data, err := os.ReadFile(fs.Path("bus/pci/devices/0000:3b:00.1/driver_override"))
+	require.NoError(t, err)
+	assert.Equal(t, "vfio-pci\n", string(data))
+}
+
+func TestGetIOMMUGroup(t *testing.T) {
+	fs := newFixture(t)
+
+	group, err := fs.GetIOMMUGroup("0000:3b:00.1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, group)
+
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddDevice(fakesysfs.Device{PCIAddress: "0000:00:1f.6", Vendor: "0x8086", DeviceID: "0x15bb"}))
+	_, err = New(tree.Root).GetIOMMUGroup("0000:00:1f.6")
+	assert.True(t, os.IsNotExist(err), "IOMMU disabled: %v", err)
+}
+
+func TestTrafficClass(t *testing.T) {
+	fs := newFixture(t)
+
+	tclass, err := fs.GetTrafficClass("mlx5_0", 1)
+	require.NoError(t, err)
+	assert.Equal(t, -1, tclass)
+	require.NoError(t, fs.SetTrafficClass("mlx5_0", 1, 106))
+	// The driver reads it back with a prefix.
+	require.NoError(t, os.WriteFile(fs.Path("class/infiniband/mlx5_0/tc/1/traffic_class"), []byte("Global tclass=106\n"), 0o644))
+	tclass, err = fs.GetTrafficClass("mlx5_0", 1)
+	require.NoError(t, err)
+	assert.Equal(t, 106, tclass)
+
+	// Only MLNX_OFED has a per-port traffic class.
+	require.NoError(t, os.RemoveAll(fs.Path("class/infiniband/mlx5_0/tc")))
+	_, err = fs.GetTrafficClass("mlx5_0", 1)
+	assert.True(t, os.IsNotExist(err), "no tc directory: %v", err)
+	assert.True(t, os.IsNotExist(fs.SetTrafficClass("mlx5_0", 1, 106)))
+}
+
+func TestGetPCIeTopology(t *testing.T) {
+	// A root port, a PCIe switch with the HCA below a downstream port, and
+	// a device directly on the root bus without IOMMU.
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddBridge("0000:00:01.0", ""))
+	require.NoError(t, tree.AddBridge("0000:01:00.0", "0000:00:01.0"))
+	require.NoError(t, tree.AddBridge("0000:02:00.0", "0000:01:00.0"))
+	require.NoError(t, tree.AddHCABelow("0000:02:00.0", fakesysfs.ConnectX7, 0x03, 0, 1))
+	require.NoError(t, tree.AddDevice(fakesysfs.Device{PCIAddress: "0000:00:1f.6", Vendor: "0x8086", DeviceID: "0x15bb"}))
+	fs := New(tree.Root)
+
+	pf := PCIeTopology{
+		RootComplex: "pci0000:00",
+		Switch:      "0000:01:00.0",
+		LinkSpeed:   "32.0 GT/s PCIe",
+		LinkWidth:   16,
+		IOMMUGroup:  0,
+	}
+	// VFs report the link of their PF.
+	vf := pf
+	vf.IOMMUGroup = 1
+	tests := map[string]PCIeTopology{
+		"0000:03:00.0": pf,
+		"0000:03:00.1": vf,
+		"0000:01:00.0": {RootComplex: "pci0000:00", IOMMUGroup: -1},
+		"0000:00:1f.6": {RootComplex: "pci0000:00", IOMMUGroup: -1},
+	}
+	for pciAddress, want := range tests {
+		t.Run(pciAddress, func(t *testing.T) {
+			topo, err := fs.GetPCIeTopology(pciAddress)
+			require.NoError(t, err)
+			assert.Equal(t, want, *topo)
+		})
+	}
+
+	_, err = fs.GetPCIeTopology("0000:ff:00.0")
+	assert.Error(t, err)
+}
+
+func TestGetPortCounters(t *testing.T) {
+	tree, err := fakesysfs.New(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, tree.AddHCA(fakesysfs.ConnectX7, 0x86, 1, 0))
+	require.NoError(t, tree.SetPortCounter("mlx5_0", 1, "counters/port_xmit_data", 1<<40))
+	require.NoError(t, tree.SetPortCounter("mlx5_0", 1, "counters/symbol_error", 3))
+	require.NoError(t, tree.SetPortCounter("mlx5_0", 1, "hw_counters/out_of_buffer", 7))
+	require.NoError(t, tree.SetPortCounter("mlx5_0", 1, "hw_counters/lifespan", 10))
+	fs := New(tree.Root)
+
+	counters, err := fs.GetPortCounters("mlx5_0", 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1<<40), counters.Counters["port_xmit_data"])
+	assert.Equal(t, uint64(3), counters.Counters["symbol_error"])
+	assert.Contains(t, counters.Counters, "link_downed")
+	assert.Equal(t, map[string]uint64{"out_of_buffer": 7}, counters.HWCounters)
+
+	_, err = fs.GetPortCounters("mlx5_0", 2)
+	assert.Error(t, err)
+}
+
+func TestListIBDevicesMissingClass(t *testing.T) {
+	devices, err := New(filepath.Join(t.TempDir(), "missing")).ListIBDevices()
+	require.NoError(t, err)
+	assert.Empty(t, devices)
+	assert.Equal(t, "/sys/class/infiniband", Default.Path("class", "infiniband"))
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright The Kubernetes Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package vfionri is an NRI plugin that passes the VFs bound to vfio-pci for
+// a pod to its containers. DRANET only moves netdevs and RDMA devices, so the
+// VFIO device nodes and the PCI addresses KubeVirt looks for are added to
+// every container of the pod when it is created.
+package vfionri
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+
+	"github.com/kubernetes-sigs/dra-example-driver/internal/ibconfig"
+)
+
+// pluginIdx orders the plugin after DRANET's, whose index is "00".
+const pluginIdx = "10"
+
+// Bindings looks up the VFs bound to vfio-pci for the pod with a network
+// namespace. It is implemented by ibinventory.DB.
+type Bindings interface {
+	VFIOBindings(netNs string) []ibconfig.VFIOBinding
+}
+
+// Plugin adjusts the containers of pods with VFs bound to vfio-pci.
+type Plugin struct {
+	bindings Bindings
+}
+
+// Run registers a plugin named name with the NRI of the container runtime and
+// serves it until ctx is done or the runtime closes the connection.
+func Run(ctx context.Context, name string, bindings Bindings) error {
+	s, err := stub.New(&Plugin{bindings: bindings},
+		stub.WithPluginName(name),
+		stub.WithPluginIdx(pluginIdx),
+		stub.WithOnClose(func() {
+			klog.Infof("%s NRI plugin closed", name)
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("create NRI plugin stub: %w", err)
+	}
+	return s.Run(ctx)
+}
+
+// CreateContainer adds the device nodes of the VFs of the pod to the
+// container, and their PCI addresses in the format of KubeVirt host devices.
+func (p *Plugin) CreateContainer(ctx context.Context, pod *api.PodSandbox, ctr *api.Container) (*api.ContainerAdjustment, []*api.ContainerUpdate, error) {
+	netNs := networkNamespace(pod)
+	if netNs == "" {
+		return nil, nil, nil
+	}
+	bindings := p.bindings.VFIOBindings(netNs)
+	if len(bindings) == 0 {
+		return nil, nil, nil
+	}
+
+	adjust := &api.ContainerAdjustment{}
+	added := make(map[string]bool)
+	var addresses []string
+	for _, binding := range bindings {
+		for _, path := range binding.DeviceNodes() {
+			if added[path] {
+				continue
+			}
+			dev, err := linuxDevice(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("VF %s of pod %s/%s: %w", binding.PCIAddress, pod.GetNamespace(), pod.GetName(), err)
+			}
+			adjust.AddDevice(dev)
+			added[path] = true
+		}
+		addresses = append(addresses, binding.PCIAddress)
+	}
+	adjust.AddEnv(ibconfig.VFIOResourceEnv, strings.Join(addresses, ","))
+	klog.FromContext(ctx).Info("Passing VFs to container", "pod", klog.KRef(pod.GetNamespace(), pod.GetName()), "container", ctr.GetName(), "vfs", addresses)
+	return adjust, nil, nil
+}
+
+// networkNamespace returns the path of the network namespace of a pod, the
+// one DRANET passes to AddPodNetNs.
+func networkNamespace(pod *api.PodSandbox) string {
+	for _, namespace := range pod.GetLinux().GetNamespaces() {
+		if namespace.Type == "network" {
+			return namespace.Path
+		}
+	}
+	return ""
+}
+
+// linuxDevice describes the character device at path.
+func linuxDevice(path string) (*api.LinuxDevice, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeCharDevice == 0 {
+		return nil, fmt.Errorf("%s is not a character device", path)
+	}
+	return &api.LinuxDevice{
+		Path:  path,
+		Type:  "c",
+		Major: int64(unix.Major(uint64(stat.Rdev))),
+		Minor: int64(unix.Minor(uint64(stat.Rdev))),
+	}, nil
+}
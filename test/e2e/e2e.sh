@@ -307,7 +307,7 @@ spec:
     config:
     - requests: ["ib"]
       opaque:
-        driver: ib.sigs.k8s.io
+        driver: config.ib.sigs.k8s.io
         parameters:
           apiVersion: ib.resource.sigs.k8s.io/v1alpha1
           kind: IbConfig
@@ -333,7 +333,7 @@ spec:
     config:
     - requests: ["ib"]
       opaque:
-        driver: ib.sigs.k8s.io
+        driver: config.ib.sigs.k8s.io
         parameters:
           apiVersion: ib.resource.sigs.k8s.io/v1alpha1
           kind: IbConfig
@@ -359,7 +359,7 @@ spec:
     config:
     - requests: ["ib"]
       opaque:
-        driver: ib.sigs.k8s.io
+        driver: config.ib.sigs.k8s.io
         parameters:
           apiVersion: ib.resource.sigs.k8s.io/v1alpha1
           kind: IbConfig
@@ -387,7 +387,7 @@ spec:
       config:
       - requests: ["ib"]
         opaque:
-          driver: ib.sigs.k8s.io
+          driver: config.ib.sigs.k8s.io
           parameters:
             apiVersion: ib.resource.sigs.k8s.io/v1alpha1
             kind: IbConfig
@@ -412,7 +412,7 @@ spec:
     config:
     - requests: ["ib"]
       opaque:
-        driver: ib.sigs.k8s.io
+        driver: config.ib.sigs.k8s.io
         parameters:
           apiVersion: ib.resource.sigs.k8s.io/v1alpha1
           kind: IbConfig